@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	backupFileFlag = &cli.StringFlag{
+		Name:  "file",
+		Value: "-",
+		Usage: "the file of the backup, - uses stdout for the export and stdin for the import",
+	}
+	backupGzipFlag = &cli.BoolFlag{
+		Name:  "gzip",
+		Value: false,
+		Usage: "compress the export with gzip, files ending with .gz are always compressed, compressed imports are detected",
+	}
+	backupTablesFlag = &cli.StringSliceFlag{
+		Name:  "tables",
+		Usage: "the tables to export or import, defaults to all tables",
+	}
+	importConflictFlag = &cli.StringFlag{
+		Name:  "conflict",
+		Value: string(generic.ConflictFail),
+		Usage: "how entities which already exist are handled, can be one of fail|skip|replace",
+	}
+	importConsistentFlag = &cli.BoolFlag{
+		Name:  "consistent",
+		Value: false,
+		Usage: "validate the whole backup against the entity types before anything is written",
+	}
+)
+
+var datastoreFlags = []cli.Flag{
+	logLevelFlag,
+	datastoreFlag,
+	datastoreSlowQueryThresholdFlag,
+	postgresDSNFlag,
+	rethinkdbAddressesFlag,
+	rethinkdbDBFlag,
+	rethinkdbDBNameFlag,
+	rethinkdbPasswordFlag,
+	rethinkdbUserFlag,
+}
+
+var datastoreCmd = &cli.Command{
+	Name:  "datastore",
+	Usage: "backup and restore the datastore",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "export",
+			Usage: "export all entities as newline delimited json",
+			Flags: append(slices.Clone(datastoreFlags), backupFileFlag, backupGzipFlag, backupTablesFlag),
+			Action: func(ctx *cli.Context) error {
+				log, level, err := createLoggers(ctx)
+				if err != nil {
+					return fmt.Errorf("unable to create logger %w", err)
+				}
+				if ctx.String(backupFileFlag.Name) == "-" {
+					// the export is written to stdout
+					log = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+				}
+
+				ds, err := createDatastore(ctx, log)
+				if err != nil {
+					return fmt.Errorf("unable to create datastore: %w", err)
+				}
+
+				w, closeFn, err := backupWriter(ctx.String(backupFileFlag.Name), ctx.Bool(backupGzipFlag.Name))
+				if err != nil {
+					return err
+				}
+
+				counts, err := ds.Export(context.Background(), w, generic.ExportConfig{
+					Tables: ctx.StringSlice(backupTablesFlag.Name),
+				})
+				if closeErr := closeFn(); err == nil {
+					err = closeErr
+				}
+				if err != nil {
+					return err
+				}
+
+				return printCounts(counts)
+			},
+		},
+		{
+			Name:  "import",
+			Usage: "import the entities of an export",
+			Flags: append(slices.Clone(datastoreFlags), backupFileFlag, backupTablesFlag, importConflictFlag, importConsistentFlag),
+			Action: func(ctx *cli.Context) error {
+				log, _, err := createLoggers(ctx)
+				if err != nil {
+					return fmt.Errorf("unable to create logger %w", err)
+				}
+
+				ds, err := createDatastore(ctx, log)
+				if err != nil {
+					return fmt.Errorf("unable to create datastore: %w", err)
+				}
+
+				r, closeFn, err := backupReader(ctx.String(backupFileFlag.Name))
+				if err != nil {
+					return err
+				}
+				defer func() {
+					_ = closeFn()
+				}()
+
+				counts, err := ds.Import(context.Background(), r, generic.ImportConfig{
+					Tables:     ctx.StringSlice(backupTablesFlag.Name),
+					Conflict:   generic.ConflictStrategy(ctx.String(importConflictFlag.Name)),
+					Consistent: ctx.Bool(importConsistentFlag.Name),
+				})
+				if printErr := printCounts(counts); err == nil {
+					err = printErr
+				}
+				return err
+			},
+		},
+	},
+}
+
+// backupWriter opens the file of an export, the returned function flushes and closes it.
+func backupWriter(file string, compress bool) (io.Writer, func() error, error) {
+	var out io.WriteCloser = os.Stdout
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to create backup: %w", err)
+		}
+		out = f
+	}
+
+	buffered := bufio.NewWriter(out)
+	if !compress && !strings.HasSuffix(file, ".gz") {
+		return buffered, func() error {
+			if err := buffered.Flush(); err != nil {
+				return err
+			}
+			return closeFile(out)
+		}, nil
+	}
+
+	zw := gzip.NewWriter(buffered)
+	return zw, func() error {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		if err := buffered.Flush(); err != nil {
+			return err
+		}
+		return closeFile(out)
+	}, nil
+}
+
+// backupReader opens the file of an import, gzip compressed backups are detected by their header.
+func backupReader(file string) (io.Reader, func() error, error) {
+	var in io.ReadCloser = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to open backup: %w", err)
+		}
+		in = f
+	}
+
+	buffered := bufio.NewReader(in)
+	magic, err := buffered.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, nil, fmt.Errorf("unable to read backup: %w", err)
+	}
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return buffered, func() error { return closeFile(in) }, nil
+	}
+
+	zr, err := gzip.NewReader(buffered)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to decompress backup: %w", err)
+	}
+	return zr, func() error {
+		if err := zr.Close(); err != nil {
+			return err
+		}
+		return closeFile(in)
+	}, nil
+}
+
+// closeFile closes the file, stdin and stdout are left open.
+func closeFile(f io.Closer) error {
+	if f == os.Stdin || f == os.Stdout {
+		return nil
+	}
+	return f.Close()
+}
+
+// printCounts prints the processed entities by table to stderr, stdout might hold the export.
+func printCounts(counts map[string]*generic.TableCount) error {
+	var tables []string
+	for table := range counts {
+		tables = append(tables, table)
+	}
+	slices.Sort(tables)
+
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tWRITTEN\tREPLACED\tSKIPPED")
+	for _, table := range tables {
+		c := counts[table]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", table, c.Written, c.Replaced, c.Skipped)
+	}
+	return w.Flush()
+}
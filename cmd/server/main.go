@@ -4,13 +4,22 @@ import (
 	"log"
 	"log/slog"
 	"os"
+	"time"
 
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	// the migrations register themselves, serve and migrate apply them through generic.RegisteredMigrations
+	_ "github.com/metal-stack/api-server/pkg/db/migrations"
+	"github.com/metal-stack/api-server/pkg/service/ip"
 	"github.com/urfave/cli/v2"
 )
 
 const (
 	stageDEV  = "DEV"
 	stagePROD = "PROD"
+
+	datastoreRethinkDB = "rethinkdb"
+	datastorePostgres  = "postgres"
+	datastoreMemory    = "memory"
 )
 
 var (
@@ -77,6 +86,22 @@ var (
 		Value: "certs/client-key.pem",
 		Usage: "masterdata-api certificate key path",
 	}
+	datastoreFlag = &cli.StringFlag{
+		Name:  "datastore",
+		Value: datastoreRethinkDB,
+		Usage: "the backend to store entities in, can be one of rethinkdb|postgres|memory, memory is not persistent and meant for local development, postgres does not support watches",
+	}
+	datastoreSlowQueryThresholdFlag = &cli.DurationFlag{
+		Name:  "datastore-slow-query-threshold",
+		Value: 500 * time.Millisecond,
+		Usage: "datastore operations which take longer are logged with their query, 0 disables the slow query log",
+	}
+	postgresDSNFlag = &cli.StringFlag{
+		Name:    "postgres-dsn",
+		Value:   "",
+		Usage:   "postgres connection string, used if datastore is postgres",
+		EnvVars: []string{"POSTGRES_DSN"},
+	}
 	rethinkdbDBFlag = &cli.StringFlag{
 		Name:  "rethinkdb-db",
 		Value: "rethinkdb",
@@ -170,6 +195,61 @@ var (
 		Value: "http://ipam:9090",
 		Usage: "the ipam grpc server endpoint",
 	}
+	ipamReconcileIntervalFlag = &cli.DurationFlag{
+		Name:  "ipam-reconcile-interval",
+		Value: 1 * time.Hour,
+		Usage: "the interval in which ips in ipam and the datastore are compared, 0 disables the reconciliation",
+	}
+	ipamReconcileRepairFlag = &cli.BoolFlag{
+		Name:  "ipam-reconcile-repair",
+		Value: false,
+		Usage: "repair differences between ipam and the datastore instead of only reporting them",
+	}
+	softDeleteRetentionFlag = &cli.DurationFlag{
+		Name:  "soft-delete-retention",
+		Value: generic.DefaultRetention,
+		Usage: "the time soft deleted entities are kept before they are removed permanently",
+	}
+	historyRetentionFlag = &cli.StringSliceFlag{
+		Name:  "history-retention",
+		Value: cli.NewStringSlice("ip=2160h"),
+		Usage: "the retention of the revision history per entity type, e.g. ip=2160h, the history of entity types without retention is kept",
+	}
+	purgeIntervalFlag = &cli.DurationFlag{
+		Name:  "purge-interval",
+		Value: 1 * time.Hour,
+		Usage: "the interval in which soft deleted entities are purged after their retention, 0 disables purging",
+	}
+	ephemeralIPCollectIntervalFlag = &cli.DurationFlag{
+		Name:  "ephemeral-ip-collect-interval",
+		Value: 0,
+		Usage: "the interval in which ephemeral ips which are not attached to a machine are released, e.g. 1h, the collection is disabled by default",
+	}
+	ephemeralIPGracePeriodFlag = &cli.DurationFlag{
+		Name:  "ephemeral-ip-grace-period",
+		Value: ip.DefaultCollectGracePeriod,
+		Usage: "the time an ephemeral ip must not be attached to a machine before it is released",
+	}
+	ephemeralIPCollectDryRunFlag = &cli.BoolFlag{
+		Name:  "ephemeral-ip-collect-dry-run",
+		Value: false,
+		Usage: "only report the ephemeral ips which would be released instead of releasing them",
+	}
+	ipQuotaStaticFlag = &cli.Uint64Flag{
+		Name:  "ip-quota-static",
+		Value: 0,
+		Usage: "the default number of static ips a project can allocate per network, 0 means unlimited, projects can be annotated with their own quota",
+	}
+	ipQuotaEphemeralFlag = &cli.Uint64Flag{
+		Name:  "ip-quota-ephemeral",
+		Value: 0,
+		Usage: "the default number of ephemeral ips a project can allocate per network, 0 means unlimited, projects can be annotated with their own quota",
+	}
+	networkUsageIntervalFlag = &cli.DurationFlag{
+		Name:  "network-usage-interval",
+		Value: 1 * time.Minute,
+		Usage: "the interval in which the usage of all networks is exported as metrics, 0 disables the export",
+	}
 )
 
 func main() {
@@ -179,6 +259,9 @@ func main() {
 		Commands: []*cli.Command{
 			serveCmd,
 			tokenCmd,
+			reconcileIpamCmd,
+			migrateCmd,
+			datastoreCmd,
 		},
 	}
 
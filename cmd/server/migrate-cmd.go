@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	migrateDryRunFlag = &cli.BoolFlag{
+		Name:  "dry-run",
+		Value: false,
+		Usage: "only show the pending migrations without applying them",
+	}
+	migrateTargetFlag = &cli.IntFlag{
+		Name:  "target",
+		Value: 0,
+		Usage: "the schema version to migrate to, 0 migrates to the latest version",
+	}
+)
+
+var migrateCmd = &cli.Command{
+	Name:  "migrate",
+	Usage: "migrate the stored entities to the schema version of this binary",
+	Flags: []cli.Flag{
+		logLevelFlag,
+		datastoreFlag,
+		datastoreSlowQueryThresholdFlag,
+		postgresDSNFlag,
+		rethinkdbAddressesFlag,
+		rethinkdbDBFlag,
+		rethinkdbDBNameFlag,
+		rethinkdbPasswordFlag,
+		rethinkdbUserFlag,
+		migrateDryRunFlag,
+		migrateTargetFlag,
+	},
+	Action: func(ctx *cli.Context) error {
+		log, _, err := createLoggers(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to create logger %w", err)
+		}
+
+		ds, err := createDatastore(ctx, log)
+		if err != nil {
+			return fmt.Errorf("unable to create datastore: %w", err)
+		}
+
+		var target *int
+		if t := ctx.Int(migrateTargetFlag.Name); t > 0 {
+			target = &t
+		}
+
+		migrator := generic.NewMigrator(generic.MigratorConfig{
+			Log:       log,
+			Datastore: ds,
+		})
+
+		version, err := migrator.SchemaVersion(context.Background())
+		if err != nil {
+			return err
+		}
+
+		dryRun := ctx.Bool(migrateDryRunFlag.Name)
+		migrations, err := migrator.Migrate(context.Background(), target, dryRun)
+
+		state := "applied"
+		if dryRun {
+			state = "pending"
+		}
+
+		fmt.Printf("schema version before migration: %d\n\n", version)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATE")
+		for _, m := range migrations {
+			fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, state)
+		}
+		if flushErr := w.Flush(); flushErr != nil {
+			return flushErr
+		}
+
+		return err
+	},
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/metal-stack/api-server/pkg/reconcile"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	reconcileDryRunFlag = &cli.BoolFlag{
+		Name:  "dry-run",
+		Value: true,
+		Usage: "only report the differences between ipam and the datastore without repairing them",
+	}
+)
+
+var reconcileIpamCmd = &cli.Command{
+	Name:  "reconcile-ipam",
+	Usage: "report and optionally repair ips which differ between ipam and the datastore",
+	Flags: []cli.Flag{
+		logLevelFlag,
+		datastoreFlag,
+		datastoreSlowQueryThresholdFlag,
+		postgresDSNFlag,
+		rethinkdbAddressesFlag,
+		rethinkdbDBFlag,
+		rethinkdbDBNameFlag,
+		rethinkdbPasswordFlag,
+		rethinkdbUserFlag,
+		ipamGrpcEndpointFlag,
+		reconcileDryRunFlag,
+	},
+	Action: func(ctx *cli.Context) error {
+		log, _, err := createLoggers(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to create logger %w", err)
+		}
+
+		ipam, err := createIpamClient(ctx, log)
+		if err != nil {
+			return fmt.Errorf("unable to create ipam client: %w", err)
+		}
+
+		ds, err := createDatastore(ctx, log)
+		if err != nil {
+			return fmt.Errorf("unable to create datastore: %w", err)
+		}
+
+		reconciler := reconcile.NewIpamReconciler(reconcile.IpamConfig{
+			Log:       log,
+			Datastore: ds,
+			Ipam:      ipam,
+		})
+
+		report, err := reconciler.Reconcile(context.Background(), !ctx.Bool(reconcileDryRunFlag.Name))
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KIND\tIP\tDATASTORE PREFIX\tIPAM PREFIX\tREPAIRED\tRESOLVED\tERROR")
+		for _, d := range report.Drifts {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%t\t%s\n", d.Kind, d.IP, d.DatastorePrefix, d.IpamPrefix, d.Repaired, d.Resolved, d.Error)
+		}
+		err = w.Flush()
+		if err != nil {
+			return err
+		}
+
+		if len(report.Skipped) > 0 {
+			fmt.Printf("\nskipped %d ips with pending operations: %v\n", len(report.Skipped), report.Skipped)
+		}
+
+		return nil
+	},
+}
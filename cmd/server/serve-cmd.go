@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -13,6 +14,8 @@ import (
 	"github.com/alicebob/miniredis/v2"
 	"github.com/avast/retry-go/v4"
 	compress "github.com/klauspost/connect-compress/v2"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
 
 	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
 	ipamv1connect "github.com/metal-stack/go-ipam/api/v1/apiv1connect"
@@ -40,6 +43,9 @@ var serveCmd = &cli.Command{
 		masterdataApiCAPathFlag,
 		masterdataApiCertPathFlag,
 		masterdataApiCertKeyPathFlag,
+		datastoreFlag,
+		datastoreSlowQueryThresholdFlag,
+		postgresDSNFlag,
 		rethinkdbAddressesFlag,
 		rethinkdbDBFlag,
 		rethinkdbDBNameFlag,
@@ -58,6 +64,17 @@ var serveCmd = &cli.Command{
 		maxRequestsPerMinuteFlag,
 		maxRequestsPerMinuteUnauthenticatedFlag,
 		ipamGrpcEndpointFlag,
+		ipamReconcileIntervalFlag,
+		ipamReconcileRepairFlag,
+		softDeleteRetentionFlag,
+		historyRetentionFlag,
+		purgeIntervalFlag,
+		ephemeralIPCollectIntervalFlag,
+		ephemeralIPGracePeriodFlag,
+		ephemeralIPCollectDryRunFlag,
+		ipQuotaStaticFlag,
+		ipQuotaEphemeralFlag,
+		networkUsageIntervalFlag,
 	},
 	Action: func(ctx *cli.Context) error {
 		log, level, err := createLoggers(ctx)
@@ -73,9 +90,16 @@ var serveCmd = &cli.Command{
 		redisAddr := ctx.String(redisAddrFlag.Name)
 		stage := ctx.String(stageFlag.Name)
 
-		rethinkDBSession, err := createRedisDBClient(ctx)
+		ds, err := createDatastore(ctx, log)
 		if err != nil {
-			log.Error("unable to create rethinkdb client", "error", err)
+			log.Error("unable to create datastore", "error", err)
+			os.Exit(1)
+		}
+
+		// refuse to start if the stored entities were migrated by a newer version
+		err = generic.NewMigrator(generic.MigratorConfig{Log: log, Datastore: ds}).Check(context.Background())
+		if err != nil {
+			log.Error("unable to serve the datastore schema", "error", err)
 			os.Exit(1)
 		}
 
@@ -85,6 +109,12 @@ var serveCmd = &cli.Command{
 			os.Exit(1)
 		}
 
+		historyRetention, err := parseHistoryRetention(ctx.StringSlice(historyRetentionFlag.Name))
+		if err != nil {
+			log.Error("unable to parse history retention", "error", err)
+			os.Exit(1)
+		}
+
 		c := config{
 			HttpServerEndpoint:                  ctx.String(httpServerEndpointFlag.Name),
 			MetricsServerEndpoint:               ctx.String(metricServerEndpointFlag.Name),
@@ -99,9 +129,18 @@ var serveCmd = &cli.Command{
 			AdminOrgs:                           ctx.StringSlice(adminOrgsFlag.Name),
 			MaxRequestsPerMinuteToken:           ctx.Int(maxRequestsPerMinuteFlag.Name),
 			MaxRequestsPerMinuteUnauthenticated: ctx.Int(maxRequestsPerMinuteUnauthenticatedFlag.Name),
-			RethinkDB:                           ctx.String(rethinkdbDBFlag.Name),
-			RethinkDBSession:                    rethinkDBSession,
+			Datastore:                           ds,
 			Ipam:                                ipam,
+			IpamReconcileInterval:               ctx.Duration(ipamReconcileIntervalFlag.Name),
+			IpamReconcileRepair:                 ctx.Bool(ipamReconcileRepairFlag.Name),
+			SoftDeleteRetention:                 ctx.Duration(softDeleteRetentionFlag.Name),
+			HistoryRetention:                    historyRetention,
+			PurgeInterval:                       ctx.Duration(purgeIntervalFlag.Name),
+			EphemeralIPCollectInterval:          ctx.Duration(ephemeralIPCollectIntervalFlag.Name),
+			EphemeralIPGracePeriod:              ctx.Duration(ephemeralIPGracePeriodFlag.Name),
+			EphemeralIPCollectDryRun:            ctx.Bool(ephemeralIPCollectDryRunFlag.Name),
+			IPQuotas:                            ipQuotas(ctx),
+			NetworkUsageInterval:                ctx.Duration(networkUsageIntervalFlag.Name),
 		}
 
 		log.Info("running api-server", "version", v.V, "level", level, "http endpoint", c.HttpServerEndpoint)
@@ -145,18 +184,47 @@ func retryConnectMasterdataClient(cli *cli.Context, logger *slog.Logger) mdm.Cli
 	return client
 }
 
-func createRedisDBClient(cli *cli.Context) (*r.Session, error) {
+func createRethinkDBClient(cli *cli.Context) (*r.Session, error) {
 	session, err := r.Connect(r.ConnectOpts{
-		Addresses: cli.StringSlice("db-addr"),
-		Database:  cli.String("db-name"),
-		Username:  cli.String("db-user"),
-		Password:  cli.String("db-password"),
+		Addresses: cli.StringSlice(rethinkdbAddressesFlag.Name),
+		Database:  cli.String(rethinkdbDBNameFlag.Name),
+		Username:  cli.String(rethinkdbUserFlag.Name),
+		Password:  cli.String(rethinkdbPasswordFlag.Name),
 		MaxIdle:   10,
 		MaxOpen:   20,
 	})
 	return session, err
 }
 
+// createDatastore creates the datastore in the backend given by the datastore flag
+func createDatastore(cli *cli.Context, log *slog.Logger) (*generic.Datastore, error) {
+	slowQueryThreshold := generic.WithSlowQueryThreshold(cli.Duration(datastoreSlowQueryThresholdFlag.Name))
+
+	switch backend := cli.String(datastoreFlag.Name); backend {
+	case datastoreRethinkDB:
+		session, err := createRethinkDBClient(cli)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create rethinkdb client: %w", err)
+		}
+		return generic.New(log, cli.String(rethinkdbDBFlag.Name), session, slowQueryThreshold)
+	case datastorePostgres:
+		db, err := sql.Open("postgres", cli.String(postgresDSNFlag.Name))
+		if err != nil {
+			return nil, fmt.Errorf("unable to create postgres client: %w", err)
+		}
+		err = db.Ping()
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to postgres: %w", err)
+		}
+		return generic.NewPostgres(log, db, slowQueryThreshold)
+	case datastoreMemory:
+		log.Warn("using in-memory datastore, all entities are lost on restart")
+		return generic.NewMemory(log, slowQueryThreshold)
+	default:
+		return nil, fmt.Errorf("unsupported datastore %q, can be one of %s|%s|%s", backend, datastoreRethinkDB, datastorePostgres, datastoreMemory)
+	}
+}
+
 // createAuditingClient creates a new auditing client
 // Can return nil,nil if auditing is disabled!
 func createAuditingClient(cli *cli.Context, log *slog.Logger) (auditing.Auditing, error) {
@@ -253,3 +321,32 @@ func createIpamClient(cli *cli.Context, log *slog.Logger) (ipamv1connect.IpamSer
 	log.Info("ipam initialized")
 	return ipamService, nil
 }
+
+// parseHistoryRetention parses the retention of the history per table given as table=duration.
+func parseHistoryRetention(values []string) (map[string]time.Duration, error) {
+	result := map[string]time.Duration{}
+	for _, v := range values {
+		table, d, ok := strings.Cut(v, "=")
+		if !ok {
+			return nil, fmt.Errorf("history retention %q must be given as table=duration", v)
+		}
+		retention, err := time.ParseDuration(d)
+		if err != nil {
+			return nil, fmt.Errorf("history retention of %s is invalid: %w", table, err)
+		}
+		result[table] = retention
+	}
+	return result, nil
+}
+
+// ipQuotas returns the default ip quotas per type, types without quota are unlimited.
+func ipQuotas(cli *cli.Context) map[metal.IPType]uint64 {
+	result := map[metal.IPType]uint64{}
+	if quota := cli.Uint64(ipQuotaStaticFlag.Name); quota > 0 {
+		result[metal.Static] = quota
+	}
+	if quota := cli.Uint64(ipQuotaEphemeralFlag.Name); quota > 0 {
+		result[metal.Ephemeral] = quota
+	}
+	return result
+}
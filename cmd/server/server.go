@@ -18,12 +18,13 @@ import (
 	"connectrpc.com/otelconnect"
 	"connectrpc.com/validate"
 
+	"github.com/metal-stack/api/go/metalstack/admin/v1/adminv1connect"
 	"github.com/metal-stack/api/go/metalstack/api/v1/apiv1connect"
+	promclient "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 	"go.opentelemetry.io/otel/exporters/prometheus"
 	"go.opentelemetry.io/otel/sdk/metric"
-	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
 
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
@@ -31,12 +32,19 @@ import (
 	"github.com/metal-stack/api-server/pkg/auth"
 	"github.com/metal-stack/api-server/pkg/certs"
 	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
 	"github.com/metal-stack/api-server/pkg/invite"
 	ratelimiter "github.com/metal-stack/api-server/pkg/rate-limiter"
+	"github.com/metal-stack/api-server/pkg/reconcile"
 	"github.com/metal-stack/api-server/pkg/service/health"
+	"github.com/metal-stack/api-server/pkg/service/image"
 	"github.com/metal-stack/api-server/pkg/service/ip"
+	"github.com/metal-stack/api-server/pkg/service/machine"
 	"github.com/metal-stack/api-server/pkg/service/method"
+	"github.com/metal-stack/api-server/pkg/service/network"
+	"github.com/metal-stack/api-server/pkg/service/partition"
 	"github.com/metal-stack/api-server/pkg/service/project"
+	"github.com/metal-stack/api-server/pkg/service/size"
 	"github.com/metal-stack/api-server/pkg/service/tenant"
 	"github.com/metal-stack/api-server/pkg/service/token"
 	"github.com/metal-stack/api-server/pkg/service/version"
@@ -62,9 +70,18 @@ type config struct {
 	AdminOrgs                           []string
 	MaxRequestsPerMinuteToken           int
 	MaxRequestsPerMinuteUnauthenticated int
-	RethinkDBSession                    *r.Session
-	RethinkDB                           string
+	Datastore                           *generic.Datastore
 	Ipam                                ipamv1connect.IpamServiceClient
+	IpamReconcileInterval               time.Duration
+	IpamReconcileRepair                 bool
+	SoftDeleteRetention                 time.Duration
+	HistoryRetention                    map[string]time.Duration
+	PurgeInterval                       time.Duration
+	EphemeralIPCollectInterval          time.Duration
+	EphemeralIPGracePeriod              time.Duration
+	EphemeralIPCollectDryRun            bool
+	IPQuotas                            map[metal.IPType]uint64
+	NetworkUsageInterval                time.Duration
 }
 type server struct {
 	c   config
@@ -160,11 +177,64 @@ func (s *server) Run() error {
 		InviteStore:  inviteStore,
 	})
 
-	ds, err := generic.New(s.log, s.c.RethinkDB, s.c.RethinkDBSession)
-	if err != nil {
-		return err
+	ds := s.c.Datastore
+	outbox := generic.NewOutbox(generic.OutboxConfig{
+		Log:       s.log,
+		Datastore: ds,
+		Handlers: map[metal.OperationType]generic.OperationHandler{
+			metal.OperationReleaseIP:           ip.ReleaseIPHandler(ds, s.c.Ipam),
+			metal.OperationExpireIPReservation: ip.ExpireIPReservationHandler(ds, s.c.Ipam),
+			metal.OperationReleasePrefixes:     network.ReleasePrefixesHandler(ds, s.c.Ipam),
+		},
+	})
+	go outbox.Run(context.Background())
+
+	if s.c.IpamReconcileInterval > 0 {
+		reconciler := reconcile.NewIpamReconciler(reconcile.IpamConfig{Log: s.log, Datastore: ds, Ipam: s.c.Ipam})
+		go reconciler.Run(context.Background(), s.c.IpamReconcileInterval, s.c.IpamReconcileRepair)
+	}
+
+	if s.c.PurgeInterval > 0 {
+		purger := generic.NewPurger(generic.PurgerConfig{
+			Log:              s.log,
+			Datastore:        ds,
+			Retention:        s.c.SoftDeleteRetention,
+			Interval:         s.c.PurgeInterval,
+			HistoryRetention: s.c.HistoryRetention,
+		})
+		go purger.Run(context.Background())
+	}
+
+	if s.c.EphemeralIPCollectInterval > 0 {
+		collector := ip.NewCollector(ip.CollectorConfig{
+			Log:          s.log,
+			Datastore:    ds,
+			Outbox:       outbox,
+			MasterClient: s.c.MasterClient,
+			Auditing:     s.c.Auditing,
+			GracePeriod:  s.c.EphemeralIPGracePeriod,
+			Interval:     s.c.EphemeralIPCollectInterval,
+			DryRun:       s.c.EphemeralIPCollectDryRun,
+		})
+		go collector.Run(context.Background())
 	}
-	ipService := ip.New(ip.Config{Log: s.log, Datastore: ds, Ipam: s.c.Ipam})
+
+	if s.c.NetworkUsageInterval > 0 {
+		reporter := network.NewUsageReporter(network.UsageReporterConfig{Log: s.log, Datastore: ds, Ipam: s.c.Ipam, Interval: s.c.NetworkUsageInterval})
+		promclient.MustRegister(reporter)
+		go reporter.Run(context.Background())
+	}
+
+	ipService := ip.New(ip.Config{Log: s.log, Datastore: ds, Ipam: s.c.Ipam, Outbox: outbox, MasterClient: s.c.MasterClient, DefaultQuotas: s.c.IPQuotas})
+	imageService := image.New(image.Config{Log: s.log, Datastore: ds})
+	imageAdminService := image.NewAdmin(image.Config{Log: s.log, Datastore: ds})
+	machineService := machine.New(machine.Config{Log: s.log, Datastore: ds})
+	networkService := network.New(network.Config{Log: s.log, Datastore: ds, Ipam: s.c.Ipam, Outbox: outbox})
+	networkAdminService := network.NewAdmin(network.Config{Log: s.log, Datastore: ds, Ipam: s.c.Ipam, Outbox: outbox})
+	partitionService := partition.New(partition.Config{Log: s.log, Datastore: ds})
+	partitionAdminService := partition.NewAdmin(partition.Config{Log: s.log, Datastore: ds})
+	sizeService := size.New(size.Config{Log: s.log, Datastore: ds})
+	sizeAdminService := size.NewAdmin(size.Config{Log: s.log, Datastore: ds})
 	tokenService := token.New(token.Config{
 		Log:           s.log,
 		CertStore:     certStore,
@@ -185,6 +255,15 @@ func (s *server) Run() error {
 	mux.Handle(apiv1connect.NewTenantServiceHandler(tenantService, interceptors))
 	mux.Handle(apiv1connect.NewProjectServiceHandler(projectService, interceptors))
 	mux.Handle(apiv1connect.NewIPServiceHandler(ipService, interceptors))
+	mux.Handle(apiv1connect.NewImageServiceHandler(imageService, interceptors))
+	mux.Handle(adminv1connect.NewImageServiceHandler(imageAdminService, interceptors))
+	mux.Handle(apiv1connect.NewMachineServiceHandler(machineService, interceptors))
+	mux.Handle(apiv1connect.NewNetworkServiceHandler(networkService, interceptors))
+	mux.Handle(adminv1connect.NewNetworkServiceHandler(networkAdminService, interceptors))
+	mux.Handle(apiv1connect.NewPartitionServiceHandler(partitionService, interceptors))
+	mux.Handle(adminv1connect.NewPartitionServiceHandler(partitionAdminService, interceptors))
+	mux.Handle(apiv1connect.NewSizeServiceHandler(sizeService, interceptors))
+	mux.Handle(adminv1connect.NewSizeServiceHandler(sizeAdminService, interceptors))
 	mux.Handle(apiv1connect.NewMethodServiceHandler(methodService, interceptors))
 
 	mux.Handle(apiv1connect.NewVersionServiceHandler(versionService, interceptors))
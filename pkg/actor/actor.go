@@ -0,0 +1,16 @@
+package actor
+
+import "context"
+
+type actorKey struct{}
+
+// ContextWithActor stores the actor of a request in the context, it is recorded in the history of all changes.
+func ContextWithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor of a request, empty if there is none.
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
@@ -43,6 +43,8 @@ is_method_allowed if {
 }
 
 # Rules per Service
+# Project scoped services like the MachineService need no rule of their own, their methods are only allowed
+# for the project of the request, the services return only the entities of this project.
 service_allowed if {
 	input.method in input.permissions[input.request.project]
 }
@@ -137,3 +137,42 @@ test_decision_admin_is_allowed if {
 		with data.roles.admin as admin_roles
 	d.allow
 }
+
+test_watch_ips_allowed if {
+	authorization.decision.allow with input as {
+		"method": "/metalstack.api.v1.IPService/Watch",
+		"request": {"project": "project-a"},
+		"token": tokenv1,
+		"permissions": {"project-a": [
+			"/metalstack.api.v1.IPService/List",
+			"/metalstack.api.v1.IPService/Watch",
+		]},
+	}
+		with data.methods as methods
+}
+
+test_watch_ips_not_allowed_for_other_project if {
+	not authorization.decision.allow with input as {
+		"method": "/metalstack.api.v1.IPService/Watch",
+		"request": {"project": "project-c"},
+		"token": tokenv1,
+		"permissions": {"project-a": [
+			"/metalstack.api.v1.IPService/List",
+			"/metalstack.api.v1.IPService/Watch",
+		]},
+	}
+		with data.methods as methods
+}
+
+test_history_of_ips_not_allowed_for_other_project if {
+	not authorization.decision.allow with input as {
+		"method": "/metalstack.api.v1.IPService/History",
+		"request": {"project": "project-c"},
+		"token": tokenv1,
+		"permissions": {"project-a": [
+			"/metalstack.api.v1.IPService/Get",
+			"/metalstack.api.v1.IPService/History",
+		]},
+	}
+		with data.methods as methods
+}
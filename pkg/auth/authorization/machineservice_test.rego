@@ -0,0 +1,83 @@
+package api.v1.metalstack.io.authorization_test
+
+import data.api.v1.metalstack.io.authorization
+import rego.v1
+
+machine_methods := [
+	"/metalstack.api.v1.MachineService/Get",
+	"/metalstack.api.v1.MachineService/List",
+]
+
+test_list_machines_allowed if {
+	authorization.decision.allow with input as {
+		"method": "/metalstack.api.v1.MachineService/List",
+		"request": {"project": "project-a"},
+		"token": tokenv1,
+		"permissions": {"project-a": [
+			"/metalstack.api.v1.MachineService/Get",
+			"/metalstack.api.v1.MachineService/List",
+		]},
+	}
+		with data.methods as machine_methods
+}
+
+test_get_machine_not_allowed_for_other_project if {
+	not authorization.decision.allow with input as {
+		"method": "/metalstack.api.v1.MachineService/Get",
+		"request": {"project": "project-c"},
+		"token": tokenv1,
+		"permissions": {"project-a": [
+			"/metalstack.api.v1.MachineService/Get",
+			"/metalstack.api.v1.MachineService/List",
+		]},
+	}
+		with data.methods as machine_methods
+}
+
+test_list_machines_not_allowed_without_project if {
+	not authorization.decision.allow with input as {
+		"method": "/metalstack.api.v1.MachineService/List",
+		"request": null,
+		"token": tokenv1,
+		"permissions": {"project-a": [
+			"/metalstack.api.v1.MachineService/Get",
+			"/metalstack.api.v1.MachineService/List",
+		]},
+	}
+		with data.methods as machine_methods
+}
+
+test_list_machines_allowed_for_project_viewer if {
+	authorization.decision.allow with input as {
+		"method": "/metalstack.api.v1.MachineService/List",
+		"request": {"project": "project-a"},
+		"token": tokenv1,
+		"project_roles": {"project-a": "PROJECT_ROLE_VIEWER"},
+	}
+		with data.methods as machine_methods
+		with data.roles.project as {"PROJECT_ROLE_VIEWER": machine_methods}
+}
+
+test_list_machines_not_allowed_for_viewer_of_other_project if {
+	not authorization.decision.allow with input as {
+		"method": "/metalstack.api.v1.MachineService/List",
+		"request": {"project": "project-c"},
+		"token": tokenv1,
+		"project_roles": {"project-a": "PROJECT_ROLE_VIEWER"},
+	}
+		with data.methods as machine_methods
+		with data.roles.project as {"PROJECT_ROLE_VIEWER": machine_methods}
+}
+
+test_get_machine_of_other_project_not_allowed_for_project_owner if {
+	not authorization.decision.allow with input as {
+		"method": "/metalstack.api.v1.MachineService/Get",
+		"request": {"id": "machine-b", "project": "project-b"},
+		"token": tokenv1,
+		"project_roles": {"project-a": "PROJECT_ROLE_OWNER"},
+		"tenant_roles": {"tenant-a": "TENANT_ROLE_OWNER"},
+	}
+		with data.methods as machine_methods
+		with data.roles.project as {"PROJECT_ROLE_OWNER": machine_methods}
+		with data.roles.tenant as {"TENANT_ROLE_OWNER": []}
+}
@@ -0,0 +1,46 @@
+package api.v1.metalstack.io.authorization_test
+
+import data.api.v1.metalstack.io.authorization
+import rego.v1
+
+network_methods := ["/metalstack.api.v1.NetworkService/Create"]
+
+test_create_network_allowed if {
+	authorization.decision.allow with input as {
+		"method": "/metalstack.api.v1.NetworkService/Create",
+		"request": {"project": "project-a"},
+		"token": tokenv1,
+		"permissions": {"project-a": [
+			"/metalstack.api.v1.NetworkService/Get",
+			"/metalstack.api.v1.NetworkService/List",
+			"/metalstack.api.v1.NetworkService/Create",
+			"/metalstack.api.v1.NetworkService/Delete",
+		]},
+	}
+		with data.methods as network_methods
+}
+
+test_delete_network_not_allowed_for_other_project if {
+	not authorization.decision.allow with input as {
+		"method": "/metalstack.api.v1.NetworkService/Delete",
+		"request": {"project": "project-c"},
+		"token": tokenv1,
+		"permissions": {"project-a": [
+			"/metalstack.api.v1.NetworkService/Get",
+			"/metalstack.api.v1.NetworkService/List",
+			"/metalstack.api.v1.NetworkService/Create",
+			"/metalstack.api.v1.NetworkService/Delete",
+		]},
+	}
+		with data.methods as network_methods
+}
+
+test_create_super_network_not_allowed_without_admin_role if {
+	not authorization.decision.allow with input as {
+		"method": "/metalstack.admin.v1.NetworkService/Create",
+		"request": {"project": "project-a"},
+		"token": tokenv1,
+		"permissions": {"project-a": ["/metalstack.api.v1.NetworkService/Create"]},
+	}
+		with data.methods as network_methods
+}
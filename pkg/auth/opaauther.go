@@ -13,6 +13,7 @@ import (
 
 	"connectrpc.com/connect"
 	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/metal-stack/api-server/pkg/actor"
 	authentication "github.com/metal-stack/api-server/pkg/auth/authentication"
 	authorization "github.com/metal-stack/api-server/pkg/auth/authorization"
 	"github.com/metal-stack/api-server/pkg/certs"
@@ -189,6 +190,15 @@ func (o *opa) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.St
 			return fmt.Errorf("opa engine not initialized properly, forgot AuthzLoad ?")
 		}
 
+		// every message of the stream is authorized when it is received, the actor is taken from the token upfront
+		t, err := o.authenticateToken(ctx, conn.RequestHeader().Get)
+		if err != nil {
+			return err
+		}
+		if t != nil {
+			ctx = actor.ContextWithActor(ctx, t.UserId)
+		}
+
 		wrapper := &recvWrapper{
 			StreamingHandlerConn: conn,
 			ctx:                  ctx,
@@ -235,6 +245,7 @@ func (o *opa) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
 		// Store the token in the context for later use in the service methods
 		if t != nil {
 			ctx = token.ContextWithToken(ctx, t)
+			ctx = actor.ContextWithActor(ctx, t.UserId)
 		}
 
 		resp, err := next(ctx, req)
@@ -250,58 +261,19 @@ func (o *opa) decide(ctx context.Context, methodName string, jwtTokenfunc func(s
 	// Allow all methods which have public visibility defined in the proto definition
 	// o.log.Debug("authorize", "method", methodName, "req", req, "visibility", o.visibility, "servicepermissions", *o.servicePermissions)
 
-	jwks, err := o.certCache.Get(ctx, nil)
+	t, err := o.authenticateToken(ctx, jwtTokenfunc)
 	if err != nil {
 		return nil, err
 	}
 
-	if jwks.set.Len() == 0 {
-		// in the initial startup phase it can happen that authorize gets called even if there are no public signing keys yet
-		// in this case due to caching there is no possibility to authenticate for 60 minutes until the cache has expired
-		// so we refresh the cache if nothing was found.
-		jwks, err = o.certCache.Refresh(ctx, nil)
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	var (
-		bearer         = jwtTokenfunc(authorizationHeader)
-		_, jwtToken, _ = strings.Cut(bearer, " ")
-		t              *v1.Token
-		projectRoles   map[string]v1.ProjectRole
-		tenantRoles    map[string]v1.TenantRole
-		permissions    map[string]*v1.MethodPermission
-		adminRole      *v1.AdminRole
+		projectRoles map[string]v1.ProjectRole
+		tenantRoles  map[string]v1.TenantRole
+		permissions  map[string]*v1.MethodPermission
+		adminRole    *v1.AdminRole
 	)
-	jwtToken = strings.TrimSpace(jwtToken)
-
-	if jwtToken != "" {
-		decision, err := o.authenticate(ctx, map[string]any{
-			"token": jwtToken,
-			"jwks":  jwks.raw,
-		})
-		if err != nil {
-			return nil, connect.NewError(connect.CodeInternal, err)
-		}
-
-		if !decision.Valid {
-			if decision.Reason != "" {
-				return nil, connect.NewError(connect.CodeUnauthenticated, errors.New(decision.Reason))
-			}
-
-			return nil, connect.NewError(connect.CodeUnauthenticated, fmt.Errorf("token is invalid or has expired"))
-		}
-
-		t, err = o.tokenStore.Get(ctx, decision.Subject, decision.JwtID)
-		if err != nil {
-			if errors.Is(err, token.ErrTokenNotFound) {
-				return nil, connect.NewError(connect.CodeUnauthenticated, fmt.Errorf("token was revoked"))
-			}
-
-			return nil, connect.NewError(connect.CodeInternal, err)
-		}
 
+	if t != nil {
 		if t.TokenType == v1.TokenType_TOKEN_TYPE_API {
 			projectRoles := t.ProjectRoles
 			tenantRoles := t.TenantRoles
@@ -363,6 +335,61 @@ func (o *opa) decide(ctx context.Context, methodName string, jwtTokenfunc func(s
 	return nil, connect.NewError(connect.CodeUnauthenticated, fmt.Errorf("not allowed to call: %s", methodName))
 }
 
+// authenticateToken validates the bearer token of a request and returns the stored token, nil if the request carries none.
+func (o *opa) authenticateToken(ctx context.Context, jwtTokenfunc func(string) string) (*v1.Token, error) {
+	jwks, err := o.certCache.Get(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if jwks.set.Len() == 0 {
+		// in the initial startup phase it can happen that authorize gets called even if there are no public signing keys yet
+		// in this case due to caching there is no possibility to authenticate for 60 minutes until the cache has expired
+		// so we refresh the cache if nothing was found.
+		jwks, err = o.certCache.Refresh(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		bearer         = jwtTokenfunc(authorizationHeader)
+		_, jwtToken, _ = strings.Cut(bearer, " ")
+	)
+	jwtToken = strings.TrimSpace(jwtToken)
+
+	if jwtToken == "" {
+		return nil, nil
+	}
+
+	decision, err := o.authenticate(ctx, map[string]any{
+		"token": jwtToken,
+		"jwks":  jwks.raw,
+	})
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	if !decision.Valid {
+		if decision.Reason != "" {
+			return nil, connect.NewError(connect.CodeUnauthenticated, errors.New(decision.Reason))
+		}
+
+		return nil, connect.NewError(connect.CodeUnauthenticated, fmt.Errorf("token is invalid or has expired"))
+	}
+
+	t, err := o.tokenStore.Get(ctx, decision.Subject, decision.JwtID)
+	if err != nil {
+		if errors.Is(err, token.ErrTokenNotFound) {
+			return nil, connect.NewError(connect.CodeUnauthenticated, fmt.Errorf("token was revoked"))
+		}
+
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return t, nil
+}
+
 func (o *opa) authenticate(ctx context.Context, input map[string]any) (authenticationDecision, error) {
 	return evalResult[authenticationDecision](ctx, o.log.WithGroup("authentication"), o.authenticationQuery, input)
 }
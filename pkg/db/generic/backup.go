@@ -0,0 +1,362 @@
+package generic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// maxDocumentSize is the maximum size of a single line of a backup
+const maxDocumentSize = 16 * 1024 * 1024
+
+type (
+	// ConflictStrategy determines how an import handles entities which already exist.
+	ConflictStrategy string
+
+	// ExportConfig selects the tables of an export.
+	ExportConfig struct {
+		// Tables to export, defaults to all tables
+		Tables []string
+	}
+
+	// ImportConfig determines how a backup is restored.
+	ImportConfig struct {
+		// Tables to import, documents of other tables are skipped, defaults to all tables
+		Tables []string
+		// Conflict strategy for entities which already exist, defaults to ConflictFail
+		Conflict ConflictStrategy
+		// Consistent reads and validates the whole backup against the entity types before anything is written,
+		// otherwise the documents are written in batches while they are read.
+		Consistent bool
+	}
+
+	// TableCount is the number of entities of a table which were processed.
+	TableCount struct {
+		// Written entities, including the replaced ones
+		Written int
+		// Replaced entities which existed before the import
+		Replaced int
+		// Skipped entities which existed before the import
+		Skipped int
+	}
+
+	// record is a line of a backup.
+	record struct {
+		Table string          `json:"table"`
+		Data  json.RawMessage `json:"data"`
+	}
+
+	// table provides access to the entities of a storage independent of their type.
+	table interface {
+		name() string
+		export(ctx context.Context, emit func(e any) error) error
+		ids(ctx context.Context) (map[string]bool, error)
+		decode(data json.RawMessage, strict bool) (Entity, error)
+		write(ctx context.Context, es []Entity) (BulkResults, error)
+	}
+
+	storageTable[E Entity] struct {
+		tableName string
+		s         Storage[E]
+	}
+
+	// allQuery selects all entities including the soft deleted ones.
+	allQuery struct{}
+)
+
+const (
+	// ConflictFail aborts the import if an entity already exists
+	ConflictFail ConflictStrategy = "fail"
+	// ConflictSkip keeps existing entities
+	ConflictSkip ConflictStrategy = "skip"
+	// ConflictReplace replaces existing entities with the ones of the backup
+	ConflictReplace ConflictStrategy = "replace"
+)
+
+func (allQuery) Predicates() []Predicate { return nil }
+func (allQuery) WithDeleted() bool       { return true }
+
+// newTable registers a storage for export and import. Restored entities are not recorded in the history,
+// because the revisions are part of the backup themselves.
+func newTable[E Entity](tableName string, s Storage[E]) table {
+	if hs, ok := s.(*historyStore[E]); ok {
+		s = hs.Storage
+	}
+	return &storageTable[E]{tableName: tableName, s: s}
+}
+
+func (t *storageTable[E]) name() string {
+	return t.tableName
+}
+
+func (t *storageTable[E]) export(ctx context.Context, emit func(e any) error) error {
+	token := ""
+	for {
+		es, next, err := t.s.SearchPage(ctx, allQuery{}, Page{Size: MaxPageSize, Token: token})
+		if err != nil {
+			return err
+		}
+		for _, e := range es {
+			err := emit(e)
+			if err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		token = next
+	}
+}
+
+func (t *storageTable[E]) ids(ctx context.Context) (map[string]bool, error) {
+	ids := map[string]bool{}
+	err := t.export(ctx, func(e any) error {
+		ids[e.(E).GetID()] = true
+		return nil
+	})
+	return ids, err
+}
+
+func (t *storageTable[E]) decode(data json.RawMessage, strict bool) (Entity, error) {
+	e := new(E)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	err := dec.Decode(e)
+	if err != nil {
+		return nil, InvalidArgument("document of %s is invalid: %s", t.tableName, err)
+	}
+	// a null document decodes to a nil entity without an error
+	if reflect.ValueOf(*e).IsNil() {
+		return nil, InvalidArgument("document of %s is empty", t.tableName)
+	}
+	if strict && (*e).GetID() == "" {
+		return nil, InvalidArgument("document of %s has no id", t.tableName)
+	}
+	return *e, nil
+}
+
+func (t *storageTable[E]) write(ctx context.Context, es []Entity) (BulkResults, error) {
+	typed := make([]E, 0, len(es))
+	for _, e := range es {
+		typed = append(typed, e.(E))
+	}
+	// the creation timestamp of the backup is kept by an upsert
+	return t.s.UpsertMany(ctx, typed)
+}
+
+// Export writes all entities of the selected tables including the soft deleted ones as newline delimited json.
+// Every line holds the table and the entity as stored.
+func (d *Datastore) Export(ctx context.Context, w io.Writer, c ExportConfig) (map[string]*TableCount, error) {
+	tables, err := d.selectTables(c.Tables)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		enc    = json.NewEncoder(w)
+		counts = map[string]*TableCount{}
+	)
+	for _, t := range tables {
+		count := &TableCount{}
+		counts[t.name()] = count
+
+		err := t.export(ctx, func(e any) error {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			count.Written++
+			return enc.Encode(record{Table: t.name(), Data: data})
+		})
+		if err != nil {
+			return counts, fmt.Errorf("unable to export %s: %w", t.name(), err)
+		}
+	}
+	return counts, nil
+}
+
+// Import restores the entities of a backup written by Export.
+func (d *Datastore) Import(ctx context.Context, r io.Reader, c ImportConfig) (map[string]*TableCount, error) {
+	tables, err := d.selectTables(c.Tables)
+	if err != nil {
+		return nil, err
+	}
+	strategy := c.Conflict
+	if strategy == "" {
+		strategy = ConflictFail
+	}
+	if !slices.Contains([]ConflictStrategy{ConflictFail, ConflictSkip, ConflictReplace}, strategy) {
+		return nil, InvalidArgument("unsupported conflict strategy %q, can be one of %s|%s|%s", strategy, ConflictFail, ConflictSkip, ConflictReplace)
+	}
+
+	im := &importer{
+		tables:   map[string]table{},
+		existing: map[string]map[string]bool{},
+		seen:     map[string]map[string]bool{},
+		pending:  map[string][]Entity{},
+		counts:   map[string]*TableCount{},
+		strategy: strategy,
+		strict:   c.Consistent,
+	}
+	for _, t := range tables {
+		im.tables[t.name()] = t
+		im.counts[t.name()] = &TableCount{}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxDocumentSize)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		err := im.add(ctx, scanner.Bytes())
+		if err != nil {
+			return im.counts, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		// a consistent import writes nothing before the whole backup was validated
+		if !im.strict {
+			err = im.flush(ctx, bulkBatchSize)
+			if err != nil {
+				return im.counts, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return im.counts, fmt.Errorf("unable to read backup: %w", err)
+	}
+
+	return im.counts, im.flush(ctx, 0)
+}
+
+// selectTables returns the tables with the given names in the order of the datastore, all if no names are given.
+func (d *Datastore) selectTables(names []string) ([]table, error) {
+	if len(names) == 0 {
+		return d.tables, nil
+	}
+
+	var result []table
+	for _, name := range names {
+		i := slices.IndexFunc(d.tables, func(t table) bool { return t.name() == name })
+		if i < 0 {
+			return nil, InvalidArgument("unknown table %q, can be one of %s", name, strings.Join(d.TableNames(), "|"))
+		}
+		result = append(result, d.tables[i])
+	}
+	return result, nil
+}
+
+// TableNames returns the names of all tables which can be exported and imported.
+func (d *Datastore) TableNames() []string {
+	var names []string
+	for _, t := range d.tables {
+		names = append(names, t.name())
+	}
+	return names
+}
+
+// importer collects the documents of a backup by table and writes them in batches.
+type importer struct {
+	tables map[string]table
+	// existing ids of a table, read before the first document of the table is written
+	existing map[string]map[string]bool
+	// seen ids of a table in the backup
+	seen     map[string]map[string]bool
+	pending  map[string][]Entity
+	counts   map[string]*TableCount
+	strategy ConflictStrategy
+	strict   bool
+}
+
+func (im *importer) add(ctx context.Context, line []byte) error {
+	var rec record
+	dec := json.NewDecoder(bytes.NewReader(line))
+	if im.strict {
+		dec.DisallowUnknownFields()
+	}
+	err := dec.Decode(&rec)
+	if err != nil {
+		return InvalidArgument("record is invalid: %s", err)
+	}
+
+	t, ok := im.tables[rec.Table]
+	if !ok {
+		if im.strict && rec.Table == "" {
+			return InvalidArgument("record has no table")
+		}
+		// documents of tables which are not selected are skipped
+		return nil
+	}
+
+	e, err := t.decode(rec.Data, im.strict)
+	if err != nil {
+		return err
+	}
+
+	if im.seen[rec.Table] == nil {
+		im.seen[rec.Table] = map[string]bool{}
+	}
+	if im.seen[rec.Table][e.GetID()] {
+		return InvalidArgument("%s with id %q is contained more than once", rec.Table, e.GetID())
+	}
+	im.seen[rec.Table][e.GetID()] = true
+
+	existing, ok := im.existing[rec.Table]
+	if !ok {
+		existing, err = t.ids(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to read existing entities of %s: %w", rec.Table, err)
+		}
+		im.existing[rec.Table] = existing
+	}
+
+	count := im.counts[rec.Table]
+	if existing[e.GetID()] {
+		switch im.strategy {
+		case ConflictFail:
+			return Conflict("%s with id %q already exists", rec.Table, e.GetID())
+		case ConflictSkip:
+			count.Skipped++
+			return nil
+		case ConflictReplace:
+			count.Replaced++
+		}
+	}
+
+	im.pending[rec.Table] = append(im.pending[rec.Table], e)
+	return nil
+}
+
+// flush writes the pending entities of every table which has at least size pending entities.
+func (im *importer) flush(ctx context.Context, size int) error {
+	for name, pending := range im.pending {
+		if len(pending) == 0 || len(pending) < size {
+			continue
+		}
+
+		results, err := im.tables[name].write(ctx, pending)
+		if err != nil {
+			return fmt.Errorf("unable to import %s: %w", name, err)
+		}
+		if err := results.Err(); err != nil {
+			return fmt.Errorf("unable to import %s: %w", name, err)
+		}
+
+		im.counts[name].Written += len(pending)
+		im.pending[name] = nil
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package generic
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	log := slog.Default()
+
+	source, err := NewMemory(log)
+	require.NoError(t, err)
+
+	_, err = source.IP().Create(ctx, &metal.IP{IPAddress: "1.2.3.4", ProjectID: "p1"})
+	require.NoError(t, err)
+	deleted, err := source.IP().Create(ctx, &metal.IP{IPAddress: "1.2.3.5", ProjectID: "p1"})
+	require.NoError(t, err)
+	require.NoError(t, source.IP().Delete(ctx, deleted))
+	_, err = source.Partition().Create(ctx, &metal.Partition{Base: metal.Base{ID: "partition-a"}})
+	require.NoError(t, err)
+
+	var backup bytes.Buffer
+	counts, err := source.Export(ctx, &backup, ExportConfig{Tables: []string{"ip", "partition"}})
+	require.NoError(t, err)
+	require.Equal(t, 2, counts["ip"].Written, "soft deleted entities must be exported")
+	require.Equal(t, 1, counts["partition"].Written)
+
+	_, err = source.Export(ctx, &backup, ExportConfig{Tables: []string{"unknown"}})
+	require.True(t, IsInvalidArgument(err), "unknown tables must be rejected: %v", err)
+
+	target, err := NewMemory(log)
+	require.NoError(t, err)
+
+	counts, err = target.Import(ctx, bytes.NewReader(backup.Bytes()), ImportConfig{Consistent: true})
+	require.NoError(t, err)
+	require.Equal(t, TableCount{Written: 2}, *counts["ip"])
+
+	ips, err := target.IP().Search(ctx, testDeletedQuery{testQuery{Eq("projectid", "p1")}})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.2.3.4", "1.2.3.5"}, ids(ips))
+	_, err = target.IP().Get(ctx, "1.2.3.5")
+	require.True(t, IsNotFound(err), "soft deleted entities must stay deleted: %v", err)
+
+	revisions, err := target.Revisions(ctx, "ip", "1.2.3.4")
+	require.NoError(t, err)
+	require.Empty(t, revisions, "restored entities must not be recorded in the history")
+
+	_, err = target.Import(ctx, bytes.NewReader(backup.Bytes()), ImportConfig{Conflict: ConflictFail})
+	require.True(t, IsConflict(err), "existing entities must fail the import: %v", err)
+
+	counts, err = target.Import(ctx, bytes.NewReader(backup.Bytes()), ImportConfig{Conflict: ConflictSkip})
+	require.NoError(t, err)
+	require.Equal(t, TableCount{Skipped: 2}, *counts["ip"])
+
+	counts, err = target.Import(ctx, bytes.NewReader(backup.Bytes()), ImportConfig{Conflict: ConflictReplace, Tables: []string{"partition"}})
+	require.NoError(t, err)
+	require.Equal(t, TableCount{Written: 1, Replaced: 1}, *counts["partition"])
+	require.NotContains(t, counts, "ip")
+
+	_, err = target.Import(ctx, bytes.NewReader(backup.Bytes()), ImportConfig{Conflict: "merge"})
+	require.True(t, IsInvalidArgument(err), "unknown strategies must be rejected: %v", err)
+}
+
+func TestImport_Consistent(t *testing.T) {
+	ctx := context.Background()
+
+	backup := strings.Join([]string{
+		`{"table":"ip","data":{"id":"1.2.3.4","projectid":"p1"}}`,
+		`{"table":"ip","data":{"id":"1.2.3.5","project":"p1"}}`,
+	}, "\n")
+
+	ds, err := NewMemory(slog.Default())
+	require.NoError(t, err)
+
+	_, err = ds.Import(ctx, strings.NewReader(backup), ImportConfig{Consistent: true})
+	require.True(t, IsInvalidArgument(err), "unknown fields must be rejected: %v", err)
+	require.ErrorContains(t, err, "line 2")
+
+	ips, err := ds.IP().List(ctx)
+	require.NoError(t, err)
+	require.Empty(t, ips, "nothing must be written if the backup is invalid")
+
+	// without validation the unknown field is ignored
+	counts, err := ds.Import(ctx, strings.NewReader(backup), ImportConfig{})
+	require.NoError(t, err)
+	require.Equal(t, 2, counts["ip"].Written)
+
+	_, err = ds.Import(ctx, strings.NewReader(`{"table":"ip","data":{"projectid":"p1"}}`), ImportConfig{Consistent: true})
+	require.True(t, IsInvalidArgument(err), "documents without id must be rejected: %v", err)
+
+	for _, consistent := range []bool{true, false} {
+		_, err = ds.Import(ctx, strings.NewReader(`{"table":"ip","data":null}`), ImportConfig{Consistent: consistent})
+		require.True(t, IsInvalidArgument(err), "empty documents must be rejected: %v", err)
+	}
+}
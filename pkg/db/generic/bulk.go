@@ -0,0 +1,157 @@
+package generic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// bulkBatchSize is the maximum number of entities which are written to the backend in one request
+const bulkBatchSize = 1000
+
+type (
+	// BulkResult is the outcome of a bulk operation for a single entity.
+	BulkResult struct {
+		// ID of the entity, ids of created entities are generated if they were empty
+		ID string
+		// Err is nil if the entity was written, a conflict if it already exists on create
+		// and a notfound if it does not exist on delete
+		Err error
+	}
+
+	// BulkResults holds the outcome of a bulk operation for every entity in the order of the given entities.
+	BulkResults []BulkResult
+)
+
+// Written returns the ids of the entities which were written.
+func (rs BulkResults) Written() []string {
+	var ids []string
+	for _, r := range rs {
+		if r.Err == nil {
+			ids = append(ids, r.ID)
+		}
+	}
+	return ids
+}
+
+// Conflicts returns the ids of the entities which were not created because they already exist.
+func (rs BulkResults) Conflicts() []string {
+	var ids []string
+	for _, r := range rs {
+		if IsConflict(r.Err) {
+			ids = append(ids, r.ID)
+		}
+	}
+	return ids
+}
+
+// Failed returns the results of the entities which were not written.
+func (rs BulkResults) Failed() BulkResults {
+	var failed BulkResults
+	for _, r := range rs {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// Err joins the errors of all entities which were not written, nil if all were written.
+func (rs BulkResults) Err() error {
+	var errs []error
+	for _, r := range rs.Failed() {
+		errs = append(errs, fmt.Errorf("%s: %w", r.ID, r.Err))
+	}
+	return errors.Join(errs...)
+}
+
+// bulkBatches assigns an id to the entities without one and splits them into batches.
+// An entity which has the same id as a previous one of the request is reported as invalid and not written,
+// the backends could otherwise not tell the results of both apart.
+func bulkBatches[E Entity](tableName string, es []E) ([][]E, map[string]error) {
+	var (
+		batches [][]E
+		batch   []E
+		seen    = map[string]bool{}
+		invalid = map[string]error{}
+	)
+	for _, e := range es {
+		if e.GetID() == "" {
+			e.SetID(uuid.NewString())
+		}
+		if seen[e.GetID()] {
+			invalid[e.GetID()] = InvalidArgument("%v with id %q is given more than once", tableName, e.GetID())
+			continue
+		}
+		seen[e.GetID()] = true
+
+		batch = append(batch, e)
+		if len(batch) == bulkBatchSize {
+			batches = append(batches, batch)
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches, invalid
+}
+
+// bulkResults returns the results in the order of the given entities, the first occurrence of an id gets the result
+// of the backend and every further occurrence the invalid error.
+func bulkResults[E Entity](es []E, written map[string]error, invalid map[string]error) BulkResults {
+	var (
+		results = make(BulkResults, 0, len(es))
+		seen    = map[string]bool{}
+	)
+	for _, e := range es {
+		id := e.GetID()
+		if seen[id] {
+			results = append(results, BulkResult{ID: id, Err: invalid[id]})
+			continue
+		}
+		seen[id] = true
+
+		err, ok := written[id]
+		if !ok {
+			err = fmt.Errorf("no result for %q", id)
+		}
+		results = append(results, BulkResult{ID: id, Err: err})
+	}
+	return results
+}
+
+// bulk writes the entities in batches, write stores the result of every entity of the batch in written.
+// If a batch fails as a whole, its entities and those of the following batches are not written and the error is returned.
+func bulk[E Entity](ctx context.Context, tableName string, es []E, write func(ctx context.Context, batch []E, written map[string]error) error) (BulkResults, error) {
+	batches, invalid := bulkBatches(tableName, es)
+
+	written := map[string]error{}
+	for i, batch := range batches {
+		err := ctx.Err()
+		if err == nil {
+			err = write(ctx, batch, written)
+		}
+		if err != nil {
+			for _, b := range batches[i:] {
+				for _, e := range b {
+					written[e.GetID()] = err
+				}
+			}
+			return bulkResults(es, written, invalid), err
+		}
+	}
+	return bulkResults(es, written, invalid), nil
+}
+
+// each writes the entities of a batch one by one, it is used by backends without batched writes.
+func each[E Entity](op func(ctx context.Context, e E) error) func(ctx context.Context, batch []E, written map[string]error) error {
+	return func(ctx context.Context, batch []E, written map[string]error) error {
+		for _, e := range batch {
+			written[e.GetID()] = op(ctx, e)
+		}
+		return nil
+	}
+}
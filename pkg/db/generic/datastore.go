@@ -0,0 +1,407 @@
+package generic
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/metal-stack/api-server/pkg/db/metal"
+)
+
+const (
+	// deletedField is the field of the deletion timestamp of soft deleted entities
+	deletedField = "deleted"
+	// tombstoneSeparator separates the id of a soft deleted entity from its deletion time in the id of its tombstone
+	tombstoneSeparator = "@"
+)
+
+type (
+	// Entity is an interface that allows metal entities to be created and stored
+	// into the database with the generic creation and update functions.
+	//
+	// see https://go.googlesource.com/proposal/+/HEAD/design/43651-type-parameters.md#pointer-method-example for possible solution to prevent slices of pointers.
+	Entity interface {
+		// GetID returns the entity's id
+		GetID() string
+		// SetID sets the entity's id
+		SetID(id string)
+		// GetChanged returns the entity's changed time
+		GetChanged() time.Time
+		// SetChanged sets the entity's changed time
+		SetChanged(changed time.Time)
+		// GetCreated sets the entity's creation time
+		GetCreated() time.Time
+		// SetCreated sets the entity's creation time
+		SetCreated(created time.Time)
+		// GetDeleted returns the entity's deletion time if it was soft deleted
+		GetDeleted() *time.Time
+		// SetDeleted sets the entity's deletion time
+		SetDeleted(deleted *time.Time)
+	}
+
+	Storage[E Entity] interface {
+		Create(ctx context.Context, e E) (E, error)
+		// Update replaces the entity with new if it was not changed since old was read, otherwise it returns a conflict.
+		// An update which sets the deletion time of an entity with soft deletion deletes it like Delete does.
+		Update(ctx context.Context, new, old E) error
+		Upsert(ctx context.Context, e E) error
+		Delete(ctx context.Context, e E) error
+		// CreateMany creates the entities in batches, ids of entities without one are generated.
+		// The results report for every entity if it was created or already exists. The error is only
+		// returned if the operation failed as a whole, the entities which were not written carry it as well.
+		CreateMany(ctx context.Context, es []E) (BulkResults, error)
+		// UpsertMany creates or replaces the entities in batches and reports the result for every entity.
+		UpsertMany(ctx context.Context, es []E) (BulkResults, error)
+		// DeleteMany deletes the entities in batches, entities which do not exist are reported as notfound.
+		DeleteMany(ctx context.Context, es []E) (BulkResults, error)
+		Get(ctx context.Context, id string) (E, error)
+		Find(ctx context.Context, query EntityQuery) (E, error)
+		Search(ctx context.Context, query EntityQuery) ([]E, error)
+		// SearchPage returns one page of the entities matching the query and the token of the next page,
+		// which is empty if there are no more entities.
+		SearchPage(ctx context.Context, query EntityQuery, page Page) ([]E, string, error)
+		List(ctx context.Context) ([]E, error)
+		// ListPage returns one page of all entities and the token of the next page,
+		// which is empty if there are no more entities.
+		ListPage(ctx context.Context, page Page) ([]E, string, error)
+		// Watch emits the changes of the entities matching the query until the context is canceled.
+		// The channel is closed when the watch ends, also if the backend aborts it before.
+		// Backends which can not observe changes, like postgres, return an Unimplemented error.
+		Watch(ctx context.Context, query EntityQuery) (<-chan Event[E], error)
+		// Purge permanently removes the entities which were soft deleted before the given time
+		// and returns their number.
+		Purge(ctx context.Context, before time.Time) (int, error)
+	}
+
+	Datastore struct {
+		image         Storage[*metal.Image]
+		ip            Storage[*metal.IP]
+		machine       Storage[*metal.Machine]
+		migration     Storage[*metal.Migration]
+		migrationLock Storage[*metal.MigrationLock]
+		network       Storage[*metal.Network]
+		operation     Storage[*metal.Operation]
+		partition     Storage[*metal.Partition]
+		revision      Storage[*metal.Revision]
+		size          Storage[*metal.Size]
+		// softDeleted are the storages with soft deletion by their table name
+		softDeleted map[string]purgeable
+		// tables are all storages which are exported and imported
+		tables []table
+		// event               Storage[*metal.ProvisioningEventContainer]
+		// filesystemlayout    Storage[*metal.FilesystemLayout]
+		// sizeimageConstraint Storage[*metal.SizeImageConstraint]
+		// sw                  Storage[*metal.Switch]
+		// switchStatus        Storage[*metal.SwitchStatus]
+	}
+
+	// backend is a database which is able to store entities, e.g. rethinkdb, postgres or memory.
+	backend interface {
+		fmt.Stringer
+	}
+
+	purgeable interface {
+		Purge(ctx context.Context, before time.Time) (int, error)
+	}
+
+	// storageConfig holds the optional features of a storage.
+	storageConfig struct {
+		indexes    []Index
+		softDelete bool
+		history    Storage[*metal.Revision]
+	}
+
+	storageOption func(c *storageConfig)
+
+	// Option configures a Datastore.
+	Option func(o *options)
+
+	options struct {
+		slowQueryThreshold time.Duration
+	}
+)
+
+// WithSlowQueryThreshold logs every operation which takes longer than the threshold, zero disables the slow query log.
+func WithSlowQueryThreshold(threshold time.Duration) Option {
+	return func(o *options) {
+		o.slowQueryThreshold = threshold
+	}
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// withIndexes declares the secondary indexes of a table.
+func withIndexes(indexes ...Index) storageOption {
+	return func(c *storageConfig) {
+		c.indexes = append(c.indexes, indexes...)
+	}
+}
+
+// withHistory records every change of the entities as revision in the given storage.
+func withHistory(revisions Storage[*metal.Revision]) storageOption {
+	return func(c *storageConfig) {
+		c.history = revisions
+	}
+}
+
+// withSoftDelete marks deleted entities with a deletion timestamp instead of removing them.
+// They are excluded from all queries unless a DeletedQuery selects them, the Purger removes them after the retention.
+// A deleted entity is kept as tombstone under its own id, a new entity with the same id does not replace it.
+func withSoftDelete() storageOption {
+	return func(c *storageConfig) {
+		c.softDelete = true
+	}
+}
+
+func newDatastore(b backend) (*Datastore, error) {
+	revision, err := newStorage[*metal.Revision](b, "revision",
+		withIndexes(
+			Index{Name: "table", Fields: []string{"table"}},
+			Index{Name: "table_entity", Fields: []string{"table", "entityid"}},
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+	image, err := newStorage[*metal.Image](b, "image",
+		withIndexes(
+			Index{Name: "os", Fields: []string{"os"}},
+			Index{Name: "features", Fields: []string{"features"}, Multi: true},
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := newStorage[*metal.IP](b, "ip",
+		withIndexes(
+			Index{Name: "projectid", Fields: []string{"projectid"}},
+			Index{Name: "allocationuuid", Fields: []string{"allocationuuid"}},
+			Index{Name: "prefix", Fields: []string{"prefix"}},
+			Index{Name: "networkid", Fields: []string{"networkid"}},
+			Index{Name: "type", Fields: []string{"type"}},
+			Index{Name: "project_addressfamily", Fields: []string{"projectid", "addressfamily"}},
+			Index{Name: "project_addressfamily_addressnumber", Fields: []string{"projectid", "addressfamily", "addressnumber"}, Ordered: true},
+			Index{Name: "project_network", Fields: []string{"projectid", "networkid"}},
+			Index{Name: "tags", Fields: []string{"tags"}, Multi: true},
+			Index{Name: "project_tags", Fields: []string{"projectid", "tags"}, Multi: true},
+		),
+		withSoftDelete(),
+		withHistory(revision),
+	)
+	if err != nil {
+		return nil, err
+	}
+	machine, err := newStorage[*metal.Machine](b, "machine",
+		withIndexes(
+			Index{Name: "projectid", Fields: []string{"projectid"}},
+			Index{Name: "partitionid", Fields: []string{"partitionid"}},
+			Index{Name: "sizeid", Fields: []string{"sizeid"}},
+			Index{Name: "imageid", Fields: []string{"imageid"}},
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+	migration, err := newStorage[*metal.Migration](b, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrationLock, err := newStorage[*metal.MigrationLock](b, "migrationlock")
+	if err != nil {
+		return nil, err
+	}
+	network, err := newStorage[*metal.Network](b, "network",
+		withIndexes(
+			Index{Name: "projectid", Fields: []string{"projectid"}},
+			Index{Name: "partitionid", Fields: []string{"partitionid"}},
+			Index{Name: "parentnetworkid", Fields: []string{"parentnetworkid"}},
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+	operation, err := newStorage[*metal.Operation](b, "operation",
+		withIndexes(Index{Name: "type", Fields: []string{"type"}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	partition, err := newStorage[*metal.Partition](b, "partition")
+	if err != nil {
+		return nil, err
+	}
+	size, err := newStorage[*metal.Size](b, "size")
+	if err != nil {
+		return nil, err
+	}
+	return &Datastore{
+		image:         image,
+		ip:            ip,
+		machine:       machine,
+		migration:     migration,
+		migrationLock: migrationLock,
+		network:       network,
+		operation:     operation,
+		partition:     partition,
+		revision:      revision,
+		size:          size,
+		softDeleted: map[string]purgeable{
+			"ip": ip,
+		},
+		tables: []table{
+			newTable("image", image),
+			newTable("ip", ip),
+			newTable("machine", machine),
+			newTable("migrations", migration),
+			newTable("network", network),
+			newTable("operation", operation),
+			newTable("partition", partition),
+			newTable("revision", revision),
+			newTable("size", size),
+		},
+		// event:               newStorage[*metal.ProvisioningEventContainer](b, "event"),
+		// filesystemlayout:    newStorage[*metal.FilesystemLayout](b, "filesystemlayout"),
+		// sizeimageConstraint: newStorage[*metal.SizeImageConstraint](b, "sizeimageconstraint"),
+		// sw:                  newStorage[*metal.Switch](b, "switch"),
+		// switchStatus:        newStorage[*metal.SwitchStatus](b, "switchstatus"),
+	}, nil
+}
+
+// newStorage creates a new Storage for the given table in the given backend.
+// The secondary indexes are created by backends which need them to serve the queries efficiently.
+func newStorage[E Entity](b backend, tableName string, opts ...storageOption) (Storage[E], error) {
+	var c storageConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	var (
+		s   Storage[E]
+		log *slog.Logger
+		o   options
+		err error
+	)
+	switch b := b.(type) {
+	case *rethinkBackend:
+		s, err = newRethinkStore[E](b, tableName, c)
+		log, o = b.log, b.opts
+	case *postgresBackend:
+		s, err = newPostgresStore[E](b, tableName, c)
+		log, o = b.log, b.opts
+	case *memoryBackend:
+		s, err = newMemoryStore[E](b, tableName, c)
+		log, o = b.log, b.opts
+	default:
+		return nil, fmt.Errorf("unsupported datastore backend %s", b)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the history is recorded outside of the instrumentation, every operation on the backend is observed on its own
+	s = &instrumentedStore[E]{
+		Storage:            s,
+		log:                log,
+		backend:            b.String(),
+		tableName:          tableName,
+		slowQueryThreshold: o.slowQueryThreshold,
+	}
+
+	if c.history != nil {
+		s = &historyStore[E]{
+			Storage:   s,
+			log:       log,
+			tableName: tableName,
+			revisions: c.history,
+		}
+	}
+	return s, nil
+}
+
+func (d *Datastore) Image() Storage[*metal.Image] {
+	return d.image
+}
+func (d *Datastore) IP() Storage[*metal.IP] {
+	return d.ip
+}
+func (d *Datastore) Machine() Storage[*metal.Machine] {
+	return d.machine
+}
+func (d *Datastore) Migration() Storage[*metal.Migration] {
+	return d.migration
+}
+func (d *Datastore) MigrationLock() Storage[*metal.MigrationLock] {
+	return d.migrationLock
+}
+func (d *Datastore) Network() Storage[*metal.Network] {
+	return d.network
+}
+func (d *Datastore) Operation() Storage[*metal.Operation] {
+	return d.operation
+}
+func (d *Datastore) Partition() Storage[*metal.Partition] {
+	return d.partition
+}
+func (d *Datastore) Revision() Storage[*metal.Revision] {
+	return d.revision
+}
+func (d *Datastore) Size() Storage[*metal.Size] {
+	return d.size
+}
+
+// predicates returns the predicates of the query, soft deleted entities are excluded unless the query selects them.
+// The query might be nil to select all entities.
+func (c storageConfig) predicates(query EntityQuery) []Predicate {
+	var predicates []Predicate
+	if query != nil {
+		predicates = query.Predicates()
+	}
+	if !c.softDelete {
+		return predicates
+	}
+	if dq, ok := query.(DeletedQuery); ok && dq.WithDeleted() {
+		return predicates
+	}
+	return append(slices.Clone(predicates), Missing(deletedField))
+}
+
+// tombstoneID returns the id under which an entity is kept after it was deleted at the given time.
+func tombstoneID(id string, deleted time.Time) string {
+	return id + tombstoneSeparator + strconv.FormatInt(deleted.UnixNano(), 10)
+}
+
+// isTombstoneID returns true if the id is the id of a tombstone.
+func isTombstoneID(id string) bool {
+	i := strings.LastIndex(id, tombstoneSeparator)
+	if i < 0 {
+		return false
+	}
+	_, err := strconv.ParseInt(id[i+len(tombstoneSeparator):], 10, 64)
+	return err == nil
+}
+
+// EntityID returns the id the entity had before it was deleted, the id of its tombstone is different.
+// The id of an entity which is not deleted is returned unchanged.
+func EntityID(e Entity) string {
+	id := e.GetID()
+	if e.GetDeleted() == nil || !isTombstoneID(id) {
+		return id
+	}
+	return id[:strings.LastIndex(id, tombstoneSeparator)]
+}
+
+// deletes returns true if the update soft deletes the entity, which moves it to the id of its tombstone.
+// Tombstones are updated in place, e.g. by a migration.
+func (c storageConfig) deletes(new, old Entity) bool {
+	return c.softDelete && new.GetDeleted() != nil && !isTombstoneID(old.GetID())
+}
@@ -6,8 +6,10 @@ import (
 )
 
 var (
-	errNotFound = errors.New("NotFound")
-	errConflict = errors.New("Conflict")
+	errNotFound        = errors.New("NotFound")
+	errConflict        = errors.New("Conflict")
+	errInvalidArgument = errors.New("InvalidArgument")
+	errUnimplemented   = errors.New("Unimplemented")
 	// TODO refactor implementations of fmt.Errorf to metal.Internal() in datastore and service
 	errInternal = errors.New("Internal")
 )
@@ -41,3 +43,23 @@ func Internal(format string, args ...interface{}) error {
 func IsInternal(e error) bool {
 	return errors.Is(e, errInternal)
 }
+
+// InvalidArgument creates a new InvalidArgument error with a given error message.
+func InvalidArgument(format string, args ...interface{}) error {
+	return fmt.Errorf("%w %s", errInvalidArgument, fmt.Sprintf(format, args...))
+}
+
+// IsInvalidArgument checks if an error is a InvalidArgument error.
+func IsInvalidArgument(e error) bool {
+	return errors.Is(e, errInvalidArgument)
+}
+
+// Unimplemented creates a new Unimplemented error for an operation which is not supported by a backend.
+func Unimplemented(format string, args ...interface{}) error {
+	return fmt.Errorf("%w %s", errUnimplemented, fmt.Sprintf(format, args...))
+}
+
+// IsUnimplemented checks if an error is a Unimplemented error.
+func IsUnimplemented(e error) bool {
+	return errors.Is(e, errUnimplemented)
+}
@@ -0,0 +1,324 @@
+package generic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/metal-stack/api-server/pkg/actor"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var historyErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "api_server",
+	Subsystem: "datastore",
+	Name:      "history_errors_total",
+	Help:      "the number of changes which could not be recorded in the history",
+}, []string{"table"})
+
+// historyStore records every change of the underlying storage as revision in the history table.
+// The revision is written after the change succeeded, a failure to record it does not revert the change.
+type historyStore[E Entity] struct {
+	Storage[E]
+	log       *slog.Logger
+	tableName string
+	revisions Storage[*metal.Revision]
+}
+
+// change of an entity which is recorded as revision
+type change[E Entity] struct {
+	operation     metal.RevisionOperation
+	id            string
+	before, after *E
+}
+
+// Create implements Storage.
+func (hs *historyStore[E]) Create(ctx context.Context, e E) (E, error) {
+	created, err := hs.Storage.Create(ctx, e)
+	if err != nil {
+		return created, err
+	}
+	hs.record(ctx, change[E]{operation: metal.RevisionCreate, id: created.GetID(), after: &created})
+	return created, nil
+}
+
+// Update implements Storage.
+func (hs *historyStore[E]) Update(ctx context.Context, new, old E) error {
+	err := hs.Storage.Update(ctx, new, old)
+	if err != nil {
+		return err
+	}
+	// an update which sets the deletion time is recorded like a deletion
+	if new.GetDeleted() != nil && old.GetDeleted() == nil {
+		hs.record(ctx, change[E]{operation: metal.RevisionDelete, id: old.GetID(), before: &old})
+		return nil
+	}
+	hs.record(ctx, change[E]{operation: metal.RevisionUpdate, id: old.GetID(), before: &old, after: &new})
+	return nil
+}
+
+// Upsert implements Storage.
+func (hs *historyStore[E]) Upsert(ctx context.Context, e E) error {
+	before, err := hs.stored(ctx, e.GetID())
+	if err != nil {
+		return err
+	}
+
+	err = hs.Storage.Upsert(ctx, e)
+	if err != nil {
+		return err
+	}
+	hs.record(ctx, upserted(e, before))
+	return nil
+}
+
+// Delete implements Storage.
+func (hs *historyStore[E]) Delete(ctx context.Context, e E) error {
+	// the stored entity is recorded, the given one might be incomplete
+	before, err := hs.stored(ctx, e.GetID())
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return hs.Storage.Delete(ctx, e)
+	}
+
+	err = hs.Storage.Delete(ctx, e)
+	if err != nil {
+		return err
+	}
+	hs.record(ctx, change[E]{operation: metal.RevisionDelete, id: e.GetID(), before: before})
+	return nil
+}
+
+// CreateMany implements Storage.
+func (hs *historyStore[E]) CreateMany(ctx context.Context, es []E) (BulkResults, error) {
+	results, err := hs.Storage.CreateMany(ctx, es)
+
+	var changes []change[E]
+	for i, r := range results {
+		if r.Err == nil {
+			changes = append(changes, change[E]{operation: metal.RevisionCreate, id: r.ID, after: &es[i]})
+		}
+	}
+	hs.record(ctx, changes...)
+	return results, err
+}
+
+// UpsertMany implements Storage, the stored entities are read one by one to record them.
+func (hs *historyStore[E]) UpsertMany(ctx context.Context, es []E) (BulkResults, error) {
+	befores := make([]*E, len(es))
+	for i, e := range es {
+		before, err := hs.stored(ctx, e.GetID())
+		if err != nil {
+			return nil, err
+		}
+		befores[i] = before
+	}
+
+	results, err := hs.Storage.UpsertMany(ctx, es)
+
+	var changes []change[E]
+	for i, r := range results {
+		if r.Err == nil {
+			changes = append(changes, upserted(es[i], befores[i]))
+		}
+	}
+	hs.record(ctx, changes...)
+	return results, err
+}
+
+// DeleteMany implements Storage, the stored entities are read one by one to record them.
+func (hs *historyStore[E]) DeleteMany(ctx context.Context, es []E) (BulkResults, error) {
+	befores := make([]*E, len(es))
+	for i, e := range es {
+		before, err := hs.stored(ctx, e.GetID())
+		if err != nil {
+			return nil, err
+		}
+		befores[i] = before
+	}
+
+	results, err := hs.Storage.DeleteMany(ctx, es)
+
+	var changes []change[E]
+	for i, r := range results {
+		if r.Err == nil && befores[i] != nil {
+			changes = append(changes, change[E]{operation: metal.RevisionDelete, id: r.ID, before: befores[i]})
+		}
+	}
+	hs.record(ctx, changes...)
+	return results, err
+}
+
+// stored returns the stored entity with the given id, nil if there is none.
+func (hs *historyStore[E]) stored(ctx context.Context, id string) (*E, error) {
+	if id == "" {
+		return nil, nil
+	}
+	e, err := hs.Storage.Get(ctx, id)
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func upserted[E Entity](e E, before *E) change[E] {
+	operation := metal.RevisionUpdate
+	if before == nil {
+		operation = metal.RevisionCreate
+	}
+	return change[E]{operation: operation, id: e.GetID(), before: before, after: &e}
+}
+
+func (hs *historyStore[E]) record(ctx context.Context, changes ...change[E]) {
+	var revisions []*metal.Revision
+	for _, c := range changes {
+		revision := &metal.Revision{
+			Table:     hs.tableName,
+			EntityID:  c.id,
+			Operation: c.operation,
+			Actor:     actor.ActorFromContext(ctx),
+		}
+
+		var err error
+		revision.Before, err = document(c.before)
+		if err == nil {
+			revision.After, err = document(c.after)
+		}
+		if err != nil {
+			hs.failed(c.id, c.operation, err)
+			continue
+		}
+		revisions = append(revisions, revision)
+	}
+
+	switch len(revisions) {
+	case 0:
+		return
+	case 1:
+		_, err := hs.revisions.Create(ctx, revisions[0])
+		if err != nil {
+			hs.failed(revisions[0].EntityID, revisions[0].Operation, err)
+		}
+		return
+	}
+
+	results, err := hs.revisions.CreateMany(ctx, revisions)
+	for i, r := range results {
+		if r.Err != nil {
+			hs.failed(revisions[i].EntityID, revisions[i].Operation, r.Err)
+		}
+	}
+	if err != nil && results == nil {
+		for _, revision := range revisions {
+			hs.failed(revision.EntityID, revision.Operation, err)
+		}
+	}
+}
+
+func (hs *historyStore[E]) failed(id string, operation metal.RevisionOperation, err error) {
+	historyErrors.WithLabelValues(hs.tableName).Inc()
+	hs.log.Error("unable to record revision", "table", hs.tableName, "id", id, "operation", operation, "error", err)
+}
+
+// document converts the entity to its stored representation.
+func document[E Entity](e *E) (map[string]any, error) {
+	if e == nil {
+		return nil, nil
+	}
+	raw, err := json.Marshal(*e)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	err = json.Unmarshal(raw, &doc)
+	return doc, err
+}
+
+// Decode converts a document of a revision back to the entity.
+func Decode[E Entity](doc map[string]any) (E, error) {
+	var zero E
+	if doc == nil {
+		return zero, nil
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return zero, err
+	}
+	e := new(E)
+	err = json.Unmarshal(raw, e)
+	if err != nil {
+		return zero, fmt.Errorf("cannot unmarshal revision: %w", err)
+	}
+	return *e, nil
+}
+
+type revisionQuery struct {
+	table    string
+	entityID string
+	before   time.Time
+}
+
+func (q revisionQuery) Predicates() []Predicate {
+	predicates := []Predicate{Eq("table", q.table)}
+	if q.entityID != "" {
+		predicates = append(predicates, Eq("entityid", q.entityID))
+	}
+	if !q.before.IsZero() {
+		predicates = append(predicates, Before("created", q.before))
+	}
+	return predicates
+}
+
+// Revisions returns the history of an entity of the given table, the oldest revision first.
+func (d *Datastore) Revisions(ctx context.Context, table, id string) ([]*metal.Revision, error) {
+	revisions, err := d.revision.Search(ctx, revisionQuery{table: table, entityID: id})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(revisions, func(a, b *metal.Revision) int {
+		return a.Created.Compare(b.Created)
+	})
+	return revisions, nil
+}
+
+// purgeRevisions removes the revisions of the table which were recorded before the given time.
+// They are read and deleted page by page to bound the memory of a large history.
+func (d *Datastore) purgeRevisions(ctx context.Context, table string, before time.Time) (int, error) {
+	var (
+		purged int
+		page   = Page{Size: MaxPageSize}
+	)
+	for {
+		revisions, next, err := d.revision.SearchPage(ctx, revisionQuery{table: table, before: before}, page)
+		if err != nil {
+			return purged, err
+		}
+		if len(revisions) == 0 {
+			return purged, nil
+		}
+
+		results, err := d.revision.DeleteMany(ctx, revisions)
+		purged += len(results.Written())
+		if err != nil {
+			return purged, err
+		}
+		if err := results.Err(); err != nil {
+			return purged, err
+		}
+
+		if next == "" {
+			return purged, nil
+		}
+		page.Token = next
+	}
+}
@@ -0,0 +1,76 @@
+package generic
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/api-server/pkg/actor"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	ctx := actor.ContextWithActor(context.Background(), "alice")
+	log := slog.Default()
+
+	ds, err := NewMemory(log)
+	require.NoError(t, err)
+
+	ip, err := ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.3.4", Name: "ip1", ProjectID: "p1"})
+	require.NoError(t, err)
+
+	updated := *ip
+	updated.Name = "ip2"
+	require.NoError(t, ds.IP().Update(actor.ContextWithActor(ctx, "bob"), &updated, ip))
+	require.NoError(t, ds.IP().Delete(ctx, &updated))
+
+	// changes of other entities are not part of the history
+	_, err = ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.3.5", ProjectID: "p1"})
+	require.NoError(t, err)
+
+	revisions, err := ds.Revisions(ctx, "ip", "1.2.3.4")
+	require.NoError(t, err)
+	require.Len(t, revisions, 3)
+
+	var (
+		operations []metal.RevisionOperation
+		actors     []string
+	)
+	for _, r := range revisions {
+		operations = append(operations, r.Operation)
+		actors = append(actors, r.Actor)
+	}
+	require.Equal(t, []metal.RevisionOperation{metal.RevisionCreate, metal.RevisionUpdate, metal.RevisionDelete}, operations)
+	require.Equal(t, []string{"alice", "bob", "alice"}, actors)
+
+	require.Nil(t, revisions[0].Before)
+	after, err := Decode[*metal.IP](revisions[0].After)
+	require.NoError(t, err)
+	require.Equal(t, "ip1", after.Name)
+
+	before, err := Decode[*metal.IP](revisions[1].Before)
+	require.NoError(t, err)
+	require.Equal(t, "ip1", before.Name)
+	after, err = Decode[*metal.IP](revisions[1].After)
+	require.NoError(t, err)
+	require.Equal(t, "ip2", after.Name)
+
+	require.Nil(t, revisions[2].After)
+
+	purged, err := ds.purgeRevisions(ctx, "ip", revisions[1].Created)
+	require.NoError(t, err)
+	require.Equal(t, 1, purged, "only the revisions before the given time must be purged")
+
+	purger := NewPurger(PurgerConfig{
+		Log:              log,
+		Datastore:        ds,
+		HistoryRetention: map[string]time.Duration{"ip": time.Nanosecond},
+	})
+	require.NoError(t, purger.Purge(ctx))
+
+	revisions, err = ds.Revisions(ctx, "ip", "1.2.3.4")
+	require.NoError(t, err)
+	require.Empty(t, revisions)
+}
@@ -0,0 +1,146 @@
+package generic
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// primaryIndex is the name of the index every table has on the id of the entities
+const primaryIndex = "id"
+
+var scans = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "api_server",
+	Subsystem: "datastore",
+	Name:      "scans_total",
+	Help:      "the number of queries which are not served by an index and scan the whole table",
+}, []string{"table", "fields"})
+
+// Index is a secondary index of a table.
+type Index struct {
+	// Name of the index, it must be unique within the table
+	Name string
+	// Fields which are indexed, more than one field creates a compound index
+	Fields []string
+	// Multi indexes every element of the last field, which must be an array
+	Multi bool
+	// Ordered indexes additionally serve a between predicate on their last field,
+	// backends which do not keep every index ordered create an ordered one for it
+	Ordered bool
+}
+
+// indexPlan describes how a query is served, Index is nil if the table needs to be scanned.
+type indexPlan struct {
+	Index *Index
+	// Key to look up in the index, an array for compound indexes
+	Key any
+	// Lower and Upper bound the keys which are read from the index instead of the single key
+	// if the last field is served by a between predicate, they are arrays for compound indexes
+	Lower, Upper any
+	// Between is true if the index is read by the range of keys
+	Between bool
+	// Predicates which are not covered by the index and need to be filtered
+	Predicates []Predicate
+}
+
+// planQuery selects the index which covers most of the predicates.
+// Equality predicates are covered by the fields of an index, a containment predicate only
+// by the last field of a multi index and a between predicate only by the last field of an ordered index.
+// The primary index is used for a lookup by id.
+func planQuery(indexes []Index, predicates []Predicate) indexPlan {
+	candidates := append([]Index{{Name: primaryIndex, Fields: []string{primaryIndex}}}, indexes...)
+
+	var (
+		best     *Index
+		bestUsed []int
+	)
+	for i := range candidates {
+		used, ok := covers(candidates[i], predicates)
+		if !ok {
+			continue
+		}
+		if best == nil || len(used) > len(bestUsed) {
+			best = &candidates[i]
+			bestUsed = used
+		}
+	}
+
+	if best == nil {
+		return indexPlan{Predicates: predicates}
+	}
+
+	var (
+		keys    []any
+		rest    []Predicate
+		between *Range
+	)
+	for _, i := range bestUsed {
+		if r, ok := predicates[i].Value.(Range); ok && predicates[i].Operator == OperatorBetween {
+			between = &r
+			continue
+		}
+		keys = append(keys, predicates[i].Value)
+	}
+	for i, p := range predicates {
+		if !slices.Contains(bestUsed, i) {
+			rest = append(rest, p)
+		}
+	}
+
+	if between != nil {
+		var lower, upper any = between.Lower, between.Upper
+		if len(keys) > 0 {
+			lower = append(slices.Clone(keys), between.Lower)
+			upper = append(slices.Clone(keys), between.Upper)
+		}
+		return indexPlan{Index: best, Lower: lower, Upper: upper, Between: true, Predicates: rest}
+	}
+
+	var key any = keys
+	if len(keys) == 1 {
+		key = keys[0]
+	}
+
+	return indexPlan{Index: best, Key: key, Predicates: rest}
+}
+
+// covers returns the positions of the predicates which provide the fields of the index in order.
+func covers(index Index, predicates []Predicate) ([]int, bool) {
+	var used []int
+	for i, field := range index.Fields {
+		last := i == len(index.Fields)-1
+
+		operator := OperatorEquals
+		if index.Multi && last {
+			operator = OperatorContains
+		}
+
+		pos := slices.IndexFunc(predicates, func(p Predicate) bool {
+			return p.Field == field && p.Operator == operator
+		})
+		if pos < 0 && index.Ordered && !index.Multi && last {
+			pos = slices.IndexFunc(predicates, func(p Predicate) bool {
+				return p.Field == field && p.Operator == OperatorBetween
+			})
+		}
+		if pos < 0 {
+			return nil, false
+		}
+		used = append(used, pos)
+	}
+	return used, true
+}
+
+// recordScan counts a query on the table which is not served by an index.
+func recordScan(table string, predicates []Predicate) {
+	var fields []string
+	for _, p := range predicates {
+		if !slices.Contains(fields, p.Field) {
+			fields = append(fields, p.Field)
+		}
+	}
+	slices.Sort(fields)
+	scans.WithLabelValues(table, strings.Join(fields, ",")).Inc()
+}
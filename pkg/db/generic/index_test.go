@@ -0,0 +1,199 @@
+package generic
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_planQuery(t *testing.T) {
+	indexes := []Index{
+		{Name: "projectid", Fields: []string{"projectid"}},
+		{Name: "project_network", Fields: []string{"projectid", "networkid"}},
+		{Name: "project_tags", Fields: []string{"projectid", "tags"}, Multi: true},
+		{Name: "addressnumber", Fields: []string{"addressnumber"}, Ordered: true},
+		{Name: "network_addressnumber", Fields: []string{"networkid", "addressnumber"}, Ordered: true},
+	}
+
+	tests := []struct {
+		name       string
+		predicates []Predicate
+		wantIndex  string
+		wantKey    any
+		wantLower  any
+		wantUpper  any
+		wantRest   []Predicate
+	}{
+		{
+			name:       "no predicates",
+			predicates: nil,
+			wantIndex:  "",
+			wantRest:   nil,
+		},
+		{
+			name:       "single field",
+			predicates: []Predicate{Eq("projectid", "p1"), Eq("name", "ip1")},
+			wantIndex:  "projectid",
+			wantKey:    "p1",
+			wantRest:   []Predicate{Eq("name", "ip1")},
+		},
+		{
+			name:       "compound index is preferred",
+			predicates: []Predicate{Eq("networkid", "n1"), Eq("projectid", "p1")},
+			wantIndex:  "project_network",
+			wantKey:    []any{"p1", "n1"},
+			wantRest:   nil,
+		},
+		{
+			name:       "compound multi index",
+			predicates: []Predicate{Eq("projectid", "p1"), Contains("tags", "a=b"), Contains("tags", "c=d")},
+			wantIndex:  "project_tags",
+			wantKey:    []any{"p1", "a=b"},
+			wantRest:   []Predicate{Contains("tags", "c=d")},
+		},
+		{
+			name:       "multi index does not serve equality",
+			predicates: []Predicate{Eq("projectid", "p1"), Eq("tags", "a=b")},
+			wantIndex:  "projectid",
+			wantKey:    "p1",
+			wantRest:   []Predicate{Eq("tags", "a=b")},
+		},
+		{
+			name:       "primary index",
+			predicates: []Predicate{Eq("id", "1.2.3.4"), Match("name", "^ip")},
+			wantIndex:  "id",
+			wantKey:    "1.2.3.4",
+			wantRest:   []Predicate{Match("name", "^ip")},
+		},
+		{
+			name:       "between on ordered index",
+			predicates: []Predicate{Between("addressnumber", "a", "f"), Eq("name", "ip1")},
+			wantIndex:  "addressnumber",
+			wantLower:  "a",
+			wantUpper:  "f",
+			wantRest:   []Predicate{Eq("name", "ip1")},
+		},
+		{
+			name:       "between on compound ordered index",
+			predicates: []Predicate{Between("addressnumber", "a", "f"), Eq("networkid", "n1")},
+			wantIndex:  "network_addressnumber",
+			wantLower:  []any{"n1", "a"},
+			wantUpper:  []any{"n1", "f"},
+			wantRest:   nil,
+		},
+		{
+			name:       "equality is preferred over between",
+			predicates: []Predicate{Between("addressnumber", "a", "f"), Eq("addressnumber", "b")},
+			wantIndex:  "addressnumber",
+			wantKey:    "b",
+			wantRest:   []Predicate{Between("addressnumber", "a", "f")},
+		},
+		{
+			name:       "between is only served by the last field",
+			predicates: []Predicate{Between("networkid", "a", "f"), Eq("addressnumber", "b")},
+			wantIndex:  "addressnumber",
+			wantKey:    "b",
+			wantRest:   []Predicate{Between("networkid", "a", "f")},
+		},
+		{
+			name:       "between on unordered index",
+			predicates: []Predicate{Between("projectid", "a", "f")},
+			wantIndex:  "",
+			wantRest:   []Predicate{Between("projectid", "a", "f")},
+		},
+		{
+			name:       "scan",
+			predicates: []Predicate{Eq("name", "ip1"), Match("id", ":")},
+			wantIndex:  "",
+			wantRest:   []Predicate{Eq("name", "ip1"), Match("id", ":")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := planQuery(indexes, tt.predicates)
+
+			var gotIndex string
+			if got.Index != nil {
+				gotIndex = got.Index.Name
+			}
+			if gotIndex != tt.wantIndex {
+				t.Errorf("planQuery() index = %q, want %q", gotIndex, tt.wantIndex)
+			}
+			if diff := cmp.Diff(tt.wantKey, got.Key); diff != "" {
+				t.Errorf("planQuery() key diff = %s", diff)
+			}
+			if diff := cmp.Diff(tt.wantLower, got.Lower); diff != "" {
+				t.Errorf("planQuery() lower diff = %s", diff)
+			}
+			if diff := cmp.Diff(tt.wantUpper, got.Upper); diff != "" {
+				t.Errorf("planQuery() upper diff = %s", diff)
+			}
+			if diff := cmp.Diff(tt.wantRest, got.Predicates); diff != "" {
+				t.Errorf("planQuery() predicates diff = %s", diff)
+			}
+		})
+	}
+}
+
+func Test_pagingPlan(t *testing.T) {
+	indexes := []Index{
+		{Name: "projectid", Fields: []string{"projectid"}},
+		{Name: "project_tags", Fields: []string{"projectid", "tags"}, Multi: true},
+		{Name: "network_addressnumber", Fields: []string{"networkid", "addressnumber"}, Ordered: true},
+	}
+
+	tests := []struct {
+		name       string
+		predicates []Predicate
+		wantIndex  Index
+		wantKey    []any
+		wantRest   []Predicate
+	}{
+		{
+			name:       "single field",
+			predicates: []Predicate{Eq("projectid", "p1"), Eq("name", "ip1")},
+			wantIndex:  Index{Name: "projectid_id", Fields: []string{"projectid"}},
+			wantKey:    []any{"p1"},
+			wantRest:   []Predicate{Eq("name", "ip1")},
+		},
+		{
+			name:       "compound multi index",
+			predicates: []Predicate{Eq("projectid", "p1"), Contains("tags", "a=b")},
+			wantIndex:  Index{Name: "project_tags_id", Fields: []string{"projectid", "tags"}, Multi: true},
+			wantKey:    []any{"p1", "a=b"},
+		},
+		{
+			name:       "range of an ordered index is filtered",
+			predicates: []Predicate{Eq("networkid", "n1"), Between("addressnumber", "a", "f")},
+			wantIndex:  Index{Name: "network_addressnumber_id", Fields: []string{"networkid"}},
+			wantKey:    []any{"n1"},
+			wantRest:   []Predicate{Between("addressnumber", "a", "f")},
+		},
+		{
+			name:       "equality on an ordered index is filtered",
+			predicates: []Predicate{Eq("networkid", "n1"), Eq("addressnumber", "b")},
+			wantIndex:  Index{Name: "network_addressnumber_id", Fields: []string{"networkid"}},
+			wantKey:    []any{"n1"},
+			wantRest:   []Predicate{Eq("addressnumber", "b")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotIndex, gotKey, gotRest := pagingPlan(planQuery(indexes, tt.predicates))
+			if diff := cmp.Diff(tt.wantIndex, gotIndex); diff != "" {
+				t.Errorf("pagingPlan() index diff = %s", diff)
+			}
+			if diff := cmp.Diff(tt.wantKey, gotKey); diff != "" {
+				t.Errorf("pagingPlan() key diff = %s", diff)
+			}
+			if diff := cmp.Diff(tt.wantRest, gotRest); diff != "" {
+				t.Errorf("pagingPlan() predicates diff = %s", diff)
+			}
+		})
+	}
+
+	_, ok := pagingIndex(Index{Name: "addressnumber", Fields: []string{"addressnumber"}, Ordered: true})
+	if ok {
+		t.Errorf("pagingIndex() of a single field ordered index must not exist")
+	}
+}
@@ -0,0 +1,243 @@
+package generic
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/metal-stack/api-server/pkg/db/generic"
+
+var operationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "api_server",
+	Subsystem: "datastore",
+	Name:      "operation_duration_seconds",
+	Help:      "the duration of the datastore operations by their result, which is either ok or the kind of error",
+	Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+}, []string{"table", "operation", "result"})
+
+// instrumentedStore observes every operation of the underlying storage with a span, the operation duration histogram
+// and the slow query log. A canceled context is rejected before the backend is called.
+type instrumentedStore[E Entity] struct {
+	Storage[E]
+	log                *slog.Logger
+	backend            string
+	tableName          string
+	slowQueryThreshold time.Duration
+}
+
+// Create implements Storage.
+func (is *instrumentedStore[E]) Create(ctx context.Context, e E) (created E, err error) {
+	ctx, done := is.observe(ctx, "create", nil)
+	defer func() { done(err) }()
+	if err = ctx.Err(); err != nil {
+		return created, err
+	}
+	return is.Storage.Create(ctx, e)
+}
+
+// Update implements Storage.
+func (is *instrumentedStore[E]) Update(ctx context.Context, new, old E) (err error) {
+	ctx, done := is.observe(ctx, "update", nil)
+	defer func() { done(err) }()
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return is.Storage.Update(ctx, new, old)
+}
+
+// Upsert implements Storage.
+func (is *instrumentedStore[E]) Upsert(ctx context.Context, e E) (err error) {
+	ctx, done := is.observe(ctx, "upsert", nil)
+	defer func() { done(err) }()
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return is.Storage.Upsert(ctx, e)
+}
+
+// Delete implements Storage.
+func (is *instrumentedStore[E]) Delete(ctx context.Context, e E) (err error) {
+	ctx, done := is.observe(ctx, "delete", nil)
+	defer func() { done(err) }()
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return is.Storage.Delete(ctx, e)
+}
+
+// CreateMany implements Storage.
+func (is *instrumentedStore[E]) CreateMany(ctx context.Context, es []E) (results BulkResults, err error) {
+	ctx, done := is.observe(ctx, "create_many", nil)
+	defer func() { done(err) }()
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	return is.Storage.CreateMany(ctx, es)
+}
+
+// UpsertMany implements Storage.
+func (is *instrumentedStore[E]) UpsertMany(ctx context.Context, es []E) (results BulkResults, err error) {
+	ctx, done := is.observe(ctx, "upsert_many", nil)
+	defer func() { done(err) }()
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	return is.Storage.UpsertMany(ctx, es)
+}
+
+// DeleteMany implements Storage.
+func (is *instrumentedStore[E]) DeleteMany(ctx context.Context, es []E) (results BulkResults, err error) {
+	ctx, done := is.observe(ctx, "delete_many", nil)
+	defer func() { done(err) }()
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	return is.Storage.DeleteMany(ctx, es)
+}
+
+// Get implements Storage.
+func (is *instrumentedStore[E]) Get(ctx context.Context, id string) (e E, err error) {
+	ctx, done := is.observe(ctx, "get", nil)
+	defer func() { done(err) }()
+	if err = ctx.Err(); err != nil {
+		return e, err
+	}
+	return is.Storage.Get(ctx, id)
+}
+
+// Find implements Storage.
+func (is *instrumentedStore[E]) Find(ctx context.Context, query EntityQuery) (e E, err error) {
+	ctx, done := is.observe(ctx, "find", query)
+	defer func() { done(err) }()
+	if err = ctx.Err(); err != nil {
+		return e, err
+	}
+	return is.Storage.Find(ctx, query)
+}
+
+// Search implements Storage.
+func (is *instrumentedStore[E]) Search(ctx context.Context, query EntityQuery) (result []E, err error) {
+	ctx, done := is.observe(ctx, "search", query)
+	defer func() { done(err) }()
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	return is.Storage.Search(ctx, query)
+}
+
+// SearchPage implements Storage.
+func (is *instrumentedStore[E]) SearchPage(ctx context.Context, query EntityQuery, page Page) (result []E, next string, err error) {
+	ctx, done := is.observe(ctx, "search_page", query)
+	defer func() { done(err) }()
+	if err = ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	return is.Storage.SearchPage(ctx, query, page)
+}
+
+// List implements Storage.
+func (is *instrumentedStore[E]) List(ctx context.Context) (result []E, err error) {
+	ctx, done := is.observe(ctx, "list", nil)
+	defer func() { done(err) }()
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	return is.Storage.List(ctx)
+}
+
+// ListPage implements Storage.
+func (is *instrumentedStore[E]) ListPage(ctx context.Context, page Page) (result []E, next string, err error) {
+	ctx, done := is.observe(ctx, "list_page", nil)
+	defer func() { done(err) }()
+	if err = ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	return is.Storage.ListPage(ctx, page)
+}
+
+// Watch implements Storage, only the start of the watch is observed.
+func (is *instrumentedStore[E]) Watch(ctx context.Context, query EntityQuery) (events <-chan Event[E], err error) {
+	_, done := is.observe(ctx, "watch", query)
+	defer func() { done(err) }()
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	// the watch outlives the span, therefore it is started with the context of the caller
+	return is.Storage.Watch(ctx, query)
+}
+
+// Purge implements Storage.
+func (is *instrumentedStore[E]) Purge(ctx context.Context, before time.Time) (purged int, err error) {
+	ctx, done := is.observe(ctx, "purge", nil)
+	defer func() { done(err) }()
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+	return is.Storage.Purge(ctx, before)
+}
+
+// observe starts the span of an operation, the returned function must be called with the result of the operation.
+func (is *instrumentedStore[E]) observe(ctx context.Context, operation string, query EntityQuery) (context.Context, func(err error)) {
+	start := time.Now()
+	ctx, span := otel.Tracer(tracerName).Start(ctx, operation+" "+is.tableName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", is.backend),
+			attribute.String("db.collection.name", is.tableName),
+			attribute.String("db.operation.name", operation),
+		),
+	)
+
+	return ctx, func(err error) {
+		duration := time.Since(start)
+		res := result(err)
+
+		operationDuration.WithLabelValues(is.tableName, operation, res).Observe(duration.Seconds())
+
+		if err != nil {
+			span.RecordError(err)
+			if res == "error" {
+				span.SetStatus(codes.Error, err.Error())
+			}
+		}
+		span.End()
+
+		if is.slowQueryThreshold > 0 && duration > is.slowQueryThreshold {
+			attrs := []any{"table", is.tableName, "operation", operation, "duration", duration, "result", res}
+			if query != nil {
+				attrs = append(attrs, "predicates", query.Predicates())
+			}
+			if sc := span.SpanContext(); sc.HasTraceID() {
+				attrs = append(attrs, "trace", sc.TraceID().String())
+			}
+			is.log.Warn("slow datastore operation", attrs...)
+		}
+	}
+}
+
+// result classifies the error of an operation, expected errors are distinguished from failures.
+func result(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case IsNotFound(err):
+		return "notfound"
+	case IsConflict(err):
+		return "conflict"
+	case IsInvalidArgument(err):
+		return "invalidargument"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	default:
+		return "error"
+	}
+}
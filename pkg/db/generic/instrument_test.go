@@ -0,0 +1,56 @@
+package generic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrumentedStore(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, nil))
+
+	ds, err := NewMemory(log, WithSlowQueryThreshold(1))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	_, err = ds.Partition().Get(ctx, "unknown")
+	require.True(t, IsNotFound(err))
+	require.Contains(t, buf.String(), "slow datastore operation")
+	require.Contains(t, buf.String(), "table=partition operation=get")
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = ds.Partition().Create(canceled, &metal.Partition{Base: metal.Base{ID: "p1"}})
+	require.True(t, errors.Is(err, context.Canceled), "canceled operations must not reach the backend: %v", err)
+
+	_, err = ds.Partition().Get(ctx, "p1")
+	require.True(t, IsNotFound(err))
+}
+
+func Test_result(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "ok", err: nil, want: "ok"},
+		{name: "notfound", err: NotFound("no ip"), want: "notfound"},
+		{name: "conflict", err: Conflict("ip exists"), want: "conflict"},
+		{name: "invalid argument", err: InvalidArgument("bad token"), want: "invalidargument"},
+		{name: "deadline", err: context.DeadlineExceeded, want: "canceled"},
+		{name: "failure", err: errors.New("connection refused"), want: "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := result(tt.err); got != tt.want {
+				t.Errorf("result() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,603 @@
+package generic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type (
+	memoryBackend struct {
+		log  *slog.Logger
+		opts options
+	}
+
+	// memoryStore keeps every entity as json document in memory, which gives the same copy semantics
+	// and field names as the persistent backends. It is meant for tests and local development.
+	memoryStore[E Entity] struct {
+		log       *slog.Logger
+		lock      sync.RWMutex
+		docs      map[string][]byte
+		watchers  map[*memoryWatcher[E]]bool
+		tableName string
+		storageConfig
+	}
+
+	memoryWatcher[E Entity] struct {
+		predicates []Predicate
+		events     chan Event[E]
+	}
+)
+
+// NewMemory creates a Datastore which keeps all entities in memory, nothing is persisted.
+func NewMemory(log *slog.Logger, opts ...Option) (*Datastore, error) {
+	return newDatastore(&memoryBackend{
+		log:  log,
+		opts: newOptions(opts),
+	})
+}
+
+func (b *memoryBackend) String() string {
+	return "memory"
+}
+
+func newMemoryStore[E Entity](b *memoryBackend, tableName string, c storageConfig) (*memoryStore[E], error) {
+	return &memoryStore[E]{
+		log:           b.log,
+		docs:          map[string][]byte{},
+		watchers:      map[*memoryWatcher[E]]bool{},
+		tableName:     tableName,
+		storageConfig: c,
+	}, nil
+}
+
+// Create implements Storage.
+func (ms *memoryStore[E]) Create(ctx context.Context, e E) (E, error) {
+	var zero E
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+
+	now := time.Now()
+	e.SetCreated(now)
+	e.SetChanged(now)
+	if e.GetID() == "" {
+		e.SetID(uuid.NewString())
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if _, ok := ms.docs[e.GetID()]; ok {
+		return zero, Conflict("cannot create %v in database, entity already exists: %s", ms.tableName, e.GetID())
+	}
+
+	err := ms.put(e)
+	if err != nil {
+		return zero, fmt.Errorf("cannot create %v in database: %w", ms.tableName, err)
+	}
+	ms.notify(nil, ms.docs[e.GetID()])
+	return e, nil
+}
+
+// Delete implements Storage.
+func (ms *memoryStore[E]) Delete(ctx context.Context, e E) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	doc, ok := ms.docs[e.GetID()]
+	if !ok {
+		return nil
+	}
+
+	if !ms.softDelete {
+		delete(ms.docs, e.GetID())
+		ms.notify(doc, nil)
+		return nil
+	}
+
+	stored, err := ms.decode(doc)
+	if err != nil {
+		return err
+	}
+	if stored.GetDeleted() != nil {
+		return nil
+	}
+	now := time.Now()
+	stored.SetDeleted(&now)
+	stored.SetChanged(now)
+	err = ms.bury(doc, stored)
+	if err != nil {
+		return fmt.Errorf("cannot delete %v with id %q from database: %w", ms.tableName, e.GetID(), err)
+	}
+	return nil
+}
+
+// CreateMany implements Storage by creating the entities one by one.
+func (ms *memoryStore[E]) CreateMany(ctx context.Context, es []E) (BulkResults, error) {
+	return bulk(ctx, ms.tableName, es, each(func(ctx context.Context, e E) error {
+		_, err := ms.Create(ctx, e)
+		return err
+	}))
+}
+
+// UpsertMany implements Storage by upserting the entities one by one.
+func (ms *memoryStore[E]) UpsertMany(ctx context.Context, es []E) (BulkResults, error) {
+	return bulk(ctx, ms.tableName, es, each(ms.Upsert))
+}
+
+// DeleteMany implements Storage by deleting the entities one by one.
+func (ms *memoryStore[E]) DeleteMany(ctx context.Context, es []E) (BulkResults, error) {
+	return bulk(ctx, ms.tableName, es, each(func(ctx context.Context, e E) error {
+		_, err := ms.Get(ctx, e.GetID())
+		if err != nil {
+			return err
+		}
+		return ms.Delete(ctx, e)
+	}))
+}
+
+// Find implements Storage.
+func (ms *memoryStore[E]) Find(ctx context.Context, query EntityQuery) (E, error) {
+	var zero E
+	result, err := ms.Search(ctx, query)
+	if err != nil {
+		return zero, fmt.Errorf("cannot find %v in database: %w", ms.tableName, err)
+	}
+
+	switch len(result) {
+	case 0:
+		return zero, NotFound("no %v with found", ms.tableName)
+	case 1:
+		return result[0], nil
+	default:
+		return zero, fmt.Errorf("more than one %v exists", ms.tableName)
+	}
+}
+
+// Search implements Storage.
+func (ms *memoryStore[E]) Search(ctx context.Context, query EntityQuery) ([]E, error) {
+	return ms.search(ctx, ms.predicates(query))
+}
+
+// List implements Storage.
+func (ms *memoryStore[E]) List(ctx context.Context) ([]E, error) {
+	return ms.search(ctx, ms.predicates(nil))
+}
+
+func (ms *memoryStore[E]) search(ctx context.Context, predicates []Predicate) ([]E, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	var result []E
+	for _, id := range ms.sortedIDs() {
+		doc := ms.docs[id]
+
+		ok, err := evaluate(doc, predicates)
+		if err != nil {
+			return nil, fmt.Errorf("cannot search %v in database: %w", ms.tableName, err)
+		}
+		if !ok {
+			continue
+		}
+
+		e, err := ms.decode(doc)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// SearchPage implements Storage.
+func (ms *memoryStore[E]) SearchPage(ctx context.Context, query EntityQuery, page Page) ([]E, string, error) {
+	return ms.page(ctx, ms.predicates(query), page)
+}
+
+// ListPage implements Storage.
+func (ms *memoryStore[E]) ListPage(ctx context.Context, page Page) ([]E, string, error) {
+	return ms.page(ctx, ms.predicates(nil), page)
+}
+
+func (ms *memoryStore[E]) page(ctx context.Context, predicates []Predicate, page Page) ([]E, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	after, err := page.after()
+	if err != nil {
+		return nil, "", err
+	}
+	limit := page.limit()
+
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	var result []E
+	for _, id := range ms.sortedIDs() {
+		if id <= after {
+			continue
+		}
+		if len(result) > limit {
+			break
+		}
+
+		ok, err := evaluate(ms.docs[id], predicates)
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot search %v in database: %w", ms.tableName, err)
+		}
+		if !ok {
+			continue
+		}
+
+		e, err := ms.decode(ms.docs[id])
+		if err != nil {
+			return nil, "", err
+		}
+		result = append(result, e)
+	}
+
+	entities, next := nextPage(result, limit)
+	return entities, next, nil
+}
+
+// Watch implements Storage.
+func (ms *memoryStore[E]) Watch(ctx context.Context, query EntityQuery) (<-chan Event[E], error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	w := &memoryWatcher[E]{
+		predicates: ms.predicates(query),
+		events:     make(chan Event[E], watchBufferSize),
+	}
+
+	ms.lock.Lock()
+	ms.watchers[w] = true
+	ms.lock.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		ms.lock.Lock()
+		defer ms.lock.Unlock()
+		ms.unwatch(w)
+	})
+
+	return w.events, nil
+}
+
+// Get implements Storage.
+func (ms *memoryStore[E]) Get(ctx context.Context, id string) (E, error) {
+	var zero E
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	doc, ok := ms.docs[id]
+	if !ok {
+		return zero, NotFound("no %v with id %q found", ms.tableName, id)
+	}
+	e, err := ms.decode(doc)
+	if err != nil {
+		return zero, err
+	}
+	if e.GetDeleted() != nil {
+		return zero, NotFound("no %v with id %q found", ms.tableName, id)
+	}
+	return e, nil
+}
+
+// Purge implements Storage.
+func (ms *memoryStore[E]) Purge(ctx context.Context, before time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if !ms.softDelete {
+		return 0, nil
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	purged := 0
+	for id, doc := range ms.docs {
+		e, err := ms.decode(doc)
+		if err != nil {
+			return purged, err
+		}
+		if deleted := e.GetDeleted(); deleted != nil && deleted.Before(before) {
+			delete(ms.docs, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// Update implements Storage.
+func (ms *memoryStore[E]) Update(ctx context.Context, new, old E) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	doc, ok := ms.docs[old.GetID()]
+	if !ok {
+		return NotFound("no %v with id %q found", ms.tableName, old.GetID())
+	}
+	stored, err := ms.decode(doc)
+	if err != nil {
+		return err
+	}
+	if !stored.GetChanged().Equal(old.GetChanged()) {
+		return Conflict("cannot update %v (%s): %s", ms.tableName, old.GetID(), entityAlreadyModifiedErrorMessage)
+	}
+
+	new.SetChanged(time.Now())
+	if ms.deletes(new, old) {
+		err = ms.bury(doc, new)
+		if err != nil {
+			return fmt.Errorf("cannot update %v (%s): %w", ms.tableName, old.GetID(), err)
+		}
+		return nil
+	}
+
+	err = ms.put(new)
+	if err != nil {
+		return fmt.Errorf("cannot update %v (%s): %w", ms.tableName, old.GetID(), err)
+	}
+	ms.notify(doc, ms.docs[new.GetID()])
+	return nil
+}
+
+// Upsert implements Storage.
+func (ms *memoryStore[E]) Upsert(ctx context.Context, e E) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if e.GetCreated().IsZero() {
+		e.SetCreated(now)
+	}
+	e.SetChanged(now)
+	if e.GetID() == "" {
+		e.SetID(uuid.NewString())
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	doc := ms.docs[e.GetID()]
+	err := ms.put(e)
+	if err != nil {
+		return fmt.Errorf("cannot upsert %v (%s) in database: %w", ms.tableName, e.GetID(), err)
+	}
+	ms.notify(doc, ms.docs[e.GetID()])
+	return nil
+}
+
+// notify emits the change from the old to the new document to all watchers, the caller must hold the write lock.
+// A document which does not match the query of a watcher is treated like a missing one.
+// The watch of a watcher whose buffer is full is ended instead of blocking the writer.
+func (ms *memoryStore[E]) notify(oldDoc, newDoc []byte) {
+	for w := range ms.watchers {
+		old, err := ms.match(oldDoc, w.predicates)
+		if err != nil {
+			ms.log.Error("unable to evaluate watch", "table", ms.tableName, "error", err)
+			continue
+		}
+		new, err := ms.match(newDoc, w.predicates)
+		if err != nil {
+			ms.log.Error("unable to evaluate watch", "table", ms.tableName, "error", err)
+			continue
+		}
+
+		ev, ok := newEvent(old, new)
+		if !ok {
+			continue
+		}
+		select {
+		case w.events <- ev:
+		default:
+			ms.log.Warn("ending watch which does not keep up with the changes", "table", ms.tableName)
+			ms.unwatch(w)
+		}
+	}
+}
+
+// unwatch removes the watcher and closes its channel if it was not removed before, the caller must hold the write lock.
+func (ms *memoryStore[E]) unwatch(w *memoryWatcher[E]) {
+	if !ms.watchers[w] {
+		return
+	}
+	delete(ms.watchers, w)
+	close(w.events)
+}
+
+// match decodes the document if it is present and matches the predicates.
+func (ms *memoryStore[E]) match(doc []byte, predicates []Predicate) (*E, error) {
+	if doc == nil {
+		return nil, nil
+	}
+	ok, err := evaluate(doc, predicates)
+	if err != nil || !ok {
+		return nil, err
+	}
+	e, err := ms.decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// bury replaces the given document of the soft deleted entity with its tombstone, the caller must hold the write lock.
+func (ms *memoryStore[E]) bury(doc []byte, e E) error {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	var fields map[string]any
+	err = json.Unmarshal(raw, &fields)
+	if err != nil {
+		return err
+	}
+	id := tombstoneID(e.GetID(), *e.GetDeleted())
+	fields[primaryIndex] = id
+	tombstone, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	delete(ms.docs, e.GetID())
+	ms.docs[id] = tombstone
+	ms.notify(doc, nil)
+	ms.notify(nil, tombstone)
+	return nil
+}
+
+// put stores the entity, the caller must hold the write lock.
+func (ms *memoryStore[E]) put(e E) error {
+	doc, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ms.docs[e.GetID()] = doc
+	return nil
+}
+
+func (ms *memoryStore[E]) decode(doc []byte) (E, error) {
+	e := new(E)
+	err := json.Unmarshal(doc, e)
+	if err != nil {
+		var zero E
+		return zero, fmt.Errorf("cannot unmarshal %v: %w", ms.tableName, err)
+	}
+	return *e, nil
+}
+
+// sortedIDs returns the ids of all entities in a stable order, the caller must hold the lock.
+func (ms *memoryStore[E]) sortedIDs() []string {
+	ids := make([]string, 0, len(ms.docs))
+	for id := range ms.docs {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// evaluate returns true if the json document matches all predicates.
+func evaluate(doc []byte, predicates []Predicate) (bool, error) {
+	if len(predicates) == 0 {
+		return true, nil
+	}
+
+	var fields map[string]any
+	err := json.Unmarshal(doc, &fields)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range predicates {
+		value, ok := fields[p.Field]
+		if p.Operator == OperatorMissing {
+			if ok && value != nil {
+				return false, nil
+			}
+			continue
+		}
+		if !ok {
+			return false, nil
+		}
+
+		var match bool
+		switch p.Operator {
+		case OperatorEquals:
+			want, err := normalize(p.Value)
+			if err != nil {
+				return false, err
+			}
+			match = reflect.DeepEqual(value, want)
+		case OperatorContains:
+			want, err := normalize(p.Value)
+			if err != nil {
+				return false, err
+			}
+			elements, _ := value.([]any)
+			match = slices.ContainsFunc(elements, func(element any) bool {
+				return reflect.DeepEqual(element, want)
+			})
+		case OperatorMatches:
+			s, isString := value.(string)
+			if !isString {
+				return false, nil
+			}
+			match, err = regexp.MatchString(fmt.Sprint(p.Value), s)
+			if err != nil {
+				return false, fmt.Errorf("invalid regular expression on field %q: %w", p.Field, err)
+			}
+		case OperatorBetween:
+			r, isRange := p.Value.(Range)
+			if !isRange {
+				return false, fmt.Errorf("invalid range on field %q: %v", p.Field, p.Value)
+			}
+			s, isString := value.(string)
+			if !isString {
+				return false, nil
+			}
+			match = s >= r.Lower && s <= r.Upper
+		case OperatorBefore:
+			before, isTime := p.Value.(time.Time)
+			if !isTime {
+				return false, fmt.Errorf("invalid time on field %q: %v", p.Field, p.Value)
+			}
+			s, isString := value.(string)
+			if !isString {
+				return false, nil
+			}
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return false, fmt.Errorf("invalid time in field %q: %w", p.Field, err)
+			}
+			match = t.Before(before)
+		default:
+			return false, fmt.Errorf("unsupported operator %q", p.Operator)
+		}
+
+		if !match {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// normalize converts a predicate value into the representation of a decoded json document.
+func normalize(value any) (any, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var result any
+	err = json.Unmarshal(raw, &result)
+	return result, err
+}
@@ -0,0 +1,324 @@
+package generic
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/metal-stack/api-server/pkg/db/metal"
+)
+
+const (
+	migrationLockID = "migrate"
+	// migrationLockLease is the time after which a lock of a crashed replica is taken over,
+	// the lease is renewed while the migrations run
+	migrationLockLease = time.Minute
+)
+
+type (
+	// MigrateFunc migrates the stored entities, it must be idempotent because a migration
+	// which was interrupted is executed again.
+	MigrateFunc func(ctx context.Context, log *slog.Logger, ds *Datastore) error
+
+	// Migration is a numbered change of the stored entities.
+	Migration struct {
+		Name    string
+		Version int
+		Up      MigrateFunc
+	}
+
+	// Migrations is a list of migrations, ordered by their version.
+	Migrations []Migration
+
+	MigratorConfig struct {
+		Log       *slog.Logger
+		Datastore *Datastore
+		// Migrations to apply, defaults to all registered migrations
+		Migrations Migrations
+	}
+
+	// Migrator applies the migrations which are not yet applied to the datastore.
+	Migrator struct {
+		log        *slog.Logger
+		ds         *Datastore
+		migrations Migrations
+		holder     string
+		lease      time.Duration
+	}
+)
+
+var (
+	registryLock sync.Mutex
+	registry     Migrations
+)
+
+// MustRegisterMigration registers a migration, it is meant to be called from init functions.
+// It panics if the version is not positive or already registered.
+func MustRegisterMigration(m Migration) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if m.Version <= 0 {
+		panic(fmt.Sprintf("migration %q must have a positive version", m.Name))
+	}
+	if slices.ContainsFunc(registry, func(r Migration) bool { return r.Version == m.Version }) {
+		panic(fmt.Sprintf("migration with version %d is already registered", m.Version))
+	}
+
+	registry = append(registry, m)
+	slices.SortFunc(registry, func(a, b Migration) int { return a.Version - b.Version })
+}
+
+// RegisteredMigrations returns all registered migrations.
+func RegisteredMigrations() Migrations {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	return slices.Clone(registry)
+}
+
+// Latest returns the version of the latest migration, 0 if there is none.
+func (ms Migrations) Latest() int {
+	latest := 0
+	for _, m := range ms {
+		latest = max(latest, m.Version)
+	}
+	return latest
+}
+
+// between returns the migrations after the current up to the target version in their order.
+func (ms Migrations) between(current, target int) Migrations {
+	var result Migrations
+	for _, m := range ms {
+		if m.Version > current && m.Version <= target {
+			result = append(result, m)
+		}
+	}
+	slices.SortFunc(result, func(a, b Migration) int { return a.Version - b.Version })
+	return result
+}
+
+// NewMigrator creates a new Migrator.
+func NewMigrator(c MigratorConfig) *Migrator {
+	migrations := c.Migrations
+	if migrations == nil {
+		migrations = RegisteredMigrations()
+	}
+
+	holder, err := os.Hostname()
+	if err != nil {
+		holder = "unknown"
+	}
+
+	return &Migrator{
+		log:        c.Log.WithGroup("migrator"),
+		ds:         c.Datastore,
+		migrations: migrations,
+		holder:     fmt.Sprintf("%s-%d", holder, os.Getpid()),
+		lease:      migrationLockLease,
+	}
+}
+
+// SchemaVersion returns the version of the latest applied migration, 0 if none was applied.
+func (m *Migrator) SchemaVersion(ctx context.Context) (int, error) {
+	applied, err := m.ds.Migration().List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("unable to list applied migrations: %w", err)
+	}
+
+	version := 0
+	for _, a := range applied {
+		version = max(version, a.Version)
+	}
+	return version, nil
+}
+
+// Check returns an error if the schema of the datastore is ahead of the migrations known to this binary,
+// in this case the binary would not understand the stored entities.
+func (m *Migrator) Check(ctx context.Context) error {
+	version, err := m.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	latest := m.migrations.Latest()
+	if version > latest {
+		return fmt.Errorf("schema version %d of the datastore is ahead of the latest known migration %d, please upgrade", version, latest)
+	}
+	if version < latest {
+		m.log.Warn("datastore is not migrated to the latest schema version", "schema version", version, "latest", latest)
+	}
+	return nil
+}
+
+// Pending returns the migrations which are not applied up to the target version, nil targets the latest version.
+func (m *Migrator) Pending(ctx context.Context, target *int) (Migrations, error) {
+	version, err := m.SchemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := m.migrations.Latest()
+	to := latest
+	if target != nil {
+		to = *target
+	}
+
+	switch {
+	case to > latest:
+		return nil, InvalidArgument("target version %d is ahead of the latest known migration %d", to, latest)
+	case to < version:
+		return nil, InvalidArgument("target version %d is behind the schema version %d, migrations can not be reverted", to, version)
+	}
+
+	return m.migrations.between(version, to), nil
+}
+
+// Migrate applies the pending migrations up to the target version, nil targets the latest version.
+// Only one replica migrates at a time, the others fail with a conflict while the lock is held.
+// The migration is aborted if the lock is lost.
+// With dryRun the pending migrations are returned without applying them.
+func (m *Migrator) Migrate(ctx context.Context, target *int, dryRun bool) (Migrations, error) {
+	if dryRun {
+		return m.Pending(ctx, target)
+	}
+
+	ctx, unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// the pending migrations are determined while holding the lock, another replica might have migrated already
+	pending, err := m.Pending(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied Migrations
+	for _, migration := range pending {
+		log := m.log.With("version", migration.Version, "name", migration.Name)
+		log.Info("applying migration")
+
+		start := time.Now()
+		err := migration.Up(ctx, log, m.ds)
+		if err == nil && ctx.Err() != nil {
+			// the migration is not recorded if the lock was lost while it ran, another replica might run it concurrently
+			err = context.Cause(ctx)
+		}
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Name, err)
+		}
+
+		err = m.ds.Migration().Upsert(ctx, &metal.Migration{
+			Base: metal.Base{
+				ID:   strconv.Itoa(migration.Version),
+				Name: migration.Name,
+			},
+			Version: migration.Version,
+		})
+		if err != nil {
+			return applied, fmt.Errorf("unable to store migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+
+		log.Info("applied migration", "duration", time.Since(start))
+		applied = append(applied, migration)
+	}
+
+	return applied, nil
+}
+
+// lock acquires the migration lock, a lock which expired or was released is taken over.
+// The lease of the lock is renewed until it is released, the returned context is canceled if the lock is lost.
+// Renewal and release update the lock with the optimistic lock, they fail if another replica took it over in the meantime.
+func (m *Migrator) lock(ctx context.Context) (context.Context, func(), error) {
+	lock := &metal.MigrationLock{
+		Base:    metal.Base{ID: migrationLockID},
+		Holder:  m.holder,
+		Expires: time.Now().Add(m.lease),
+	}
+
+	held, err := m.ds.MigrationLock().Create(ctx, lock)
+	if IsConflict(err) {
+		existing, getErr := m.ds.MigrationLock().Get(ctx, migrationLockID)
+		if getErr != nil {
+			return nil, nil, fmt.Errorf("unable to get migration lock: %w", getErr)
+		}
+		if existing.Holder != "" && time.Now().Before(existing.Expires) {
+			return nil, nil, Conflict("migration is locked by %s until %s", existing.Holder, existing.Expires.Format(time.RFC3339))
+		}
+		if existing.Holder != "" {
+			m.log.Warn("taking over expired migration lock", "holder", existing.Holder, "expired", existing.Expires)
+		}
+
+		// the update fails with a conflict if another replica took over the lock in the meantime
+		lock.Created = existing.Created
+		err = m.ds.MigrationLock().Update(ctx, lock, existing)
+		held = lock
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to acquire migration lock: %w", err)
+	}
+
+	var (
+		lockCtx, cancel = context.WithCancelCause(ctx)
+		done            = make(chan struct{})
+		wg              sync.WaitGroup
+		lost            bool
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(m.lease / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			renewed := *held
+			renewed.Expires = time.Now().Add(m.lease)
+			err := m.ds.MigrationLock().Update(context.Background(), &renewed, held)
+			switch {
+			case err == nil:
+				held = &renewed
+			case IsConflict(err) || IsNotFound(err) || time.Now().After(held.Expires):
+				m.log.Error("lost migration lock, aborting migration", "error", err)
+				lost = true
+				cancel(Conflict("migration lock of %s was lost: %s", m.holder, err))
+				return
+			default:
+				m.log.Warn("unable to renew migration lock, retrying", "expires", held.Expires, "error", err)
+			}
+		}
+	}()
+
+	return lockCtx, func() {
+		close(done)
+		wg.Wait()
+		defer cancel(nil)
+
+		if lost {
+			return
+		}
+
+		// the lock is released even if the context was canceled during the migration
+		released := *held
+		released.Holder = ""
+		released.Expires = time.Now()
+		err := m.ds.MigrationLock().Update(context.Background(), &released, held)
+		if err != nil {
+			m.log.Error("unable to release migration lock", "error", err)
+		}
+	}, nil
+}
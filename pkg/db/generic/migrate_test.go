@@ -0,0 +1,162 @@
+package generic
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/metal-lib/pkg/pointer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrator_Migrate(t *testing.T) {
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := NewMemory(log)
+	require.NoError(t, err)
+
+	var applied []int
+	up := func(version int) MigrateFunc {
+		return func(ctx context.Context, log *slog.Logger, ds *Datastore) error {
+			applied = append(applied, version)
+			return nil
+		}
+	}
+
+	migrator := NewMigrator(MigratorConfig{
+		Log:       log,
+		Datastore: ds,
+		Migrations: Migrations{
+			{Name: "second", Version: 2, Up: up(2)},
+			{Name: "first", Version: 1, Up: up(1)},
+			{Name: "third", Version: 3, Up: up(3)},
+		},
+	})
+
+	pending, err := migrator.Migrate(ctx, nil, true)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3}, versions(pending))
+	require.Empty(t, applied)
+
+	done, err := migrator.Migrate(ctx, pointer.Pointer(2), false)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2}, versions(done))
+	require.Equal(t, []int{1, 2}, applied)
+
+	version, err := migrator.SchemaVersion(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+
+	_, err = migrator.Migrate(ctx, pointer.Pointer(1), false)
+	require.True(t, IsInvalidArgument(err), "migrating backwards must be rejected: %v", err)
+	_, err = migrator.Migrate(ctx, pointer.Pointer(4), false)
+	require.True(t, IsInvalidArgument(err), "migrating beyond the latest migration must be rejected: %v", err)
+
+	lock, err := ds.MigrationLock().Get(ctx, migrationLockID)
+	require.NoError(t, err)
+	require.Empty(t, lock.Holder, "lock must be released after the migration")
+
+	other := *lock
+	other.Holder = "other"
+	other.Expires = time.Now().Add(time.Minute)
+	require.NoError(t, ds.MigrationLock().Update(ctx, &other, lock))
+	_, err = migrator.Migrate(ctx, nil, false)
+	require.True(t, IsConflict(err), "migration must not run while another replica holds the lock: %v", err)
+
+	expired := other
+	expired.Expires = time.Now().Add(-time.Minute)
+	require.NoError(t, ds.MigrationLock().Update(ctx, &expired, &other))
+
+	done, err = migrator.Migrate(ctx, nil, false)
+	require.NoError(t, err)
+	require.Equal(t, []int{3}, versions(done))
+	require.Equal(t, []int{1, 2, 3}, applied)
+
+	lock, err = ds.MigrationLock().Get(ctx, migrationLockID)
+	require.NoError(t, err)
+	require.Empty(t, lock.Holder, "lock must be released after the migration")
+
+	done, err = migrator.Migrate(ctx, nil, false)
+	require.NoError(t, err)
+	require.Empty(t, done)
+
+	require.NoError(t, migrator.Check(ctx))
+
+	older := NewMigrator(MigratorConfig{
+		Log:        log,
+		Datastore:  ds,
+		Migrations: Migrations{{Name: "first", Version: 1, Up: up(1)}},
+	})
+	require.Error(t, older.Check(ctx))
+}
+
+func TestMigrator_MigrateLease(t *testing.T) {
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := NewMemory(log)
+	require.NoError(t, err)
+
+	const lease = 30 * time.Millisecond
+
+	var expires []time.Time
+	migrator := NewMigrator(MigratorConfig{
+		Log:       log,
+		Datastore: ds,
+		Migrations: Migrations{
+			{Name: "long", Version: 1, Up: func(ctx context.Context, log *slog.Logger, ds *Datastore) error {
+				for range 3 {
+					time.Sleep(lease)
+					lock, err := ds.MigrationLock().Get(ctx, migrationLockID)
+					if err != nil {
+						return err
+					}
+					expires = append(expires, lock.Expires)
+				}
+				return nil
+			}},
+			{Name: "lost", Version: 2, Up: func(ctx context.Context, log *slog.Logger, ds *Datastore) error {
+				lock, err := ds.MigrationLock().Get(ctx, migrationLockID)
+				if err != nil {
+					return err
+				}
+				other := *lock
+				other.Holder = "other"
+				err = ds.MigrationLock().Update(ctx, &other, lock)
+				if err != nil {
+					return err
+				}
+				<-ctx.Done()
+				return nil
+			}},
+		},
+	})
+	migrator.lease = lease
+
+	done, err := migrator.Migrate(ctx, pointer.Pointer(1), false)
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, versions(done))
+	require.Len(t, expires, 3)
+	require.True(t, expires[2].After(expires[0]), "lease must be renewed while the migration runs")
+
+	_, err = migrator.Migrate(ctx, nil, false)
+	require.True(t, IsConflict(err), "migration must be aborted if the lock was lost: %v", err)
+
+	version, err := migrator.SchemaVersion(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, version, "migration must not be recorded if the lock was lost")
+
+	lock, err := ds.MigrationLock().Get(ctx, migrationLockID)
+	require.NoError(t, err)
+	require.Equal(t, "other", lock.Holder, "lock of another replica must not be released")
+}
+
+func versions(ms Migrations) []int {
+	var result []int
+	for _, m := range ms {
+		result = append(result, m.Version)
+	}
+	return result
+}
@@ -0,0 +1,159 @@
+package generic
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultOutboxInterval = 30 * time.Second
+	maxOutboxBackoff      = time.Hour
+)
+
+var pendingOperationsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "api_server",
+	Subsystem: "datastore",
+	Name:      "pending_operations",
+	Help:      "the number of pending operations which are not yet executed successfully",
+}, []string{"type"})
+
+type (
+	// OperationHandler executes a pending operation.
+	// It must be idempotent because an operation might be executed more than once.
+	OperationHandler func(ctx context.Context, op *metal.Operation) error
+
+	OutboxConfig struct {
+		Log       *slog.Logger
+		Datastore *Datastore
+		Handlers  map[metal.OperationType]OperationHandler
+		// Interval in which pending operations are retried, defaults to 30 seconds
+		Interval time.Duration
+	}
+
+	// Outbox stores operations against other backends as pending in the datastore before they are executed.
+	// Operations which failed are retried by a worker until they succeed, this also survives restarts.
+	Outbox struct {
+		log      *slog.Logger
+		store    Storage[*metal.Operation]
+		handlers map[metal.OperationType]OperationHandler
+		interval time.Duration
+	}
+)
+
+func NewOutbox(c OutboxConfig) *Outbox {
+	interval := defaultOutboxInterval
+	if c.Interval > 0 {
+		interval = c.Interval
+	}
+	return &Outbox{
+		log:      c.Log.WithGroup("outbox"),
+		store:    c.Datastore.Operation(),
+		handlers: c.Handlers,
+		interval: interval,
+	}
+}
+
+// Enqueue stores the operation as pending. The worker will not execute it before the given delay passed,
+// which gives the caller the chance to execute or complete it first.
+func (o *Outbox) Enqueue(ctx context.Context, op *metal.Operation, delay time.Duration) (*metal.Operation, error) {
+	if _, ok := o.handlers[op.Type]; !ok {
+		return nil, fmt.Errorf("no handler registered for operation type %q", op.Type)
+	}
+	if op.ID == "" {
+		op.ID = uuid.NewString()
+	}
+	op.NextAttempt = time.Now().Add(delay)
+
+	created, err := o.store.Create(ctx, op)
+	if err != nil {
+		return nil, fmt.Errorf("unable to store pending operation: %w", err)
+	}
+	return created, nil
+}
+
+// Complete removes a pending operation without executing it.
+func (o *Outbox) Complete(ctx context.Context, op *metal.Operation) error {
+	return o.store.Delete(ctx, op)
+}
+
+// Execute runs the handler of a pending operation. On success the operation is removed,
+// otherwise it is kept and retried later by the worker.
+func (o *Outbox) Execute(ctx context.Context, op *metal.Operation) error {
+	handler, ok := o.handlers[op.Type]
+	if !ok {
+		return fmt.Errorf("no handler registered for operation type %q", op.Type)
+	}
+
+	err := handler(ctx, op)
+	if err == nil {
+		return o.Complete(ctx, op)
+	}
+
+	updated := *op
+	updated.Attempts++
+	updated.LastError = err.Error()
+	updated.NextAttempt = time.Now().Add(o.backoff(updated.Attempts))
+
+	if updateErr := o.store.Update(ctx, &updated, op); updateErr != nil {
+		o.log.Error("unable to update pending operation", "id", op.ID, "type", op.Type, "error", updateErr)
+	}
+
+	return fmt.Errorf("unable to execute operation %q of type %q: %w", op.ID, op.Type, err)
+}
+
+// Run retries all pending operations which are due in the configured interval until the context is done.
+func (o *Outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+
+	for {
+		o.processPending(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			o.log.Info("stop processing pending operations")
+			return
+		}
+	}
+}
+
+func (o *Outbox) processPending(ctx context.Context) {
+	ops, err := o.store.List(ctx)
+	if err != nil {
+		o.log.Error("unable to list pending operations", "error", err)
+		return
+	}
+
+	pendingOperationsGauge.Reset()
+	now := time.Now()
+
+	for _, op := range ops {
+		pendingOperationsGauge.WithLabelValues(string(op.Type)).Inc()
+
+		if op.NextAttempt.After(now) {
+			continue
+		}
+
+		err := o.Execute(ctx, op)
+		if err != nil {
+			o.log.Warn("pending operation failed, retrying later", "id", op.ID, "type", op.Type, "attempts", op.Attempts+1, "error", err)
+			continue
+		}
+
+		pendingOperationsGauge.WithLabelValues(string(op.Type)).Dec()
+		o.log.Info("pending operation executed", "id", op.ID, "type", op.Type, "attempts", op.Attempts+1)
+	}
+}
+
+func (o *Outbox) backoff(attempts int) time.Duration {
+	backoff := o.interval * time.Duration(1<<min(attempts, 10))
+	return min(backoff, maxOutboxBackoff)
+}
@@ -0,0 +1,49 @@
+package generic
+
+import (
+	"encoding/base64"
+)
+
+const (
+	// DefaultPageSize is used if a page does not specify a size
+	DefaultPageSize = 100
+	// MaxPageSize is the maximum number of entities returned in a single page
+	MaxPageSize = 1000
+)
+
+// Page limits a search to a number of entities, ordered by their id.
+// The token is opaque to callers and continues after the last entity of the previous page.
+type Page struct {
+	Size  int
+	Token string
+}
+
+// limit returns the page size within the allowed bounds.
+func (p Page) limit() int {
+	if p.Size <= 0 {
+		return DefaultPageSize
+	}
+	return min(p.Size, MaxPageSize)
+}
+
+// after returns the id of the last entity of the previous page, empty for the first page.
+func (p Page) after() (string, error) {
+	if p.Token == "" {
+		return "", nil
+	}
+	id, err := base64.RawURLEncoding.DecodeString(p.Token)
+	if err != nil || len(id) == 0 {
+		return "", InvalidArgument("invalid page token %q", p.Token)
+	}
+	return string(id), nil
+}
+
+// nextPage cuts the result which was fetched with one additional entity to the page size
+// and returns the token of the next page, which is empty if there are no more entities.
+func nextPage[E Entity](result []E, limit int) ([]E, string) {
+	if len(result) <= limit {
+		return result, ""
+	}
+	result = result[:limit]
+	return result, base64.RawURLEncoding.EncodeToString([]byte(result[limit-1].GetID()))
+}
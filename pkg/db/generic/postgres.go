@@ -0,0 +1,561 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// uniqueViolation is the postgres error code for a duplicate primary key
+const uniqueViolation = "23505"
+
+type (
+	postgresBackend struct {
+		log  *slog.Logger
+		db   *sql.DB
+		opts options
+	}
+
+	// postgresStore stores every entity as jsonb document in a table with the entity id as primary key.
+	postgresStore[E Entity] struct {
+		log       *slog.Logger
+		db        *sql.DB
+		table     string
+		tableName string
+		storageConfig
+	}
+)
+
+// NewPostgres creates a Datastore which stores all entities in the given postgres database.
+func NewPostgres(log *slog.Logger, db *sql.DB, opts ...Option) (*Datastore, error) {
+	return newDatastore(&postgresBackend{
+		log:  log,
+		db:   db,
+		opts: newOptions(opts),
+	})
+}
+
+func (b *postgresBackend) String() string {
+	return "postgres"
+}
+
+func newPostgresStore[E Entity](b *postgresBackend, tableName string, c storageConfig) (*postgresStore[E], error) {
+	ps := &postgresStore[E]{
+		log:           b.log,
+		db:            b.db,
+		table:         pq.QuoteIdentifier(tableName),
+		tableName:     tableName,
+		storageConfig: c,
+	}
+	err := ps.Initialize()
+	if err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// Initialize creates the table and an index which supports the containment queries of the predicates.
+func (ps *postgresStore[E]) Initialize() error {
+	ps.log.Info("starting database init", "table", ps.tableName)
+
+	_, err := ps.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id text PRIMARY KEY, data jsonb NOT NULL)`, ps.table))
+	if err != nil {
+		return fmt.Errorf("cannot create table %s %w", ps.tableName, err)
+	}
+	_, err = ps.db.Exec(fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s ON %s USING GIN (data jsonb_path_ops)`, pq.QuoteIdentifier(ps.tableName+"_data_idx"), ps.table))
+	if err != nil {
+		return fmt.Errorf("cannot create index on table %s %w", ps.tableName, err)
+	}
+
+	// the gin index does not support ranges, the last field of an ordered index gets a btree index for them.
+	// The equality of the other fields is served by the gin index, postgres combines both.
+	for _, index := range ps.indexes {
+		if !index.Ordered || index.Multi {
+			continue
+		}
+		field := index.Fields[len(index.Fields)-1]
+		_, err = ps.db.Exec(fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s ON %s ((%s))`, pq.QuoteIdentifier(ps.tableName+"_"+index.Name+"_idx"), ps.table, orderedField(field)))
+		if err != nil {
+			return fmt.Errorf("cannot create index %s on table %s %w", index.Name, ps.tableName, err)
+		}
+	}
+	return nil
+}
+
+// orderedField is the expression of a string field which is compared bytewise, independent of the collation of the database.
+func orderedField(field string) string {
+	return fmt.Sprintf(`(data->>%s) COLLATE "C"`, pq.QuoteLiteral(field))
+}
+
+// Create implements Storage.
+func (ps *postgresStore[E]) Create(ctx context.Context, e E) (E, error) {
+	now := time.Now()
+	e.SetCreated(now)
+	e.SetChanged(now)
+	if e.GetID() == "" {
+		e.SetID(uuid.NewString())
+	}
+
+	var zero E
+	data, err := json.Marshal(e)
+	if err != nil {
+		return zero, fmt.Errorf("cannot marshal %v: %w", ps.tableName, err)
+	}
+
+	_, err = ps.db.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (id, data) VALUES ($1, $2::jsonb)`, ps.table), e.GetID(), string(data))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+			return zero, Conflict("cannot create %v in database, entity already exists: %s", ps.tableName, e.GetID())
+		}
+		return zero, fmt.Errorf("cannot create %v in database: %w", ps.tableName, err)
+	}
+
+	return e, nil
+}
+
+// CreateMany implements Storage with one insert per batch.
+func (ps *postgresStore[E]) CreateMany(ctx context.Context, es []E) (BulkResults, error) {
+	return bulk(ctx, ps.tableName, es, func(ctx context.Context, batch []E, written map[string]error) error {
+		now := time.Now()
+		for _, e := range batch {
+			e.SetCreated(now)
+			e.SetChanged(now)
+		}
+
+		ids, docs, err := ps.documents(batch)
+		if err != nil {
+			return err
+		}
+
+		created, err := ps.returning(ctx, fmt.Sprintf(`INSERT INTO %s (id, data) SELECT * FROM unnest($1::text[], $2::jsonb[]) ON CONFLICT (id) DO NOTHING RETURNING id`, ps.table), pq.Array(ids), pq.Array(docs))
+		if err != nil {
+			return fmt.Errorf("cannot create %v in database: %w", ps.tableName, err)
+		}
+
+		for _, e := range batch {
+			if created[e.GetID()] {
+				written[e.GetID()] = nil
+				continue
+			}
+			written[e.GetID()] = Conflict("cannot create %v in database, entity already exists: %s", ps.tableName, e.GetID())
+		}
+		return nil
+	})
+}
+
+// UpsertMany implements Storage with one insert per batch.
+func (ps *postgresStore[E]) UpsertMany(ctx context.Context, es []E) (BulkResults, error) {
+	return bulk(ctx, ps.tableName, es, func(ctx context.Context, batch []E, written map[string]error) error {
+		now := time.Now()
+		for _, e := range batch {
+			if e.GetCreated().IsZero() {
+				e.SetCreated(now)
+			}
+			e.SetChanged(now)
+		}
+
+		ids, docs, err := ps.documents(batch)
+		if err != nil {
+			return err
+		}
+
+		upserted, err := ps.returning(ctx, fmt.Sprintf(`INSERT INTO %s (id, data) SELECT * FROM unnest($1::text[], $2::jsonb[]) ON CONFLICT (id) DO UPDATE SET data = excluded.data RETURNING id`, ps.table), pq.Array(ids), pq.Array(docs))
+		if err != nil {
+			return fmt.Errorf("cannot upsert %v in database: %w", ps.tableName, err)
+		}
+
+		for _, e := range batch {
+			if upserted[e.GetID()] {
+				written[e.GetID()] = nil
+				continue
+			}
+			written[e.GetID()] = fmt.Errorf("cannot upsert %v (%s) in database", ps.tableName, e.GetID())
+		}
+		return nil
+	})
+}
+
+// DeleteMany implements Storage with one delete per batch.
+func (ps *postgresStore[E]) DeleteMany(ctx context.Context, es []E) (BulkResults, error) {
+	return bulk(ctx, ps.tableName, es, func(ctx context.Context, batch []E, written map[string]error) error {
+		var ids []string
+		for _, e := range batch {
+			ids = append(ids, e.GetID())
+		}
+
+		var (
+			deleted map[string]bool
+			err     error
+		)
+		if ps.softDelete {
+			// the suffix of the tombstone ids is the same for the whole batch
+			now := time.Now()
+			deleted, err = ps.returning(ctx, fmt.Sprintf(`WITH deleted AS (DELETE FROM %[1]s WHERE id = ANY($1) AND data->'deleted' IS NULL RETURNING id, data),
+				buried AS (INSERT INTO %[1]s (id, data) SELECT id || $2, data || jsonb_build_object('id', id || $2, 'deleted', $3::text, 'changed', $3::text) FROM deleted)
+				SELECT id FROM deleted`, ps.table), pq.Array(ids), tombstoneID("", now), now.Format(time.RFC3339Nano))
+		} else {
+			deleted, err = ps.returning(ctx, fmt.Sprintf(`DELETE FROM %s WHERE id = ANY($1) RETURNING id`, ps.table), pq.Array(ids))
+		}
+		if err != nil {
+			return fmt.Errorf("cannot delete %v from database: %w", ps.tableName, err)
+		}
+
+		for _, e := range batch {
+			if deleted[e.GetID()] {
+				written[e.GetID()] = nil
+				continue
+			}
+			written[e.GetID()] = NotFound("no %v with id %q found", ps.tableName, e.GetID())
+		}
+		return nil
+	})
+}
+
+// documents returns the ids and json documents of the entities.
+func (ps *postgresStore[E]) documents(es []E) ([]string, []string, error) {
+	var ids, docs []string
+	for _, e := range es {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot marshal %v (%s): %w", ps.tableName, e.GetID(), err)
+		}
+		ids = append(ids, e.GetID())
+		docs = append(docs, string(data))
+	}
+	return ids, docs, nil
+}
+
+// returning executes the statement and returns the ids of its RETURNING clause.
+func (ps *postgresStore[E]) returning(ctx context.Context, query string, args ...any) (map[string]bool, error) {
+	rows, err := ps.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := map[string]bool{}
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// Delete implements Storage.
+func (ps *postgresStore[E]) Delete(ctx context.Context, e E) error {
+	if ps.softDelete {
+		// the entity is moved to its tombstone, which leaves its id to a new entity
+		now := time.Now()
+		_, err := ps.db.ExecContext(ctx, fmt.Sprintf(`WITH deleted AS (DELETE FROM %[1]s WHERE id = $1 AND data->'deleted' IS NULL RETURNING data)
+			INSERT INTO %[1]s (id, data) SELECT $2, data || jsonb_build_object('id', $2::text, 'deleted', $3::text, 'changed', $3::text) FROM deleted`, ps.table),
+			e.GetID(), tombstoneID(e.GetID(), now), now.Format(time.RFC3339Nano))
+		if err != nil {
+			return fmt.Errorf("cannot delete %v with id %q from database: %w", ps.tableName, e.GetID(), err)
+		}
+		return nil
+	}
+
+	_, err := ps.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE id = $1`, ps.table), e.GetID())
+	if err != nil {
+		return fmt.Errorf("cannot delete %v with id %q from database: %w", ps.tableName, e.GetID(), err)
+	}
+	return nil
+}
+
+// Find implements Storage.
+func (ps *postgresStore[E]) Find(ctx context.Context, query EntityQuery) (E, error) {
+	var zero E
+	result, err := ps.Search(ctx, query)
+	if err != nil {
+		return zero, fmt.Errorf("cannot find %v in database: %w", ps.tableName, err)
+	}
+
+	switch len(result) {
+	case 0:
+		return zero, NotFound("no %v with found", ps.tableName)
+	case 1:
+		return result[0], nil
+	default:
+		return zero, fmt.Errorf("more than one %v exists", ps.tableName)
+	}
+}
+
+// Search implements Storage.
+func (ps *postgresStore[E]) Search(ctx context.Context, query EntityQuery) ([]E, error) {
+	conditions, args, err := ps.conditions(ps.predicates(query))
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := ps.query(ctx, fmt.Sprintf(`SELECT data FROM %s%s ORDER BY id`, ps.table, where(conditions)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot search %v in database: %w", ps.tableName, err)
+	}
+	return result, nil
+}
+
+// List implements Storage.
+func (ps *postgresStore[E]) List(ctx context.Context) ([]E, error) {
+	conditions, args, err := ps.conditions(ps.predicates(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := ps.query(ctx, fmt.Sprintf(`SELECT data FROM %s%s ORDER BY id`, ps.table, where(conditions)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list %v from database: %w", ps.tableName, err)
+	}
+	return result, nil
+}
+
+// SearchPage implements Storage.
+func (ps *postgresStore[E]) SearchPage(ctx context.Context, query EntityQuery, page Page) ([]E, string, error) {
+	return ps.page(ctx, ps.predicates(query), page)
+}
+
+// ListPage implements Storage.
+func (ps *postgresStore[E]) ListPage(ctx context.Context, page Page) ([]E, string, error) {
+	return ps.page(ctx, ps.predicates(nil), page)
+}
+
+// page fetches the entities after the page token in the order of the primary key,
+// only one more entity than the page size is read to determine if there is a next page.
+func (ps *postgresStore[E]) page(ctx context.Context, predicates []Predicate, page Page) ([]E, string, error) {
+	after, err := page.after()
+	if err != nil {
+		return nil, "", err
+	}
+	limit := page.limit()
+
+	conditions, args, err := ps.conditions(predicates)
+	if err != nil {
+		return nil, "", err
+	}
+	if after != "" {
+		args = append(args, after)
+		conditions = append(conditions, fmt.Sprintf("id > $%d", len(args)))
+	}
+	args = append(args, limit+1)
+
+	result, err := ps.query(ctx, fmt.Sprintf(`SELECT data FROM %s%s ORDER BY id LIMIT $%d`, ps.table, where(conditions), len(args)), args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot search %v in database: %w", ps.tableName, err)
+	}
+
+	entities, next := nextPage(result, limit)
+	return entities, next, nil
+}
+
+// Watch implements Storage, changes are not observable with a plain connection pool, postgres has no watch therefore.
+func (ps *postgresStore[E]) Watch(ctx context.Context, query EntityQuery) (<-chan Event[E], error) {
+	return nil, Unimplemented("cannot watch %v, watch is not supported by the postgres datastore", ps.tableName)
+}
+
+// Get implements Storage.
+func (ps *postgresStore[E]) Get(ctx context.Context, id string) (E, error) {
+	var (
+		zero E
+		data []byte
+	)
+	err := ps.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT data FROM %s WHERE id = $1`, ps.table), id).Scan(&data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return zero, NotFound("no %v with id %q found", ps.tableName, id)
+		}
+		return zero, fmt.Errorf("cannot find %v with id %q in database: %w", ps.tableName, id, err)
+	}
+
+	e := new(E)
+	err = json.Unmarshal(data, e)
+	if err != nil {
+		return zero, fmt.Errorf("cannot unmarshal %v with id %q: %w", ps.tableName, id, err)
+	}
+	if (*e).GetDeleted() != nil {
+		return zero, NotFound("no %v with id %q found", ps.tableName, id)
+	}
+	return *e, nil
+}
+
+// Purge implements Storage.
+func (ps *postgresStore[E]) Purge(ctx context.Context, before time.Time) (int, error) {
+	if !ps.softDelete {
+		return 0, nil
+	}
+
+	res, err := ps.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE data->'deleted' IS NOT NULL AND (data->>'deleted')::timestamptz < $1`, ps.table), before)
+	if err != nil {
+		return 0, fmt.Errorf("cannot purge %v from database: %w", ps.tableName, err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("cannot purge %v from database: %w", ps.tableName, err)
+	}
+	return int(affected), nil
+}
+
+// Update implements Storage.
+func (ps *postgresStore[E]) Update(ctx context.Context, new, old E) error {
+	new.SetChanged(time.Now())
+
+	data, err := json.Marshal(new)
+	if err != nil {
+		return fmt.Errorf("cannot marshal %v (%s): %w", ps.tableName, old.GetID(), err)
+	}
+
+	// the changed timestamp is compared in its json representation to detect concurrent modifications
+	query := `UPDATE %[1]s SET data = $1::jsonb WHERE id = $2 AND data->>'changed' = $3`
+	args := []any{string(data), old.GetID(), old.GetChanged().Format(time.RFC3339Nano)}
+	if ps.deletes(new, old) {
+		query = `WITH deleted AS (DELETE FROM %[1]s WHERE id = $2 AND data->>'changed' = $3 RETURNING id)
+			INSERT INTO %[1]s (id, data) SELECT $4, $1::jsonb || jsonb_build_object('id', $4::text) FROM deleted`
+		args = append(args, tombstoneID(old.GetID(), *new.GetDeleted()))
+	}
+
+	res, err := ps.db.ExecContext(ctx, fmt.Sprintf(query, ps.table), args...)
+	if err != nil {
+		return fmt.Errorf("cannot update %v (%s): %w", ps.tableName, old.GetID(), err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("cannot update %v (%s): %w", ps.tableName, old.GetID(), err)
+	}
+	if affected > 0 {
+		return nil
+	}
+
+	_, err = ps.Get(ctx, old.GetID())
+	if err != nil {
+		return err
+	}
+	return Conflict("cannot update %v (%s): %s", ps.tableName, old.GetID(), entityAlreadyModifiedErrorMessage)
+}
+
+// Upsert implements Storage.
+func (ps *postgresStore[E]) Upsert(ctx context.Context, e E) error {
+	now := time.Now()
+	if e.GetCreated().IsZero() {
+		e.SetCreated(now)
+	}
+	e.SetChanged(now)
+	if e.GetID() == "" {
+		e.SetID(uuid.NewString())
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("cannot marshal %v (%s): %w", ps.tableName, e.GetID(), err)
+	}
+
+	_, err = ps.db.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (id, data) VALUES ($1, $2::jsonb) ON CONFLICT (id) DO UPDATE SET data = excluded.data`, ps.table), e.GetID(), string(data))
+	if err != nil {
+		return fmt.Errorf("cannot upsert %v (%s) in database: %w", ps.tableName, e.GetID(), err)
+	}
+	return nil
+}
+
+func (ps *postgresStore[E]) query(ctx context.Context, query string, args ...any) ([]E, error) {
+	rows, err := ps.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []E
+	for rows.Next() {
+		var data []byte
+		err := rows.Scan(&data)
+		if err != nil {
+			return nil, err
+		}
+
+		e := new(E)
+		err = json.Unmarshal(data, e)
+		if err != nil {
+			return nil, fmt.Errorf("cannot unmarshal %v: %w", ps.tableName, err)
+		}
+		result = append(result, *e)
+	}
+
+	return result, rows.Err()
+}
+
+// conditions translates the predicates into sql conditions and their arguments.
+// Equality and containment are expressed as jsonb containment which is supported by the gin index.
+func (ps *postgresStore[E]) conditions(predicates []Predicate) ([]string, []any, error) {
+	var (
+		conditions []string
+		args       []any
+	)
+
+	for _, p := range predicates {
+		switch p.Operator {
+		case OperatorEquals, OperatorContains:
+			var value any = p.Value
+			if p.Operator == OperatorContains {
+				value = []any{p.Value}
+			}
+			doc, err := json.Marshal(map[string]any{p.Field: value})
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot marshal predicate on field %q: %w", p.Field, err)
+			}
+			args = append(args, string(doc))
+			conditions = append(conditions, fmt.Sprintf("data @> $%d::jsonb", len(args)))
+		case OperatorMatches:
+			args = append(args, p.Value)
+			conditions = append(conditions, fmt.Sprintf("data->>%s ~ $%d", pq.QuoteLiteral(p.Field), len(args)))
+		case OperatorMissing:
+			conditions = append(conditions, fmt.Sprintf("data->%s IS NULL", pq.QuoteLiteral(p.Field)))
+		case OperatorBetween:
+			between, ok := p.Value.(Range)
+			if !ok {
+				return nil, nil, fmt.Errorf("invalid range on field %q", p.Field)
+			}
+			args = append(args, between.Lower, between.Upper)
+			conditions = append(conditions, fmt.Sprintf("%s BETWEEN $%d AND $%d", orderedField(p.Field), len(args)-1, len(args)))
+		case OperatorBefore:
+			args = append(args, p.Value)
+			conditions = append(conditions, fmt.Sprintf("(data->>%s)::timestamptz < $%d", pq.QuoteLiteral(p.Field), len(args)))
+		default:
+			return nil, nil, fmt.Errorf("unsupported operator %q", p.Operator)
+		}
+	}
+
+	// matches and missing fields are not supported by the gin index, ranges only by the btree index of an ordered index
+	if len(predicates) > 0 && !slices.ContainsFunc(predicates, func(p Predicate) bool {
+		return p.Operator == OperatorEquals || p.Operator == OperatorContains || (p.Operator == OperatorBetween && ps.ordered(p.Field))
+	}) {
+		recordScan(ps.tableName, predicates)
+	}
+
+	return conditions, args, nil
+}
+
+// ordered returns true if the field is the last field of an ordered index and has a btree index therefore.
+func (ps *postgresStore[E]) ordered(field string) bool {
+	return slices.ContainsFunc(ps.indexes, func(index Index) bool {
+		return index.Ordered && !index.Multi && index.Fields[len(index.Fields)-1] == field
+	})
+}
+
+// where joins the conditions to a where clause, which is empty without conditions.
+func where(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
@@ -0,0 +1,128 @@
+package generic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultPurgeInterval = time.Hour
+	// DefaultRetention is the time soft deleted entities are kept before they are purged
+	DefaultRetention = 30 * 24 * time.Hour
+)
+
+var purgedEntities = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "api_server",
+	Subsystem: "datastore",
+	Name:      "purged_entities_total",
+	Help:      "the number of soft deleted entities which were removed permanently after their retention",
+}, []string{"table"})
+
+var purgedRevisions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "api_server",
+	Subsystem: "datastore",
+	Name:      "purged_revisions_total",
+	Help:      "the number of revisions which were removed from the history after their retention",
+}, []string{"table"})
+
+type (
+	PurgerConfig struct {
+		Log       *slog.Logger
+		Datastore *Datastore
+		// Retention of soft deleted entities, defaults to 30 days
+		Retention time.Duration
+		// Interval in which soft deleted entities are purged, defaults to one hour
+		Interval time.Duration
+		// HistoryRetention of the revisions by table name, the history of tables without retention is kept
+		HistoryRetention map[string]time.Duration
+	}
+
+	// Purger permanently removes soft deleted entities and revisions of the history after their retention.
+	Purger struct {
+		log              *slog.Logger
+		ds               *Datastore
+		tables           map[string]purgeable
+		retention        time.Duration
+		interval         time.Duration
+		historyRetention map[string]time.Duration
+	}
+)
+
+func NewPurger(c PurgerConfig) *Purger {
+	retention := DefaultRetention
+	if c.Retention > 0 {
+		retention = c.Retention
+	}
+	interval := defaultPurgeInterval
+	if c.Interval > 0 {
+		interval = c.Interval
+	}
+	return &Purger{
+		log:              c.Log.WithGroup("purger"),
+		ds:               c.Datastore,
+		tables:           c.Datastore.softDeleted,
+		retention:        retention,
+		interval:         interval,
+		historyRetention: c.HistoryRetention,
+	}
+}
+
+// Purge removes the entities of all tables with soft deletion which were deleted longer than the retention ago
+// and the revisions which are older than the history retention of their table.
+func (p *Purger) Purge(ctx context.Context) error {
+	before := time.Now().Add(-p.retention)
+
+	var errs []error
+	for table, store := range p.tables {
+		purged, err := store.Purge(ctx, before)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to purge %s: %w", table, err))
+			continue
+		}
+		purgedEntities.WithLabelValues(table).Add(float64(purged))
+		if purged > 0 {
+			p.log.Info("purged soft deleted entities", "table", table, "count", purged, "deleted before", before)
+		}
+	}
+
+	for table, retention := range p.historyRetention {
+		before := time.Now().Add(-retention)
+		purged, err := p.ds.purgeRevisions(ctx, table, before)
+		purgedRevisions.WithLabelValues(table).Add(float64(purged))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to purge history of %s: %w", table, err))
+			continue
+		}
+		if purged > 0 {
+			p.log.Info("purged revisions", "table", table, "count", purged, "recorded before", before)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Run purges soft deleted entities in the configured interval until the context is done.
+func (p *Purger) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		err := p.Purge(ctx)
+		if err != nil {
+			p.log.Error("unable to purge soft deleted entities", "error", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			p.log.Info("stop purging soft deleted entities")
+			return
+		}
+	}
+}
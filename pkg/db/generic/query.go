@@ -0,0 +1,80 @@
+package generic
+
+import "time"
+
+type (
+	// Operator defines how the value of a field is compared in a predicate.
+	Operator string
+
+	// Predicate is a condition on a single field of an entity.
+	// Fields are referenced by their name in the stored document, e.g. "projectid".
+	Predicate struct {
+		Field    string
+		Operator Operator
+		Value    any
+	}
+
+	// EntityQuery is a backend neutral query, an entity matches if all predicates match.
+	EntityQuery interface {
+		Predicates() []Predicate
+	}
+
+	// DeletedQuery is implemented by queries which are able to select soft deleted entities as well,
+	// they are excluded by default.
+	DeletedQuery interface {
+		EntityQuery
+		WithDeleted() bool
+	}
+)
+
+const (
+	// OperatorEquals matches if the field equals the value
+	OperatorEquals Operator = "eq"
+	// OperatorContains matches if the field is an array which contains the value
+	OperatorContains Operator = "contains"
+	// OperatorMatches matches if the field matches the regular expression given as value
+	OperatorMatches Operator = "match"
+	// OperatorMissing matches if the field is not present or null
+	OperatorMissing Operator = "missing"
+	// OperatorBetween matches if the string field is within the range given as value
+	OperatorBetween Operator = "between"
+	// OperatorBefore matches if the time field is before the time given as value
+	OperatorBefore Operator = "before"
+)
+
+// Range is the value of a between predicate, both bounds are inclusive.
+type Range struct {
+	Lower string
+	Upper string
+}
+
+// Eq returns a predicate which matches if the field equals the value.
+func Eq(field string, value any) Predicate {
+	return Predicate{Field: field, Operator: OperatorEquals, Value: value}
+}
+
+// Contains returns a predicate which matches if the array field contains the value.
+func Contains(field string, value any) Predicate {
+	return Predicate{Field: field, Operator: OperatorContains, Value: value}
+}
+
+// Match returns a predicate which matches if the field matches the regular expression.
+func Match(field string, regex string) Predicate {
+	return Predicate{Field: field, Operator: OperatorMatches, Value: regex}
+}
+
+// Missing returns a predicate which matches if the field is not present or null.
+func Missing(field string) Predicate {
+	return Predicate{Field: field, Operator: OperatorMissing}
+}
+
+// Between returns a predicate which matches if the string field is within lower and upper, both inclusive.
+// Strings are compared bytewise, values of a fixed width therefore compare like the numbers they encode.
+func Between(field string, lower, upper string) Predicate {
+	return Predicate{Field: field, Operator: OperatorBetween, Value: Range{Lower: lower, Upper: upper}}
+}
+
+// Before returns a predicate which matches if the time field is before the given time.
+func Before(field string, t time.Time) Predicate {
+	return Predicate{Field: field, Operator: OperatorBefore, Value: t}
+}
@@ -4,62 +4,31 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"slices"
 	"strings"
 	"time"
 
-	"github.com/metal-stack/api-server/pkg/db/metal"
 	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
 )
 
-const entityAlreadyModifiedErrorMessage = "the entity was changed from another, please retry"
+const (
+	entityAlreadyModifiedErrorMessage = "the entity was changed from another, please retry"
+	// duplicatePrimaryKeyErrorMessage is the error of rethinkdb for an insert of an existing id
+	duplicatePrimaryKeyErrorMessage = "Duplicate primary key"
+)
 
 type (
-	// Entity is an interface that allows metal entities to be created and stored
-	// into the database with the generic creation and update functions.
-	//
-	// see https://go.googlesource.com/proposal/+/HEAD/design/43651-type-parameters.md#pointer-method-example for possible solution to prevent slices of pointers.
-	Entity interface {
-		// GetID returns the entity's id
-		GetID() string
-		// SetID sets the entity's id
-		SetID(id string)
-		// GetChanged returns the entity's changed time
-		GetChanged() time.Time
-		// SetChanged sets the entity's changed time
-		SetChanged(changed time.Time)
-		// GetCreated sets the entity's creation time
-		GetCreated() time.Time
-		// SetCreated sets the entity's creation time
-		SetCreated(created time.Time)
-	}
-
-	EntityQuery interface {
-		Query(q r.Term) *r.Term
-	}
-
-	Storage[E Entity] interface {
-		Create(ctx context.Context, e E) (E, error)
-		Update(ctx context.Context, new, old E) error
-		Upsert(ctx context.Context, e E) error
-		Delete(ctx context.Context, e E) error
-		Get(ctx context.Context, id string) (E, error)
-		Find(ctx context.Context, query EntityQuery) (E, error)
-		Search(ctx context.Context, query EntityQuery) ([]E, error)
-		List(ctx context.Context) ([]E, error)
-	}
-
-	Datastore struct {
-		ip        Storage[*metal.IP]
-		partition Storage[*metal.Partition]
-		// event               Storage[*metal.ProvisioningEventContainer]
-		// filesystemlayout    Storage[*metal.FilesystemLayout]
-		// image               Storage[*metal.Image]
-		// machine             Storage[*metal.Machine]
-		// network             Storage[*metal.Network]
-		// size                Storage[*metal.Size]
-		// sizeimageConstraint Storage[*metal.SizeImageConstraint]
-		// sw                  Storage[*metal.Switch]
-		// switchStatus        Storage[*metal.SwitchStatus]
+	rethinkBackend struct {
+		log           *slog.Logger
+		queryExecutor r.QueryExecutor
+		dbname        string
+		opts          options
+	}
+
+	// rethinkChange is a single document of a changefeed
+	rethinkChange[E Entity] struct {
+		NewVal *E `rethinkdb:"new_val"`
+		OldVal *E `rethinkdb:"old_val"`
 	}
 
 	rethinkStore[E Entity] struct {
@@ -68,10 +37,12 @@ type (
 		dbname        string
 		table         r.Term
 		tableName     string
+		storageConfig
 	}
 )
 
-func New(log *slog.Logger, dbname string, queryExecutor r.QueryExecutor) (*Datastore, error) {
+// New creates a Datastore which stores all entities in the given rethinkdb database.
+func New(log *slog.Logger, dbname string, queryExecutor r.QueryExecutor, opts ...Option) (*Datastore, error) {
 	// Create the database
 	err := r.DBList().Contains(dbname).Do(func(row r.Term) r.Term {
 		return r.Branch(row, nil, r.DBCreate(dbname))
@@ -79,46 +50,28 @@ func New(log *slog.Logger, dbname string, queryExecutor r.QueryExecutor) (*Datas
 	if err != nil {
 		return nil, fmt.Errorf("cannot create database: %w", err)
 	}
-	// create tables
-	// TODO loop over them
-	ip, err := newStorage[*metal.IP](log, dbname, "ip", queryExecutor)
-	if err != nil {
-		return nil, err
-	}
-	partition, err := newStorage[*metal.Partition](log, dbname, "partition", queryExecutor)
-	if err != nil {
-		return nil, err
-	}
-	return &Datastore{
-		ip:        ip,
-		partition: partition,
-		// event:               newStorage[*metal.ProvisioningEventContainer](log, dbname, "event", queryExecutor),
-		// filesystemlayout:    newStorage[*metal.FilesystemLayout](log, dbname, "filesystemlayout", queryExecutor),
-		// image:               newStorage[*metal.Image](log, dbname, "image", queryExecutor),
-		// machine:             newStorage[*metal.Machine](log, dbname, "machine", queryExecutor),
-		// network:             newStorage[*metal.Network](log, dbname, "network", queryExecutor),
-		// size:                newStorage[*metal.Size](log, dbname, "size", queryExecutor),
-		// sizeimageConstraint: newStorage[*metal.SizeImageConstraint](log, dbname, "sizeimageconstraint", queryExecutor),
-		// sw:                  newStorage[*metal.Switch](log, dbname, "switch", queryExecutor),
-		// switchStatus:        newStorage[*metal.SwitchStatus](log, dbname, "switchstatus", queryExecutor),
-	}, nil
-}
 
-func (d *Datastore) IP() Storage[*metal.IP] {
-	return d.ip
+	return newDatastore(&rethinkBackend{
+		log:           log,
+		queryExecutor: queryExecutor,
+		dbname:        dbname,
+		opts:          newOptions(opts),
+	})
 }
-func (d *Datastore) Partition() Storage[*metal.Partition] {
-	return d.partition
+
+func (b *rethinkBackend) String() string {
+	return "rethinkdb"
 }
 
-// newStorage creates a new Storage which uses the given database abstraction.
-func newStorage[E Entity](log *slog.Logger, dbname, tableName string, queryExecutor r.QueryExecutor) (Storage[E], error) {
+// newRethinkStore creates a new Storage which uses the given database abstraction.
+func newRethinkStore[E Entity](b *rethinkBackend, tableName string, c storageConfig) (*rethinkStore[E], error) {
 	ds := &rethinkStore[E]{
-		log:           log,
-		queryExecutor: queryExecutor,
-		dbname:        dbname,
-		table:         r.DB(dbname).Table(tableName),
+		log:           b.log,
+		queryExecutor: b.queryExecutor,
+		dbname:        b.dbname,
+		table:         r.DB(b.dbname).Table(tableName),
 		tableName:     tableName,
+		storageConfig: c,
 	}
 	err := ds.Initialize()
 	if err != nil {
@@ -149,8 +102,156 @@ func (rs *rethinkStore[E]) Create(ctx context.Context, e E) (E, error) {
 	return e, nil
 }
 
+// CreateMany implements Storage with one insert per batch.
+func (rs *rethinkStore[E]) CreateMany(ctx context.Context, es []E) (BulkResults, error) {
+	return bulk(ctx, rs.tableName, es, func(ctx context.Context, batch []E, written map[string]error) error {
+		now := time.Now()
+		for _, e := range batch {
+			e.SetCreated(now)
+			e.SetChanged(now)
+		}
+
+		changes, err := rs.changes(ctx, rs.table.Insert(batch, r.InsertOpts{ReturnChanges: "always"}))
+		if err != nil {
+			return fmt.Errorf("cannot create %v in database: %w", rs.tableName, err)
+		}
+
+		for _, e := range batch {
+			change, ok := changes[e.GetID()]
+			switch {
+			case !ok:
+				written[e.GetID()] = fmt.Errorf("cannot create %v in database, no result for %s", rs.tableName, e.GetID())
+			case change.Error == "":
+				written[e.GetID()] = nil
+			case strings.Contains(change.Error, duplicatePrimaryKeyErrorMessage):
+				written[e.GetID()] = Conflict("cannot create %v in database, entity already exists: %s", rs.tableName, e.GetID())
+			default:
+				written[e.GetID()] = fmt.Errorf("cannot create %v in database: %s", rs.tableName, change.Error)
+			}
+		}
+		return nil
+	})
+}
+
+// UpsertMany implements Storage with one insert per batch.
+func (rs *rethinkStore[E]) UpsertMany(ctx context.Context, es []E) (BulkResults, error) {
+	return bulk(ctx, rs.tableName, es, func(ctx context.Context, batch []E, written map[string]error) error {
+		now := time.Now()
+		for _, e := range batch {
+			if e.GetCreated().IsZero() {
+				e.SetCreated(now)
+			}
+			e.SetChanged(now)
+		}
+
+		changes, err := rs.changes(ctx, rs.table.Insert(batch, r.InsertOpts{
+			Conflict:      "replace",
+			ReturnChanges: "always",
+		}))
+		if err != nil {
+			return fmt.Errorf("cannot upsert %v in database: %w", rs.tableName, err)
+		}
+
+		for _, e := range batch {
+			change, ok := changes[e.GetID()]
+			switch {
+			case !ok:
+				written[e.GetID()] = fmt.Errorf("cannot upsert %v in database, no result for %s", rs.tableName, e.GetID())
+			case change.Error == "":
+				written[e.GetID()] = nil
+			default:
+				written[e.GetID()] = fmt.Errorf("cannot upsert %v (%s) in database: %s", rs.tableName, e.GetID(), change.Error)
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteMany implements Storage with one delete per batch.
+func (rs *rethinkStore[E]) DeleteMany(ctx context.Context, es []E) (BulkResults, error) {
+	return bulk(ctx, rs.tableName, es, func(ctx context.Context, batch []E, written map[string]error) error {
+		var ids []any
+		for _, e := range batch {
+			ids = append(ids, e.GetID())
+		}
+
+		q := rs.table.GetAll(ids...)
+		if rs.softDelete {
+			// the suffix of the tombstone ids is the same for the whole batch
+			now := time.Now()
+			suffix := tombstoneID("", now)
+			q = q.Filter(r.Row.HasFields(deletedField).Not()).ForEach(func(doc r.Term) any {
+				return rs.bury(doc, doc.Field(primaryIndex).Add(suffix), now)
+			})
+		} else {
+			q = q.Delete(r.DeleteOpts{ReturnChanges: true})
+		}
+
+		changes, err := rs.changes(ctx, q)
+		if err != nil {
+			return fmt.Errorf("cannot delete %v from database: %w", rs.tableName, err)
+		}
+
+		for _, e := range batch {
+			change, ok := changes[e.GetID()]
+			switch {
+			case !ok:
+				written[e.GetID()] = NotFound("no %v with id %q found", rs.tableName, e.GetID())
+			case change.Error == "":
+				written[e.GetID()] = nil
+			default:
+				written[e.GetID()] = fmt.Errorf("cannot delete %v with id %q from database: %s", rs.tableName, e.GetID(), change.Error)
+			}
+		}
+		return nil
+	})
+}
+
+// changes runs the write query and returns the changes by the id of the document. Errors of single documents
+// are part of their change, unlike RunWrite which fails on the first one.
+func (rs *rethinkStore[E]) changes(ctx context.Context, q r.Term) (map[string]r.ChangeResponse, error) {
+	res, err := q.Run(rs.queryExecutor, r.RunOpts{Context: ctx})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var response r.WriteResponse
+	err = res.One(&response)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := map[string]r.ChangeResponse{}
+	for _, change := range response.Changes {
+		// the new value is missing for deletions and the old value for insertions
+		for _, val := range []any{change.NewValue, change.OldValue} {
+			doc, ok := val.(map[string]any)
+			if !ok {
+				continue
+			}
+			if id, ok := doc["id"].(string); ok {
+				changes[id] = change
+				break
+			}
+		}
+	}
+	return changes, nil
+}
+
 // Delete implements Storage.
 func (rs *rethinkStore[E]) Delete(ctx context.Context, e E) error {
+	if rs.softDelete {
+		now := time.Now()
+		_, err := rs.table.GetAll(e.GetID()).Filter(r.Row.HasFields(deletedField).Not()).ForEach(func(doc r.Term) any {
+			return rs.bury(doc, tombstoneID(e.GetID(), now), now)
+		}).RunWrite(rs.queryExecutor, r.RunOpts{Context: ctx})
+		if err != nil {
+			return fmt.Errorf("cannot delete %v with id %q from database: %w", rs.tableName, e.GetID(), err)
+		}
+		return nil
+	}
+
 	_, err := rs.table.Get(e.GetID()).Delete().RunWrite(rs.queryExecutor, r.RunOpts{Context: ctx})
 	if err != nil {
 		return fmt.Errorf("cannot delete %v with id %q from database: %w", rs.tableName, e.GetID(), err)
@@ -161,7 +262,7 @@ func (rs *rethinkStore[E]) Delete(ctx context.Context, e E) error {
 // Find implements Storage.
 func (rs *rethinkStore[E]) Find(ctx context.Context, query EntityQuery) (E, error) {
 	var zero E
-	res, err := query.Query(rs.table).Run(rs.queryExecutor, r.RunOpts{Context: ctx})
+	res, err := rs.query(rs.predicates(query)).Run(rs.queryExecutor, r.RunOpts{Context: ctx})
 	if err != nil {
 		return zero, fmt.Errorf("cannot find %v in database: %w", rs.tableName, err)
 	}
@@ -186,8 +287,7 @@ func (rs *rethinkStore[E]) Find(ctx context.Context, query EntityQuery) (E, erro
 }
 
 func (rs *rethinkStore[E]) Search(ctx context.Context, query EntityQuery) ([]E, error) {
-	rs.log.Info("search", "table", rs.table, "query", query.Query(rs.table))
-	res, err := query.Query(rs.table).Run(rs.queryExecutor, r.RunOpts{Context: ctx})
+	res, err := rs.query(rs.predicates(query)).Run(rs.queryExecutor, r.RunOpts{Context: ctx})
 	if err != nil {
 		return nil, fmt.Errorf("cannot search %v in database: %w", rs.tableName, err)
 	}
@@ -202,7 +302,7 @@ func (rs *rethinkStore[E]) Search(ctx context.Context, query EntityQuery) ([]E,
 }
 
 func (rs *rethinkStore[E]) List(ctx context.Context) ([]E, error) {
-	res, err := rs.table.Run(rs.queryExecutor, r.RunOpts{Context: ctx})
+	res, err := rs.query(rs.predicates(nil)).Run(rs.queryExecutor, r.RunOpts{Context: ctx})
 	if err != nil {
 		return nil, fmt.Errorf("cannot list %v from database: %w", rs.tableName, err)
 	}
@@ -216,6 +316,125 @@ func (rs *rethinkStore[E]) List(ctx context.Context) ([]E, error) {
 	return *result, nil
 }
 
+// SearchPage implements Storage.
+func (rs *rethinkStore[E]) SearchPage(ctx context.Context, query EntityQuery, page Page) ([]E, string, error) {
+	return rs.page(ctx, rs.predicates(query), page)
+}
+
+// ListPage implements Storage.
+func (rs *rethinkStore[E]) ListPage(ctx context.Context, page Page) ([]E, string, error) {
+	return rs.page(ctx, rs.predicates(nil), page)
+}
+
+// page fetches the entities after the page token in the order of the primary index,
+// only one more entity than the page size is read to determine if there is a next page.
+// If a secondary index covers the predicates, the entities are read from its paging index which orders them by id.
+func (rs *rethinkStore[E]) page(ctx context.Context, predicates []Predicate, page Page) ([]E, string, error) {
+	after, err := page.after()
+	if err != nil {
+		return nil, "", err
+	}
+	limit := page.limit()
+
+	var (
+		plan = planQuery(rs.indexes, predicates)
+		q    r.Term
+	)
+	if plan.Index != nil && plan.Index.Name != primaryIndex {
+		if _, ok := pagingIndex(*plan.Index); !ok {
+			// a single field ordered index is ordered by its field, the table is read in the order of the ids instead
+			plan = indexPlan{Predicates: predicates}
+		}
+	}
+
+	var (
+		lower     any = r.MinVal
+		leftBound     = "closed"
+	)
+	if after != "" {
+		lower = after
+		leftBound = "open"
+	}
+
+	switch {
+	case plan.Index == nil:
+		if len(predicates) > 0 {
+			recordScan(rs.tableName, predicates)
+		}
+		q = rs.table.Between(lower, r.MaxVal, r.BetweenOpts{LeftBound: leftBound}).OrderBy(r.OrderByOpts{Index: primaryIndex})
+	case plan.Index.Name == primaryIndex:
+		// a lookup by id yields a single entity
+		q = rs.table.Between(plan.Key, plan.Key, r.BetweenOpts{RightBound: "closed"}).OrderBy(r.OrderByOpts{Index: primaryIndex})
+		if after != "" {
+			q = q.Filter(func(row r.Term) r.Term {
+				return row.Field(primaryIndex).Gt(after)
+			})
+		}
+	default:
+		// the paging index orders the entities of the key by id, the page starts after the last id
+		index, key, rest := pagingPlan(plan)
+		q = rs.table.Between(append(slices.Clone(key), lower), append(slices.Clone(key), r.MaxVal), r.BetweenOpts{Index: index.Name, LeftBound: leftBound}).
+			OrderBy(r.OrderByOpts{Index: index.Name})
+		plan.Predicates = rest
+	}
+	q = rs.filter(q, plan.Predicates).Limit(limit + 1)
+
+	res, err := q.Run(rs.queryExecutor, r.RunOpts{Context: ctx})
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot search %v in database: %w", rs.tableName, err)
+	}
+	defer res.Close()
+
+	result := new([]E)
+	err = res.All(result)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot fetch entities: %w", err)
+	}
+
+	entities, next := nextPage(*result, limit)
+	return entities, next, nil
+}
+
+// Watch implements Storage by a changefeed on the filtered table.
+func (rs *rethinkStore[E]) Watch(ctx context.Context, query EntityQuery) (<-chan Event[E], error) {
+	res, err := rs.query(rs.predicates(query)).Changes().Run(rs.queryExecutor, r.RunOpts{Context: ctx})
+	if err != nil {
+		return nil, fmt.Errorf("cannot watch %v in database: %w", rs.tableName, err)
+	}
+
+	events := make(chan Event[E], watchBufferSize)
+
+	go func() {
+		defer close(events)
+		defer res.Close()
+
+		// closing the cursor unblocks the pending Next call
+		stop := context.AfterFunc(ctx, func() {
+			_ = res.Close()
+		})
+		defer stop()
+
+		var change rethinkChange[E]
+		for res.Next(&change) {
+			ev, ok := newEvent(change.OldVal, change.NewVal)
+			change = rethinkChange[E]{}
+			if !ok {
+				continue
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := res.Err(); err != nil && ctx.Err() == nil {
+			rs.log.Error("changefeed aborted", "table", rs.tableName, "error", err)
+		}
+	}()
+
+	return events, nil
+}
+
 // Get implements Storage.
 func (rs *rethinkStore[E]) Get(ctx context.Context, id string) (E, error) {
 	var zero E
@@ -232,17 +451,38 @@ func (rs *rethinkStore[E]) Get(ctx context.Context, id string) (E, error) {
 	if err != nil {
 		return zero, fmt.Errorf("more than one %v with same id exists: %w", rs.tableName, err)
 	}
+	if (*e).GetDeleted() != nil {
+		return zero, NotFound("no %v with id %q found", rs.tableName, id)
+	}
 	return *e, nil
 }
 
+// Purge implements Storage.
+func (rs *rethinkStore[E]) Purge(ctx context.Context, before time.Time) (int, error) {
+	if !rs.softDelete {
+		return 0, nil
+	}
+
+	res, err := rs.table.Filter(func(row r.Term) r.Term {
+		return row.HasFields(deletedField).And(row.Field(deletedField).Lt(before))
+	}).Delete().RunWrite(rs.queryExecutor, r.RunOpts{Context: ctx})
+	if err != nil {
+		return 0, fmt.Errorf("cannot purge %v from database: %w", rs.tableName, err)
+	}
+	return res.Deleted, nil
+}
+
 // Update implements Storage.
 func (rs *rethinkStore[E]) Update(ctx context.Context, new, old E) error {
 	new.SetChanged(time.Now())
 
-	// FIXME use context
+	if rs.deletes(new, old) {
+		return rs.updateDeleted(ctx, new, old)
+	}
+
 	_, err := rs.table.Get(old.GetID()).Replace(func(row r.Term) r.Term {
 		return r.Branch(row.Field("changed").Eq(r.Expr(old.GetChanged())), new, r.Error(entityAlreadyModifiedErrorMessage))
-	}).RunWrite(rs.queryExecutor)
+	}).RunWrite(rs.queryExecutor, r.RunOpts{Context: ctx})
 	if err != nil {
 		if strings.Contains(err.Error(), entityAlreadyModifiedErrorMessage) {
 			return Conflict("cannot update %v (%s): %s", rs.tableName, old.GetID(), entityAlreadyModifiedErrorMessage)
@@ -253,6 +493,42 @@ func (rs *rethinkStore[E]) Update(ctx context.Context, new, old E) error {
 	return nil
 }
 
+// updateDeleted moves the entity to its tombstone if it was not changed since the old one was read.
+// Rethinkdb does not write two documents atomically, the tombstone is inserted before the entity is removed.
+func (rs *rethinkStore[E]) updateDeleted(ctx context.Context, new, old E) error {
+	res, err := rs.table.GetAll(old.GetID()).Filter(r.Row.Field("changed").Eq(r.Expr(old.GetChanged()))).ForEach(func(doc r.Term) any {
+		return []any{
+			rs.table.Insert(r.Expr(new).Merge(map[string]any{primaryIndex: tombstoneID(old.GetID(), *new.GetDeleted())})),
+			rs.table.Get(old.GetID()).Delete(),
+		}
+	}).RunWrite(rs.queryExecutor, r.RunOpts{Context: ctx})
+	if err != nil {
+		return fmt.Errorf("cannot update %v (%s): %w", rs.tableName, old.GetID(), err)
+	}
+	if res.Deleted > 0 {
+		return nil
+	}
+
+	_, err = rs.Get(ctx, old.GetID())
+	if err != nil {
+		return err
+	}
+	return Conflict("cannot update %v (%s): %s", rs.tableName, old.GetID(), entityAlreadyModifiedErrorMessage)
+}
+
+// bury returns the writes which replace the document with its tombstone, the tombstone is inserted first.
+// The changes of the removed documents are returned to report the deleted entities.
+func (rs *rethinkStore[E]) bury(doc r.Term, id any, deleted time.Time) []any {
+	return []any{
+		rs.table.Insert(doc.Merge(map[string]any{
+			primaryIndex: id,
+			deletedField: deleted,
+			"changed":    deleted,
+		})),
+		rs.table.Get(doc.Field(primaryIndex)).Delete(r.DeleteOpts{ReturnChanges: true}),
+	}
+}
+
 func (rs *rethinkStore[E]) Upsert(ctx context.Context, e E) error {
 	now := time.Now()
 	if e.GetCreated().IsZero() {
@@ -262,7 +538,7 @@ func (rs *rethinkStore[E]) Upsert(ctx context.Context, e E) error {
 
 	res, err := rs.table.Insert(e, r.InsertOpts{
 		Conflict: "replace",
-	}).RunWrite(rs.queryExecutor)
+	}).RunWrite(rs.queryExecutor, r.RunOpts{Context: ctx})
 	if err != nil {
 		return fmt.Errorf("cannot upsert %v (%s) in database: %w", rs.tableName, e.GetID(), err)
 	}
@@ -273,10 +549,65 @@ func (rs *rethinkStore[E]) Upsert(ctx context.Context, e E) error {
 	return nil
 }
 
+// query selects the entities matching the predicates by the index which covers most of them,
+// the table is scanned if no index can be used.
+func (rs *rethinkStore[E]) query(predicates []Predicate) r.Term {
+	plan := planQuery(rs.indexes, predicates)
+	if plan.Index == nil {
+		if len(predicates) > 0 {
+			recordScan(rs.tableName, predicates)
+		}
+		return rs.filter(rs.table, predicates)
+	}
+	return rs.filter(rs.lookup(plan), plan.Predicates)
+}
+
+// lookup reads the entities of the index of the plan, either by its key or by its range of keys.
+func (rs *rethinkStore[E]) lookup(plan indexPlan) r.Term {
+	if plan.Between {
+		return rs.table.Between(plan.Lower, plan.Upper, r.BetweenOpts{Index: plan.Index.Name, RightBound: "closed"})
+	}
+	return rs.table.GetAllByIndex(plan.Index.Name, plan.Key)
+}
+
+// filter translates the predicates into filters on the given term.
+func (rs *rethinkStore[E]) filter(q r.Term, predicates []Predicate) r.Term {
+	for _, p := range predicates {
+		p := p
+		q = q.Filter(func(row r.Term) r.Term {
+			switch p.Operator {
+			case OperatorEquals:
+				return row.Field(p.Field).Eq(p.Value)
+			case OperatorContains:
+				return row.Field(p.Field).Contains(r.Expr(p.Value))
+			case OperatorMatches:
+				return row.Field(p.Field).Match(p.Value)
+			case OperatorMissing:
+				return row.HasFields(p.Field).Not()
+			case OperatorBetween:
+				between, ok := p.Value.(Range)
+				if !ok {
+					return r.Error(fmt.Sprintf("invalid range on field %q", p.Field))
+				}
+				return row.Field(p.Field).Ge(between.Lower).And(row.Field(p.Field).Le(between.Upper))
+			case OperatorBefore:
+				return row.Field(p.Field).Lt(p.Value)
+			default:
+				return r.Error(fmt.Sprintf("unsupported operator %q", p.Operator))
+			}
+		})
+	}
+	return q
+}
+
 // Initialize initializes the database, it should be called before serving the metal-api
 // in order to ensure that tables, pools, permissions are properly initialized
 func (rs *rethinkStore[E]) Initialize() error {
-	return rs.initializeTable(r.TableCreateOpts{Shards: 1, Replicas: 1})
+	err := rs.initializeTable(r.TableCreateOpts{Shards: 1, Replicas: 1})
+	if err != nil {
+		return err
+	}
+	return rs.initializeIndexes()
 }
 
 func (rs *rethinkStore[E]) initializeTable(opts r.TableCreateOpts) error {
@@ -290,3 +621,108 @@ func (rs *rethinkStore[E]) initializeTable(opts r.TableCreateOpts) error {
 	}
 	return nil
 }
+
+// initializeIndexes creates the missing secondary indexes and waits until all of them are ready.
+func (rs *rethinkStore[E]) initializeIndexes() error {
+	create := func(index Index, paged bool) error {
+		err := rs.table.IndexList().Contains(index.Name).Do(func(row r.Term) r.Term {
+			return r.Branch(row, nil, rs.table.IndexCreateFunc(index.Name, indexFunc(index, paged), r.IndexCreateOpts{Multi: index.Multi}))
+		}).Exec(rs.queryExecutor)
+		if err != nil {
+			return fmt.Errorf("cannot create index %s on table %s %w", index.Name, rs.tableName, err)
+		}
+		return nil
+	}
+
+	for _, index := range rs.indexes {
+		err := create(index, false)
+		if err != nil {
+			return err
+		}
+		// the index is accompanied by one which additionally orders the entities of a key by id to serve pages
+		if paging, ok := pagingIndex(index); ok {
+			err := create(paging, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(rs.indexes) == 0 {
+		return nil
+	}
+
+	rs.log.Info("waiting for indexes", "table", rs.tableName)
+	err := rs.table.IndexWait().Exec(rs.queryExecutor)
+	if err != nil {
+		return fmt.Errorf("cannot wait for indexes on table %s %w", rs.tableName, err)
+	}
+	return nil
+}
+
+// pagingIndex returns the index which extends the keys of the given index by the id of the entities to serve pages.
+// The paging index of an ordered index leaves out its last field, a range on it is filtered from the entities ordered by id,
+// a single field ordered index has no paging index therefore.
+func pagingIndex(index Index) (Index, bool) {
+	fields := index.Fields
+	if index.Ordered && !index.Multi {
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) == 0 {
+		return Index{}, false
+	}
+	return Index{Name: index.Name + "_" + primaryIndex, Fields: fields, Multi: index.Multi}, true
+}
+
+// pagingPlan returns the paging index of the index of the plan, the key of its fields
+// and the predicates which need to be filtered from its entities.
+func pagingPlan(plan indexPlan) (Index, []any, []Predicate) {
+	var (
+		paging, _ = pagingIndex(*plan.Index)
+		n         = len(plan.Index.Fields)
+	)
+
+	if !plan.Index.Ordered || plan.Index.Multi {
+		if n == 1 {
+			return paging, []any{plan.Key}, plan.Predicates
+		}
+		return paging, plan.Key.([]any), plan.Predicates
+	}
+
+	last := plan.Index.Fields[n-1]
+	if plan.Between {
+		lower, upper := plan.Lower.([]any), plan.Upper.([]any)
+		return paging, lower[:n-1], append(slices.Clone(plan.Predicates), Between(last, lower[n-1].(string), upper[n-1].(string)))
+	}
+	key := plan.Key.([]any)
+	return paging, key[:n-1], append(slices.Clone(plan.Predicates), Eq(last, key[n-1]))
+}
+
+// indexFunc returns the function which computes the index key of a row.
+// A compound multi index emits one key for every element of the last field,
+// the keys of a paging index end with the id of the row.
+func indexFunc(index Index, paged bool) func(row r.Term) any {
+	return func(row r.Term) any {
+		if len(index.Fields) == 1 && !paged {
+			return row.Field(index.Fields[0])
+		}
+
+		var keys []any
+		for _, field := range index.Fields[:len(index.Fields)-1] {
+			keys = append(keys, row.Field(field))
+		}
+
+		var suffix []any
+		if paged {
+			suffix = []any{row.Field(primaryIndex)}
+		}
+
+		last := row.Field(index.Fields[len(index.Fields)-1])
+		if !index.Multi {
+			return append(append(keys, last), suffix...)
+		}
+		return last.Map(func(element r.Term) any {
+			return append(append(slices.Clone(keys), element), suffix...)
+		})
+	}
+}
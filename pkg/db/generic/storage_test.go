@@ -0,0 +1,353 @@
+package generic
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/metal-stack/api-server/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+type testQuery []Predicate
+
+func (q testQuery) Predicates() []Predicate {
+	return q
+}
+
+type testDeletedQuery struct {
+	testQuery
+}
+
+func (q testDeletedQuery) WithDeleted() bool {
+	return true
+}
+
+func TestMemoryStore(t *testing.T) {
+	ds, err := NewMemory(slog.Default())
+	require.NoError(t, err)
+
+	testStorage(t, ds)
+	testBulk(t, ds)
+	testWatch(t, ds)
+}
+
+func TestMemoryStore_SlowWatcher(t *testing.T) {
+	ctx := context.Background()
+
+	ds, err := NewMemory(slog.Default())
+	require.NoError(t, err)
+
+	events, err := ds.IP().Watch(ctx, testQuery{})
+	require.NoError(t, err)
+
+	// the writes must not block on the watcher which does not read its events
+	for i := range watchBufferSize + 1 {
+		_, err := ds.IP().Create(ctx, &metal.IP{IPAddress: fmt.Sprintf("10.0.%d.%d", i/256, i%256)})
+		require.NoError(t, err)
+	}
+
+	received := 0
+	for range events {
+		received++
+	}
+	require.Equal(t, watchBufferSize, received, "the watch must end after its buffer is full")
+}
+
+func TestPostgresStore(t *testing.T) {
+	container, db, err := test.StartPostgres(t)
+	require.NoError(t, err)
+	defer func() {
+		_ = container.Terminate(context.Background())
+	}()
+
+	ds, err := NewPostgres(slog.Default(), db)
+	require.NoError(t, err)
+
+	testStorage(t, ds)
+	testBulk(t, ds)
+
+	_, err = ds.IP().Watch(context.Background(), testQuery{})
+	require.True(t, IsUnimplemented(err), "postgres must reject watches as unimplemented: %v", err)
+}
+
+func TestRethinkStore(t *testing.T) {
+	container, c, err := test.StartRethink(t)
+	require.NoError(t, err)
+	defer func() {
+		_ = container.Terminate(context.Background())
+	}()
+
+	ds, err := New(slog.Default(), "metal", c)
+	require.NoError(t, err)
+
+	testStorage(t, ds)
+	testBulk(t, ds)
+	testWatch(t, ds)
+}
+
+// testStorage verifies that a backend implements the semantics every Storage must provide.
+func testStorage(t *testing.T, ds *Datastore) {
+	ctx := context.Background()
+
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", ProjectID: "p1", Tags: []string{"color=red"}},
+		{IPAddress: "1.2.3.5", ProjectID: "p1"},
+		{IPAddress: "2001:db8::1", ProjectID: "p2", Tags: []string{"color=red"}},
+	} {
+		require.NoError(t, ip.SetAddressFields())
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+
+	_, err := ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.3.4"})
+	require.True(t, IsConflict(err), "duplicate create must conflict: %v", err)
+
+	_, err = ds.IP().Get(ctx, "1.2.3.6")
+	require.True(t, IsNotFound(err))
+
+	got, err := ds.IP().Search(ctx, testQuery{Eq("projectid", "p1")})
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+
+	got, err = ds.IP().Search(ctx, testQuery{Contains("tags", "color=red"), Match("id", ":")})
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	require.Equal(t, "2001:db8::1", got[0].IPAddress)
+
+	lower, upper := metal.AddressNumberRange(netip.MustParsePrefix("1.2.3.5/32"))
+	got, err = ds.IP().Search(ctx, testQuery{Eq("projectid", "p1"), Between("addressnumber", lower, upper)})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.5"}, ids(got))
+
+	lower, upper = metal.AddressNumberRange(netip.MustParsePrefix("0.0.0.0/0"))
+	got, err = ds.IP().Search(ctx, testQuery{Between("addressnumber", lower, upper)})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.2.3.4", "1.2.3.5"}, ids(got))
+
+	_, err = ds.IP().Find(ctx, testQuery{Eq("projectid", "p1")})
+	require.Error(t, err)
+
+	old, err := ds.IP().Get(ctx, "1.2.3.4")
+	require.NoError(t, err)
+
+	updated := *old
+	updated.Name = "updated"
+	require.NoError(t, ds.IP().Update(ctx, &updated, old))
+
+	stale := *old
+	stale.Name = "stale"
+	err = ds.IP().Update(ctx, &stale, old)
+	require.True(t, IsConflict(err), "update with stale changed must conflict: %v", err)
+
+	page, next, err := ds.IP().ListPage(ctx, Page{Size: 2})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.4", "1.2.3.5"}, ids(page))
+	require.NotEmpty(t, next)
+
+	page, next, err = ds.IP().ListPage(ctx, Page{Size: 2, Token: next})
+	require.NoError(t, err)
+	require.Equal(t, []string{"2001:db8::1"}, ids(page))
+	require.Empty(t, next)
+
+	page, next, err = ds.IP().SearchPage(ctx, testQuery{Contains("tags", "color=red")}, Page{Size: 1})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.4"}, ids(page))
+	page, next, err = ds.IP().SearchPage(ctx, testQuery{Contains("tags", "color=red")}, Page{Size: 1, Token: next})
+	require.NoError(t, err)
+	require.Equal(t, []string{"2001:db8::1"}, ids(page))
+	require.Empty(t, next)
+
+	page, next, err = ds.IP().SearchPage(ctx, testQuery{Eq("projectid", "p1")}, Page{Size: 1})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.4"}, ids(page))
+	page, next, err = ds.IP().SearchPage(ctx, testQuery{Eq("projectid", "p1")}, Page{Size: 1, Token: next})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.5"}, ids(page))
+	require.Empty(t, next)
+
+	_, _, err = ds.IP().ListPage(ctx, Page{Token: "not a token"})
+	require.True(t, IsInvalidArgument(err), "invalid page token must be rejected: %v", err)
+
+	require.NoError(t, ds.IP().Delete(ctx, old))
+	all, err := ds.IP().List(ctx)
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+
+	// ips are soft deleted
+	_, err = ds.IP().Get(ctx, "1.2.3.4")
+	require.True(t, IsNotFound(err), "soft deleted entity must not be found: %v", err)
+	got, err = ds.IP().Search(ctx, testQuery{Eq("id", "1.2.3.4")})
+	require.NoError(t, err)
+	require.Empty(t, got)
+	got, err = ds.IP().Search(ctx, testDeletedQuery{testQuery{Eq("addressnumber", old.AddressNumber)}})
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	require.NotNil(t, got[0].Deleted)
+	require.Equal(t, "1.2.3.4", EntityID(got[0]))
+	require.NotEqual(t, "1.2.3.4", got[0].IPAddress, "soft deleted entity must be kept under the id of its tombstone")
+
+	purged, err := ds.IP().Purge(ctx, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Zero(t, purged)
+
+	_, err = ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.3.4", ProjectID: "p3"})
+	require.NoError(t, err, "soft deleted entity must not prevent a new one with the same id")
+	recreated, err := ds.IP().Get(ctx, "1.2.3.4")
+	require.NoError(t, err)
+	require.Nil(t, recreated.Deleted)
+	require.Equal(t, "p3", recreated.ProjectID)
+	got, err = ds.IP().Search(ctx, testDeletedQuery{testQuery{Eq("addressnumber", old.AddressNumber)}})
+	require.NoError(t, err)
+	require.Len(t, got, 1, "tombstone must not be replaced by a new entity with the same id")
+	require.Equal(t, "p1", got[0].ProjectID)
+
+	// an update which sets the deletion time deletes the entity if it was not changed meanwhile
+	now := time.Now()
+	deleted := *recreated
+	deleted.Deleted = &now
+	err = ds.IP().Update(ctx, &deleted, old)
+	require.True(t, IsConflict(err), "deletion by a stale update must conflict: %v", err)
+	require.NoError(t, ds.IP().Update(ctx, &deleted, recreated))
+	_, err = ds.IP().Get(ctx, "1.2.3.4")
+	require.True(t, IsNotFound(err), "entity deleted by an update must not be found: %v", err)
+
+	purged, err = ds.IP().Purge(ctx, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 2, purged)
+	got, err = ds.IP().Search(ctx, testDeletedQuery{testQuery{Eq("addressnumber", old.AddressNumber)}})
+	require.NoError(t, err)
+	require.Empty(t, got)
+}
+
+// testBulk verifies the results of the bulk operations for every entity.
+func testBulk(t *testing.T, ds *Datastore) {
+	ctx := context.Background()
+
+	results, err := ds.IP().CreateMany(ctx, []*metal.IP{
+		{IPAddress: "4.0.0.1", ProjectID: "bulk"},
+		{IPAddress: "4.0.0.2", ProjectID: "bulk"},
+		{IPAddress: "4.0.0.1", ProjectID: "bulk"},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	require.Equal(t, []string{"4.0.0.1", "4.0.0.2"}, results.Written())
+	require.True(t, IsInvalidArgument(results[2].Err), "duplicates must be rejected: %v", results[2].Err)
+
+	results, err = ds.IP().CreateMany(ctx, []*metal.IP{
+		{IPAddress: "4.0.0.2", ProjectID: "bulk"},
+		{IPAddress: "4.0.0.3", ProjectID: "bulk"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"4.0.0.3"}, results.Written())
+	require.Equal(t, []string{"4.0.0.2"}, results.Conflicts())
+	require.Error(t, results.Err())
+
+	results, err = ds.IP().UpsertMany(ctx, []*metal.IP{
+		{IPAddress: "4.0.0.3", ProjectID: "bulk", Name: "upserted"},
+		{IPAddress: "4.0.0.4", ProjectID: "bulk", Name: "upserted"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, results.Err())
+	got, err := ds.IP().Search(ctx, testQuery{Eq("name", "upserted")})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"4.0.0.3", "4.0.0.4"}, ids(got))
+
+	results, err = ds.IP().DeleteMany(ctx, []*metal.IP{
+		{IPAddress: "4.0.0.1"},
+		{IPAddress: "4.0.0.9"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"4.0.0.1"}, results.Written())
+	require.True(t, IsNotFound(results[1].Err), "unknown entities must be reported: %v", results[1].Err)
+
+	// soft deleted entities are gone for a second deletion but can be created again
+	results, err = ds.IP().DeleteMany(ctx, []*metal.IP{{IPAddress: "4.0.0.1"}})
+	require.NoError(t, err)
+	require.True(t, IsNotFound(results[0].Err), "soft deleted entities must be reported as not found: %v", results[0].Err)
+	results, err = ds.IP().CreateMany(ctx, []*metal.IP{{IPAddress: "4.0.0.1", ProjectID: "bulk"}})
+	require.NoError(t, err)
+	require.NoError(t, results.Err())
+
+	revisions, err := ds.Revisions(ctx, "ip", "4.0.0.1")
+	require.NoError(t, err)
+	var operations []metal.RevisionOperation
+	for _, r := range revisions {
+		operations = append(operations, r.Operation)
+	}
+	require.Equal(t, []metal.RevisionOperation{metal.RevisionCreate, metal.RevisionDelete, metal.RevisionCreate}, operations)
+
+	partitions := []*metal.Partition{{Base: metal.Base{Name: "a"}}, {Base: metal.Base{Name: "b"}}}
+	results, err = ds.Partition().CreateMany(ctx, partitions)
+	require.NoError(t, err)
+	require.NoError(t, results.Err())
+	for i, p := range partitions {
+		require.NotEmpty(t, p.ID, "ids must be generated")
+		require.Equal(t, p.ID, results[i].ID)
+	}
+
+	results, err = ds.Partition().DeleteMany(ctx, partitions)
+	require.NoError(t, err)
+	require.NoError(t, results.Err())
+	all, err := ds.Partition().List(ctx)
+	require.NoError(t, err)
+	require.Empty(t, all)
+}
+
+// testWatch verifies the events of a watch, the postgres backend does not support watches.
+func testWatch(t *testing.T, ds *Datastore) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := ds.IP().Watch(ctx, testQuery{Eq("projectid", "watched")})
+	require.NoError(t, err)
+
+	ip, err := ds.IP().Create(ctx, &metal.IP{IPAddress: "3.4.5.6", ProjectID: "watched"})
+	require.NoError(t, err)
+	_, err = ds.IP().Create(ctx, &metal.IP{IPAddress: "3.4.5.7", ProjectID: "other"})
+	require.NoError(t, err)
+
+	updated := *ip
+	updated.Name = "updated"
+	require.NoError(t, ds.IP().Update(ctx, &updated, ip))
+
+	moved := updated
+	moved.ProjectID = "other"
+	require.NoError(t, ds.IP().Update(ctx, &moved, &updated))
+
+	for _, want := range []struct {
+		typ  EventType
+		old  string
+		name string
+	}{
+		{typ: EventCreated},
+		{typ: EventUpdated, name: "updated"},
+		{typ: EventDeleted, old: "updated"},
+	} {
+		ev := <-events
+		require.Equal(t, want.typ, ev.Type)
+		if ev.New != nil {
+			require.Equal(t, "3.4.5.6", ev.New.IPAddress)
+			require.Equal(t, want.name, ev.New.Name)
+		}
+		if want.old != "" {
+			require.Equal(t, want.old, ev.Old.Name)
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func ids(ips []*metal.IP) []string {
+	var result []string
+	for _, ip := range ips {
+		result = append(result, EntityID(ip))
+	}
+	return result
+}
@@ -0,0 +1,43 @@
+package generic
+
+// EventType describes the kind of change of an entity which was observed by a watch.
+type EventType string
+
+const (
+	// EventCreated is emitted if an entity was created or started to match the query of the watch
+	EventCreated EventType = "created"
+	// EventUpdated is emitted if an entity was updated and still matches the query of the watch
+	EventUpdated EventType = "updated"
+	// EventDeleted is emitted if an entity was deleted or does not match the query of the watch anymore
+	EventDeleted EventType = "deleted"
+)
+
+// watchBufferSize is the number of events which are buffered for a slow watcher
+const watchBufferSize = 100
+
+// Event is a change of an entity, Old is nil for created and New is nil for deleted entities.
+type Event[E Entity] struct {
+	Type EventType
+	Old  E
+	New  E
+}
+
+// newEvent derives the type of the event from the presence of the old and new entity.
+func newEvent[E Entity](old, new *E) (Event[E], bool) {
+	var ev Event[E]
+	switch {
+	case old == nil && new == nil:
+		return ev, false
+	case old == nil:
+		ev.Type = EventCreated
+		ev.New = *new
+	case new == nil:
+		ev.Type = EventDeleted
+		ev.Old = *old
+	default:
+		ev.Type = EventUpdated
+		ev.Old = *old
+		ev.New = *new
+	}
+	return ev, true
+}
@@ -6,11 +6,12 @@ import (
 
 // Base implements common fields for most basic entity types (not all).
 type Base struct {
-	ID          string    `rethinkdb:"id,omitempty" json:"id,omitempty"`
-	Name        string    `rethinkdb:"name" json:"name"`
-	Description string    `rethinkdb:"description" json:"description"`
-	Created     time.Time `rethinkdb:"created" json:"created"`
-	Changed     time.Time `rethinkdb:"changed" json:"changed"`
+	ID          string     `rethinkdb:"id,omitempty" json:"id,omitempty"`
+	Name        string     `rethinkdb:"name" json:"name"`
+	Description string     `rethinkdb:"description" json:"description"`
+	Created     time.Time  `rethinkdb:"created" json:"created"`
+	Changed     time.Time  `rethinkdb:"changed" json:"changed"`
+	Deleted     *time.Time `rethinkdb:"deleted,omitempty" json:"deleted,omitempty"`
 }
 
 // GetID returns the ID of the entity
@@ -42,3 +43,13 @@ func (b *Base) GetCreated() time.Time {
 func (b *Base) SetCreated(created time.Time) {
 	b.Created = created
 }
+
+// GetDeleted returns the deletion timestamp of a soft deleted entity, nil if it is not deleted
+func (b *Base) GetDeleted() *time.Time {
+	return b.Deleted
+}
+
+// SetDeleted sets the deletion timestamp of the entity
+func (b *Base) SetDeleted(deleted *time.Time) {
+	b.Deleted = deleted
+}
@@ -0,0 +1,120 @@
+package metal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImageFeature is a capability of an image, it decides for which machines an image can be used.
+type ImageFeature string
+
+// ImageClassification is the lifecycle state of an image.
+type ImageClassification string
+
+const (
+	// ImageFeatureMachine images can be used for machines
+	ImageFeatureMachine ImageFeature = "machine"
+	// ImageFeatureFirewall images can be used for firewalls
+	ImageFeatureFirewall ImageFeature = "firewall"
+
+	// ClassificationPreview images are not yet recommended for production
+	ClassificationPreview ImageClassification = "preview"
+	// ClassificationSupported images are recommended for production
+	ClassificationSupported ImageClassification = "supported"
+	// ClassificationDeprecated images should be replaced by newer versions
+	ClassificationDeprecated ImageClassification = "deprecated"
+)
+
+// Image of a machine, the id consists of the os and the version, e.g. ubuntu-24.04.20240801.
+type Image struct {
+	Base
+	URL            string              `rethinkdb:"url" json:"url"`
+	Features       []ImageFeature      `rethinkdb:"features" json:"features"`
+	OS             string              `rethinkdb:"os" json:"os"`
+	Version        string              `rethinkdb:"version" json:"version"`
+	ExpirationDate time.Time           `rethinkdb:"expirationDate" json:"expirationDate"`
+	Classification ImageClassification `rethinkdb:"classification" json:"classification"`
+}
+
+// Expired returns true if the expiration date of the image passed.
+func (i *Image) Expired(now time.Time) bool {
+	return !i.ExpirationDate.IsZero() && now.After(i.ExpirationDate)
+}
+
+// HasFeature returns true if the image can be used for the given feature.
+func (i *Image) HasFeature(feature ImageFeature) bool {
+	for _, f := range i.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseImageID splits an image id into the os and the version, the version is the part after the last dash
+// if it starts with a digit. An id without version like ubuntu is an os only.
+func ParseImageID(id string) (os string, version string) {
+	i := strings.LastIndex(id, "-")
+	if i < 0 || i == len(id)-1 || id[i+1] < '0' || id[i+1] > '9' {
+		return id, ""
+	}
+	return id[:i], id[i+1:]
+}
+
+// CompareVersions compares two versions which consist of numeric parts separated by dots,
+// the result is -1 if a is lower than b, 0 if they are equal and 1 if a is greater than b.
+func CompareVersions(a, b string) (int, error) {
+	as, err := versionParts(a)
+	if err != nil {
+		return 0, err
+	}
+	bs, err := versionParts(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < max(len(as), len(bs)); i++ {
+		var x, y uint64
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		switch {
+		case x < y:
+			return -1, nil
+		case x > y:
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// HasVersionPrefix returns true if the version starts with all parts of the prefix, e.g. 24.04.20240801 has the prefix 24.04 but not 24.0.
+func HasVersionPrefix(version, prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	return version == prefix || strings.HasPrefix(version, prefix+".")
+}
+
+// ValidateVersion returns an error if the version does not consist of numeric parts separated by dots.
+func ValidateVersion(version string) error {
+	_, err := versionParts(version)
+	return err
+}
+
+func versionParts(version string) ([]uint64, error) {
+	var parts []uint64
+	for _, p := range strings.Split(version, ".") {
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("version %q must consist of numbers separated by dots", version)
+		}
+		parts = append(parts, n)
+	}
+	return parts, nil
+}
@@ -1,6 +1,9 @@
 package metal
 
 import (
+	"encoding/hex"
+	"fmt"
+	"net/netip"
 	"time"
 )
 
@@ -17,6 +20,58 @@ const (
 	Static IPType = "static"
 )
 
+// AddressFamily is the address family of an ip or prefix, it is derived from the address
+// and stored with the ip to be able to filter by an index.
+type AddressFamily string
+
+const (
+	// IPv4AddressFamily is the address family of ipv4 addresses, including ipv4 addresses mapped into ipv6
+	IPv4AddressFamily AddressFamily = "ipv4"
+	// IPv6AddressFamily is the address family of ipv6 addresses
+	IPv6AddressFamily AddressFamily = "ipv6"
+)
+
+// AddressFamilyOf returns the address family of the given ip.
+func AddressFamilyOf(ip string) (AddressFamily, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse ip %q: %w", ip, err)
+	}
+	return addressFamily(addr), nil
+}
+
+func addressFamily(addr netip.Addr) AddressFamily {
+	if addr.Unmap().Is4() {
+		return IPv4AddressFamily
+	}
+	return IPv6AddressFamily
+}
+
+// AddressNumber returns the address as number which is stored with the ip to search for ranges by an index.
+// The 128 bit of an ipv6 address exceed the numbers of json, the number is therefore encoded as 32 hex digits
+// of the ipv6 form of the address, these strings sort like the numbers they encode. Ipv4 addresses are mapped
+// into ipv6 and sort within ::ffff:0:0/96.
+func AddressNumber(addr netip.Addr) string {
+	b := addr.As16()
+	return hex.EncodeToString(b[:])
+}
+
+// AddressNumberRange returns the address numbers of the first and the last address of the prefix.
+func AddressNumberRange(prefix netip.Prefix) (string, string) {
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+
+	first := prefix.Masked().Addr().As16()
+	last := first
+	for i := bits; i < 128; i++ {
+		last[i/8] |= 1 << (7 - i%8)
+	}
+
+	return hex.EncodeToString(first[:]), hex.EncodeToString(last[:])
+}
+
 // IP of a machine/firewall.
 type IP struct {
 	IPAddress string `rethinkdb:"id" json:"id"`
@@ -24,16 +79,41 @@ type IP struct {
 	// when an IP was created. This is not the primary key!
 	// This field can help to distinguish whether an IP address was re-acquired or
 	// if it is still the same ip address as before.
-	AllocationUUID   string    `rethinkdb:"allocationuuid" json:"allocationuuid"`
-	ParentPrefixCidr string    `rethinkdb:"prefix" json:"prefix"`
-	Name             string    `rethinkdb:"name" json:"name"`
-	Description      string    `rethinkdb:"description" json:"description"`
-	ProjectID        string    `rethinkdb:"projectid" json:"projectid"`
-	NetworkID        string    `rethinkdb:"networkid" json:"networkid"`
-	Type             IPType    `rethinkdb:"type" json:"type"`
-	Tags             []string  `rethinkdb:"tags" json:"tags"`
-	Created          time.Time `rethinkdb:"created" json:"created"`
-	Changed          time.Time `rethinkdb:"changed" json:"changed"`
+	AllocationUUID   string        `rethinkdb:"allocationuuid" json:"allocationuuid"`
+	ParentPrefixCidr string        `rethinkdb:"prefix" json:"prefix"`
+	Name             string        `rethinkdb:"name" json:"name"`
+	Description      string        `rethinkdb:"description" json:"description"`
+	ProjectID        string        `rethinkdb:"projectid" json:"projectid"`
+	NetworkID        string        `rethinkdb:"networkid" json:"networkid"`
+	Type             IPType        `rethinkdb:"type" json:"type"`
+	AddressFamily    AddressFamily `rethinkdb:"addressfamily" json:"addressfamily"`
+	AddressNumber    string        `rethinkdb:"addressnumber" json:"addressnumber"`
+	Tags             []string      `rethinkdb:"tags" json:"tags"`
+	Created          time.Time     `rethinkdb:"created" json:"created"`
+	Changed          time.Time     `rethinkdb:"changed" json:"changed"`
+	Deleted          *time.Time    `rethinkdb:"deleted,omitempty" json:"deleted,omitempty"`
+	// ReservedUntil is set while the ip is only reserved, it is released after this point in time
+	// unless the reservation was confirmed before.
+	ReservedUntil *time.Time `rethinkdb:"reserveduntil,omitempty" json:"reserveduntil,omitempty"`
+	// DetachedSince is set by the collector of ephemeral ips when it first found the ip not attached to a machine,
+	// it is cleared once the ip is attached again.
+	DetachedSince *time.Time `rethinkdb:"detachedsince,omitempty" json:"detachedsince,omitempty"`
+}
+
+// SetAddressFields derives the address family and the address number from the ip address.
+func (ip *IP) SetAddressFields() error {
+	addr, err := netip.ParseAddr(ip.IPAddress)
+	if err != nil {
+		return fmt.Errorf("unable to parse ip %q: %w", ip.IPAddress, err)
+	}
+	ip.AddressFamily = addressFamily(addr)
+	ip.AddressNumber = AddressNumber(addr)
+	return nil
+}
+
+// Reserved returns true if the ip is reserved and the reservation was not confirmed yet.
+func (ip *IP) Reserved() bool {
+	return ip.ReservedUntil != nil
 }
 
 // GetID returns the ID of the entity
@@ -65,3 +145,13 @@ func (ip *IP) GetCreated() time.Time {
 func (ip *IP) SetCreated(created time.Time) {
 	ip.Created = created
 }
+
+// GetDeleted returns the deletion timestamp of a soft deleted entity, nil if it is not deleted
+func (ip *IP) GetDeleted() *time.Time {
+	return ip.Deleted
+}
+
+// SetDeleted sets the deletion timestamp of the entity
+func (ip *IP) SetDeleted(deleted *time.Time) {
+	ip.Deleted = deleted
+}
@@ -0,0 +1,58 @@
+package metal
+
+import (
+	"time"
+)
+
+// MachineRole is the role of an allocated machine.
+type MachineRole string
+
+const (
+	// RoleMachine is a machine which runs the workload of a project
+	RoleMachine MachineRole = "machine"
+	// RoleFirewall is a machine which routes the traffic of the private network of a project
+	RoleFirewall MachineRole = "firewall"
+)
+
+// Machine is a bare metal server.
+// ProjectID and ImageID are part of the allocation, they are stored on top level to be queried
+// and are empty as long as the machine is not allocated.
+type Machine struct {
+	Base
+	PartitionID string             `rethinkdb:"partitionid" json:"partitionid"`
+	SizeID      string             `rethinkdb:"sizeid" json:"sizeid"`
+	RackID      string             `rethinkdb:"rackid" json:"rackid"`
+	ProjectID   string             `rethinkdb:"projectid" json:"projectid"`
+	ImageID     string             `rethinkdb:"imageid" json:"imageid"`
+	Allocation  *MachineAllocation `rethinkdb:"allocation" json:"allocation"`
+	Hardware    MachineHardware    `rethinkdb:"hardware" json:"hardware"`
+	Tags        []string           `rethinkdb:"tags" json:"tags"`
+}
+
+// MachineAllocation holds the data of the project which allocated the machine.
+type MachineAllocation struct {
+	Created     time.Time   `rethinkdb:"created" json:"created"`
+	Name        string      `rethinkdb:"name" json:"name"`
+	Description string      `rethinkdb:"description" json:"description"`
+	Hostname    string      `rethinkdb:"hostname" json:"hostname"`
+	Role        MachineRole `rethinkdb:"role" json:"role"`
+	SSHPubKeys  []string    `rethinkdb:"sshPubKeys" json:"sshPubKeys"`
+}
+
+// MachineHardware stores the data which is collected by the metal-hammer when the machine is registered.
+type MachineHardware struct {
+	Memory   uint64        `rethinkdb:"memory" json:"memory"`
+	CPUCores int           `rethinkdb:"cpu_cores" json:"cpu_cores"`
+	Disks    []BlockDevice `rethinkdb:"block_devices" json:"block_devices"`
+}
+
+// BlockDevice is a disk of a machine, its size is given in bytes.
+type BlockDevice struct {
+	Name string `rethinkdb:"name" json:"name"`
+	Size uint64 `rethinkdb:"size" json:"size"`
+}
+
+// Allocated returns true if the machine is allocated by a project.
+func (m *Machine) Allocated() bool {
+	return m.Allocation != nil
+}
@@ -0,0 +1,18 @@
+package metal
+
+import (
+	"time"
+)
+
+// Migration is an applied migration of the stored entities, the name of the migration is stored in Base.
+type Migration struct {
+	Base
+	Version int `rethinkdb:"version" json:"version"`
+}
+
+// MigrationLock is held by the api-server replica which currently migrates the datastore.
+type MigrationLock struct {
+	Base
+	Holder  string    `rethinkdb:"holder" json:"holder"`
+	Expires time.Time `rethinkdb:"expires" json:"expires"`
+}
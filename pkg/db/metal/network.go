@@ -0,0 +1,76 @@
+package metal
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+)
+
+// Prefix is a ip with mask for either IPv4/IPv6
+type Prefix struct {
+	IP     string `rethinkdb:"ip" json:"ip"`
+	Length string `rethinkdb:"length" json:"length"`
+}
+
+// Prefixes is an array of prefixes
+type Prefixes []Prefix
+
+// NewPrefixFromCIDR returns a new prefix from a given cidr.
+func NewPrefixFromCIDR(cidr string) (*Prefix, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse prefix %q: %w", cidr, err)
+	}
+	return &Prefix{
+		IP:     prefix.Addr().String(),
+		Length: strconv.Itoa(prefix.Bits()),
+	}, nil
+}
+
+// String implements the Stringer interface
+func (p *Prefix) String() string {
+	return p.IP + "/" + p.Length
+}
+
+// AddressFamily returns the address family of the prefix.
+func (p *Prefix) AddressFamily() (AddressFamily, error) {
+	return AddressFamilyOf(p.IP)
+}
+
+// String returns the cidr representation of all prefixes
+func (p Prefixes) String() []string {
+	var result []string
+	for _, prefix := range p {
+		result = append(result, prefix.String())
+	}
+	return result
+}
+
+// Network is a network in a metal as a service infrastructure.
+type Network struct {
+	Base
+	Prefixes            Prefixes          `rethinkdb:"prefixes" json:"prefixes"`
+	DestinationPrefixes Prefixes          `rethinkdb:"destinationprefixes" json:"destinationprefixes"`
+	PartitionID         string            `rethinkdb:"partitionid" json:"partitionid"`
+	ProjectID           string            `rethinkdb:"projectid" json:"projectid"`
+	ParentNetworkID     string            `rethinkdb:"parentnetworkid" json:"parentnetworkid"`
+	Vrf                 uint              `rethinkdb:"vrf" json:"vrf"`
+	PrivateSuper        bool              `rethinkdb:"privatesuper" json:"privatesuper"`
+	Nat                 bool              `rethinkdb:"nat" json:"nat"`
+	Underlay            bool              `rethinkdb:"underlay" json:"underlay"`
+	Shared              bool              `rethinkdb:"shared" json:"shared"`
+	Labels              map[string]string `rethinkdb:"labels" json:"labels"`
+}
+
+// NewPrefixesFromCIDRs returns the prefixes of the given cidrs.
+func NewPrefixesFromCIDRs(cidrs []string) (Prefixes, error) {
+	var result Prefixes
+	for _, cidr := range cidrs {
+		prefix, err := NewPrefixFromCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *prefix)
+	}
+	return result, nil
+}
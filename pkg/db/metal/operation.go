@@ -0,0 +1,46 @@
+package metal
+
+import (
+	"time"
+)
+
+// OperationType is the type of a pending operation.
+type OperationType string
+
+const (
+	// OperationReleaseIP releases an ip in ipam once it is not present in the datastore anymore
+	OperationReleaseIP OperationType = "releaseip"
+	// OperationReleasePrefixes releases the prefixes of a network in ipam once it is not present in the datastore anymore
+	OperationReleasePrefixes OperationType = "releaseprefixes"
+	// OperationExpireIPReservation removes a reserved ip from the datastore and releases it in ipam once the reservation expired,
+	// confirmed reservations are left untouched
+	OperationExpireIPReservation OperationType = "expireipreservation"
+)
+
+const (
+	// OperationPayloadIP is the payload key of the ip address an operation refers to
+	OperationPayloadIP = "ip"
+	// OperationPayloadPrefix is the payload key of the parent prefix an operation refers to
+	OperationPayloadPrefix = "prefix"
+	// OperationPayloadAllocationUUID is the payload key of the allocation uuid an operation refers to
+	OperationPayloadAllocationUUID = "allocationuuid"
+	// OperationPayloadNetwork is the payload key of the network an operation refers to
+	OperationPayloadNetwork = "network"
+	// OperationPayloadPrefixes is the payload key of the comma separated prefixes an operation refers to
+	OperationPayloadPrefixes = "prefixes"
+	// OperationPayloadParentNetwork is the payload key of the parent network an operation refers to,
+	// prefixes of a network with a parent network are child prefixes in ipam
+	OperationPayloadParentNetwork = "parentnetwork"
+)
+
+// Operation is a pending operation against a backend other than the datastore, e.g. go-ipam.
+// It is stored before the datastore is modified and removed after the operation was executed successfully,
+// which makes it possible to retry failed operations until both backends are consistent again.
+type Operation struct {
+	Base
+	Type        OperationType     `rethinkdb:"type" json:"type"`
+	Payload     map[string]string `rethinkdb:"payload" json:"payload"`
+	Attempts    int               `rethinkdb:"attempts" json:"attempts"`
+	LastError   string            `rethinkdb:"lasterror" json:"lasterror"`
+	NextAttempt time.Time         `rethinkdb:"nextattempt" json:"nextattempt"`
+}
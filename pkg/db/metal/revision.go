@@ -0,0 +1,22 @@
+package metal
+
+// RevisionOperation is the kind of change which created a revision.
+type RevisionOperation string
+
+const (
+	RevisionCreate RevisionOperation = "create"
+	RevisionUpdate RevisionOperation = "update"
+	RevisionDelete RevisionOperation = "delete"
+)
+
+// Revision is a change of an entity which is kept in the history.
+// Before is empty for created, After is empty for deleted entities, the time of the change is the creation time.
+type Revision struct {
+	Base
+	Table     string            `rethinkdb:"table" json:"table"`
+	EntityID  string            `rethinkdb:"entityid" json:"entityid"`
+	Operation RevisionOperation `rethinkdb:"operation" json:"operation"`
+	Actor     string            `rethinkdb:"actor" json:"actor"`
+	Before    map[string]any    `rethinkdb:"before" json:"before,omitempty"`
+	After     map[string]any    `rethinkdb:"after" json:"after,omitempty"`
+}
@@ -0,0 +1,100 @@
+package metal
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ConstraintType is the hardware property a constraint of a size applies to.
+type ConstraintType string
+
+const (
+	// CoreConstraint limits the number of cpu cores
+	CoreConstraint ConstraintType = "cores"
+	// MemoryConstraint limits the memory in bytes
+	MemoryConstraint ConstraintType = "memory"
+	// StorageConstraint limits the sum of the sizes of all disks in bytes
+	StorageConstraint ConstraintType = "storage"
+)
+
+// Constraint is a range of a hardware property, min and max are inclusive.
+type Constraint struct {
+	Type ConstraintType `rethinkdb:"type" json:"type"`
+	Min  uint64         `rethinkdb:"min" json:"min"`
+	Max  uint64         `rethinkdb:"max" json:"max"`
+}
+
+// Size groups machines with similar hardware, a machine has the size whose constraints all match its hardware.
+type Size struct {
+	Base
+	Constraints []Constraint      `rethinkdb:"constraints" json:"constraints"`
+	Labels      map[string]string `rethinkdb:"labels" json:"labels"`
+}
+
+// Validate checks that the size has constraints with valid ranges and every type at most once.
+func (s *Size) Validate() error {
+	if len(s.Constraints) == 0 {
+		return fmt.Errorf("size %s must have at least one constraint", s.ID)
+	}
+
+	var errs []error
+	seen := map[ConstraintType]bool{}
+	for _, c := range s.Constraints {
+		switch c.Type {
+		case CoreConstraint, MemoryConstraint, StorageConstraint:
+		default:
+			errs = append(errs, fmt.Errorf("constraint type %q is not supported", c.Type))
+		}
+		if seen[c.Type] {
+			errs = append(errs, fmt.Errorf("constraint type %q is given more than once", c.Type))
+		}
+		seen[c.Type] = true
+		if c.Min > c.Max {
+			errs = append(errs, fmt.Errorf("min %d of constraint type %q is greater than its max %d", c.Min, c.Type, c.Max))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("size %s is invalid: %w", s.ID, errors.Join(errs...))
+	}
+	return nil
+}
+
+// Matches returns true if the hardware fulfills all constraints of the size.
+func (s *Size) Matches(hw MachineHardware) bool {
+	for _, c := range s.Constraints {
+		var value uint64
+		switch c.Type {
+		case CoreConstraint:
+			value = uint64(max(hw.CPUCores, 0))
+		case MemoryConstraint:
+			value = hw.Memory
+		case StorageConstraint:
+			for _, disk := range hw.Disks {
+				value += disk.Size
+			}
+		default:
+			return false
+		}
+		if value < c.Min || value > c.Max {
+			return false
+		}
+	}
+	return true
+}
+
+// Overlaps returns true if there is hardware which matches both sizes. This is the case if the ranges
+// of all constraint types which are present in both sizes intersect, a constraint type which is only
+// present in one of them does not restrict the other.
+func (s *Size) Overlaps(other *Size) bool {
+	for _, c := range s.Constraints {
+		for _, o := range other.Constraints {
+			if c.Type != o.Type {
+				continue
+			}
+			if c.Max < o.Min || o.Max < c.Min {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,41 @@
+package migrations
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+)
+
+func init() {
+	generic.MustRegisterMigration(generic.Migration{
+		Name:    "store address family of ips",
+		Version: 1,
+		Up:      ipAddressFamily,
+	})
+}
+
+// ipAddressFamily stores the address family of all ips which were created before it was a field of the ip.
+func ipAddressFamily(ctx context.Context, log *slog.Logger, ds *generic.Datastore) error {
+	migrated, err := updateIPs(ctx, ds, func(ip *metal.IP) bool {
+		if ip.AddressFamily != "" {
+			return false
+		}
+		// the id of a soft deleted ip is the id of its tombstone
+		af, err := metal.AddressFamilyOf(generic.EntityID(ip))
+		if err != nil {
+			// such an ip can not be filtered by address family anyway, there is no reason to fail the migration
+			log.Warn("skipping ip with unparsable address", "ip", ip.IPAddress, "error", err)
+			return false
+		}
+		ip.AddressFamily = af
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("stored address family of ips", "count", migrated)
+	return nil
+}
@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ipAddressFamily(t *testing.T) {
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	deleted := time.Now()
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", ProjectID: "p1"},
+		{IPAddress: "2001:db8::1", ProjectID: "p1"},
+		{IPAddress: "::ffff:1.2.3.5", ProjectID: "p1"},
+		{IPAddress: "2001:db8::2", ProjectID: "p1", Deleted: &deleted},
+		{IPAddress: "1.2.3.6", ProjectID: "p1", AddressFamily: metal.IPv4AddressFamily},
+		{IPAddress: "invalid-ip", ProjectID: "p1"},
+	} {
+		require.NoError(t, ds.IP().Upsert(ctx, ip))
+	}
+
+	require.NoError(t, ipAddressFamily(ctx, log, ds))
+	// the migration must be idempotent
+	require.NoError(t, ipAddressFamily(ctx, log, ds))
+
+	ips, _, err := ds.IP().SearchPage(ctx, allIPs{}, generic.Page{})
+	require.NoError(t, err)
+
+	got := map[string]metal.AddressFamily{}
+	for _, ip := range ips {
+		got[generic.EntityID(ip)] = ip.AddressFamily
+	}
+	require.Equal(t, map[string]metal.AddressFamily{
+		"1.2.3.4":        metal.IPv4AddressFamily,
+		"1.2.3.6":        metal.IPv4AddressFamily,
+		"2001:db8::1":    metal.IPv6AddressFamily,
+		"2001:db8::2":    metal.IPv6AddressFamily,
+		"::ffff:1.2.3.5": metal.IPv4AddressFamily,
+		"invalid-ip":     "",
+	}, got)
+}
@@ -0,0 +1,42 @@
+package migrations
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+)
+
+func init() {
+	generic.MustRegisterMigration(generic.Migration{
+		Name:    "store address number of ips",
+		Version: 2,
+		Up:      ipAddressNumber,
+	})
+}
+
+// ipAddressNumber stores the address number of all ips which were created before it was a field of the ip.
+func ipAddressNumber(ctx context.Context, log *slog.Logger, ds *generic.Datastore) error {
+	migrated, err := updateIPs(ctx, ds, func(ip *metal.IP) bool {
+		if ip.AddressNumber != "" {
+			return false
+		}
+		// the id of a soft deleted ip is the id of its tombstone
+		addr, err := netip.ParseAddr(generic.EntityID(ip))
+		if err != nil {
+			// such an ip can not be found by a range anyway, there is no reason to fail the migration
+			log.Warn("skipping ip with unparsable address", "ip", ip.IPAddress, "error", err)
+			return false
+		}
+		ip.AddressNumber = metal.AddressNumber(addr)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("stored address number of ips", "count", migrated)
+	return nil
+}
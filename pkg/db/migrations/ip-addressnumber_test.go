@@ -0,0 +1,42 @@
+package migrations
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ipAddressNumber(t *testing.T) {
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	for _, ip := range []*metal.IP{
+		{IPAddress: "10.0.0.1", ProjectID: "p1", AddressFamily: metal.IPv4AddressFamily},
+		{IPAddress: "2001:db8::1", ProjectID: "p1"},
+		{IPAddress: "invalid-ip", ProjectID: "p1"},
+	} {
+		require.NoError(t, ds.IP().Upsert(ctx, ip))
+	}
+
+	require.NoError(t, ipAddressNumber(ctx, log, ds))
+
+	ips, _, err := ds.IP().SearchPage(ctx, allIPs{}, generic.Page{})
+	require.NoError(t, err)
+
+	got := map[string]string{}
+	for _, ip := range ips {
+		got[ip.IPAddress] = ip.AddressNumber
+	}
+	require.Equal(t, map[string]string{
+		"10.0.0.1":    "00000000000000000000ffff0a000001",
+		"2001:db8::1": "20010db8000000000000000000000001",
+		"invalid-ip":  "",
+	}, got)
+}
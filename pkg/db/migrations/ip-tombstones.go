@@ -0,0 +1,32 @@
+package migrations
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+)
+
+func init() {
+	generic.MustRegisterMigration(generic.Migration{
+		Name:    "keep soft deleted ips as tombstones",
+		Version: 3,
+		Up:      ipTombstones,
+	})
+}
+
+// ipTombstones moves the soft deleted ips which are still stored under their address to their own tombstone,
+// an ip which is allocated again replaced them before.
+func ipTombstones(ctx context.Context, log *slog.Logger, ds *generic.Datastore) error {
+	migrated, err := updateIPs(ctx, ds, func(ip *metal.IP) bool {
+		// an update of the soft deleted ip moves it to its tombstone
+		return ip.Deleted != nil && generic.EntityID(ip) == ip.IPAddress
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("moved soft deleted ips to their tombstones", "count", migrated)
+	return nil
+}
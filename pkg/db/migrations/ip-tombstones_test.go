@@ -0,0 +1,48 @@
+package migrations
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ipTombstones(t *testing.T) {
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	deleted := time.Now()
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", ProjectID: "p1"},
+		{IPAddress: "1.2.3.5", ProjectID: "p1", Deleted: &deleted},
+	} {
+		require.NoError(t, ds.IP().Upsert(ctx, ip))
+	}
+
+	require.NoError(t, ipTombstones(ctx, log, ds))
+	// the migration must be idempotent
+	require.NoError(t, ipTombstones(ctx, log, ds))
+
+	// the address of the soft deleted ip can be allocated again
+	_, err = ds.IP().Create(ctx, &metal.IP{IPAddress: "1.2.3.5", ProjectID: "p2"})
+	require.NoError(t, err)
+
+	ips, _, err := ds.IP().SearchPage(ctx, allIPs{}, generic.Page{})
+	require.NoError(t, err)
+
+	got := map[string][]string{}
+	for _, ip := range ips {
+		got[generic.EntityID(ip)] = append(got[generic.EntityID(ip)], ip.ProjectID)
+	}
+	require.Equal(t, map[string][]string{
+		"1.2.3.4": {"p1"},
+		"1.2.3.5": {"p2", "p1"},
+	}, got)
+}
@@ -0,0 +1,53 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+)
+
+// updateIPs passes a copy of all ips page by page to the migrate function and updates the ones for which it returns true.
+// Soft deleted ips are migrated as well because they are shown in the history. Every ip is updated on its own with the
+// optimistic lock of the datastore, the migration fails instead of overwriting an ip which was changed meanwhile.
+// It returns the number of updated ips.
+func updateIPs(ctx context.Context, ds *generic.Datastore, migrate func(ip *metal.IP) bool) (int, error) {
+	var (
+		page     = generic.Page{Size: generic.MaxPageSize}
+		migrated int
+	)
+	for {
+		ips, next, err := ds.IP().SearchPage(ctx, allIPs{}, page)
+		if err != nil {
+			return migrated, fmt.Errorf("unable to list ips: %w", err)
+		}
+
+		for _, ip := range ips {
+			updated := *ip
+			if !migrate(&updated) {
+				continue
+			}
+			err := ds.IP().Update(ctx, &updated, ip)
+			if err != nil {
+				return migrated, fmt.Errorf("unable to update ip %q: %w", ip.IPAddress, err)
+			}
+			migrated++
+		}
+
+		if next == "" {
+			return migrated, nil
+		}
+		page.Token = next
+	}
+}
+
+type allIPs struct{}
+
+func (allIPs) Predicates() []generic.Predicate {
+	return nil
+}
+
+func (allIPs) WithDeleted() bool {
+	return true
+}
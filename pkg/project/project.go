@@ -3,6 +3,7 @@ package project
 import (
 	"context"
 	"fmt"
+	"slices"
 	"strconv"
 
 	"connectrpc.com/connect"
@@ -17,6 +18,12 @@ const (
 	DefaultProjectAnnotation = "metal-stack.io/default-project"
 	ProjectRoleAnnotation    = "metalstack.cloud/project-role"
 	AvatarURLAnnotation      = "avatarUrl"
+
+	// EphemeralIPCollectionOptOutLabel excludes the ephemeral ips of a project from the garbage collection
+	EphemeralIPCollectionOptOutLabel = "metal-stack.io/ephemeral-ip-collection=disabled"
+	// IPQuotaAnnotationPrefix prefixes the annotations which limit the number of ips of a type a project can allocate per network,
+	// e.g. quota.metal-stack.io/static-ips applies to every network and quota.metal-stack.io/static-ips.internet only to the network internet
+	IPQuotaAnnotationPrefix = "quota.metal-stack.io/"
 )
 
 func ProjectRoleFromMap(annotations map[string]string) apiv1.ProjectRole {
@@ -64,6 +71,24 @@ func IsDefaultProject(p *mdcv1.Project) bool {
 	return res
 }
 
+// IsEphemeralIPCollectionDisabled returns true if the project opted out of the garbage collection of ephemeral ips.
+func IsEphemeralIPCollectionDisabled(p *mdcv1.Project) bool {
+	if p == nil || p.Meta == nil {
+		return false
+	}
+	return slices.Contains(p.Meta.Labels, EphemeralIPCollectionOptOutLabel)
+}
+
+// IPQuotaAnnotation returns the annotation which limits the number of ips of the given type a project can allocate
+// in the given network, or in every network if the network is empty.
+func IPQuotaAnnotation(ipType, network string) string {
+	annotation := IPQuotaAnnotationPrefix + ipType + "-ips"
+	if network != "" {
+		annotation += "." + network
+	}
+	return annotation
+}
+
 func GetProjectMember(ctx context.Context, c mdc.Client, projectID, tenantID string) (*mdcv1.ProjectMember, *mdcv1.Project, error) {
 	getResp, err := c.Project().Get(ctx, &mdcv1.ProjectGetRequest{
 		Id: projectID,
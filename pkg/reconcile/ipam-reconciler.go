@@ -0,0 +1,336 @@
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sort"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/metal-stack/api-server/pkg/actor"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
+	ipamv1connect "github.com/metal-stack/go-ipam/api/v1/apiv1connect"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DriftKind describes how an ip differs between go-ipam and the datastore.
+type DriftKind string
+
+const (
+	// OrphanInIpam is an ip which is acquired in go-ipam but not present in the datastore
+	OrphanInIpam DriftKind = "orphan-in-ipam"
+	// OrphanInDatastore is an ip which is present in the datastore but not acquired in go-ipam
+	OrphanInDatastore DriftKind = "orphan-in-datastore"
+	// PrefixMismatch is an ip which is acquired in a different prefix than the one stored in the datastore
+	PrefixMismatch DriftKind = "prefix-mismatch"
+)
+
+var driftGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "api_server",
+	Subsystem: "ipam",
+	Name:      "drift",
+	Help:      "the number of ips which differ between go-ipam and the datastore",
+}, []string{"kind"})
+
+type (
+	IpamConfig struct {
+		Log       *slog.Logger
+		Datastore *generic.Datastore
+		Ipam      ipamv1connect.IpamServiceClient
+	}
+
+	// IpamReconciler compares the ips acquired in go-ipam with the ips stored in the datastore.
+	IpamReconciler struct {
+		log  *slog.Logger
+		ds   *generic.Datastore
+		ipam ipamv1connect.IpamServiceClient
+	}
+
+	// Drift is a single difference between go-ipam and the datastore.
+	Drift struct {
+		Kind DriftKind `json:"kind"`
+		IP   string    `json:"ip"`
+		// DatastorePrefix is the parent prefix stored in the datastore
+		DatastorePrefix string `json:"datastore_prefix,omitempty"`
+		// IpamPrefix is the prefix the ip is acquired in go-ipam
+		IpamPrefix string `json:"ipam_prefix,omitempty"`
+		Repaired   bool   `json:"repaired"`
+		// Resolved is true if the drift no longer held when it was about to be repaired
+		Resolved bool   `json:"resolved,omitempty"`
+		Error    string `json:"error,omitempty"`
+	}
+
+	Report struct {
+		Drifts []Drift `json:"drifts"`
+		// Skipped contains ips which have a pending operation and will be consistent after it was executed
+		Skipped []string `json:"skipped,omitempty"`
+	}
+
+	// ipamPrefix is the representation of a prefix in the go-ipam dump
+	ipamPrefix struct {
+		Cidr       string          `json:"Cidr"`
+		ParentCidr string          `json:"ParentCidr"`
+		IPs        map[string]bool `json:"IPs"`
+	}
+)
+
+func NewIpamReconciler(c IpamConfig) *IpamReconciler {
+	return &IpamReconciler{
+		log:  c.Log.WithGroup("ipamReconciler"),
+		ds:   c.Datastore,
+		ipam: c.Ipam,
+	}
+}
+
+// Count returns the number of drifts of the given kind.
+func (r *Report) Count(kind DriftKind) int {
+	count := 0
+	for _, d := range r.Drifts {
+		if d.Kind == kind {
+			count++
+		}
+	}
+	return count
+}
+
+// Reconcile reports all drifts between go-ipam and the datastore, if repair is true the drifts are repaired as well.
+func (r *IpamReconciler) Reconcile(ctx context.Context, repair bool) (*Report, error) {
+	ctx = actor.ContextWithActor(ctx, "ipam-reconciler")
+
+	ips, err := r.ds.IP().List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list ips: %w", err)
+	}
+
+	ipamIPs, err := r.ipamIPs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := r.pendingIPs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		report    = &Report{}
+		datastore = map[string]*metal.IP{}
+	)
+
+	for _, ip := range ips {
+		datastore[ip.IPAddress] = ip
+
+		if pending[ip.IPAddress] {
+			report.Skipped = append(report.Skipped, ip.IPAddress)
+			continue
+		}
+
+		prefix, ok := ipamIPs[ip.IPAddress]
+		if !ok {
+			report.Drifts = append(report.Drifts, Drift{Kind: OrphanInDatastore, IP: ip.IPAddress, DatastorePrefix: ip.ParentPrefixCidr})
+			continue
+		}
+		if prefix != ip.ParentPrefixCidr {
+			report.Drifts = append(report.Drifts, Drift{Kind: PrefixMismatch, IP: ip.IPAddress, DatastorePrefix: ip.ParentPrefixCidr, IpamPrefix: prefix})
+		}
+	}
+
+	for ip, prefix := range ipamIPs {
+		if _, ok := datastore[ip]; ok {
+			continue
+		}
+		if pending[ip] {
+			report.Skipped = append(report.Skipped, ip)
+			continue
+		}
+		report.Drifts = append(report.Drifts, Drift{Kind: OrphanInIpam, IP: ip, IpamPrefix: prefix})
+	}
+
+	sort.Slice(report.Drifts, func(i, j int) bool {
+		return report.Drifts[i].IP < report.Drifts[j].IP
+	})
+	sort.Strings(report.Skipped)
+
+	if !repair {
+		return report, nil
+	}
+
+	for i := range report.Drifts {
+		drift := &report.Drifts[i]
+
+		ip, holds, err := r.current(ctx, drift)
+		if err == nil && !holds {
+			r.log.Info("drift was resolved before it was repaired", "kind", drift.Kind, "ip", drift.IP)
+			drift.Resolved = true
+			continue
+		}
+		if err == nil {
+			err = r.repair(ctx, drift, ip)
+		}
+		if err != nil {
+			r.log.Error("unable to repair drift", "kind", drift.Kind, "ip", drift.IP, "error", err)
+			drift.Error = err.Error()
+			continue
+		}
+
+		r.log.Info("repaired drift", "kind", drift.Kind, "ip", drift.IP)
+		drift.Repaired = true
+	}
+
+	return report, nil
+}
+
+// Run reconciles in the given interval until the context is done and exports the drift counts as metrics.
+func (r *IpamReconciler) Run(ctx context.Context, interval time.Duration, repair bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := r.Reconcile(ctx, repair)
+		if err != nil {
+			r.log.Error("unable to reconcile ipam", "error", err)
+		} else {
+			for _, kind := range []DriftKind{OrphanInIpam, OrphanInDatastore, PrefixMismatch} {
+				driftGauge.WithLabelValues(string(kind)).Set(float64(report.Count(kind)))
+			}
+			if len(report.Drifts) > 0 {
+				r.log.Warn("ipam and datastore differ", "drifts", len(report.Drifts), "repair", repair)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			r.log.Info("stop reconciling ipam")
+			return
+		}
+	}
+}
+
+// current reads the ip and the pending operations again right before a drift is repaired, because the drifts are found
+// in a snapshot which concurrent allocations and deletions may have outdated in the meantime.
+// It returns the ip stored in the datastore, nil if there is none, and whether the drift still holds.
+// The ip is read before the operations, allocations and deletions enqueue their operation before they change the datastore
+// and complete it afterwards, a change after the ip was read is therefore still pending when the operations are read.
+func (r *IpamReconciler) current(ctx context.Context, drift *Drift) (*metal.IP, bool, error) {
+	ip, err := r.ds.IP().Get(ctx, drift.IP)
+	if err != nil {
+		if !generic.IsNotFound(err) {
+			return nil, false, fmt.Errorf("unable to get ip: %w", err)
+		}
+		ip = nil
+	}
+
+	holds := true
+	switch drift.Kind {
+	case OrphanInIpam:
+		holds = ip == nil
+	case OrphanInDatastore, PrefixMismatch:
+		holds = ip != nil && ip.ParentPrefixCidr == drift.DatastorePrefix
+	}
+	if !holds {
+		return ip, false, nil
+	}
+
+	pending, err := r.pendingIPs(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return ip, !pending[drift.IP], nil
+}
+
+// pendingIPs returns the ips which have a pending operation.
+func (r *IpamReconciler) pendingIPs(ctx context.Context) (map[string]bool, error) {
+	ops, err := r.ds.Operation().List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pending operations: %w", err)
+	}
+	pending := map[string]bool{}
+	for _, op := range ops {
+		if ip, ok := op.Payload[metal.OperationPayloadIP]; ok {
+			pending[ip] = true
+		}
+	}
+	return pending, nil
+}
+
+func (r *IpamReconciler) repair(ctx context.Context, drift *Drift, ip *metal.IP) error {
+	switch drift.Kind {
+	case OrphanInIpam:
+		_, err := r.ipam.ReleaseIP(ctx, connect.NewRequest(&ipamv1.ReleaseIPRequest{Ip: drift.IP, PrefixCidr: drift.IpamPrefix}))
+		return err
+	case OrphanInDatastore:
+		if ip.ParentPrefixCidr == "" {
+			return errors.New("ip has no parent prefix, unable to acquire it in ipam")
+		}
+		_, err := r.ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{Ip: &ip.IPAddress, PrefixCidr: ip.ParentPrefixCidr}))
+		return err
+	case PrefixMismatch:
+		newIP := *ip
+		newIP.ParentPrefixCidr = drift.IpamPrefix
+		return r.ds.IP().Update(ctx, &newIP, ip)
+	default:
+		return fmt.Errorf("unknown drift kind %q", drift.Kind)
+	}
+}
+
+// ipamIPs returns all acquired ips in go-ipam mapped to the prefix they are acquired in.
+func (r *IpamReconciler) ipamIPs(ctx context.Context) (map[string]string, error) {
+	dump, err := r.ipam.Dump(ctx, connect.NewRequest(&ipamv1.DumpRequest{}))
+	if err != nil {
+		return nil, fmt.Errorf("unable to dump ipam: %w", err)
+	}
+
+	var prefixes []ipamPrefix
+	err = json.Unmarshal([]byte(dump.Msg.Dump), &prefixes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse ipam dump: %w", err)
+	}
+
+	result := map[string]string{}
+	for _, p := range prefixes {
+		pfx, err := netip.ParsePrefix(p.Cidr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse prefix %q of ipam dump: %w", p.Cidr, err)
+		}
+
+		for ip := range p.IPs {
+			if isReserved(pfx, ip) {
+				continue
+			}
+			result[ip] = p.Cidr
+		}
+	}
+
+	return result, nil
+}
+
+// isReserved returns true for the ips which go-ipam blocks on prefix creation,
+// which are the network address and for ipv4 the broadcast address.
+func isReserved(pfx netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	network := pfx.Masked().Addr()
+	if addr == network {
+		return true
+	}
+	if !network.Is4() {
+		return false
+	}
+
+	broadcast := network.As4()
+	for i := pfx.Bits(); i < 32; i++ {
+		broadcast[i/8] |= 1 << (7 - i%8)
+	}
+	return addr == netip.AddrFrom4(broadcast)
+}
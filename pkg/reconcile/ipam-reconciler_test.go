@@ -0,0 +1,171 @@
+package reconcile
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/google/go-cmp/cmp"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/metal-stack/api-server/pkg/test"
+	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
+	"github.com/metal-stack/metal-lib/pkg/pointer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIpamReconciler_Reconcile(t *testing.T) {
+	ipam := test.StartIpam(t)
+
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	for _, prefix := range []string{"1.2.3.0/24", "2.3.4.0/24"} {
+		_, err := ipam.CreatePrefix(ctx, connect.NewRequest(&ipamv1.CreatePrefixRequest{Cidr: prefix}))
+		require.NoError(t, err)
+	}
+	for ip, prefix := range map[string]string{
+		"1.2.3.4": "1.2.3.0/24",
+		"1.2.3.5": "1.2.3.0/24",
+		"2.3.4.5": "2.3.4.0/24",
+		"2.3.4.6": "2.3.4.0/24",
+	} {
+		_, err := ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{Ip: pointer.Pointer(ip), PrefixCidr: prefix}))
+		require.NoError(t, err)
+	}
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", ParentPrefixCidr: "1.2.3.0/24"},
+		{IPAddress: "1.2.3.6", ParentPrefixCidr: "1.2.3.0/24"},
+		{IPAddress: "2.3.4.5", ParentPrefixCidr: "1.2.3.0/24"},
+	} {
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+	_, err = ds.Operation().Create(ctx, &metal.Operation{
+		Base:    metal.Base{ID: "op1"},
+		Type:    metal.OperationReleaseIP,
+		Payload: map[string]string{metal.OperationPayloadIP: "2.3.4.6"},
+	})
+	require.NoError(t, err)
+
+	reconciler := NewIpamReconciler(IpamConfig{Log: log, Datastore: ds, Ipam: ipam})
+
+	wantDrifts := []Drift{
+		{Kind: OrphanInIpam, IP: "1.2.3.5", IpamPrefix: "1.2.3.0/24"},
+		{Kind: OrphanInDatastore, IP: "1.2.3.6", DatastorePrefix: "1.2.3.0/24"},
+		{Kind: PrefixMismatch, IP: "2.3.4.5", DatastorePrefix: "1.2.3.0/24", IpamPrefix: "2.3.4.0/24"},
+	}
+
+	report, err := reconciler.Reconcile(ctx, false)
+	require.NoError(t, err)
+	if diff := cmp.Diff(wantDrifts, report.Drifts); diff != "" {
+		t.Errorf("IpamReconciler.Reconcile() diff = %s", diff)
+	}
+	require.Equal(t, []string{"2.3.4.6"}, report.Skipped)
+
+	report, err = reconciler.Reconcile(ctx, true)
+	require.NoError(t, err)
+	for _, d := range report.Drifts {
+		require.True(t, d.Repaired, "drift %s of %s not repaired: %s", d.Kind, d.IP, d.Error)
+	}
+
+	report, err = reconciler.Reconcile(ctx, false)
+	require.NoError(t, err)
+	require.Empty(t, report.Drifts)
+}
+
+func Test_isReserved(t *testing.T) {
+	tests := []struct {
+		prefix string
+		ip     string
+		want   bool
+	}{
+		{prefix: "1.2.3.0/24", ip: "1.2.3.0", want: true},
+		{prefix: "1.2.3.0/24", ip: "1.2.3.255", want: true},
+		{prefix: "1.2.3.0/24", ip: "1.2.3.4", want: false},
+		{prefix: "10.0.0.0/22", ip: "10.0.3.255", want: true},
+		{prefix: "10.0.0.0/22", ip: "10.0.1.255", want: false},
+		{prefix: "2001:db8::/96", ip: "2001:db8::", want: true},
+		{prefix: "2001:db8::/96", ip: "2001:db8::ffff:ffff", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix+"-"+tt.ip, func(t *testing.T) {
+			if got := isReserved(netip.MustParsePrefix(tt.prefix), tt.ip); got != tt.want {
+				t.Errorf("isReserved() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIpamReconciler_current(t *testing.T) {
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.4", ParentPrefixCidr: "1.2.3.0/24"},
+		{IPAddress: "1.2.3.5", ParentPrefixCidr: "1.2.3.0/24"},
+	} {
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+	_, err = ds.Operation().Create(ctx, &metal.Operation{
+		Base:    metal.Base{ID: "op1"},
+		Type:    metal.OperationReleaseIP,
+		Payload: map[string]string{metal.OperationPayloadIP: "1.2.3.5"},
+	})
+	require.NoError(t, err)
+
+	reconciler := NewIpamReconciler(IpamConfig{Log: log, Datastore: ds})
+
+	tests := []struct {
+		name  string
+		drift Drift
+		want  bool
+	}{
+		{
+			name:  "orphan in ipam which is still missing in the datastore",
+			drift: Drift{Kind: OrphanInIpam, IP: "1.2.3.6", IpamPrefix: "1.2.3.0/24"},
+			want:  true,
+		},
+		{
+			name:  "orphan in ipam which was stored by a concurrent allocation",
+			drift: Drift{Kind: OrphanInIpam, IP: "1.2.3.4", IpamPrefix: "1.2.3.0/24"},
+			want:  false,
+		},
+		{
+			name:  "orphan in datastore which still exists",
+			drift: Drift{Kind: OrphanInDatastore, IP: "1.2.3.4", DatastorePrefix: "1.2.3.0/24"},
+			want:  true,
+		},
+		{
+			name:  "orphan in datastore which was deleted concurrently",
+			drift: Drift{Kind: OrphanInDatastore, IP: "1.2.3.6", DatastorePrefix: "1.2.3.0/24"},
+			want:  false,
+		},
+		{
+			name:  "orphan in datastore with a pending operation",
+			drift: Drift{Kind: OrphanInDatastore, IP: "1.2.3.5", DatastorePrefix: "1.2.3.0/24"},
+			want:  false,
+		},
+		{
+			name:  "prefix mismatch which was updated concurrently",
+			drift: Drift{Kind: PrefixMismatch, IP: "1.2.3.4", DatastorePrefix: "2.3.4.0/24", IpamPrefix: "1.2.3.0/24"},
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, got, err := reconciler.current(ctx, &tt.drift)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	adminv1 "github.com/metal-stack/api/go/metalstack/admin/v1"
+	"github.com/metal-stack/api/go/metalstack/admin/v1/adminv1connect"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+)
+
+// DefaultExpiration is the time an image can be used after its creation if no expiration date is given
+const DefaultExpiration = 90 * 24 * time.Hour
+
+type imageAdminServiceServer struct {
+	log *slog.Logger
+	ds  *generic.Datastore
+	now func() time.Time
+}
+
+func NewAdmin(c Config) adminv1connect.ImageServiceHandler {
+	return &imageAdminServiceServer{
+		log: c.Log.WithGroup("imageAdminService"),
+		ds:  c.Datastore,
+		now: time.Now,
+	}
+}
+
+// Create implements adminv1.ImageServiceServer
+func (i *imageAdminServiceServer) Create(ctx context.Context, rq *connect.Request[adminv1.ImageServiceCreateRequest]) (*connect.Response[adminv1.ImageServiceCreateResponse], error) {
+	i.log.Debug("create", "image", rq)
+	req := rq.Msg.Image
+	if req == nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("image must be given"))
+	}
+
+	os, version := metal.ParseImageID(req.Id)
+	if version == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("image id %q must consist of the os and the version, e.g. ubuntu-24.04.20240801", req.Id))
+	}
+
+	image := &metal.Image{
+		Base: metal.Base{
+			ID:          req.Id,
+			Name:        req.Name,
+			Description: req.Description,
+		},
+		URL:            req.Url,
+		OS:             os,
+		Version:        version,
+		ExpirationDate: i.now().Add(DefaultExpiration),
+		Classification: metal.ClassificationPreview,
+	}
+	if req.ExpiresAt != nil {
+		image.ExpirationDate = req.ExpiresAt.AsTime()
+	}
+	if req.Classification != apiv1.ImageClassification_IMAGE_CLASSIFICATION_UNSPECIFIED {
+		classification, err := toClassification(req.Classification)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		image.Classification = classification
+	}
+	features, err := toFeatures(req.Features)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	image.Features = features
+
+	err = validate(image)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	created, err := i.ds.Image().Create(ctx, image)
+	if err != nil {
+		if generic.IsConflict(err) {
+			return nil, connect.NewError(connect.CodeAlreadyExists, err)
+		}
+		return nil, err
+	}
+
+	return connect.NewResponse(&adminv1.ImageServiceCreateResponse{
+		Image: convert(created),
+	}), nil
+}
+
+// Update implements adminv1.ImageServiceServer, the os and the version of an image can not be changed.
+func (i *imageAdminServiceServer) Update(ctx context.Context, rq *connect.Request[adminv1.ImageServiceUpdateRequest]) (*connect.Response[adminv1.ImageServiceUpdateResponse], error) {
+	i.log.Debug("update", "image", rq)
+	req := rq.Msg
+
+	old, err := i.ds.Image().Get(ctx, req.Id)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	newImage := *old
+
+	if req.Name != nil {
+		newImage.Name = *req.Name
+	}
+	if req.Description != nil {
+		newImage.Description = *req.Description
+	}
+	if req.Url != nil {
+		newImage.URL = *req.Url
+	}
+	if req.Features != nil {
+		features, err := toFeatures(req.Features)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		newImage.Features = features
+	}
+	if req.Classification != nil {
+		classification, err := toClassification(*req.Classification)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		newImage.Classification = classification
+	}
+	if req.ExpiresAt != nil {
+		newImage.ExpirationDate = req.ExpiresAt.AsTime()
+	}
+
+	err = validate(&newImage)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	err = i.ds.Image().Update(ctx, &newImage, old)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		if generic.IsConflict(err) {
+			return nil, connect.NewError(connect.CodeAborted, err)
+		}
+		return nil, err
+	}
+
+	return connect.NewResponse(&adminv1.ImageServiceUpdateResponse{
+		Image: convert(&newImage),
+	}), nil
+}
+
+// Delete implements adminv1.ImageServiceServer
+func (i *imageAdminServiceServer) Delete(ctx context.Context, rq *connect.Request[adminv1.ImageServiceDeleteRequest]) (*connect.Response[adminv1.ImageServiceDeleteResponse], error) {
+	i.log.Debug("delete", "image", rq)
+	req := rq.Msg
+
+	image, err := i.ds.Image().Get(ctx, req.Id)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	machines, err := i.ds.Machine().Search(ctx, machineQuery{image: image.ID})
+	if err != nil {
+		return nil, err
+	}
+	if len(machines) > 0 {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("image %s is still used by %d machines", image.ID, len(machines)))
+	}
+
+	err = i.ds.Image().Delete(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&adminv1.ImageServiceDeleteResponse{
+		Image: convert(image),
+	}), nil
+}
+
+// validate checks that the image can be downloaded and used.
+func validate(image *metal.Image) error {
+	parsed, err := url.Parse(image.URL)
+	if err != nil {
+		return fmt.Errorf("url of image %s is invalid: %w", image.ID, err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("url %q of image %s must use http or https", image.URL, image.ID)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("url %q of image %s has no host", image.URL, image.ID)
+	}
+
+	if len(image.Features) == 0 {
+		return fmt.Errorf("image %s must have at least one feature", image.ID)
+	}
+
+	err = metal.ValidateVersion(image.Version)
+	if err != nil {
+		return fmt.Errorf("image %s has an invalid version: %w", image.ID, err)
+	}
+	return nil
+}
+
+func toFeatures(features []apiv1.ImageFeature) ([]metal.ImageFeature, error) {
+	var result []metal.ImageFeature
+	for _, f := range features {
+		feature, err := toFeature(f)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, feature)
+	}
+	return result, nil
+}
+
+type machineQuery struct {
+	image string
+}
+
+func (q machineQuery) Predicates() []generic.Predicate {
+	return []generic.Predicate{generic.Eq("imageid", q.image)}
+}
@@ -0,0 +1,227 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+	"github.com/metal-stack/api/go/metalstack/api/v1/apiv1connect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type Config struct {
+	Log       *slog.Logger
+	Datastore *generic.Datastore
+}
+type imageServiceServer struct {
+	log *slog.Logger
+	ds  *generic.Datastore
+	now func() time.Time
+}
+
+func New(c Config) apiv1connect.ImageServiceHandler {
+	return &imageServiceServer{
+		log: c.Log.WithGroup("imageService"),
+		ds:  c.Datastore,
+		now: time.Now,
+	}
+}
+
+// Get implements v1.ImageServiceServer
+func (i *imageServiceServer) Get(ctx context.Context, rq *connect.Request[apiv1.ImageServiceGetRequest]) (*connect.Response[apiv1.ImageServiceGetResponse], error) {
+	i.log.Debug("get", "image", rq)
+	req := rq.Msg
+
+	resp, err := i.ds.Image().Get(ctx, req.Id)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	return connect.NewResponse(&apiv1.ImageServiceGetResponse{
+		Image: convert(resp),
+	}), nil
+}
+
+// List implements v1.ImageServiceServer
+func (i *imageServiceServer) List(ctx context.Context, rq *connect.Request[apiv1.ImageServiceListRequest]) (*connect.Response[apiv1.ImageServiceListResponse], error) {
+	i.log.Debug("list", "image", rq)
+	req := rq.Msg
+
+	q := query{os: req.Os}
+	if req.Feature != nil {
+		feature, err := toFeature(*req.Feature)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		q.feature = &feature
+	}
+	if req.Classification != nil {
+		classification, err := toClassification(*req.Classification)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		q.classification = &classification
+	}
+
+	resp, err := i.ds.Image().Search(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*apiv1.Image
+	for _, image := range resp {
+		res = append(res, convert(image))
+	}
+
+	return connect.NewResponse(&apiv1.ImageServiceListResponse{
+		Images: res,
+	}), nil
+}
+
+// Latest implements v1.ImageServiceServer, it resolves an os with an optional version prefix like ubuntu or
+// ubuntu-24.04 to the image with the highest version which is not expired.
+func (i *imageServiceServer) Latest(ctx context.Context, rq *connect.Request[apiv1.ImageServiceLatestRequest]) (*connect.Response[apiv1.ImageServiceLatestResponse], error) {
+	i.log.Debug("latest", "image", rq)
+	req := rq.Msg
+
+	os, versionPrefix := metal.ParseImageID(req.Os)
+	q := query{os: &os}
+	if req.Feature != nil {
+		feature, err := toFeature(*req.Feature)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		q.feature = &feature
+	}
+
+	resp, err := i.ds.Image().Search(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	latest, err := latestImage(resp, versionPrefix, i.now())
+	if err != nil {
+		return nil, err
+	}
+	if latest == nil {
+		return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("no image for os %q found", req.Os))
+	}
+
+	return connect.NewResponse(&apiv1.ImageServiceLatestResponse{
+		Image: convert(latest),
+	}), nil
+}
+
+// latestImage returns the image with the highest version which starts with the version prefix and is not expired.
+func latestImage(images []*metal.Image, versionPrefix string, now time.Time) (*metal.Image, error) {
+	var latest *metal.Image
+	for _, image := range images {
+		if image.Expired(now) || !metal.HasVersionPrefix(image.Version, versionPrefix) {
+			continue
+		}
+		if latest == nil {
+			latest = image
+			continue
+		}
+		c, err := metal.CompareVersions(image.Version, latest.Version)
+		if err != nil {
+			return nil, err
+		}
+		if c > 0 {
+			latest = image
+		}
+	}
+	return latest, nil
+}
+
+func convert(resp *metal.Image) *apiv1.Image {
+	classification := apiv1.ImageClassification_IMAGE_CLASSIFICATION_UNSPECIFIED
+	switch resp.Classification {
+	case metal.ClassificationPreview:
+		classification = apiv1.ImageClassification_IMAGE_CLASSIFICATION_PREVIEW
+	case metal.ClassificationSupported:
+		classification = apiv1.ImageClassification_IMAGE_CLASSIFICATION_SUPPORTED
+	case metal.ClassificationDeprecated:
+		classification = apiv1.ImageClassification_IMAGE_CLASSIFICATION_DEPRECATED
+	}
+
+	image := &apiv1.Image{
+		Id:             resp.ID,
+		Name:           resp.Name,
+		Description:    resp.Description,
+		Url:            resp.URL,
+		Os:             resp.OS,
+		Version:        resp.Version,
+		Classification: classification,
+		CreatedAt:      timestamppb.New(resp.Created),
+		UpdatedAt:      timestamppb.New(resp.Changed),
+	}
+	if !resp.ExpirationDate.IsZero() {
+		image.ExpiresAt = timestamppb.New(resp.ExpirationDate)
+	}
+	for _, feature := range resp.Features {
+		switch feature {
+		case metal.ImageFeatureMachine:
+			image.Features = append(image.Features, apiv1.ImageFeature_IMAGE_FEATURE_MACHINE)
+		case metal.ImageFeatureFirewall:
+			image.Features = append(image.Features, apiv1.ImageFeature_IMAGE_FEATURE_FIREWALL)
+		}
+	}
+	return image
+}
+
+func toFeature(feature apiv1.ImageFeature) (metal.ImageFeature, error) {
+	switch feature {
+	case apiv1.ImageFeature_IMAGE_FEATURE_MACHINE:
+		return metal.ImageFeatureMachine, nil
+	case apiv1.ImageFeature_IMAGE_FEATURE_FIREWALL:
+		return metal.ImageFeatureFirewall, nil
+	default:
+		return "", fmt.Errorf("image feature %s is not supported", feature)
+	}
+}
+
+func toClassification(classification apiv1.ImageClassification) (metal.ImageClassification, error) {
+	switch classification {
+	case apiv1.ImageClassification_IMAGE_CLASSIFICATION_PREVIEW:
+		return metal.ClassificationPreview, nil
+	case apiv1.ImageClassification_IMAGE_CLASSIFICATION_SUPPORTED:
+		return metal.ClassificationSupported, nil
+	case apiv1.ImageClassification_IMAGE_CLASSIFICATION_DEPRECATED:
+		return metal.ClassificationDeprecated, nil
+	default:
+		return "", fmt.Errorf("image classification %s is not supported", classification)
+	}
+}
+
+type query struct {
+	os             *string
+	feature        *metal.ImageFeature
+	classification *metal.ImageClassification
+}
+
+func (q query) Predicates() []generic.Predicate {
+	var predicates []generic.Predicate
+
+	if q.os != nil {
+		predicates = append(predicates, generic.Eq("os", *q.os))
+	}
+
+	if q.feature != nil {
+		predicates = append(predicates, generic.Contains("features", string(*q.feature)))
+	}
+
+	if q.classification != nil {
+		predicates = append(predicates, generic.Eq("classification", string(*q.classification)))
+	}
+
+	return predicates
+}
@@ -0,0 +1,158 @@
+package image
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	adminv1 "github.com/metal-stack/api/go/metalstack/admin/v1"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+	"github.com/metal-stack/metal-lib/pkg/pointer"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var now = time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)
+
+func Test_imageServiceServer_Latest(t *testing.T) {
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	for _, image := range []*metal.Image{
+		{Base: metal.Base{ID: "ubuntu-22.04.20240801"}, OS: "ubuntu", Version: "22.04.20240801", Features: []metal.ImageFeature{metal.ImageFeatureMachine}, ExpirationDate: now.Add(time.Hour)},
+		{Base: metal.Base{ID: "ubuntu-24.04.20240701"}, OS: "ubuntu", Version: "24.04.20240701", Features: []metal.ImageFeature{metal.ImageFeatureMachine}, ExpirationDate: now.Add(time.Hour)},
+		{Base: metal.Base{ID: "ubuntu-24.04.20240801"}, OS: "ubuntu", Version: "24.04.20240801", Features: []metal.ImageFeature{metal.ImageFeatureMachine}, ExpirationDate: now.Add(-time.Hour)},
+		{Base: metal.Base{ID: "ubuntu-24.10.20240801"}, OS: "ubuntu", Version: "24.10.20240801", Features: []metal.ImageFeature{metal.ImageFeatureFirewall}, ExpirationDate: now.Add(time.Hour)},
+		{Base: metal.Base{ID: "firewall-ubuntu-3.0.20240801"}, OS: "firewall-ubuntu", Version: "3.0.20240801", Features: []metal.ImageFeature{metal.ImageFeatureFirewall}, ExpirationDate: now.Add(time.Hour)},
+	} {
+		_, err := ds.Image().Create(ctx, image)
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		name           string
+		rq             *apiv1.ImageServiceLatestRequest
+		want           string
+		wantReturnCode connect.Code
+	}{
+		{
+			name: "os only",
+			rq:   &apiv1.ImageServiceLatestRequest{Os: "ubuntu"},
+			want: "ubuntu-24.10.20240801",
+		},
+		{
+			name: "os with feature",
+			rq:   &apiv1.ImageServiceLatestRequest{Os: "ubuntu", Feature: pointer.Pointer(apiv1.ImageFeature_IMAGE_FEATURE_MACHINE)},
+			want: "ubuntu-24.04.20240701",
+		},
+		{
+			name: "expired images are skipped",
+			rq:   &apiv1.ImageServiceLatestRequest{Os: "ubuntu-24.04"},
+			want: "ubuntu-24.04.20240701",
+		},
+		{
+			name:           "version prefix matches whole parts",
+			rq:             &apiv1.ImageServiceLatestRequest{Os: "ubuntu-24.1"},
+			wantReturnCode: connect.CodeNotFound,
+		},
+		{
+			name: "os with dash",
+			rq:   &apiv1.ImageServiceLatestRequest{Os: "firewall-ubuntu"},
+			want: "firewall-ubuntu-3.0.20240801",
+		},
+		{
+			name:           "unknown os",
+			rq:             &apiv1.ImageServiceLatestRequest{Os: "debian"},
+			wantReturnCode: connect.CodeNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := &imageServiceServer{log: log, ds: ds, now: func() time.Time { return now }}
+			got, err := i.Latest(ctx, connect.NewRequest(tt.rq))
+			if tt.wantReturnCode != 0 {
+				require.Error(t, err)
+				require.Equal(t, tt.wantReturnCode, connect.CodeOf(err))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got.Msg.Image.Id)
+		})
+	}
+}
+
+func Test_imageAdminServiceServer(t *testing.T) {
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	i := &imageAdminServiceServer{log: log, ds: ds, now: func() time.Time { return now }}
+
+	created, err := i.Create(ctx, connect.NewRequest(&adminv1.ImageServiceCreateRequest{Image: &apiv1.Image{
+		Id:       "debian-12.0.20240801",
+		Url:      "https://images.metal-stack.io/debian/12.0/20240801/img.tar.lz4",
+		Features: []apiv1.ImageFeature{apiv1.ImageFeature_IMAGE_FEATURE_MACHINE},
+	}}))
+	require.NoError(t, err)
+	require.Equal(t, "debian", created.Msg.Image.Os)
+	require.Equal(t, "12.0.20240801", created.Msg.Image.Version)
+	require.Equal(t, apiv1.ImageClassification_IMAGE_CLASSIFICATION_PREVIEW, created.Msg.Image.Classification)
+	require.Equal(t, now.Add(DefaultExpiration), created.Msg.Image.ExpiresAt.AsTime())
+
+	tests := []struct {
+		name  string
+		image *apiv1.Image
+	}{
+		{
+			name:  "without version",
+			image: &apiv1.Image{Id: "debian", Url: "https://images.metal-stack.io/debian.tar.lz4", Features: []apiv1.ImageFeature{apiv1.ImageFeature_IMAGE_FEATURE_MACHINE}},
+		},
+		{
+			name:  "invalid version",
+			image: &apiv1.Image{Id: "debian-12.0-rc1", Url: "https://images.metal-stack.io/debian.tar.lz4", Features: []apiv1.ImageFeature{apiv1.ImageFeature_IMAGE_FEATURE_MACHINE}},
+		},
+		{
+			name:  "relative url",
+			image: &apiv1.Image{Id: "debian-12.1", Url: "debian.tar.lz4", Features: []apiv1.ImageFeature{apiv1.ImageFeature_IMAGE_FEATURE_MACHINE}},
+		},
+		{
+			name:  "without features",
+			image: &apiv1.Image{Id: "debian-12.1", Url: "https://images.metal-stack.io/debian.tar.lz4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := i.Create(ctx, connect.NewRequest(&adminv1.ImageServiceCreateRequest{Image: tt.image}))
+			require.Error(t, err)
+			require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+		})
+	}
+
+	updated, err := i.Update(ctx, connect.NewRequest(&adminv1.ImageServiceUpdateRequest{
+		Id:             "debian-12.0.20240801",
+		Classification: pointer.Pointer(apiv1.ImageClassification_IMAGE_CLASSIFICATION_DEPRECATED),
+		ExpiresAt:      timestamppb.New(now.Add(time.Hour)),
+	}))
+	require.NoError(t, err)
+	require.Equal(t, apiv1.ImageClassification_IMAGE_CLASSIFICATION_DEPRECATED, updated.Msg.Image.Classification)
+	require.Equal(t, now.Add(time.Hour), updated.Msg.Image.ExpiresAt.AsTime())
+
+	_, err = ds.Machine().Create(ctx, &metal.Machine{Base: metal.Base{ID: "m1"}, ProjectID: "p1", ImageID: "debian-12.0.20240801"})
+	require.NoError(t, err)
+	_, err = i.Delete(ctx, connect.NewRequest(&adminv1.ImageServiceDeleteRequest{Id: "debian-12.0.20240801"}))
+	require.Error(t, err)
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	require.NoError(t, ds.Machine().Delete(ctx, &metal.Machine{Base: metal.Base{ID: "m1"}}))
+	_, err = i.Delete(ctx, connect.NewRequest(&adminv1.ImageServiceDeleteRequest{Id: "debian-12.0.20240801"}))
+	require.NoError(t, err)
+}
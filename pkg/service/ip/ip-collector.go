@@ -0,0 +1,330 @@
+package ip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/metal-stack/api-server/pkg/actor"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	putil "github.com/metal-stack/api-server/pkg/project"
+	mdcv1 "github.com/metal-stack/masterdata-api/api/v1"
+	mdc "github.com/metal-stack/masterdata-api/pkg/client"
+	"github.com/metal-stack/metal-lib/auditing"
+	"github.com/metal-stack/metal-lib/pkg/tag"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// DefaultCollectGracePeriod is the time an ephemeral ip must not be attached to a machine before it is collected
+	DefaultCollectGracePeriod = 24 * time.Hour
+	defaultCollectInterval    = time.Hour
+
+	// collectorActor is recorded in the history of the collected ips
+	collectorActor = "ephemeral-ip-collector"
+)
+
+var collectedIPs = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "api_server",
+	Subsystem: "ip_collector",
+	Name:      "collected_total",
+	Help:      "the number of ephemeral ips which were released because they were not attached to a machine, in dry-run mode the ones which would have been released",
+}, []string{"dry_run"})
+
+var collectFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "api_server",
+	Subsystem: "ip_collector",
+	Name:      "failures_total",
+	Help:      "the number of ephemeral ips which could not be released",
+})
+
+var optedOutIPs = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "api_server",
+	Subsystem: "ip_collector",
+	Name:      "opted_out",
+	Help:      "the number of ephemeral ips which were not collected in the last run because their project opted out",
+})
+
+type (
+	CollectorConfig struct {
+		Log          *slog.Logger
+		Datastore    *generic.Datastore
+		Outbox       *generic.Outbox
+		MasterClient mdc.Client
+		// Auditing receives an event for every collected ip, it is optional
+		Auditing auditing.Auditing
+		// GracePeriod an ephemeral ip must not be attached to a machine before it is collected, defaults to one day
+		GracePeriod time.Duration
+		// Interval in which ephemeral ips are collected, defaults to one hour
+		Interval time.Duration
+		// DryRun only reports the ips which would be collected without releasing them,
+		// the time since which ips are detached is recorded nevertheless
+		DryRun bool
+	}
+
+	// Collector releases ephemeral ips which are not attached to a machine anymore.
+	// An ip is attached if it carries the machine tag of an existing machine. The collector records when it finds an ip
+	// detached for the first time and collects it once it stayed detached for the grace period. Projects which carry
+	// the opt-out label keep their ips.
+	Collector struct {
+		log          *slog.Logger
+		ds           *generic.Datastore
+		outbox       *generic.Outbox
+		masterClient mdc.Client
+		audit        auditing.Auditing
+		gracePeriod  time.Duration
+		interval     time.Duration
+		dryRun       bool
+		now          func() time.Time
+	}
+
+	// CollectResult is the outcome of a single collection.
+	CollectResult struct {
+		// Collected contains the released ips, in dry-run mode the ones which would have been released
+		Collected []string
+		// OptedOut contains the ips which would have been collected if their project had not opted out
+		OptedOut []string
+	}
+)
+
+func NewCollector(c CollectorConfig) *Collector {
+	gracePeriod := DefaultCollectGracePeriod
+	if c.GracePeriod > 0 {
+		gracePeriod = c.GracePeriod
+	}
+	interval := defaultCollectInterval
+	if c.Interval > 0 {
+		interval = c.Interval
+	}
+	return &Collector{
+		log:          c.Log.WithGroup("ipCollector"),
+		ds:           c.Datastore,
+		outbox:       c.Outbox,
+		masterClient: c.MasterClient,
+		audit:        c.Auditing,
+		gracePeriod:  gracePeriod,
+		interval:     interval,
+		dryRun:       c.DryRun,
+		now:          time.Now,
+	}
+}
+
+// Collect releases all ephemeral ips which were detached longer than the grace period in ipam and the datastore.
+// Ips which are found detached for the first time are marked, the grace period starts with this collection.
+func (c *Collector) Collect(ctx context.Context) (*CollectResult, error) {
+	ctx = actor.ContextWithActor(ctx, collectorActor)
+
+	ips, err := c.ds.IP().Search(ctx, ephemeralQuery{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list ephemeral ips: %w", err)
+	}
+
+	var (
+		result   = &CollectResult{}
+		errs     []error
+		optedOut = map[string]bool{}
+		now      = c.now()
+		deadline = now.Add(-c.gracePeriod)
+	)
+	for _, ip := range ips {
+		// reservations are released once they expire
+		if ip.Reserved() {
+			continue
+		}
+
+		attached, err := c.attached(ctx, ip)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if attached {
+			if ip.DetachedSince != nil {
+				err = c.markDetached(ctx, ip, nil)
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}
+			continue
+		}
+
+		if ip.DetachedSince == nil {
+			err = c.markDetached(ctx, ip, &now)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if ip.DetachedSince.After(deadline) {
+			continue
+		}
+
+		out, ok := optedOut[ip.ProjectID]
+		if !ok {
+			out, err = c.optedOut(ctx, ip.ProjectID)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			optedOut[ip.ProjectID] = out
+		}
+		if out {
+			result.OptedOut = append(result.OptedOut, ip.IPAddress)
+			continue
+		}
+
+		if c.dryRun {
+			c.log.Info("would collect ephemeral ip", "ip", ip.IPAddress, "project", ip.ProjectID, "detached-since", ip.DetachedSince)
+			result.Collected = append(result.Collected, ip.IPAddress)
+			continue
+		}
+
+		released, err := c.release(ctx, ip)
+		if err != nil {
+			collectFailures.Inc()
+			errs = append(errs, err)
+			continue
+		}
+		if released {
+			result.Collected = append(result.Collected, ip.IPAddress)
+		}
+	}
+
+	collectedIPs.WithLabelValues(strconv.FormatBool(c.dryRun)).Add(float64(len(result.Collected)))
+	optedOutIPs.Set(float64(len(result.OptedOut)))
+
+	return result, errors.Join(errs...)
+}
+
+// Run collects ephemeral ips in the configured interval until the context is done.
+func (c *Collector) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		result, err := c.Collect(ctx)
+		if err != nil {
+			c.log.Error("unable to collect ephemeral ips", "error", err)
+		}
+		if result != nil && len(result.Collected) > 0 {
+			c.log.Info("collected ephemeral ips", "count", len(result.Collected), "dry-run", c.dryRun)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			c.log.Info("stop collecting ephemeral ips")
+			return
+		}
+	}
+}
+
+// attached returns true if the ip carries the tag of a machine which still exists.
+func (c *Collector) attached(ctx context.Context, ip *metal.IP) (bool, error) {
+	machineID, ok := tag.NewTagMap(ip.Tags).Value(tag.MachineID)
+	if !ok {
+		return false, nil
+	}
+	_, err := c.ds.Machine().Get(ctx, machineID)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to get machine %q of ip %q: %w", machineID, ip.IPAddress, err)
+	}
+	return true, nil
+}
+
+// optedOut returns true if the project carries the opt-out label, the ips of a project which does not exist anymore are collected.
+func (c *Collector) optedOut(ctx context.Context, projectID string) (bool, error) {
+	if projectID == "" {
+		return false, nil
+	}
+	resp, err := c.masterClient.Project().Get(ctx, &mdcv1.ProjectGetRequest{Id: projectID})
+	if err != nil {
+		if mdcv1.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to get project %q: %w", projectID, err)
+	}
+	return putil.IsEphemeralIPCollectionDisabled(resp.GetProject()), nil
+}
+
+// markDetached records the time since which the ip is not attached to a machine, nil clears it.
+// An ip which was changed since it was listed is left to the next collection.
+func (c *Collector) markDetached(ctx context.Context, ip *metal.IP, since *time.Time) error {
+	updated := *ip
+	updated.DetachedSince = since
+	err := c.ds.IP().Update(ctx, &updated, ip)
+	if err != nil && !generic.IsConflict(err) && !generic.IsNotFound(err) {
+		return fmt.Errorf("unable to update detached time of ip %q: %w", ip.IPAddress, err)
+	}
+	return nil
+}
+
+// release deletes the ip in the datastore and releases it in ipam like a deletion by the user.
+// The ip is deleted by an update which fails if the ip was changed since it was listed, e.g. because it was
+// attached to a machine meanwhile. It returns false in this case or if the ip was deleted already.
+func (c *Collector) release(ctx context.Context, ip *metal.IP) (bool, error) {
+	op, err := c.outbox.Enqueue(ctx, releaseIPOperation(ip), releaseGracePeriod)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	deleted := *ip
+	deleted.Deleted = &now
+	err = c.ds.IP().Update(ctx, &deleted, ip)
+	if err != nil {
+		if completeErr := c.outbox.Complete(context.WithoutCancel(ctx), op); completeErr != nil {
+			c.log.Error("unable to remove pending release operation", "ip", ip.IPAddress, "error", completeErr)
+		}
+		if generic.IsConflict(err) || generic.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to delete ip %q: %w", ip.IPAddress, err)
+	}
+
+	err = c.outbox.Execute(ctx, op)
+	if err != nil {
+		c.log.Warn("unable to release ip in ipam, will be retried", "ip", ip.IPAddress, "error", err)
+	}
+
+	c.log.Info("collected ephemeral ip", "ip", ip.IPAddress, "project", ip.ProjectID, "detached-since", ip.DetachedSince)
+	c.auditRelease(ip)
+	return true, nil
+}
+
+func (c *Collector) auditRelease(ip *metal.IP) {
+	if c.audit == nil {
+		return
+	}
+	err := c.audit.Index(auditing.Entry{
+		Type:    auditing.EntryTypeEvent,
+		Phase:   auditing.EntryPhaseSingle,
+		User:    collectorActor,
+		Project: ip.ProjectID,
+		Path:    "ip/collect",
+		Body: map[string]any{
+			"ip":             ip.IPAddress,
+			"allocationuuid": ip.AllocationUUID,
+			"network":        ip.NetworkID,
+			"prefix":         ip.ParentPrefixCidr,
+			"detached_since": ip.DetachedSince,
+			"grace_period":   c.gracePeriod.String(),
+		},
+	})
+	if err != nil {
+		c.log.Error("unable to audit collected ip", "ip", ip.IPAddress, "error", err)
+	}
+}
+
+type ephemeralQuery struct{}
+
+func (ephemeralQuery) Predicates() []generic.Predicate {
+	return []generic.Predicate{generic.Eq("type", string(metal.Ephemeral))}
+}
@@ -0,0 +1,152 @@
+package ip
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	putil "github.com/metal-stack/api-server/pkg/project"
+	"github.com/metal-stack/api-server/pkg/test"
+	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
+	mdmv1 "github.com/metal-stack/masterdata-api/api/v1"
+	mdmv1mock "github.com/metal-stack/masterdata-api/api/v1/mocks"
+	mdc "github.com/metal-stack/masterdata-api/pkg/client"
+	"github.com/metal-stack/metal-lib/auditing"
+	"github.com/metal-stack/metal-lib/pkg/tag"
+	tmock "github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type auditingMock struct {
+	auditing.Auditing
+	entries []auditing.Entry
+}
+
+func (a *auditingMock) Index(e auditing.Entry) error {
+	a.entries = append(a.entries, e)
+	return nil
+}
+
+func Test_Collector_Collect(t *testing.T) {
+	ipam := test.StartIpam(t)
+
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	prefixes := map[string][]string{
+		"1.2.3.0/24": {"1.2.3.1", "1.2.3.2", "1.2.3.3", "1.2.3.4", "1.2.3.5", "1.2.3.6"},
+	}
+	createIPs(t, ctx, ds, ipam, prefixes, []*metal.IP{
+		{IPAddress: "1.2.3.1", ProjectID: "p1", Type: metal.Ephemeral, ParentPrefixCidr: "1.2.3.0/24"},
+		{IPAddress: "1.2.3.2", ProjectID: "p1", Type: metal.Ephemeral, ParentPrefixCidr: "1.2.3.0/24", Tags: []string{tag.New(tag.MachineID, "m1")}},
+		{IPAddress: "1.2.3.3", ProjectID: "p1", Type: metal.Ephemeral, ParentPrefixCidr: "1.2.3.0/24", Tags: []string{tag.New(tag.MachineID, "m2")}},
+		{IPAddress: "1.2.3.4", ProjectID: "p1", Type: metal.Static, ParentPrefixCidr: "1.2.3.0/24"},
+		{IPAddress: "1.2.3.5", ProjectID: "p2", Type: metal.Ephemeral, ParentPrefixCidr: "1.2.3.0/24"},
+		{IPAddress: "1.2.3.6", ProjectID: "p3", Type: metal.Ephemeral, ParentPrefixCidr: "1.2.3.0/24"},
+	})
+	_, err = ds.Machine().Create(ctx, &metal.Machine{Base: metal.Base{ID: "m1"}})
+	require.NoError(t, err)
+
+	psc := mdmv1mock.NewProjectServiceClient(t)
+	psc.On("Get", tmock.Anything, &mdmv1.ProjectGetRequest{Id: "p1"}).Return(&mdmv1.ProjectResponse{Project: &mdmv1.Project{Meta: &mdmv1.Meta{Id: "p1"}}}, nil)
+	psc.On("Get", tmock.Anything, &mdmv1.ProjectGetRequest{Id: "p2"}).Return(&mdmv1.ProjectResponse{Project: &mdmv1.Project{Meta: &mdmv1.Meta{Id: "p2", Labels: []string{putil.EphemeralIPCollectionOptOutLabel}}}}, nil)
+	psc.On("Get", tmock.Anything, &mdmv1.ProjectGetRequest{Id: "p3"}).Return(nil, status.Error(codes.NotFound, "project p3 not found"))
+
+	audit := &auditingMock{}
+	newCollector := func(dryRun bool, now time.Time) *Collector {
+		c := NewCollector(CollectorConfig{
+			Log:          log,
+			Datastore:    ds,
+			Outbox:       newOutbox(log, ds, ipam),
+			MasterClient: mdc.NewMock(psc, nil, nil, nil),
+			Auditing:     audit,
+			GracePeriod:  time.Hour,
+			DryRun:       dryRun,
+		})
+		c.now = func() time.Time { return now }
+		return c
+	}
+
+	acquiredIPs := func() uint64 {
+		usage, err := ipam.PrefixUsage(ctx, connect.NewRequest(&ipamv1.PrefixUsageRequest{Cidr: "1.2.3.0/24"}))
+		require.NoError(t, err)
+		return usage.Msg.AcquiredIps
+	}
+	existingIPs := func() []string {
+		ips, err := ds.IP().List(ctx)
+		require.NoError(t, err)
+		var addresses []string
+		for _, ip := range ips {
+			addresses = append(addresses, ip.IPAddress)
+		}
+		return addresses
+	}
+
+	detachedSince := func(address string) *time.Time {
+		ip, err := ds.IP().Get(ctx, address)
+		require.NoError(t, err)
+		return ip.DetachedSince
+	}
+
+	t.Run("detached ips are marked first", func(t *testing.T) {
+		got, err := newCollector(false, time.Now()).Collect(ctx)
+		require.NoError(t, err)
+		require.Empty(t, got.Collected)
+		require.Empty(t, got.OptedOut)
+		require.Len(t, existingIPs(), 6)
+		require.NotNil(t, detachedSince("1.2.3.1"))
+		require.NotNil(t, detachedSince("1.2.3.3"))
+		require.Nil(t, detachedSince("1.2.3.2"))
+	})
+
+	t.Run("ips within the grace period are kept", func(t *testing.T) {
+		got, err := newCollector(false, time.Now().Add(30*time.Minute)).Collect(ctx)
+		require.NoError(t, err)
+		require.Empty(t, got.Collected)
+		require.Len(t, existingIPs(), 6)
+	})
+
+	t.Run("dry run does not release any ip", func(t *testing.T) {
+		got, err := newCollector(true, time.Now().Add(2*time.Hour)).Collect(ctx)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"1.2.3.1", "1.2.3.3", "1.2.3.6"}, got.Collected)
+		require.Equal(t, []string{"1.2.3.5"}, got.OptedOut)
+		require.Len(t, existingIPs(), 6)
+		require.Equal(t, uint64(6), acquiredIPs())
+		require.Empty(t, audit.entries)
+	})
+
+	t.Run("attached ips are unmarked", func(t *testing.T) {
+		_, err := ds.Machine().Create(ctx, &metal.Machine{Base: metal.Base{ID: "m2"}})
+		require.NoError(t, err)
+
+		got, err := newCollector(true, time.Now().Add(2*time.Hour)).Collect(ctx)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"1.2.3.1", "1.2.3.6"}, got.Collected)
+		require.Nil(t, detachedSince("1.2.3.3"))
+	})
+
+	t.Run("detached ips are released", func(t *testing.T) {
+		got, err := newCollector(false, time.Now().Add(2*time.Hour)).Collect(ctx)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"1.2.3.1", "1.2.3.6"}, got.Collected)
+		require.Equal(t, []string{"1.2.3.5"}, got.OptedOut)
+		require.ElementsMatch(t, []string{"1.2.3.2", "1.2.3.3", "1.2.3.4", "1.2.3.5"}, existingIPs())
+		require.Equal(t, uint64(4), acquiredIPs())
+
+		require.Len(t, audit.entries, 2)
+		for _, e := range audit.entries {
+			require.Equal(t, auditing.EntryTypeEvent, e.Type)
+			require.Equal(t, collectorActor, e.User)
+		}
+	})
+}
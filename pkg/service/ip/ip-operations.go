@@ -0,0 +1,121 @@
+package ip
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/google/uuid"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
+	ipamv1connect "github.com/metal-stack/go-ipam/api/v1/apiv1connect"
+)
+
+// releaseGracePeriod is the time a pending release operation is not touched by the outbox worker,
+// the request which enqueued it should have finished its datastore modification by then.
+const releaseGracePeriod = time.Minute
+
+// ReleaseIPHandler returns the handler which releases an ip in ipam if it is not present in the datastore anymore.
+// If the ip is still present, the datastore modification which enqueued the operation never happened
+// or the ip was already acquired again, in both cases ipam must not be touched. The allocation uuid of the
+// stored ip is therefore irrelevant, the operation does not carry it.
+func ReleaseIPHandler(ds *generic.Datastore, ipam ipamv1connect.IpamServiceClient) generic.OperationHandler {
+	return func(ctx context.Context, op *metal.Operation) error {
+		var (
+			ip     = op.Payload[metal.OperationPayloadIP]
+			prefix = op.Payload[metal.OperationPayloadPrefix]
+		)
+
+		_, err := ds.IP().Get(ctx, ip)
+		if err == nil {
+			return nil
+		}
+		if !generic.IsNotFound(err) {
+			return err
+		}
+
+		return releaseIP(ctx, ipam, ip, prefix)
+	}
+}
+
+// ExpireIPReservationHandler returns the handler which removes a reserved ip from the datastore and releases it in ipam
+// once its reservation expired. Ips which were confirmed, deleted or allocated again in the meantime are left untouched,
+// a deleted ip is released by the release operation of its deletion.
+// The ip is deleted by an update which conflicts with a concurrent confirmation, it is released in ipam only after that.
+// If the release fails, it is handed over to a release operation because the ip is not present in the datastore anymore
+// and a retry of this operation would not release it.
+func ExpireIPReservationHandler(ds *generic.Datastore, ipam ipamv1connect.IpamServiceClient) generic.OperationHandler {
+	return func(ctx context.Context, op *metal.Operation) error {
+		var (
+			ip     = op.Payload[metal.OperationPayloadIP]
+			prefix = op.Payload[metal.OperationPayloadPrefix]
+		)
+
+		reserved, err := ds.IP().Get(ctx, ip)
+		if err != nil {
+			if generic.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		if reserved.AllocationUUID != op.Payload[metal.OperationPayloadAllocationUUID] || !reserved.Reserved() {
+			return nil
+		}
+		if reserved.ReservedUntil.After(time.Now()) {
+			return fmt.Errorf("reservation of ip %q does not expire before %s", ip, reserved.ReservedUntil)
+		}
+
+		now := time.Now()
+		expired := *reserved
+		expired.Deleted = &now
+		err = ds.IP().Update(ctx, &expired, reserved)
+		if err != nil {
+			return fmt.Errorf("unable to delete expired reservation of ip %q: %w", ip, err)
+		}
+
+		err = releaseIP(ctx, ipam, ip, prefix)
+		if err == nil {
+			return nil
+		}
+
+		release := releaseIPOperation(reserved)
+		release.ID = uuid.NewString()
+		release.NextAttempt = time.Now()
+		release.LastError = err.Error()
+		_, err = ds.Operation().Create(ctx, release)
+		if err != nil {
+			return fmt.Errorf("unable to store release of expired reservation of ip %q: %w", ip, err)
+		}
+		return nil
+	}
+}
+
+// releaseIP releases the ip in ipam, an ip which is not acquired anymore is ignored.
+func releaseIP(ctx context.Context, ipam ipamv1connect.IpamServiceClient, ip, prefix string) error {
+	_, err := ipam.ReleaseIP(ctx, connect.NewRequest(&ipamv1.ReleaseIPRequest{Ip: ip, PrefixCidr: prefix}))
+	if err != nil && connect.CodeOf(err) != connect.CodeNotFound {
+		return fmt.Errorf("unable to release ip %q in prefix %q: %w", ip, prefix, err)
+	}
+	return nil
+}
+
+// releaseIPOperation carries no allocation uuid, the ip must not be released while any ip with its address is present.
+func releaseIPOperation(ip *metal.IP) *metal.Operation {
+	return &metal.Operation{
+		Type: metal.OperationReleaseIP,
+		Payload: map[string]string{
+			metal.OperationPayloadIP:     ip.IPAddress,
+			metal.OperationPayloadPrefix: ip.ParentPrefixCidr,
+		},
+	}
+}
+
+// expireIPReservationOperation carries the allocation uuid to expire only the reservation it was enqueued for.
+func expireIPReservationOperation(ip *metal.IP) *metal.Operation {
+	op := releaseIPOperation(ip)
+	op.Type = metal.OperationExpireIPReservation
+	op.Payload[metal.OperationPayloadAllocationUUID] = ip.AllocationUUID
+	return op
+}
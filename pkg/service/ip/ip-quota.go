@@ -0,0 +1,160 @@
+package ip
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"connectrpc.com/connect"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	putil "github.com/metal-stack/api-server/pkg/project"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+	mdcv1 "github.com/metal-stack/masterdata-api/api/v1"
+)
+
+// quotaTypes are the ip types which are limited by quotas.
+var quotaTypes = []metal.IPType{metal.Static, metal.Ephemeral}
+
+// Quota implements v1.IPServiceServer
+func (i *ipServiceServer) Quota(ctx context.Context, rq *connect.Request[apiv1.IPServiceQuotaRequest]) (*connect.Response[apiv1.IPServiceQuotaResponse], error) {
+	i.log.Debug("quota", "ip", rq)
+	req := rq.Msg
+
+	p, err := i.project(ctx, req.Project)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := i.ds.IP().Search(ctx, quotaQuery{project: req.Project})
+	if err != nil {
+		return nil, err
+	}
+
+	used := map[string]map[metal.IPType]uint64{}
+	for _, ip := range ips {
+		if used[ip.NetworkID] == nil {
+			used[ip.NetworkID] = map[metal.IPType]uint64{}
+		}
+		used[ip.NetworkID][ip.Type]++
+	}
+	// networks without ips are only shown if the project has a quota for them
+	for _, network := range annotatedNetworks(p) {
+		if used[network] == nil {
+			used[network] = map[metal.IPType]uint64{}
+		}
+	}
+
+	var quotas []*apiv1.IPQuota
+	for network, usage := range used {
+		for _, ipType := range quotaTypes {
+			limit, err := i.quota(p, network, ipType)
+			if err != nil {
+				return nil, err
+			}
+			quotas = append(quotas, &apiv1.IPQuota{
+				Network: network,
+				Type:    convertType(ipType),
+				Used:    usage[ipType],
+				Max:     limit,
+			})
+		}
+	}
+	slices.SortStableFunc(quotas, func(a, b *apiv1.IPQuota) int {
+		return strings.Compare(a.Network, b.Network)
+	})
+
+	return connect.NewResponse(&apiv1.IPServiceQuotaResponse{Quotas: quotas}), nil
+}
+
+// checkQuota returns CodeResourceExhausted if the project holds more ips of the type in the network than its quota allows
+// after the given number of ips were added.
+func (i *ipServiceServer) checkQuota(ctx context.Context, project, network string, ipType metal.IPType, additional int) error {
+	p, err := i.project(ctx, project)
+	if err != nil {
+		return err
+	}
+	limit, err := i.quota(p, network, ipType)
+	if err != nil {
+		return err
+	}
+	if limit == nil {
+		return nil
+	}
+
+	ips, err := i.ds.IP().Search(ctx, quotaQuery{project: project, network: network, ipType: ipType})
+	if err != nil {
+		return err
+	}
+	if uint64(len(ips)+additional) > *limit {
+		return connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("project %q exceeds its quota of %d %s ips in network %q", project, *limit, ipType, network))
+	}
+	return nil
+}
+
+// quota returns the number of ips of the type the project can allocate in the network, nil if it is unlimited.
+// The quota of the network takes precedence over the quota of the project for every network, which takes precedence over the default.
+func (i *ipServiceServer) quota(p *mdcv1.Project, network string, ipType metal.IPType) (*uint64, error) {
+	annotations := p.GetMeta().GetAnnotations()
+	for _, annotation := range []string{putil.IPQuotaAnnotation(string(ipType), network), putil.IPQuotaAnnotation(string(ipType), "")} {
+		value, ok := annotations[annotation]
+		if !ok {
+			continue
+		}
+		limit, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("invalid quota %s=%q of project %q: %w", annotation, value, p.GetMeta().GetId(), err))
+		}
+		return &limit, nil
+	}
+
+	if limit, ok := i.defaultQuotas[ipType]; ok {
+		return &limit, nil
+	}
+	return nil, nil
+}
+
+func (i *ipServiceServer) project(ctx context.Context, id string) (*mdcv1.Project, error) {
+	resp, err := i.masterClient.Project().Get(ctx, &mdcv1.ProjectGetRequest{Id: id})
+	if err != nil {
+		if mdcv1.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("project %q not found", id))
+		}
+		return nil, fmt.Errorf("unable to get project %q: %w", id, err)
+	}
+	return resp.GetProject(), nil
+}
+
+// annotatedNetworks returns the networks the project has a dedicated quota for.
+func annotatedNetworks(p *mdcv1.Project) []string {
+	var networks []string
+	for annotation := range p.GetMeta().GetAnnotations() {
+		for _, ipType := range quotaTypes {
+			network, ok := strings.CutPrefix(annotation, putil.IPQuotaAnnotation(string(ipType), "")+".")
+			if ok && !slices.Contains(networks, network) {
+				networks = append(networks, network)
+			}
+		}
+	}
+	return networks
+}
+
+// quotaQuery selects all ips of a project which count against its quotas, machine ips included.
+type quotaQuery struct {
+	project string
+	network string
+	ipType  metal.IPType
+}
+
+func (q quotaQuery) Predicates() []generic.Predicate {
+	predicates := []generic.Predicate{generic.Eq("projectid", q.project)}
+	if q.network != "" {
+		predicates = append(predicates, generic.Eq("networkid", q.network))
+	}
+	if q.ipType != "" {
+		predicates = append(predicates, generic.Eq("type", string(q.ipType)))
+	}
+	return predicates
+}
@@ -0,0 +1,132 @@
+package ip
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/google/go-cmp/cmp"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	putil "github.com/metal-stack/api-server/pkg/project"
+	"github.com/metal-stack/api-server/pkg/test"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
+	mdmv1 "github.com/metal-stack/masterdata-api/api/v1"
+	"github.com/metal-stack/metal-lib/pkg/pointer"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func Test_ipServiceServer_Quota(t *testing.T) {
+	ipam := test.StartIpam(t)
+
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	createIPs(t, ctx, ds, ipam, map[string][]string{"1.2.3.0/24": nil, "2.3.4.0/24": nil}, nil)
+	createNetworks(t, ctx, ds, []*metal.Network{
+		{Base: metal.Base{ID: "n1"}, Prefixes: metal.Prefixes{{IP: "1.2.3.0", Length: "24"}}},
+		{Base: metal.Base{ID: "n2"}, Prefixes: metal.Prefixes{{IP: "2.3.4.0", Length: "24"}}},
+	})
+
+	i := &ipServiceServer{
+		log:    log,
+		ds:     ds,
+		ipam:   ipam,
+		outbox: newOutbox(log, ds, ipam),
+		masterClient: newMasterClient(t,
+			&mdmv1.Project{Meta: &mdmv1.Meta{Id: "p1", Annotations: map[string]string{
+				putil.IPQuotaAnnotation(string(metal.Static), ""):      "1",
+				putil.IPQuotaAnnotation(string(metal.Ephemeral), "n1"): "2",
+				putil.IPQuotaAnnotation(string(metal.Ephemeral), "n3"): "0",
+			}}},
+			&mdmv1.Project{Meta: &mdmv1.Meta{Id: "p2", Annotations: map[string]string{
+				putil.IPQuotaAnnotation(string(metal.Static), ""): "many",
+			}}},
+		),
+		defaultQuotas: map[metal.IPType]uint64{metal.Ephemeral: 5},
+	}
+
+	acquiredIPs := func() uint64 {
+		usage, err := ipam.PrefixUsage(ctx, connect.NewRequest(&ipamv1.PrefixUsageRequest{Cidr: "1.2.3.0/24"}))
+		require.NoError(t, err)
+		return usage.Msg.AcquiredIps
+	}
+	allocate := func(network string, ipType apiv1.IPType) (*apiv1.IP, error) {
+		got, err := i.Allocate(ctx, connect.NewRequest(&apiv1.IPServiceAllocateRequest{Project: "p1", Network: network, Type: ipType.Enum()}))
+		if err != nil {
+			return nil, err
+		}
+		return got.Msg.Ip, nil
+	}
+
+	t.Run("quota of the project applies to every network", func(t *testing.T) {
+		_, err := allocate("n1", apiv1.IPType_IP_TYPE_STATIC)
+		require.NoError(t, err)
+
+		before := acquiredIPs()
+		_, err = allocate("n1", apiv1.IPType_IP_TYPE_STATIC)
+		require.Error(t, err)
+		require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+		// the ip is not acquired in ipam if the quota is already exhausted
+		require.Equal(t, before, acquiredIPs())
+	})
+
+	t.Run("quota of the network takes precedence", func(t *testing.T) {
+		for range 2 {
+			_, err := allocate("n1", apiv1.IPType_IP_TYPE_EPHEMERAL)
+			require.NoError(t, err)
+		}
+		_, err := allocate("n1", apiv1.IPType_IP_TYPE_EPHEMERAL)
+		require.Error(t, err)
+		require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+	})
+
+	t.Run("default quota applies without annotation", func(t *testing.T) {
+		for range 5 {
+			_, err := allocate("n2", apiv1.IPType_IP_TYPE_EPHEMERAL)
+			require.NoError(t, err)
+		}
+		_, err := allocate("n2", apiv1.IPType_IP_TYPE_EPHEMERAL)
+		require.Error(t, err)
+		require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+	})
+
+	t.Run("type can not be changed beyond the quota", func(t *testing.T) {
+		ips, err := ds.IP().Search(ctx, quotaQuery{project: "p1", network: "n1", ipType: metal.Ephemeral})
+		require.NoError(t, err)
+		require.NotEmpty(t, ips)
+
+		_, err = i.Update(ctx, connect.NewRequest(&apiv1.IPServiceUpdateRequest{Ip: ips[0].IPAddress, Project: "p1", Type: apiv1.IPType_IP_TYPE_STATIC.Enum()}))
+		require.Error(t, err)
+		require.Equal(t, connect.CodeResourceExhausted, connect.CodeOf(err))
+	})
+
+	t.Run("invalid quota annotation", func(t *testing.T) {
+		_, err := i.Allocate(ctx, connect.NewRequest(&apiv1.IPServiceAllocateRequest{Project: "p2", Network: "n1", Type: apiv1.IPType_IP_TYPE_STATIC.Enum()}))
+		require.Error(t, err)
+		require.Equal(t, connect.CodeInternal, connect.CodeOf(err))
+	})
+
+	t.Run("usage of the project", func(t *testing.T) {
+		got, err := i.Quota(ctx, connect.NewRequest(&apiv1.IPServiceQuotaRequest{Project: "p1"}))
+		require.NoError(t, err)
+
+		want := []*apiv1.IPQuota{
+			{Network: "n1", Type: apiv1.IPType_IP_TYPE_STATIC, Used: 1, Max: pointer.Pointer(uint64(1))},
+			{Network: "n1", Type: apiv1.IPType_IP_TYPE_EPHEMERAL, Used: 2, Max: pointer.Pointer(uint64(2))},
+			{Network: "n2", Type: apiv1.IPType_IP_TYPE_STATIC, Used: 0, Max: pointer.Pointer(uint64(1))},
+			{Network: "n2", Type: apiv1.IPType_IP_TYPE_EPHEMERAL, Used: 5, Max: pointer.Pointer(uint64(5))},
+			{Network: "n3", Type: apiv1.IPType_IP_TYPE_STATIC, Used: 0, Max: pointer.Pointer(uint64(1))},
+			{Network: "n3", Type: apiv1.IPType_IP_TYPE_EPHEMERAL, Used: 0, Max: pointer.Pointer(uint64(0))},
+		}
+		if diff := cmp.Diff(want, got.Msg.Quotas, protocmp.Transform()); diff != "" {
+			t.Errorf("ipServiceServer.Quota() diff = %s", diff)
+		}
+	})
+}
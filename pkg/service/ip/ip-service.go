@@ -2,38 +2,55 @@ package ip
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log/slog"
+	"net/netip"
 	"time"
 
 	"connectrpc.com/connect"
+	"github.com/google/uuid"
 	"github.com/metal-stack/api-server/pkg/db/generic"
 	"github.com/metal-stack/api-server/pkg/db/metal"
 	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
 	"github.com/metal-stack/api/go/metalstack/api/v1/apiv1connect"
 	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
 	ipamv1connect "github.com/metal-stack/go-ipam/api/v1/apiv1connect"
+	mdc "github.com/metal-stack/masterdata-api/pkg/client"
+	"github.com/metal-stack/metal-lib/pkg/pointer"
 	"github.com/metal-stack/metal-lib/pkg/tag"
 	"google.golang.org/protobuf/types/known/timestamppb"
-	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
 )
 
+// maxReservationTTL is the longest time an ip can be reserved without confirming the reservation.
+const maxReservationTTL = 24 * time.Hour
+
 type Config struct {
-	Log       *slog.Logger
-	Datastore *generic.Datastore
-	Ipam      ipamv1connect.IpamServiceClient
+	Log          *slog.Logger
+	Datastore    *generic.Datastore
+	Ipam         ipamv1connect.IpamServiceClient
+	Outbox       *generic.Outbox
+	MasterClient mdc.Client
+	// DefaultQuotas limit the ips of a type a project can allocate per network unless the project is annotated with its own quota,
+	// types without default are unlimited
+	DefaultQuotas map[metal.IPType]uint64
 }
 type ipServiceServer struct {
-	log  *slog.Logger
-	ds   *generic.Datastore
-	ipam ipamv1connect.IpamServiceClient
+	log           *slog.Logger
+	ds            *generic.Datastore
+	ipam          ipamv1connect.IpamServiceClient
+	outbox        *generic.Outbox
+	masterClient  mdc.Client
+	defaultQuotas map[metal.IPType]uint64
 }
 
 func New(c Config) apiv1connect.IPServiceHandler {
 	return &ipServiceServer{
-		log: c.Log.WithGroup("ipService"),
-		ds:  c.Datastore,
+		log:           c.Log.WithGroup("ipService"),
+		ds:            c.Datastore,
+		ipam:          c.Ipam,
+		outbox:        c.Outbox,
+		masterClient:  c.MasterClient,
+		defaultQuotas: c.DefaultQuotas,
 	}
 }
 
@@ -60,7 +77,14 @@ func (i *ipServiceServer) List(ctx context.Context, rq *connect.Request[apiv1.IP
 	i.log.Debug("list", "ip", rq)
 	req := rq.Msg
 
+	addresses, family, err := addressRange(req)
+	if err != nil {
+		return nil, err
+	}
+
 	q := &query{
+		addresses: addresses,
+		family:    family,
 		IPServiceListRequest: &apiv1.IPServiceListRequest{
 			Ip:               req.Ip,
 			Name:             req.Name,
@@ -72,14 +96,19 @@ func (i *ipServiceServer) List(ctx context.Context, rq *connect.Request[apiv1.IP
 			MachineId:        req.MachineId,
 			ParentPrefixCidr: req.ParentPrefixCidr,
 			Tags:             req.Tags,
+			IncludeDeleted:   req.IncludeDeleted,
 		},
 	}
 
-	resp, err := i.ds.IP().Search(ctx, q)
+	resp, nextPageToken, err := i.ds.IP().SearchPage(ctx, q, generic.Page{Size: int(req.PageSize), Token: req.PageToken})
 	if err != nil {
+		if generic.IsInvalidArgument(err) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
 		return nil, err
 	}
 
+	// machine ips are filtered after paging, a page might therefore contain less ips than requested
 	var res []*apiv1.IP
 	for _, ip := range resp {
 
@@ -93,10 +122,108 @@ func (i *ipServiceServer) List(ctx context.Context, rq *connect.Request[apiv1.IP
 	}
 
 	return connect.NewResponse(&apiv1.IPServiceListResponse{
-		Ips: res,
+		Ips:           res,
+		NextPageToken: nextPageToken,
+	}), nil
+}
+
+// Watch implements v1.IPServiceServer
+func (i *ipServiceServer) Watch(ctx context.Context, rq *connect.Request[apiv1.IPServiceWatchRequest], stream *connect.ServerStream[apiv1.IPServiceWatchResponse]) error {
+	i.log.Debug("watch", "ip", rq)
+	req := rq.Msg
+
+	q := &query{
+		IPServiceListRequest: &apiv1.IPServiceListRequest{
+			Project: req.Project,
+		},
+	}
+
+	events, err := i.ds.IP().Watch(ctx, q)
+	if err != nil {
+		if generic.IsUnimplemented(err) {
+			return connect.NewError(connect.CodeUnimplemented, err)
+		}
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// the client disconnected
+			return nil
+		case ev, ok := <-events:
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return connect.NewError(connect.CodeUnavailable, fmt.Errorf("watch of ips was aborted"))
+			}
+
+			resp := convertEvent(ev)
+			if resp == nil {
+				continue
+			}
+			err := stream.Send(resp)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// History implements v1.IPServiceServer
+func (i *ipServiceServer) History(ctx context.Context, rq *connect.Request[apiv1.IPServiceHistoryRequest]) (*connect.Response[apiv1.IPServiceHistoryResponse], error) {
+	i.log.Debug("history", "ip", rq)
+	req := rq.Msg
+
+	revisions, err := i.ds.Revisions(ctx, "ip", req.Ip)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*apiv1.IPRevision
+	for _, revision := range revisions {
+		before, err := generic.Decode[*metal.IP](revision.Before)
+		if err != nil {
+			return nil, err
+		}
+		after, err := generic.Decode[*metal.IP](revision.After)
+		if err != nil {
+			return nil, err
+		}
+
+		// an address might have been allocated by another project before, its revisions are not shown
+		if !belongsTo(before, req.Project) && !belongsTo(after, req.Project) {
+			continue
+		}
+
+		r := &apiv1.IPRevision{
+			Actor:     revision.Actor,
+			Operation: string(revision.Operation),
+			Timestamp: timestamppb.New(revision.Created),
+		}
+		if before != nil {
+			r.Before = convert(before)
+		}
+		if after != nil {
+			r.After = convert(after)
+		}
+		res = append(res, r)
+	}
+
+	if len(res) == 0 {
+		return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("no history of ip %s found", req.Ip))
+	}
+
+	return connect.NewResponse(&apiv1.IPServiceHistoryResponse{
+		Revisions: res,
 	}), nil
 }
 
+func belongsTo(ip *metal.IP, project string) bool {
+	return ip != nil && ip.ProjectID == project
+}
+
 // Delete implements v1.IPServiceServer
 func (i *ipServiceServer) Delete(ctx context.Context, rq *connect.Request[apiv1.IPServiceDeleteRequest]) (*connect.Response[apiv1.IPServiceDeleteResponse], error) {
 	i.log.Debug("delete", "ip", rq)
@@ -109,23 +236,31 @@ func (i *ipServiceServer) Delete(ctx context.Context, rq *connect.Request[apiv1.
 		}
 		return nil, err
 	}
+	if !belongsTo(resp, req.Project) {
+		return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("ip %q not found in project %q", req.Ip, req.Project))
+	}
+
+	// the release in ipam is stored as pending operation first, if it fails after the ip was deleted
+	// in the datastore it gets retried until both stores are consistent again
+	op, err := i.outbox.Enqueue(ctx, releaseIPOperation(resp), releaseGracePeriod)
+	if err != nil {
+		return nil, err
+	}
 
-	// TODO also delete in go-ipam in one transaction
-	err = i.ds.IP().Delete(ctx, &metal.IP{IPAddress: req.Ip})
+	err = i.ds.IP().Delete(ctx, resp)
 	if err != nil {
+		if completeErr := i.outbox.Complete(context.WithoutCancel(ctx), op); completeErr != nil {
+			i.log.Error("unable to remove pending release operation", "ip", resp.IPAddress, "error", completeErr)
+		}
 		if generic.IsNotFound(err) {
 			return nil, connect.NewError(connect.CodeNotFound, err)
 		}
 		return nil, err
 	}
-	_, err = i.ipam.ReleaseIP(ctx, connect.NewRequest(&ipamv1.ReleaseIPRequest{Ip: req.Ip, PrefixCidr: resp.ParentPrefixCidr}))
+
+	err = i.outbox.Execute(ctx, op)
 	if err != nil {
-		var connectErr *connect.Error
-		if errors.As(err, &connectErr) {
-			if connectErr.Code() != connect.CodeNotFound {
-				return nil, err
-			}
-		}
+		i.log.Warn("unable to release ip in ipam, will be retried", "ip", resp.IPAddress, "error", err)
 	}
 
 	return connect.NewResponse(&apiv1.IPServiceDeleteResponse{
@@ -136,32 +271,305 @@ func (i *ipServiceServer) Delete(ctx context.Context, rq *connect.Request[apiv1.
 // Allocate implements v1.IPServiceServer
 func (i *ipServiceServer) Allocate(ctx context.Context, rq *connect.Request[apiv1.IPServiceAllocateRequest]) (*connect.Response[apiv1.IPServiceAllocateResponse], error) {
 	i.log.Debug("allocate", "ip", rq)
-	// req := rq.Msg
-
-	// ipType := models.V1IPBaseTypeEphemeral
-	// if req.Type != apiv1.IPType_IP_TYPE_UNSPECIFIED.Enum() {
-	// 	ipType = models.V1IPAllocateRequestTypeStatic
-	// }
-
-	// ipResp, err := i.m.IP().AllocateIP(ip.NewAllocateIPParams().WithBody(&models.V1IPAllocateRequest{
-	// 	Description: req.Description,
-	// 	Name:        req.Name,
-	// 	Networkid:   &req.Network,
-	// 	Projectid:   &req.Project,
-	// 	Type:        pointer.Pointer(string(ipType)),
-	// 	Tags:        req.Tags,
-	// }), nil)
-	// if err != nil {
-	// 	var conflict *ip.AllocateIPConflict
-	// 	if errors.As(err, &conflict) {
-	// 		return nil, connect.NewError(connect.CodeAlreadyExists, err)
-	// 	}
-
-	// 	return nil, err
-	// }
-
-	// return connect.NewResponse(&apiv1.IPServiceAllocateResponse{Ip: convert(ipResp.Payload)}), nil
-	return connect.NewResponse(&apiv1.IPServiceAllocateResponse{}), nil
+	req := rq.Msg
+
+	nw, err := i.ds.Network().Get(ctx, req.Network)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+	if len(nw.Prefixes) == 0 {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("network %q has no prefixes", nw.ID))
+	}
+
+	ipType := metal.Ephemeral
+	if req.Type != nil {
+		switch *req.Type {
+		case apiv1.IPType_IP_TYPE_STATIC:
+			ipType = metal.Static
+		case apiv1.IPType_IP_TYPE_EPHEMERAL, apiv1.IPType_IP_TYPE_UNSPECIFIED:
+			ipType = metal.Ephemeral
+		}
+	}
+
+	af, err := toAddressFamily(req.AddressFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	var reservedUntil *time.Time
+	if req.ReservationTtl != nil {
+		ttl := req.ReservationTtl.AsDuration()
+		if ttl <= 0 || ttl > maxReservationTTL {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("reservation ttl must be positive and must not exceed %s", maxReservationTTL))
+		}
+		reservedUntil = pointer.Pointer(time.Now().Add(ttl))
+	}
+
+	count := 1
+	if req.DualStack {
+		count = 2
+	}
+	err = i.checkQuota(ctx, req.Project, nw.ID, ipType, count)
+	if err != nil {
+		return nil, err
+	}
+
+	var acquired []*ipamv1.IP
+	switch {
+	case req.DualStack:
+		if req.Ip != nil && *req.Ip != "" {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("a specific ip can not be allocated dual-stack"))
+		}
+		if af != "" {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("address family can not be given for a dual-stack allocation"))
+		}
+		acquired, err = i.acquireDualStack(ctx, nw)
+	case req.Ip != nil && *req.Ip != "":
+		var ip *ipamv1.IP
+		ip, err = i.acquireSpecificIP(ctx, nw, *req.Ip, af)
+		acquired = append(acquired, ip)
+	default:
+		var ip *ipamv1.IP
+		ip, err = i.acquireRandomIP(ctx, nw, af)
+		acquired = append(acquired, ip)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []*metal.IP
+	for _, a := range acquired {
+		ip := &metal.IP{
+			IPAddress:        a.Ip,
+			AllocationUUID:   uuid.NewString(),
+			ParentPrefixCidr: a.ParentPrefix,
+			Name:             req.Name,
+			Description:      req.Description,
+			ProjectID:        req.Project,
+			NetworkID:        nw.ID,
+			Type:             ipType,
+			Tags:             req.Tags,
+			ReservedUntil:    reservedUntil,
+		}
+		err := ip.SetAddressFields()
+		if err != nil {
+			i.releaseAcquired(ctx, acquired...)
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+
+	created, err := i.store(ctx, acquired, ips)
+	if err != nil {
+		return nil, err
+	}
+
+	// concurrent allocations all pass the check above, the quota is therefore checked again including the stored ips.
+	// The last allocation which is stored always sees all others, the quota is never exceeded but all of them might be rolled back.
+	err = i.checkQuota(ctx, req.Project, nw.ID, ipType, 0)
+	if err != nil {
+		i.remove(ctx, created)
+		return nil, err
+	}
+
+	resp := &apiv1.IPServiceAllocateResponse{Ip: convert(created[0])}
+	if req.DualStack {
+		for _, ip := range created {
+			resp.Ips = append(resp.Ips, convert(ip))
+		}
+	}
+	return connect.NewResponse(resp), nil
+}
+
+// store creates the ips which are already acquired in ipam in the datastore. Either all of them are stored
+// or none, if anything fails the ips which were already stored are removed and all are released in ipam again.
+func (i *ipServiceServer) store(ctx context.Context, acquired []*ipamv1.IP, ips []*metal.IP) ([]*metal.IP, error) {
+	var ops []*metal.Operation
+	for idx, ip := range ips {
+		op, err := i.outbox.Enqueue(ctx, releaseIPOperation(ip), releaseGracePeriod)
+		if err != nil {
+			i.executeReleases(ctx, ops)
+			i.releaseAcquired(ctx, acquired[idx:]...)
+			return nil, err
+		}
+		ops = append(ops, op)
+
+		if ip.Reserved() {
+			// the expiry is enqueued before the ip is stored to never lose a reservation, if the allocation
+			// fails it is left to the worker which drops it because no matching reservation exists
+			_, err := i.outbox.Enqueue(ctx, expireIPReservationOperation(ip), time.Until(*ip.ReservedUntil))
+			if err != nil {
+				i.executeReleases(ctx, ops)
+				i.releaseAcquired(ctx, acquired[idx+1:]...)
+				return nil, err
+			}
+		}
+	}
+
+	var created []*metal.IP
+	for _, ip := range ips {
+		c, err := i.ds.IP().Create(ctx, ip)
+		if err != nil {
+			for _, c := range created {
+				if deleteErr := i.ds.IP().Delete(context.WithoutCancel(ctx), c); deleteErr != nil {
+					// the release skips ips which are still present, the ip is therefore kept in both stores
+					i.log.Error("unable to remove ip after failed allocation", "ip", c.IPAddress, "error", deleteErr)
+				}
+			}
+			i.executeReleases(ctx, ops)
+			if generic.IsConflict(err) {
+				return nil, connect.NewError(connect.CodeAlreadyExists, err)
+			}
+			return nil, err
+		}
+		created = append(created, c)
+	}
+
+	for _, op := range ops {
+		err := i.outbox.Complete(ctx, op)
+		if err != nil {
+			// the worker will find the ip in the datastore and drop the operation without releasing the ip
+			i.log.Warn("unable to remove pending release operation", "ip", op.Payload[metal.OperationPayloadIP], "error", err)
+		}
+	}
+
+	return created, nil
+}
+
+// remove deletes stored ips after a failed allocation and releases them in ipam, failed releases are retried by the outbox worker.
+func (i *ipServiceServer) remove(ctx context.Context, ips []*metal.IP) {
+	ctx = context.WithoutCancel(ctx)
+	for _, ip := range ips {
+		op, err := i.outbox.Enqueue(ctx, releaseIPOperation(ip), releaseGracePeriod)
+		if err != nil {
+			i.log.Error("unable to remove ip after failed allocation", "ip", ip.IPAddress, "error", err)
+			continue
+		}
+		err = i.ds.IP().Delete(ctx, ip)
+		if err != nil {
+			i.log.Error("unable to remove ip after failed allocation", "ip", ip.IPAddress, "error", err)
+			if completeErr := i.outbox.Complete(ctx, op); completeErr != nil {
+				i.log.Error("unable to remove pending release operation", "ip", ip.IPAddress, "error", completeErr)
+			}
+			continue
+		}
+		err = i.outbox.Execute(ctx, op)
+		if err != nil {
+			i.log.Warn("unable to release ip in ipam after failed allocation, will be retried", "ip", ip.IPAddress, "error", err)
+		}
+	}
+}
+
+// executeReleases releases the ips of the pending operations in ipam, failed releases are retried by the outbox worker.
+func (i *ipServiceServer) executeReleases(ctx context.Context, ops []*metal.Operation) {
+	for _, op := range ops {
+		err := i.outbox.Execute(context.WithoutCancel(ctx), op)
+		if err != nil {
+			i.log.Warn("unable to release ip in ipam after failed allocation, will be retried", "ip", op.Payload[metal.OperationPayloadIP], "error", err)
+		}
+	}
+}
+
+// releaseAcquired releases acquired ips in ipam which were not stored in the datastore.
+func (i *ipServiceServer) releaseAcquired(ctx context.Context, acquired ...*ipamv1.IP) {
+	for _, ip := range acquired {
+		_, err := i.ipam.ReleaseIP(context.WithoutCancel(ctx), connect.NewRequest(&ipamv1.ReleaseIPRequest{Ip: ip.Ip, PrefixCidr: ip.ParentPrefix}))
+		if err != nil {
+			i.log.Error("unable to release ip in ipam after failed allocation", "ip", ip.Ip, "prefix", ip.ParentPrefix, "error", err)
+		}
+	}
+}
+
+// acquireDualStack acquires one ipv4 and one ipv6 ip in the network, if only one of them could be acquired it is released again.
+func (i *ipServiceServer) acquireDualStack(ctx context.Context, nw *metal.Network) ([]*ipamv1.IP, error) {
+	var acquired []*ipamv1.IP
+	for _, af := range []metal.AddressFamily{metal.IPv4AddressFamily, metal.IPv6AddressFamily} {
+		ip, err := i.acquireRandomIP(ctx, nw, af)
+		if err != nil {
+			i.releaseAcquired(ctx, acquired...)
+			return nil, err
+		}
+		acquired = append(acquired, ip)
+	}
+	return acquired, nil
+}
+
+// acquireSpecificIP acquires the given ip in the prefix of the network which contains it.
+// If an address family is given, the ip must be of this family.
+func (i *ipServiceServer) acquireSpecificIP(ctx context.Context, nw *metal.Network, ip string, af metal.AddressFamily) (*ipamv1.IP, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to parse ip %q: %w", ip, err))
+	}
+	if af != "" {
+		family, err := metal.AddressFamilyOf(ip)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		if family != af {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip %q is not of address family %s", ip, af))
+		}
+	}
+
+	for _, prefix := range nw.Prefixes {
+		pfx, err := netip.ParsePrefix(prefix.String())
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse prefix %q of network %q: %w", prefix.String(), nw.ID, err)
+		}
+		if !pfx.Contains(addr) {
+			continue
+		}
+
+		resp, err := i.ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{Ip: &ip, PrefixCidr: pfx.String()}))
+		if err != nil {
+			if connect.CodeOf(err) == connect.CodeAlreadyExists {
+				return nil, connect.NewError(connect.CodeAlreadyExists, fmt.Errorf("ip %q is already allocated: %w", ip, err))
+			}
+			return nil, err
+		}
+		return resp.Msg.Ip, nil
+	}
+
+	return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip %q is not contained in any prefix of network %q", ip, nw.ID))
+}
+
+// acquireRandomIP acquires the next free ip of the first prefix of the network which has one available.
+// If an address family is given, only prefixes of this family are considered.
+func (i *ipServiceServer) acquireRandomIP(ctx context.Context, nw *metal.Network, af metal.AddressFamily) (*ipamv1.IP, error) {
+	candidates := 0
+	for _, prefix := range nw.Prefixes {
+		if af != "" {
+			family, err := prefix.AddressFamily()
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse prefix %q of network %q: %w", prefix.String(), nw.ID, err)
+			}
+			if family != af {
+				continue
+			}
+		}
+		candidates++
+
+		resp, err := i.ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: prefix.String()}))
+		if err != nil {
+			if connect.CodeOf(err) == connect.CodeNotFound {
+				// no ip available in this prefix, try the next one
+				continue
+			}
+			return nil, err
+		}
+		return resp.Msg.Ip, nil
+	}
+
+	if candidates == 0 {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("network %q has no %s prefixes", nw.ID, af))
+	}
+	if af != "" {
+		return nil, connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("no %s ip available in network %q", af, nw.ID))
+	}
+	return nil, connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("no ip available in network %q", nw.ID))
 }
 
 // Static implements v1.IPServiceServer
@@ -198,8 +606,21 @@ func (i *ipServiceServer) Update(ctx context.Context, rq *connect.Request[apiv1.
 		}
 		newIP.Type = t
 	}
+	if newIP.Type != old.Type {
+		err = i.checkQuota(ctx, old.ProjectID, old.NetworkID, newIP.Type, 1)
+		if err != nil {
+			return nil, err
+		}
+	}
 	newIP.Tags = req.Tags
 
+	// the collector of ephemeral ips starts the grace period again once the ip was attached to another machine
+	oldMachine, _ := tag.NewTagMap(old.Tags).Value(tag.MachineID)
+	newMachine, _ := tag.NewTagMap(newIP.Tags).Value(tag.MachineID)
+	if oldMachine != newMachine {
+		newIP.DetachedSince = nil
+	}
+
 	err = i.ds.IP().Update(ctx, &newIP, old)
 	if err != nil {
 		if generic.IsNotFound(err) {
@@ -219,69 +640,270 @@ func (i *ipServiceServer) Update(ctx context.Context, rq *connect.Request[apiv1.
 	return connect.NewResponse(&apiv1.IPServiceUpdateResponse{Ip: convert(stored)}), nil
 }
 
-func convert(resp *metal.IP) *apiv1.IP {
-	t := apiv1.IPType_IP_TYPE_UNSPECIFIED
-	switch resp.Type {
+// Confirm implements v1.IPServiceServer
+func (i *ipServiceServer) Confirm(ctx context.Context, rq *connect.Request[apiv1.IPServiceConfirmRequest]) (*connect.Response[apiv1.IPServiceConfirmResponse], error) {
+	i.log.Debug("confirm", "ip", rq)
+	req := rq.Msg
+
+	old, err := i.ds.IP().Get(ctx, req.Ip)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+	if !belongsTo(old, req.Project) {
+		return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("ip %q not found in project %q", req.Ip, req.Project))
+	}
+	if !old.Reserved() {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("ip %q is not reserved", req.Ip))
+	}
+	if !old.ReservedUntil.After(time.Now()) {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("reservation of ip %q expired at %s", req.Ip, old.ReservedUntil))
+	}
+
+	newIP := *old
+	newIP.ReservedUntil = nil
+
+	if req.Type != nil {
+		switch *req.Type {
+		case apiv1.IPType_IP_TYPE_EPHEMERAL:
+			newIP.Type = metal.Ephemeral
+		case apiv1.IPType_IP_TYPE_STATIC:
+			newIP.Type = metal.Static
+		case apiv1.IPType_IP_TYPE_UNSPECIFIED:
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip type cannot be unspecified: %s", req.Type))
+		}
+	}
+
+	if newIP.Type != old.Type {
+		err = i.checkQuota(ctx, old.ProjectID, old.NetworkID, newIP.Type, 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the pending expiry finds the confirmed ip and leaves it untouched
+	err = i.ds.IP().Update(ctx, &newIP, old)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	stored, err := i.ds.IP().Get(ctx, req.Ip)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	return connect.NewResponse(&apiv1.IPServiceConfirmResponse{Ip: convert(stored)}), nil
+}
+
+// convertEvent returns nil for events of machine ips, which are not shown to the user like in List.
+func convertEvent(ev generic.Event[*metal.IP]) *apiv1.IPServiceWatchResponse {
+	resp := &apiv1.IPServiceWatchResponse{}
+
+	switch ev.Type {
+	case generic.EventCreated:
+		resp.Type = apiv1.WatchEventType_WATCH_EVENT_TYPE_CREATED
+	case generic.EventUpdated:
+		resp.Type = apiv1.WatchEventType_WATCH_EVENT_TYPE_UPDATED
+	case generic.EventDeleted:
+		resp.Type = apiv1.WatchEventType_WATCH_EVENT_TYPE_DELETED
+	}
+
+	for _, ip := range []*metal.IP{ev.Old, ev.New} {
+		if ip == nil {
+			continue
+		}
+		m := tag.NewTagMap(ip.Tags)
+		if _, ok := m.Value(tag.MachineID); ok {
+			return nil
+		}
+	}
+
+	if ev.Old != nil {
+		resp.Old = convert(ev.Old)
+	}
+	if ev.New != nil {
+		resp.New = convert(ev.New)
+	}
+	return resp
+}
+
+// toAddressFamily returns the requested address family, empty if any family is acceptable.
+func toAddressFamily(af *apiv1.IPAddressFamily) (metal.AddressFamily, error) {
+	if af == nil {
+		return "", nil
+	}
+	switch *af {
+	case apiv1.IPAddressFamily_IP_ADDRESS_FAMILY_V4:
+		return metal.IPv4AddressFamily, nil
+	case apiv1.IPAddressFamily_IP_ADDRESS_FAMILY_V6:
+		return metal.IPv6AddressFamily, nil
+	case apiv1.IPAddressFamily_IP_ADDRESS_FAMILY_UNSPECIFIED:
+		return "", nil
+	default:
+		return "", connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("address family %s is not supported", af))
+	}
+}
+
+func convertType(t metal.IPType) apiv1.IPType {
+	switch t {
 	case metal.Ephemeral:
-		t = apiv1.IPType_IP_TYPE_EPHEMERAL
+		return apiv1.IPType_IP_TYPE_EPHEMERAL
 	case metal.Static:
-		t = apiv1.IPType_IP_TYPE_STATIC
+		return apiv1.IPType_IP_TYPE_STATIC
+	default:
+		return apiv1.IPType_IP_TYPE_UNSPECIFIED
 	}
+}
 
+func convert(resp *metal.IP) *apiv1.IP {
 	ip := &apiv1.IP{
-		Ip:          resp.IPAddress,
+		Ip:          generic.EntityID(resp),
 		Uuid:        resp.AllocationUUID,
 		Name:        resp.Name,
 		Description: resp.Description,
 		Network:     resp.NetworkID,
 		Project:     resp.ProjectID,
-		Type:        t,
+		Type:        convertType(resp.Type),
 		Tags:        resp.Tags,
 		CreatedAt:   timestamppb.New(time.Time(resp.Created)),
 		UpdatedAt:   timestamppb.New(time.Time(resp.Changed)),
-		DeletedAt:   &timestamppb.Timestamp{},
+	}
+	if resp.Deleted != nil {
+		ip.DeletedAt = timestamppb.New(*resp.Deleted)
+	}
+	if resp.ReservedUntil != nil {
+		ip.ReservedUntil = timestamppb.New(*resp.ReservedUntil)
 	}
 	return ip
 }
 
+// addressRange returns the range of address numbers which is selected by the cidr and the ip range of the request
+// and the address family of the range, nil if neither is given. If both are given, the addresses must match both.
+// Ipv4 addresses are numbered within ::ffff:0:0/96 of the ipv6 addresses, a range is therefore only complete with its family.
+func addressRange(req *apiv1.IPServiceListRequest) (*generic.Range, metal.AddressFamily, error) {
+	var (
+		result *generic.Range
+		family metal.AddressFamily
+	)
+
+	if req.Cidr != nil {
+		prefix, err := netip.ParsePrefix(*req.Cidr)
+		if err != nil {
+			return nil, "", connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to parse cidr %q: %w", *req.Cidr, err))
+		}
+		lower, upper := metal.AddressNumberRange(prefix)
+		result = &generic.Range{Lower: lower, Upper: upper}
+		family = addressFamily(prefix.Addr())
+	}
+
+	if req.IpFrom == nil && req.IpTo == nil {
+		return result, family, nil
+	}
+
+	var from, to netip.Addr
+	if req.IpFrom != nil {
+		addr, err := netip.ParseAddr(*req.IpFrom)
+		if err != nil {
+			return nil, "", connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to parse ip %q: %w", *req.IpFrom, err))
+		}
+		from = addr.Unmap()
+	}
+	if req.IpTo != nil {
+		addr, err := netip.ParseAddr(*req.IpTo)
+		if err != nil {
+			return nil, "", connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unable to parse ip %q: %w", *req.IpTo, err))
+		}
+		to = addr.Unmap()
+	}
+
+	// a range which is open on one side ends at the first or last address of the family of the other side
+	if !from.IsValid() {
+		from = netip.PrefixFrom(to, 0).Masked().Addr()
+	}
+	if !to.IsValid() {
+		to = netip.AddrFrom16([16]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+		if from.Is4() {
+			to = netip.AddrFrom4([4]byte{0xff, 0xff, 0xff, 0xff})
+		}
+	}
+
+	if from.Is4() != to.Is4() {
+		return nil, "", connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip range from %s to %s spans address families", from, to))
+	}
+	if to.Less(from) {
+		return nil, "", connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip range from %s to %s is empty", from, to))
+	}
+	if family != "" && family != addressFamily(from) {
+		return nil, "", connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("ip range from %s to %s is not of the address family of cidr %s", from, to, *req.Cidr))
+	}
+
+	return intersect(result, &generic.Range{Lower: metal.AddressNumber(from), Upper: metal.AddressNumber(to)}), addressFamily(from), nil
+}
+
+func addressFamily(addr netip.Addr) metal.AddressFamily {
+	if addr.Unmap().Is4() {
+		return metal.IPv4AddressFamily
+	}
+	return metal.IPv6AddressFamily
+}
+
+// intersect returns the range of address numbers which are in both ranges, a nil range does not restrict.
+func intersect(a, b *generic.Range) *generic.Range {
+	if a == nil {
+		return b
+	}
+	return &generic.Range{Lower: max(a.Lower, b.Lower), Upper: min(a.Upper, b.Upper)}
+}
+
 type query struct {
 	*apiv1.IPServiceListRequest
+	// addresses restricts the address numbers of the ips, nil selects all
+	addresses *generic.Range
+	// family of the addresses, the numbers of ipv6 addresses include the ones of ipv4 addresses
+	family metal.AddressFamily
+}
+
+// WithDeleted implements generic.DeletedQuery, released ips are only returned on request.
+func (p query) WithDeleted() bool {
+	return p.IncludeDeleted
 }
 
-func (p query) Query(q r.Term) *r.Term {
+func (p query) Predicates() []generic.Predicate {
 	// Project is mandatory
-	q = q.Filter(func(row r.Term) r.Term {
-		return row.Field("projectid").Eq(p.Project)
-	})
+	predicates := []generic.Predicate{generic.Eq("projectid", p.Project)}
 
 	if p.Ip != nil {
-		q = q.Filter(func(row r.Term) r.Term {
-			return row.Field("id").Eq(*p.Ip)
-		})
+		// released ips are kept under the id of their tombstone, they are found by their address instead
+		addr, err := netip.ParseAddr(*p.Ip)
+		if p.IncludeDeleted && err == nil {
+			predicates = append(predicates, generic.Eq("addressnumber", metal.AddressNumber(addr)))
+		} else {
+			predicates = append(predicates, generic.Eq("id", *p.Ip))
+		}
 	}
 
 	if p.Uuid != nil {
-		q = q.Filter(func(row r.Term) r.Term {
-			return row.Field("allocationuuid").Eq(*p.Uuid)
-		})
+		predicates = append(predicates, generic.Eq("allocationuuid", *p.Uuid))
 	}
 
 	if p.Name != nil {
-		q = q.Filter(func(row r.Term) r.Term {
-			return row.Field("name").Eq(*p.Name)
-		})
+		predicates = append(predicates, generic.Eq("name", *p.Name))
 	}
 
 	if p.Network != nil {
-		q = q.Filter(func(row r.Term) r.Term {
-			return row.Field("networkid").Eq(*p.Network)
-		})
+		predicates = append(predicates, generic.Eq("networkid", *p.Network))
 	}
 
 	if p.ParentPrefixCidr != nil {
-		q = q.Filter(func(row r.Term) r.Term {
-			return row.Field("prefix").Eq(*p.ParentPrefixCidr)
-		})
+		predicates = append(predicates, generic.Eq("prefix", *p.ParentPrefixCidr))
 	}
 
 	if p.MachineId != nil {
@@ -289,31 +911,28 @@ func (p query) Query(q r.Term) *r.Term {
 	}
 
 	for _, t := range p.Tags {
-		t := t
-		q = q.Filter(func(row r.Term) r.Term {
-			return row.Field("tags").Contains(r.Expr(t))
-		})
+		predicates = append(predicates, generic.Contains("tags", t))
 	}
 
 	if p.Type != nil {
-		q = q.Filter(func(row r.Term) r.Term {
-			return row.Field("type").Eq(p.Type.String())
-		})
+		predicates = append(predicates, generic.Eq("type", p.Type.String()))
+	}
+
+	if p.addresses != nil {
+		predicates = append(predicates,
+			generic.Eq("addressfamily", string(p.family)),
+			generic.Between("addressnumber", p.addresses.Lower, p.addresses.Upper),
+		)
 	}
 
 	if p.Af != nil {
-		var separator string
-		switch p.Af.String() {
-		case apiv1.IPAddressFamily_IP_ADDRESS_FAMILY_V4.String():
-			separator = "\\."
-		case apiv1.IPAddressFamily_IP_ADDRESS_FAMILY_V6.String():
-			separator = ":"
+		switch *p.Af {
+		case apiv1.IPAddressFamily_IP_ADDRESS_FAMILY_V4:
+			predicates = append(predicates, generic.Eq("addressfamily", string(metal.IPv4AddressFamily)))
+		case apiv1.IPAddressFamily_IP_ADDRESS_FAMILY_V6:
+			predicates = append(predicates, generic.Eq("addressfamily", string(metal.IPv6AddressFamily)))
 		}
-
-		q = q.Filter(func(row r.Term) r.Term {
-			return row.Field("id").Match(separator)
-		})
 	}
 
-	return &q
+	return predicates
 }
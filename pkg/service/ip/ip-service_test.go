@@ -6,18 +6,27 @@ import (
 	"log/slog"
 	"slices"
 	"testing"
+	"time"
 
 	"connectrpc.com/connect"
 	"github.com/google/go-cmp/cmp"
+	"github.com/metal-stack/api-server/pkg/actor"
 	"github.com/metal-stack/api-server/pkg/db/generic"
 	"github.com/metal-stack/api-server/pkg/db/metal"
 	"github.com/metal-stack/api-server/pkg/test"
 	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
 	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
 	ipamv1connect "github.com/metal-stack/go-ipam/api/v1/apiv1connect"
+	mdmv1 "github.com/metal-stack/masterdata-api/api/v1"
+	mdmv1mock "github.com/metal-stack/masterdata-api/api/v1/mocks"
+	mdc "github.com/metal-stack/masterdata-api/pkg/client"
 	"github.com/metal-stack/metal-lib/pkg/pointer"
+	"github.com/metal-stack/metal-lib/pkg/tag"
+	tmock "github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
 	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 var prefixMap = map[string][]string{
@@ -27,18 +36,12 @@ var prefixMap = map[string][]string{
 }
 
 func Test_ipServiceServer_Get(t *testing.T) {
-	container, c, err := test.StartRethink(t)
-	require.NoError(t, err)
-	defer func() {
-		_ = container.Terminate(context.Background())
-	}()
-
 	ipam := test.StartIpam(t)
 
 	ctx := context.Background()
 	log := slog.Default()
 
-	ds, err := generic.New(log, "metal", c)
+	ds, err := generic.NewMemory(log)
 	require.NoError(t, err)
 
 	createIPs(t, ctx, ds, ipam, prefixMap, []*metal.IP{{IPAddress: "1.2.3.4"}})
@@ -77,9 +80,10 @@ func Test_ipServiceServer_Get(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			i := &ipServiceServer{
-				log:  tt.log,
-				ds:   tt.ds,
-				ipam: ipam,
+				log:    tt.log,
+				ds:     tt.ds,
+				ipam:   ipam,
+				outbox: newOutbox(tt.log, tt.ds, ipam),
 			}
 			got, err := i.Get(tt.ctx, connect.NewRequest(tt.rq))
 			if (err != nil) != tt.wantErr {
@@ -109,18 +113,12 @@ func Test_ipServiceServer_Get(t *testing.T) {
 }
 
 func Test_ipServiceServer_List(t *testing.T) {
-	container, c, err := test.StartRethink(t)
-	require.NoError(t, err)
-	defer func() {
-		_ = container.Terminate(context.Background())
-	}()
-
 	ipam := test.StartIpam(t)
 
 	ctx := context.Background()
 	log := slog.Default()
 
-	ds, err := generic.New(log, "metal", c)
+	ds, err := generic.NewMemory(log)
 	require.NoError(t, err)
 
 	ips := []*metal.IP{
@@ -169,6 +167,117 @@ func Test_ipServiceServer_List(t *testing.T) {
 			want:    &apiv1.IPServiceListResponse{Ips: []*apiv1.IP{{Name: "ip4", Ip: "2001:db8::1", Project: "p2", Network: "n2"}}},
 			wantErr: false,
 		},
+		{
+			name:    "get by cidr",
+			log:     log,
+			ctx:     ctx,
+			rq:      &apiv1.IPServiceListRequest{Cidr: pointer.Pointer("1.2.3.4/31"), Project: "p1"},
+			ds:      ds,
+			want:    &apiv1.IPServiceListResponse{Ips: []*apiv1.IP{{Name: "ip1", Ip: "1.2.3.4", Project: "p1"}, {Name: "ip2", Ip: "1.2.3.5", Project: "p1"}}},
+			wantErr: false,
+		},
+		{
+			name:    "get by ipv6 cidr",
+			log:     log,
+			ctx:     ctx,
+			rq:      &apiv1.IPServiceListRequest{Cidr: pointer.Pointer("2001:db8::/32"), Project: "p2"},
+			ds:      ds,
+			want:    &apiv1.IPServiceListResponse{Ips: []*apiv1.IP{{Name: "ip4", Ip: "2001:db8::1", Project: "p2", Network: "n2"}}},
+			wantErr: false,
+		},
+		{
+			name:    "get by ip range",
+			log:     log,
+			ctx:     ctx,
+			rq:      &apiv1.IPServiceListRequest{IpFrom: pointer.Pointer("1.2.3.5"), IpTo: pointer.Pointer("1.2.3.6"), Project: "p1"},
+			ds:      ds,
+			want:    &apiv1.IPServiceListResponse{Ips: []*apiv1.IP{{Name: "ip2", Ip: "1.2.3.5", Project: "p1"}, {Name: "ip3", Ip: "1.2.3.6", Project: "p1", Network: "n1"}}},
+			wantErr: false,
+		},
+		{
+			name:    "get by ip range open at the end",
+			log:     log,
+			ctx:     ctx,
+			rq:      &apiv1.IPServiceListRequest{IpFrom: pointer.Pointer("1.2.3.6"), Project: "p1"},
+			ds:      ds,
+			want:    &apiv1.IPServiceListResponse{Ips: []*apiv1.IP{{Name: "ip3", Ip: "1.2.3.6", Project: "p1", Network: "n1"}}},
+			wantErr: false,
+		},
+		{
+			name:    "get by ip range open at the start does not include other families",
+			log:     log,
+			ctx:     ctx,
+			rq:      &apiv1.IPServiceListRequest{IpTo: pointer.Pointer("2001:db8::ffff"), Project: "p2"},
+			ds:      ds,
+			want:    &apiv1.IPServiceListResponse{Ips: []*apiv1.IP{{Name: "ip4", Ip: "2001:db8::1", Project: "p2", Network: "n2"}}},
+			wantErr: false,
+		},
+		{
+			name:    "get by ip range open at the end does not include other families",
+			log:     log,
+			ctx:     ctx,
+			rq:      &apiv1.IPServiceListRequest{IpFrom: pointer.Pointer("::1"), Project: "p2"},
+			ds:      ds,
+			want:    &apiv1.IPServiceListResponse{Ips: []*apiv1.IP{{Name: "ip4", Ip: "2001:db8::1", Project: "p2", Network: "n2"}}},
+			wantErr: false,
+		},
+		{
+			name:    "get by ipv6 cidr does not include other families",
+			log:     log,
+			ctx:     ctx,
+			rq:      &apiv1.IPServiceListRequest{Cidr: pointer.Pointer("::/0"), Project: "p2"},
+			ds:      ds,
+			want:    &apiv1.IPServiceListResponse{Ips: []*apiv1.IP{{Name: "ip4", Ip: "2001:db8::1", Project: "p2", Network: "n2"}}},
+			wantErr: false,
+		},
+		{
+			name:    "get by ipv4 cidr does not include other families",
+			log:     log,
+			ctx:     ctx,
+			rq:      &apiv1.IPServiceListRequest{Cidr: pointer.Pointer("0.0.0.0/0"), Project: "p2"},
+			ds:      ds,
+			want:    &apiv1.IPServiceListResponse{Ips: []*apiv1.IP{{Name: "ip5", Ip: "2.3.4.5", Project: "p2", Network: "n3"}}},
+			wantErr: false,
+		},
+		{
+			name:    "get by cidr and ip range",
+			log:     log,
+			ctx:     ctx,
+			rq:      &apiv1.IPServiceListRequest{Cidr: pointer.Pointer("1.2.3.4/30"), IpFrom: pointer.Pointer("1.2.3.5"), Project: "p1"},
+			ds:      ds,
+			want:    &apiv1.IPServiceListResponse{Ips: []*apiv1.IP{{Name: "ip2", Ip: "1.2.3.5", Project: "p1"}, {Name: "ip3", Ip: "1.2.3.6", Project: "p1", Network: "n1"}}},
+			wantErr: false,
+		},
+		{
+			name:           "invalid cidr",
+			log:            log,
+			ctx:            ctx,
+			rq:             &apiv1.IPServiceListRequest{Cidr: pointer.Pointer("1.2.3.0"), Project: "p1"},
+			ds:             ds,
+			want:           nil,
+			wantReturnCode: connect.CodeInvalidArgument,
+			wantErr:        true,
+		},
+		{
+			name:           "ip range spans address families",
+			log:            log,
+			ctx:            ctx,
+			rq:             &apiv1.IPServiceListRequest{IpFrom: pointer.Pointer("1.2.3.4"), IpTo: pointer.Pointer("2001:db8::1"), Project: "p1"},
+			ds:             ds,
+			want:           nil,
+			wantReturnCode: connect.CodeInvalidArgument,
+			wantErr:        true,
+		},
+		{
+			name:           "ip range and cidr of different address families",
+			log:            log,
+			ctx:            ctx,
+			rq:             &apiv1.IPServiceListRequest{Cidr: pointer.Pointer("::/0"), IpFrom: pointer.Pointer("1.2.3.4"), Project: "p1"},
+			ds:             ds,
+			want:           nil,
+			wantReturnCode: connect.CodeInvalidArgument,
+			wantErr:        true,
+		},
 		{
 			name:    "get by parent prefix cidr",
 			log:     log,
@@ -178,13 +287,42 @@ func Test_ipServiceServer_List(t *testing.T) {
 			want:    &apiv1.IPServiceListResponse{Ips: []*apiv1.IP{{Name: "ip5", Ip: "2.3.4.5", Project: "p2", Network: "n3"}}},
 			wantErr: false,
 		},
+		{
+			name:    "first page by project",
+			log:     log,
+			ctx:     ctx,
+			rq:      &apiv1.IPServiceListRequest{Project: "p1", PageSize: 2},
+			ds:      ds,
+			want:    &apiv1.IPServiceListResponse{Ips: []*apiv1.IP{{Name: "ip1", Ip: "1.2.3.4", Project: "p1"}, {Name: "ip2", Ip: "1.2.3.5", Project: "p1"}}, NextPageToken: "MS4yLjMuNQ"},
+			wantErr: false,
+		},
+		{
+			name:    "next page by project",
+			log:     log,
+			ctx:     ctx,
+			rq:      &apiv1.IPServiceListRequest{Project: "p1", PageSize: 2, PageToken: "MS4yLjMuNQ"},
+			ds:      ds,
+			want:    &apiv1.IPServiceListResponse{Ips: []*apiv1.IP{{Name: "ip3", Ip: "1.2.3.6", Project: "p1", Network: "n1"}}},
+			wantErr: false,
+		},
+		{
+			name:           "invalid page token",
+			log:            log,
+			ctx:            ctx,
+			rq:             &apiv1.IPServiceListRequest{Project: "p1", PageToken: "not a token"},
+			ds:             ds,
+			want:           nil,
+			wantReturnCode: connect.CodeInvalidArgument,
+			wantErr:        true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			i := &ipServiceServer{
-				log:  tt.log,
-				ds:   tt.ds,
-				ipam: ipam,
+				log:    tt.log,
+				ds:     tt.ds,
+				ipam:   ipam,
+				outbox: newOutbox(tt.log, tt.ds, ipam),
 			}
 			got, err := i.List(tt.ctx, connect.NewRequest(tt.rq))
 			if (err != nil) != tt.wantErr {
@@ -214,18 +352,12 @@ func Test_ipServiceServer_List(t *testing.T) {
 }
 
 func Test_ipServiceServer_Update(t *testing.T) {
-	container, c, err := test.StartRethink(t)
-	require.NoError(t, err)
-	defer func() {
-		_ = container.Terminate(context.Background())
-	}()
-
 	ipam := test.StartIpam(t)
 
 	ctx := context.Background()
 	log := slog.Default()
 
-	ds, err := generic.New(log, "metal", c)
+	ds, err := generic.NewMemory(log)
 	require.NoError(t, err)
 
 	ips := []*metal.IP{
@@ -287,9 +419,11 @@ func Test_ipServiceServer_Update(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			i := &ipServiceServer{
-				log:  tt.log,
-				ds:   tt.ds,
-				ipam: ipam,
+				log:          tt.log,
+				ds:           tt.ds,
+				ipam:         ipam,
+				outbox:       newOutbox(tt.log, tt.ds, ipam),
+				masterClient: newMasterClient(t),
 			}
 			got, err := i.Update(tt.ctx, connect.NewRequest(tt.rq))
 			if (err != nil) != tt.wantErr {
@@ -319,18 +453,12 @@ func Test_ipServiceServer_Update(t *testing.T) {
 }
 
 func Test_ipServiceServer_Delete(t *testing.T) {
-	container, c, err := test.StartRethink(t)
-	require.NoError(t, err)
-	defer func() {
-		_ = container.Terminate(context.Background())
-	}()
-
 	ipam := test.StartIpam(t)
 
 	ctx := context.Background()
 	log := slog.Default()
 
-	ds, err := generic.New(log, "metal", c)
+	ds, err := generic.NewMemory(log)
 	require.NoError(t, err)
 
 	ips := []*metal.IP{
@@ -371,13 +499,24 @@ func Test_ipServiceServer_Delete(t *testing.T) {
 			wantErr:        true,
 			wantReturnCode: connect.CodeNotFound,
 		},
+		{
+			name:           "delete ip of another project",
+			log:            log,
+			ctx:            ctx,
+			rq:             &apiv1.IPServiceDeleteRequest{Ip: "2.3.4.5", Project: "p1"},
+			ds:             ds,
+			want:           nil,
+			wantErr:        true,
+			wantReturnCode: connect.CodeNotFound,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			i := &ipServiceServer{
-				log:  tt.log,
-				ds:   tt.ds,
-				ipam: ipam,
+				log:    tt.log,
+				ds:     tt.ds,
+				ipam:   ipam,
+				outbox: newOutbox(tt.log, tt.ds, ipam),
 			}
 			got, err := i.Delete(tt.ctx, connect.NewRequest(tt.rq))
 			if (err != nil) != tt.wantErr {
@@ -410,6 +549,596 @@ func Test_ipServiceServer_Delete(t *testing.T) {
 			}
 		})
 	}
+	// the ip of another project was not deleted
+	_, err = ds.IP().Get(ctx, "2.3.4.5")
+	require.NoError(t, err)
+
+	// deleted ips are only listed on request and carry their deletion timestamp
+	i := &ipServiceServer{log: log, ds: ds, ipam: ipam, outbox: newOutbox(log, ds, ipam)}
+	list, err := i.List(ctx, connect.NewRequest(&apiv1.IPServiceListRequest{Project: "p1", Ip: pointer.Pointer("1.2.3.4")}))
+	require.NoError(t, err)
+	require.Empty(t, list.Msg.Ips)
+
+	list, err = i.List(ctx, connect.NewRequest(&apiv1.IPServiceListRequest{Project: "p1", Ip: pointer.Pointer("1.2.3.4"), IncludeDeleted: true}))
+	require.NoError(t, err)
+	require.Len(t, list.Msg.Ips, 1)
+	require.Equal(t, "1.2.3.4", list.Msg.Ips[0].Ip)
+	require.NotNil(t, list.Msg.Ips[0].DeletedAt)
+}
+
+func Test_ipServiceServer_Allocate(t *testing.T) {
+	ipam := test.StartIpam(t)
+
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	ips := []*metal.IP{
+		{Name: "ip1", IPAddress: "1.2.3.4", ProjectID: "p1", NetworkID: "n1", ParentPrefixCidr: "1.2.3.0/24"},
+	}
+	createIPs(t, ctx, ds, ipam, prefixMap, ips)
+	createNetworks(t, ctx, ds, []*metal.Network{
+		{Base: metal.Base{ID: "n1"}, Prefixes: metal.Prefixes{{IP: "1.2.3.0", Length: "24"}}},
+		{Base: metal.Base{ID: "n2"}, Prefixes: metal.Prefixes{{IP: "2001:db8::", Length: "96"}}},
+		{Base: metal.Base{ID: "n3"}},
+	})
+
+	tests := []struct {
+		name           string
+		log            *slog.Logger
+		ctx            context.Context
+		rq             *apiv1.IPServiceAllocateRequest
+		ds             *generic.Datastore
+		want           *apiv1.IPServiceAllocateResponse
+		wantReturnCode connect.Code
+		wantErr        bool
+	}{
+		{
+			name:    "allocate specific ip",
+			log:     log,
+			ctx:     ctx,
+			rq:      &apiv1.IPServiceAllocateRequest{Ip: pointer.Pointer("1.2.3.10"), Project: "p1", Network: "n1", Name: "ip-specific", Tags: []string{"purpose=lb"}},
+			ds:      ds,
+			want:    &apiv1.IPServiceAllocateResponse{Ip: &apiv1.IP{Name: "ip-specific", Ip: "1.2.3.10", Project: "p1", Network: "n1", Type: apiv1.IPType_IP_TYPE_EPHEMERAL, Tags: []string{"purpose=lb"}}},
+			wantErr: false,
+		},
+		{
+			name:    "allocate static ip",
+			log:     log,
+			ctx:     ctx,
+			rq:      &apiv1.IPServiceAllocateRequest{Ip: pointer.Pointer("2001:db8::2"), Project: "p2", Network: "n2", Name: "ip-static", Description: "a static ip", Type: apiv1.IPType_IP_TYPE_STATIC.Enum()},
+			ds:      ds,
+			want:    &apiv1.IPServiceAllocateResponse{Ip: &apiv1.IP{Name: "ip-static", Ip: "2001:db8::2", Project: "p2", Network: "n2", Description: "a static ip", Type: apiv1.IPType_IP_TYPE_STATIC}},
+			wantErr: false,
+		},
+		{
+			name:           "allocate already allocated ip",
+			log:            log,
+			ctx:            ctx,
+			rq:             &apiv1.IPServiceAllocateRequest{Ip: pointer.Pointer("1.2.3.4"), Project: "p1", Network: "n1"},
+			ds:             ds,
+			want:           nil,
+			wantErr:        true,
+			wantReturnCode: connect.CodeAlreadyExists,
+		},
+		{
+			name:           "allocate ip outside of network",
+			log:            log,
+			ctx:            ctx,
+			rq:             &apiv1.IPServiceAllocateRequest{Ip: pointer.Pointer("2.3.4.10"), Project: "p1", Network: "n1"},
+			ds:             ds,
+			want:           nil,
+			wantErr:        true,
+			wantReturnCode: connect.CodeInvalidArgument,
+		},
+		{
+			name:           "allocate in unknown network",
+			log:            log,
+			ctx:            ctx,
+			rq:             &apiv1.IPServiceAllocateRequest{Project: "p1", Network: "n4"},
+			ds:             ds,
+			want:           nil,
+			wantErr:        true,
+			wantReturnCode: connect.CodeNotFound,
+		},
+		{
+			name:           "allocate in network without prefixes",
+			log:            log,
+			ctx:            ctx,
+			rq:             &apiv1.IPServiceAllocateRequest{Project: "p1", Network: "n3"},
+			ds:             ds,
+			want:           nil,
+			wantErr:        true,
+			wantReturnCode: connect.CodeFailedPrecondition,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := &ipServiceServer{
+				log:          tt.log,
+				ds:           tt.ds,
+				ipam:         ipam,
+				outbox:       newOutbox(tt.log, tt.ds, ipam),
+				masterClient: newMasterClient(t),
+			}
+			got, err := i.Allocate(tt.ctx, connect.NewRequest(tt.rq))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ipServiceServer.Allocate() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if (err != nil) && tt.wantErr {
+				var connectErr *connect.Error
+				if errors.As(err, &connectErr) && tt.wantReturnCode != connectErr.Code() {
+					t.Errorf("ipServiceServer.Allocate() errcode = %v, wantReturnCode %v", connectErr.Code(), tt.wantReturnCode)
+				}
+			}
+			if tt.want == nil && got == nil {
+				return
+			}
+			if tt.want == nil && got != nil {
+				t.Error("tt.want is nil but got is not")
+				return
+			}
+			if diff := cmp.Diff(
+				tt.want, got.Msg,
+				cmp.Options{
+					protocmp.Transform(),
+					protocmp.IgnoreFields(
+						&apiv1.IP{}, "uuid", "created_at", "updated_at", "deleted_at",
+					),
+				},
+			); diff != "" {
+				t.Errorf("ipServiceServer.Allocate() = %v, want %vņdiff:%s", got.Msg, tt.want, diff)
+			}
+			require.NotEmpty(t, got.Msg.Ip.Uuid)
+		})
+	}
+
+	t.Run("allocate random ip", func(t *testing.T) {
+		i := &ipServiceServer{
+			log:          log,
+			ds:           ds,
+			ipam:         ipam,
+			outbox:       newOutbox(log, ds, ipam),
+			masterClient: newMasterClient(t),
+		}
+		got, err := i.Allocate(ctx, connect.NewRequest(&apiv1.IPServiceAllocateRequest{Project: "p1", Network: "n1"}))
+		require.NoError(t, err)
+
+		stored, err := ds.IP().Get(ctx, got.Msg.Ip.Ip)
+		require.NoError(t, err)
+		require.Equal(t, "1.2.3.0/24", stored.ParentPrefixCidr)
+		require.Equal(t, got.Msg.Ip.Uuid, stored.AllocationUUID)
+		require.Equal(t, metal.IPv4AddressFamily, stored.AddressFamily)
+	})
+}
+
+func Test_ipServiceServer_AllocateDualStack(t *testing.T) {
+	ipam := test.StartIpam(t)
+
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	prefixes := map[string][]string{
+		"1.2.3.0/24":       nil,
+		"2001:db8::/96":    nil,
+		"3.4.5.0/24":       nil,
+		"2001:db8:1::/126": nil,
+	}
+	createIPs(t, ctx, ds, ipam, prefixes, nil)
+	createNetworks(t, ctx, ds, []*metal.Network{
+		{Base: metal.Base{ID: "dual"}, Prefixes: metal.Prefixes{{IP: "1.2.3.0", Length: "24"}, {IP: "2001:db8::", Length: "96"}}},
+		{Base: metal.Base{ID: "v4"}, Prefixes: metal.Prefixes{{IP: "1.2.3.0", Length: "24"}}},
+		{Base: metal.Base{ID: "conflict"}, Prefixes: metal.Prefixes{{IP: "3.4.5.0", Length: "24"}, {IP: "2001:db8:1::", Length: "126"}}},
+	})
+
+	i := &ipServiceServer{
+		log:          log,
+		ds:           ds,
+		ipam:         ipam,
+		outbox:       newOutbox(log, ds, ipam),
+		masterClient: newMasterClient(t),
+	}
+
+	acquiredIPs := func(prefix string) uint64 {
+		usage, err := ipam.PrefixUsage(ctx, connect.NewRequest(&ipamv1.PrefixUsageRequest{Cidr: prefix}))
+		require.NoError(t, err)
+		return usage.Msg.AcquiredIps
+	}
+
+	t.Run("allocate one ip of every family", func(t *testing.T) {
+		got, err := i.Allocate(ctx, connect.NewRequest(&apiv1.IPServiceAllocateRequest{Project: "p1", Network: "dual", Name: "lb", DualStack: true}))
+		require.NoError(t, err)
+		require.Len(t, got.Msg.Ips, 2)
+		require.Equal(t, got.Msg.Ip.Ip, got.Msg.Ips[0].Ip)
+
+		for idx, want := range []metal.AddressFamily{metal.IPv4AddressFamily, metal.IPv6AddressFamily} {
+			stored, err := ds.IP().Get(ctx, got.Msg.Ips[idx].Ip)
+			require.NoError(t, err)
+			require.Equal(t, want, stored.AddressFamily)
+			require.Equal(t, "lb", stored.Name)
+		}
+
+		listed, err := i.List(ctx, connect.NewRequest(&apiv1.IPServiceListRequest{Project: "p1", Af: apiv1.IPAddressFamily_IP_ADDRESS_FAMILY_V6.Enum()}))
+		require.NoError(t, err)
+		require.Len(t, listed.Msg.Ips, 1)
+		require.Equal(t, got.Msg.Ips[1].Ip, listed.Msg.Ips[0].Ip)
+	})
+
+	t.Run("allocate by address family", func(t *testing.T) {
+		got, err := i.Allocate(ctx, connect.NewRequest(&apiv1.IPServiceAllocateRequest{Project: "p1", Network: "dual", AddressFamily: apiv1.IPAddressFamily_IP_ADDRESS_FAMILY_V6.Enum()}))
+		require.NoError(t, err)
+		require.Empty(t, got.Msg.Ips)
+
+		af, err := metal.AddressFamilyOf(got.Msg.Ip.Ip)
+		require.NoError(t, err)
+		require.Equal(t, metal.IPv6AddressFamily, af)
+
+		_, err = i.Allocate(ctx, connect.NewRequest(&apiv1.IPServiceAllocateRequest{Project: "p1", Network: "dual", Ip: pointer.Pointer("1.2.3.100"), AddressFamily: apiv1.IPAddressFamily_IP_ADDRESS_FAMILY_V6.Enum()}))
+		require.Error(t, err)
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	})
+
+	t.Run("network without ipv6 prefix", func(t *testing.T) {
+		before := acquiredIPs("1.2.3.0/24")
+
+		_, err := i.Allocate(ctx, connect.NewRequest(&apiv1.IPServiceAllocateRequest{Project: "p1", Network: "v4", DualStack: true}))
+		require.Error(t, err)
+		require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+		// the ipv4 ip which was acquired first is released again
+		require.Equal(t, before, acquiredIPs("1.2.3.0/24"))
+	})
+
+	t.Run("specific ip can not be allocated dual-stack", func(t *testing.T) {
+		_, err := i.Allocate(ctx, connect.NewRequest(&apiv1.IPServiceAllocateRequest{Project: "p1", Network: "dual", Ip: pointer.Pointer("1.2.3.100"), DualStack: true}))
+		require.Error(t, err)
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	})
+
+	t.Run("both ips are rolled back if one can not be stored", func(t *testing.T) {
+		// every address of the ipv6 prefix is present in the datastore but not acquired in ipam,
+		// therefore storing whichever ipv6 ip ipam returns conflicts
+		for _, addr := range []string{"2001:db8:1::", "2001:db8:1::1", "2001:db8:1::2", "2001:db8:1::3"} {
+			_, err := ds.IP().Create(ctx, &metal.IP{IPAddress: addr, ProjectID: "p2", AddressFamily: metal.IPv6AddressFamily})
+			require.NoError(t, err)
+		}
+		before := acquiredIPs("3.4.5.0/24")
+
+		_, err := i.Allocate(ctx, connect.NewRequest(&apiv1.IPServiceAllocateRequest{Project: "p1", Network: "conflict", DualStack: true}))
+		require.Error(t, err)
+		require.Equal(t, connect.CodeAlreadyExists, connect.CodeOf(err))
+
+		// the conflicting ipv6 ip stays acquired because it is present in the datastore
+		require.Equal(t, before, acquiredIPs("3.4.5.0/24"))
+
+		ips, err := ds.IP().Search(ctx, &query{IPServiceListRequest: &apiv1.IPServiceListRequest{Project: "p1", Network: pointer.Pointer("conflict")}})
+		require.NoError(t, err)
+		require.Empty(t, ips)
+
+		ops, err := ds.Operation().List(ctx)
+		require.NoError(t, err)
+		require.Empty(t, ops)
+	})
+}
+
+func Test_ipServiceServer_Reservation(t *testing.T) {
+	ipam := test.StartIpam(t)
+
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	createIPs(t, ctx, ds, ipam, map[string][]string{"1.2.3.0/24": nil}, nil)
+	createNetworks(t, ctx, ds, []*metal.Network{
+		{Base: metal.Base{ID: "n1"}, Prefixes: metal.Prefixes{{IP: "1.2.3.0", Length: "24"}}},
+	})
+
+	outbox := newOutbox(log, ds, ipam)
+	i := &ipServiceServer{
+		log:          log,
+		ds:           ds,
+		ipam:         ipam,
+		outbox:       outbox,
+		masterClient: newMasterClient(t),
+	}
+
+	acquiredIPs := func() uint64 {
+		usage, err := ipam.PrefixUsage(ctx, connect.NewRequest(&ipamv1.PrefixUsageRequest{Cidr: "1.2.3.0/24"}))
+		require.NoError(t, err)
+		return usage.Msg.AcquiredIps
+	}
+	reserve := func(t *testing.T) (*apiv1.IP, *metal.Operation) {
+		got, err := i.Allocate(ctx, connect.NewRequest(&apiv1.IPServiceAllocateRequest{Project: "p1", Network: "n1", ReservationTtl: durationpb.New(time.Hour)}))
+		require.NoError(t, err)
+		require.NotNil(t, got.Msg.Ip.ReservedUntil)
+
+		ops, err := ds.Operation().List(ctx)
+		require.NoError(t, err)
+		for _, op := range ops {
+			if op.Type == metal.OperationExpireIPReservation && op.Payload[metal.OperationPayloadIP] == got.Msg.Ip.Ip {
+				require.True(t, op.NextAttempt.After(time.Now().Add(59*time.Minute)))
+				return got.Msg.Ip, op
+			}
+		}
+		require.Fail(t, "no pending expiry of the reservation", got.Msg.Ip.Ip)
+		return nil, nil
+	}
+	expire := func(t *testing.T, addr string) {
+		old, err := ds.IP().Get(ctx, addr)
+		require.NoError(t, err)
+		expired := *old
+		expired.ReservedUntil = pointer.Pointer(time.Now().Add(-time.Minute))
+		require.NoError(t, ds.IP().Update(ctx, &expired, old))
+	}
+
+	t.Run("confirmed reservation is kept", func(t *testing.T) {
+		reserved, op := reserve(t)
+
+		got, err := i.Confirm(ctx, connect.NewRequest(&apiv1.IPServiceConfirmRequest{Ip: reserved.Ip, Project: "p1", Type: apiv1.IPType_IP_TYPE_STATIC.Enum()}))
+		require.NoError(t, err)
+		require.Nil(t, got.Msg.Ip.ReservedUntil)
+		require.Equal(t, apiv1.IPType_IP_TYPE_STATIC, got.Msg.Ip.Type)
+
+		before := acquiredIPs()
+		require.NoError(t, outbox.Execute(ctx, op))
+		_, err = ds.IP().Get(ctx, reserved.Ip)
+		require.NoError(t, err)
+		require.Equal(t, before, acquiredIPs())
+
+		_, err = i.Confirm(ctx, connect.NewRequest(&apiv1.IPServiceConfirmRequest{Ip: reserved.Ip, Project: "p1"}))
+		require.Error(t, err)
+		require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	})
+
+	t.Run("expired reservation is released", func(t *testing.T) {
+		reserved, op := reserve(t)
+		expire(t, reserved.Ip)
+		before := acquiredIPs()
+
+		_, err := i.Confirm(ctx, connect.NewRequest(&apiv1.IPServiceConfirmRequest{Ip: reserved.Ip, Project: "p1"}))
+		require.Error(t, err)
+		require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+		require.NoError(t, outbox.Execute(ctx, op))
+		_, err = ds.IP().Get(ctx, reserved.Ip)
+		require.True(t, generic.IsNotFound(err))
+		require.Equal(t, before-1, acquiredIPs())
+	})
+
+	t.Run("expired reservation which was deleted already is left to its release operation", func(t *testing.T) {
+		reserved, op := reserve(t)
+		expire(t, reserved.Ip)
+		before := acquiredIPs()
+
+		stored, err := ds.IP().Get(ctx, reserved.Ip)
+		require.NoError(t, err)
+		require.NoError(t, ds.IP().Delete(ctx, stored))
+
+		require.NoError(t, outbox.Execute(ctx, op))
+		require.Equal(t, before, acquiredIPs())
+	})
+
+	t.Run("reservation which is not expired yet is retried", func(t *testing.T) {
+		reserved, op := reserve(t)
+
+		require.Error(t, outbox.Execute(ctx, op))
+		_, err := ds.IP().Get(ctx, reserved.Ip)
+		require.NoError(t, err)
+	})
+
+	t.Run("reservation of another project can not be confirmed", func(t *testing.T) {
+		reserved, _ := reserve(t)
+
+		_, err := i.Confirm(ctx, connect.NewRequest(&apiv1.IPServiceConfirmRequest{Ip: reserved.Ip, Project: "p2"}))
+		require.Error(t, err)
+		require.Equal(t, connect.CodeNotFound, connect.CodeOf(err))
+	})
+
+	t.Run("invalid reservation ttl", func(t *testing.T) {
+		for _, ttl := range []time.Duration{-time.Minute, 0, maxReservationTTL + time.Minute} {
+			_, err := i.Allocate(ctx, connect.NewRequest(&apiv1.IPServiceAllocateRequest{Project: "p1", Network: "n1", ReservationTtl: durationpb.New(ttl)}))
+			require.Error(t, err)
+			require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+		}
+	})
+}
+
+func Test_ipServiceServer_DeleteWithFailingIpam(t *testing.T) {
+	ipam := test.StartIpam(t)
+
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	// ipam refuses to release an unparsable ip, therefore the release fails and must stay pending
+	_, err = ds.IP().Create(ctx, &metal.IP{IPAddress: "invalid-ip", ProjectID: "p1", ParentPrefixCidr: "3.4.5.0/24"})
+	require.NoError(t, err)
+
+	i := &ipServiceServer{
+		log:    log,
+		ds:     ds,
+		ipam:   ipam,
+		outbox: newOutbox(log, ds, ipam),
+	}
+	_, err = i.Delete(ctx, connect.NewRequest(&apiv1.IPServiceDeleteRequest{Ip: "invalid-ip", Project: "p1"}))
+	require.NoError(t, err)
+
+	_, err = ds.IP().Get(ctx, "invalid-ip")
+	require.True(t, generic.IsNotFound(err))
+
+	ops, err := ds.Operation().List(ctx)
+	require.NoError(t, err)
+	require.Len(t, ops, 1)
+	require.Equal(t, metal.OperationReleaseIP, ops[0].Type)
+	require.Equal(t, "invalid-ip", ops[0].Payload[metal.OperationPayloadIP])
+	require.Equal(t, 1, ops[0].Attempts)
+	require.NotEmpty(t, ops[0].LastError)
+	require.True(t, ops[0].NextAttempt.After(ops[0].Created))
+}
+
+func Test_ExpireIPReservationHandlerWithFailingIpam(t *testing.T) {
+	ipam := test.StartIpam(t)
+
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	// ipam refuses to release an unparsable ip, therefore the release must be handed over to a release operation
+	reserved, err := ds.IP().Create(ctx, &metal.IP{
+		IPAddress:        "invalid-ip",
+		ProjectID:        "p1",
+		ParentPrefixCidr: "3.4.5.0/24",
+		AllocationUUID:   "a1",
+		ReservedUntil:    pointer.Pointer(time.Now().Add(-time.Minute)),
+	})
+	require.NoError(t, err)
+
+	err = ExpireIPReservationHandler(ds, ipam)(ctx, expireIPReservationOperation(reserved))
+	require.NoError(t, err)
+
+	_, err = ds.IP().Get(ctx, "invalid-ip")
+	require.True(t, generic.IsNotFound(err))
+
+	ops, err := ds.Operation().List(ctx)
+	require.NoError(t, err)
+	require.Len(t, ops, 1)
+	require.Equal(t, metal.OperationReleaseIP, ops[0].Type)
+	require.Equal(t, "invalid-ip", ops[0].Payload[metal.OperationPayloadIP])
+	require.Equal(t, "3.4.5.0/24", ops[0].Payload[metal.OperationPayloadPrefix])
+	require.NotEmpty(t, ops[0].LastError)
+}
+
+func Test_ipServiceServer_History(t *testing.T) {
+	ipam := test.StartIpam(t)
+
+	ctx := actor.ContextWithActor(context.Background(), "alice")
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	ips := []*metal.IP{
+		{Name: "ip1", IPAddress: "1.2.3.4", ProjectID: "p1"},
+	}
+	createIPs(t, ctx, ds, ipam, prefixMap, ips)
+
+	i := &ipServiceServer{log: log, ds: ds, ipam: ipam, outbox: newOutbox(log, ds, ipam)}
+	_, err = i.Update(ctx, connect.NewRequest(&apiv1.IPServiceUpdateRequest{Ip: "1.2.3.4", Project: "p1", Name: pointer.Pointer("ip2")}))
+	require.NoError(t, err)
+
+	got, err := i.History(ctx, connect.NewRequest(&apiv1.IPServiceHistoryRequest{Ip: "1.2.3.4", Project: "p1"}))
+	require.NoError(t, err)
+
+	want := &apiv1.IPServiceHistoryResponse{
+		Revisions: []*apiv1.IPRevision{
+			{Actor: "alice", Operation: "create", After: &apiv1.IP{Name: "ip1", Ip: "1.2.3.4", Project: "p1"}},
+			{Actor: "alice", Operation: "update", Before: &apiv1.IP{Name: "ip1", Ip: "1.2.3.4", Project: "p1"}, After: &apiv1.IP{Name: "ip2", Ip: "1.2.3.4", Project: "p1"}},
+		},
+	}
+	if diff := cmp.Diff(
+		want, got.Msg,
+		cmp.Options{
+			protocmp.Transform(),
+			protocmp.IgnoreFields(&apiv1.IP{}, "created_at", "updated_at", "deleted_at"),
+			protocmp.IgnoreFields(&apiv1.IPRevision{}, "timestamp"),
+		},
+	); diff != "" {
+		t.Errorf("ipServiceServer.History() diff:%s", diff)
+	}
+
+	_, err = i.History(ctx, connect.NewRequest(&apiv1.IPServiceHistoryRequest{Ip: "1.2.3.4", Project: "p2"}))
+	var connectErr *connect.Error
+	require.True(t, errors.As(err, &connectErr))
+	require.Equal(t, connect.CodeNotFound, connectErr.Code())
+}
+
+func Test_convertEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   generic.Event[*metal.IP]
+		want *apiv1.IPServiceWatchResponse
+	}{
+		{
+			name: "created",
+			ev:   generic.Event[*metal.IP]{Type: generic.EventCreated, New: &metal.IP{Name: "ip1", IPAddress: "1.2.3.4", ProjectID: "p1"}},
+			want: &apiv1.IPServiceWatchResponse{Type: apiv1.WatchEventType_WATCH_EVENT_TYPE_CREATED, New: &apiv1.IP{Name: "ip1", Ip: "1.2.3.4", Project: "p1"}},
+		},
+		{
+			name: "updated",
+			ev:   generic.Event[*metal.IP]{Type: generic.EventUpdated, Old: &metal.IP{Name: "ip1", IPAddress: "1.2.3.4", ProjectID: "p1"}, New: &metal.IP{Name: "ip2", IPAddress: "1.2.3.4", ProjectID: "p1"}},
+			want: &apiv1.IPServiceWatchResponse{Type: apiv1.WatchEventType_WATCH_EVENT_TYPE_UPDATED, Old: &apiv1.IP{Name: "ip1", Ip: "1.2.3.4", Project: "p1"}, New: &apiv1.IP{Name: "ip2", Ip: "1.2.3.4", Project: "p1"}},
+		},
+		{
+			name: "deleted",
+			ev:   generic.Event[*metal.IP]{Type: generic.EventDeleted, Old: &metal.IP{Name: "ip1", IPAddress: "1.2.3.4", ProjectID: "p1"}},
+			want: &apiv1.IPServiceWatchResponse{Type: apiv1.WatchEventType_WATCH_EVENT_TYPE_DELETED, Old: &apiv1.IP{Name: "ip1", Ip: "1.2.3.4", Project: "p1"}},
+		},
+		{
+			name: "machine ip is hidden",
+			ev:   generic.Event[*metal.IP]{Type: generic.EventCreated, New: &metal.IP{Name: "ip1", IPAddress: "1.2.3.4", ProjectID: "p1", Tags: []string{tag.MachineID + "=m1"}}},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := convertEvent(tt.ev)
+			if diff := cmp.Diff(
+				tt.want, got,
+				cmp.Options{
+					protocmp.Transform(),
+					protocmp.IgnoreFields(
+						&apiv1.IP{}, "created_at", "updated_at", "deleted_at",
+					),
+				},
+			); diff != "" {
+				t.Errorf("convertEvent() diff:%s", diff)
+			}
+		})
+	}
+}
+
+func newOutbox(log *slog.Logger, ds *generic.Datastore, ipam ipamv1connect.IpamServiceClient) *generic.Outbox {
+	return generic.NewOutbox(generic.OutboxConfig{
+		Log:       log,
+		Datastore: ds,
+		Handlers: map[metal.OperationType]generic.OperationHandler{
+			metal.OperationReleaseIP:           ReleaseIPHandler(ds, ipam),
+			metal.OperationExpireIPReservation: ExpireIPReservationHandler(ds, ipam),
+		},
+	})
+}
+
+// newMasterClient returns a masterdata client which knows every project, the given projects are returned with their annotations.
+func newMasterClient(t *testing.T, projects ...*mdmv1.Project) mdc.Client {
+	psc := mdmv1mock.NewProjectServiceClient(t)
+	psc.On("Get", tmock.Anything, tmock.Anything).Return(func(_ context.Context, req *mdmv1.ProjectGetRequest, _ ...grpc.CallOption) (*mdmv1.ProjectResponse, error) {
+		for _, p := range projects {
+			if p.Meta.Id == req.Id {
+				return &mdmv1.ProjectResponse{Project: p}, nil
+			}
+		}
+		return &mdmv1.ProjectResponse{Project: &mdmv1.Project{Meta: &mdmv1.Meta{Id: req.Id}}}, nil
+	}).Maybe()
+	return mdc.NewMock(psc, nil, nil, nil)
+}
+
+func createNetworks(t *testing.T, ctx context.Context, ds *generic.Datastore, nws []*metal.Network) {
+	for _, nw := range nws {
+		_, err := ds.Network().Create(ctx, nw)
+		require.NoError(t, err)
+	}
 }
 
 func createIPs(t *testing.T, ctx context.Context, ds *generic.Datastore, ipam ipamv1connect.IpamServiceClient, prefixesMap map[string][]string, ips []*metal.IP) {
@@ -418,12 +1147,15 @@ func createIPs(t *testing.T, ctx context.Context, ds *generic.Datastore, ipam ip
 		require.NoError(t, err)
 	}
 	for _, ip := range ips {
-		created, err := ds.IP().Create(ctx, &metal.IP{
+		newIP := &metal.IP{
 			Name: ip.Name, IPAddress: ip.IPAddress,
 			ProjectID: ip.ProjectID, AllocationUUID: ip.AllocationUUID,
 			ParentPrefixCidr: ip.ParentPrefixCidr, Description: ip.Description,
 			NetworkID: ip.NetworkID, Type: ip.Type, Tags: ip.Tags,
-		})
+		}
+		require.NoError(t, newIP.SetAddressFields())
+
+		created, err := ds.IP().Create(ctx, newIP)
 		require.NoError(t, err)
 
 		var prefix string
@@ -0,0 +1,188 @@
+package machine
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"connectrpc.com/connect"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+	"github.com/metal-stack/api/go/metalstack/api/v1/apiv1connect"
+	"github.com/metal-stack/metal-lib/pkg/tag"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type Config struct {
+	Log       *slog.Logger
+	Datastore *generic.Datastore
+}
+type machineServiceServer struct {
+	log *slog.Logger
+	ds  *generic.Datastore
+}
+
+func New(c Config) apiv1connect.MachineServiceHandler {
+	return &machineServiceServer{
+		log: c.Log.WithGroup("machineService"),
+		ds:  c.Datastore,
+	}
+}
+
+// Get implements v1.MachineServiceServer
+func (m *machineServiceServer) Get(ctx context.Context, rq *connect.Request[apiv1.MachineServiceGetRequest]) (*connect.Response[apiv1.MachineServiceGetResponse], error) {
+	m.log.Debug("get", "machine", rq)
+	req := rq.Msg
+	if req.Project == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("project must be given"))
+	}
+
+	resp, err := m.ds.Machine().Get(ctx, req.Id)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+	// machines of other projects and machines which are not allocated are not visible
+	if resp.ProjectID != req.Project {
+		return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("machine %q not found", req.Id))
+	}
+
+	ips, err := m.ds.IP().Search(ctx, ipQuery{project: req.Project, machine: &resp.ID})
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&apiv1.MachineServiceGetResponse{
+		Machine: convert(resp, ips),
+	}), nil
+}
+
+// List implements v1.MachineServiceServer
+func (m *machineServiceServer) List(ctx context.Context, rq *connect.Request[apiv1.MachineServiceListRequest]) (*connect.Response[apiv1.MachineServiceListResponse], error) {
+	m.log.Debug("list", "machine", rq)
+	req := rq.Msg
+	if req.Project == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("project must be given"))
+	}
+
+	resp, err := m.ds.Machine().Search(ctx, query{MachineServiceListRequest: req})
+	if err != nil {
+		return nil, err
+	}
+
+	// the ips of all machines are read at once and assigned by their machine tag
+	ips, err := m.ds.IP().Search(ctx, ipQuery{project: req.Project})
+	if err != nil {
+		return nil, err
+	}
+	ipsByMachine := map[string][]*metal.IP{}
+	for _, ip := range ips {
+		machineID, ok := tag.NewTagMap(ip.Tags).Value(tag.MachineID)
+		if !ok {
+			continue
+		}
+		ipsByMachine[machineID] = append(ipsByMachine[machineID], ip)
+	}
+
+	var res []*apiv1.Machine
+	for _, machine := range resp {
+		res = append(res, convert(machine, ipsByMachine[machine.ID]))
+	}
+
+	return connect.NewResponse(&apiv1.MachineServiceListResponse{
+		Machines: res,
+	}), nil
+}
+
+func convert(resp *metal.Machine, ips []*metal.IP) *apiv1.Machine {
+	machine := &apiv1.Machine{
+		Id:        resp.ID,
+		Partition: resp.PartitionID,
+		Size:      resp.SizeID,
+		Rack:      resp.RackID,
+		Project:   resp.ProjectID,
+		Image:     resp.ImageID,
+		Hardware: &apiv1.MachineHardware{
+			Memory:   resp.Hardware.Memory,
+			CpuCores: uint32(resp.Hardware.CPUCores),
+		},
+		Tags:      resp.Tags,
+		CreatedAt: timestamppb.New(resp.Created),
+		UpdatedAt: timestamppb.New(resp.Changed),
+	}
+	for _, disk := range resp.Hardware.Disks {
+		machine.Hardware.Disks = append(machine.Hardware.Disks, &apiv1.MachineBlockDevice{
+			Name: disk.Name,
+			Size: disk.Size,
+		})
+	}
+
+	if resp.Allocation != nil {
+		role := apiv1.MachineRole_MACHINE_ROLE_UNSPECIFIED
+		switch resp.Allocation.Role {
+		case metal.RoleMachine:
+			role = apiv1.MachineRole_MACHINE_ROLE_MACHINE
+		case metal.RoleFirewall:
+			role = apiv1.MachineRole_MACHINE_ROLE_FIREWALL
+		}
+
+		machine.Allocation = &apiv1.MachineAllocation{
+			Name:          resp.Allocation.Name,
+			Description:   resp.Allocation.Description,
+			Hostname:      resp.Allocation.Hostname,
+			Role:          role,
+			SshPublicKeys: resp.Allocation.SSHPubKeys,
+			CreatedAt:     timestamppb.New(resp.Allocation.Created),
+		}
+		for _, ip := range ips {
+			machine.Allocation.Ips = append(machine.Allocation.Ips, ip.IPAddress)
+		}
+	}
+
+	return machine
+}
+
+type query struct {
+	*apiv1.MachineServiceListRequest
+}
+
+func (p query) Predicates() []generic.Predicate {
+	// Project is mandatory, machines which are not allocated are never listed
+	predicates := []generic.Predicate{generic.Eq("projectid", p.Project)}
+
+	if p.Partition != nil {
+		predicates = append(predicates, generic.Eq("partitionid", *p.Partition))
+	}
+
+	if p.Size != nil {
+		predicates = append(predicates, generic.Eq("sizeid", *p.Size))
+	}
+
+	if p.Image != nil {
+		predicates = append(predicates, generic.Eq("imageid", *p.Image))
+	}
+
+	for _, t := range p.Tags {
+		predicates = append(predicates, generic.Contains("tags", t))
+	}
+
+	return predicates
+}
+
+type ipQuery struct {
+	project string
+	machine *string
+}
+
+func (q ipQuery) Predicates() []generic.Predicate {
+	predicates := []generic.Predicate{generic.Eq("projectid", q.project)}
+
+	if q.machine != nil {
+		predicates = append(predicates, generic.Contains("tags", fmt.Sprintf("%s=%s", tag.MachineID, *q.machine)))
+	}
+
+	return predicates
+}
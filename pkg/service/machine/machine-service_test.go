@@ -0,0 +1,193 @@
+package machine
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/google/go-cmp/cmp"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+	"github.com/metal-stack/metal-lib/pkg/pointer"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func Test_machineServiceServer_Get(t *testing.T) {
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds := createMachines(t, ctx)
+
+	tests := []struct {
+		name           string
+		rq             *apiv1.MachineServiceGetRequest
+		want           *apiv1.MachineServiceGetResponse
+		wantReturnCode connect.Code
+	}{
+		{
+			name: "allocated machine of the project",
+			rq:   &apiv1.MachineServiceGetRequest{Id: "m1", Project: "p1"},
+			want: &apiv1.MachineServiceGetResponse{Machine: &apiv1.Machine{
+				Id:        "m1",
+				Partition: "partition-a",
+				Size:      "c1-large-x86",
+				Project:   "p1",
+				Image:     "debian-12",
+				Hardware: &apiv1.MachineHardware{
+					Memory:   1 << 30,
+					CpuCores: 8,
+					Disks:    []*apiv1.MachineBlockDevice{{Name: "/dev/sda", Size: 1 << 40}},
+				},
+				Allocation: &apiv1.MachineAllocation{
+					Name:     "worker",
+					Hostname: "worker-0",
+					Role:     apiv1.MachineRole_MACHINE_ROLE_MACHINE,
+					Ips:      []string{"1.2.3.4"},
+				},
+			}},
+		},
+		{
+			name:           "machine of another project",
+			rq:             &apiv1.MachineServiceGetRequest{Id: "m3", Project: "p1"},
+			wantReturnCode: connect.CodeNotFound,
+		},
+		{
+			name:           "machine which is not allocated",
+			rq:             &apiv1.MachineServiceGetRequest{Id: "m4", Project: "p1"},
+			wantReturnCode: connect.CodeNotFound,
+		},
+		{
+			name:           "machine which is not allocated without project",
+			rq:             &apiv1.MachineServiceGetRequest{Id: "m4"},
+			wantReturnCode: connect.CodeInvalidArgument,
+		},
+		{
+			name:           "non existing machine",
+			rq:             &apiv1.MachineServiceGetRequest{Id: "m5", Project: "p1"},
+			wantReturnCode: connect.CodeNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &machineServiceServer{log: log, ds: ds}
+			got, err := m.Get(ctx, connect.NewRequest(tt.rq))
+			if tt.wantReturnCode != 0 {
+				require.Error(t, err)
+				require.Equal(t, tt.wantReturnCode, connect.CodeOf(err))
+				return
+			}
+			require.NoError(t, err)
+			if diff := cmp.Diff(
+				tt.want, got.Msg,
+				protocmp.Transform(),
+				protocmp.IgnoreFields(&apiv1.Machine{}, "created_at", "updated_at"),
+				protocmp.IgnoreFields(&apiv1.MachineAllocation{}, "created_at"),
+			); diff != "" {
+				t.Errorf("machineServiceServer.Get() diff:%s", diff)
+			}
+		})
+	}
+}
+
+func Test_machineServiceServer_List(t *testing.T) {
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds := createMachines(t, ctx)
+
+	tests := []struct {
+		name    string
+		rq      *apiv1.MachineServiceListRequest
+		want    []string
+		wantIPs map[string][]string
+	}{
+		{
+			name:    "all machines of the project",
+			rq:      &apiv1.MachineServiceListRequest{Project: "p1"},
+			want:    []string{"m1", "m2"},
+			wantIPs: map[string][]string{"m1": {"1.2.3.4"}, "m2": {"1.2.3.5", "2001:db8::1"}},
+		},
+		{
+			name: "by size",
+			rq:   &apiv1.MachineServiceListRequest{Project: "p1", Size: pointer.Pointer("c1-large-x86")},
+			want: []string{"m1"},
+		},
+		{
+			name: "by partition",
+			rq:   &apiv1.MachineServiceListRequest{Project: "p2", Partition: pointer.Pointer("partition-a")},
+			want: []string{"m3"},
+		},
+		{
+			name: "by tag",
+			rq:   &apiv1.MachineServiceListRequest{Project: "p1", Tags: []string{"purpose=firewall"}},
+			want: []string{"m2"},
+		},
+		{
+			name: "project without machines",
+			rq:   &apiv1.MachineServiceListRequest{Project: "p3"},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &machineServiceServer{log: log, ds: ds}
+			got, err := m.List(ctx, connect.NewRequest(tt.rq))
+			require.NoError(t, err)
+
+			var ids []string
+			for _, machine := range got.Msg.Machines {
+				ids = append(ids, machine.Id)
+				if tt.wantIPs != nil {
+					require.ElementsMatch(t, tt.wantIPs[machine.Id], machine.Allocation.Ips)
+				}
+			}
+			require.ElementsMatch(t, tt.want, ids)
+		})
+	}
+}
+
+func createMachines(t *testing.T, ctx context.Context) *generic.Datastore {
+	ds, err := generic.NewMemory(slog.Default())
+	require.NoError(t, err)
+
+	machines := []*metal.Machine{
+		{
+			Base: metal.Base{ID: "m1"}, PartitionID: "partition-a", SizeID: "c1-large-x86", ProjectID: "p1", ImageID: "debian-12",
+			Allocation: &metal.MachineAllocation{Name: "worker", Hostname: "worker-0", Role: metal.RoleMachine},
+			Hardware:   metal.MachineHardware{Memory: 1 << 30, CPUCores: 8, Disks: []metal.BlockDevice{{Name: "/dev/sda", Size: 1 << 40}}},
+		},
+		{
+			Base: metal.Base{ID: "m2"}, PartitionID: "partition-a", SizeID: "n1-medium-x86", ProjectID: "p1", ImageID: "firewall-3",
+			Allocation: &metal.MachineAllocation{Name: "firewall", Role: metal.RoleFirewall},
+			Tags:       []string{"purpose=firewall"},
+		},
+		{
+			Base: metal.Base{ID: "m3"}, PartitionID: "partition-a", SizeID: "c1-large-x86", ProjectID: "p2", ImageID: "debian-12",
+			Allocation: &metal.MachineAllocation{Name: "other", Role: metal.RoleMachine},
+		},
+		{
+			Base: metal.Base{ID: "m4"}, PartitionID: "partition-b", SizeID: "c1-large-x86",
+		},
+	}
+	for _, m := range machines {
+		_, err := ds.Machine().Create(ctx, m)
+		require.NoError(t, err)
+	}
+
+	ips := []*metal.IP{
+		{IPAddress: "1.2.3.4", ProjectID: "p1", Tags: []string{"machine.metal-stack.io/id=m1"}},
+		{IPAddress: "1.2.3.5", ProjectID: "p1", Tags: []string{"machine.metal-stack.io/id=m2"}},
+		{IPAddress: "2001:db8::1", ProjectID: "p1", Tags: []string{"machine.metal-stack.io/id=m2"}},
+		{IPAddress: "1.2.3.6", ProjectID: "p1"},
+		{IPAddress: "1.2.3.7", ProjectID: "p2", Tags: []string{"machine.metal-stack.io/id=m1"}},
+	}
+	for _, ip := range ips {
+		_, err := ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+
+	return ds
+}
@@ -0,0 +1,299 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"connectrpc.com/connect"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	adminv1 "github.com/metal-stack/api/go/metalstack/admin/v1"
+	"github.com/metal-stack/api/go/metalstack/admin/v1/adminv1connect"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
+	"github.com/metal-stack/metal-lib/pkg/pointer"
+)
+
+type networkAdminServiceServer struct {
+	networks
+}
+
+func NewAdmin(c Config) adminv1connect.NetworkServiceHandler {
+	return &networkAdminServiceServer{
+		networks: networks{
+			log:    c.Log.WithGroup("networkAdminService"),
+			ds:     c.Datastore,
+			ipam:   c.Ipam,
+			outbox: c.Outbox,
+		},
+	}
+}
+
+// List implements adminv1.NetworkServiceServer
+func (n *networkAdminServiceServer) List(ctx context.Context, rq *connect.Request[adminv1.NetworkServiceListRequest]) (*connect.Response[adminv1.NetworkServiceListResponse], error) {
+	n.log.Debug("list", "network", rq)
+	req := rq.Msg
+
+	resp, err := n.ds.Network().Search(ctx, query{
+		project:      req.Project,
+		partition:    req.Partition,
+		parent:       req.ParentNetworkId,
+		privateSuper: req.PrivateSuper,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*apiv1.Network
+	for _, nw := range resp {
+		res = append(res, convert(nw))
+	}
+
+	return connect.NewResponse(&adminv1.NetworkServiceListResponse{
+		Networks: res,
+	}), nil
+}
+
+// Create implements adminv1.NetworkServiceServer, the prefixes of the network are created in ipam,
+// or acquired as child prefixes if the network has a parent network.
+func (n *networkAdminServiceServer) Create(ctx context.Context, rq *connect.Request[adminv1.NetworkServiceCreateRequest]) (*connect.Response[adminv1.NetworkServiceCreateResponse], error) {
+	n.log.Debug("create", "network", rq)
+	req := rq.Msg.Network
+	if req == nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("network must be given"))
+	}
+	if req.Id == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("network id must be given"))
+	}
+
+	prefixes, err := metal.NewPrefixesFromCIDRs(req.Prefixes)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if len(prefixes) == 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("network %q must have at least one prefix", req.Id))
+	}
+	destinationPrefixes, err := metal.NewPrefixesFromCIDRs(req.DestinationPrefixes)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	nw := &metal.Network{
+		Base: metal.Base{
+			ID:          req.Id,
+			Name:        req.Name,
+			Description: req.Description,
+		},
+		Prefixes:            prefixes,
+		DestinationPrefixes: destinationPrefixes,
+		PartitionID:         req.Partition,
+		ProjectID:           req.Project,
+		ParentNetworkID:     req.ParentNetworkId,
+		Vrf:                 uint(req.Vrf),
+		PrivateSuper:        req.PrivateSuper,
+		Nat:                 req.Nat,
+		Underlay:            req.Underlay,
+		Shared:              req.Shared,
+		Labels:              req.Labels,
+	}
+
+	err = n.validate(ctx, nw)
+	if err != nil {
+		return nil, err
+	}
+
+	err = n.createPrefixes(ctx, nw)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := n.store(ctx, nw)
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&adminv1.NetworkServiceCreateResponse{Network: convert(created)}), nil
+}
+
+// Update implements adminv1.NetworkServiceServer, the prefixes of a network can not be changed.
+func (n *networkAdminServiceServer) Update(ctx context.Context, rq *connect.Request[adminv1.NetworkServiceUpdateRequest]) (*connect.Response[adminv1.NetworkServiceUpdateResponse], error) {
+	n.log.Debug("update", "network", rq)
+	req := rq.Msg
+
+	old, err := n.ds.Network().Get(ctx, req.Id)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	newNetwork := *old
+
+	if req.Name != nil {
+		newNetwork.Name = *req.Name
+	}
+	if req.Description != nil {
+		newNetwork.Description = *req.Description
+	}
+	if req.DestinationPrefixes != nil {
+		destinationPrefixes, err := metal.NewPrefixesFromCIDRs(req.DestinationPrefixes)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		newNetwork.DestinationPrefixes = destinationPrefixes
+	}
+	if req.Nat != nil {
+		newNetwork.Nat = *req.Nat
+	}
+	if req.Shared != nil {
+		newNetwork.Shared = *req.Shared
+	}
+	if req.Labels != nil {
+		newNetwork.Labels = req.Labels
+	}
+
+	err = n.update(ctx, &newNetwork, old)
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&adminv1.NetworkServiceUpdateResponse{Network: convert(&newNetwork)}), nil
+}
+
+// Delete implements adminv1.NetworkServiceServer
+func (n *networkAdminServiceServer) Delete(ctx context.Context, rq *connect.Request[adminv1.NetworkServiceDeleteRequest]) (*connect.Response[adminv1.NetworkServiceDeleteResponse], error) {
+	n.log.Debug("delete", "network", rq)
+	req := rq.Msg
+
+	nw, err := n.ds.Network().Get(ctx, req.Id)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	err = n.remove(ctx, nw)
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&adminv1.NetworkServiceDeleteResponse{Network: convert(nw)}), nil
+}
+
+// validate checks the references of a network, a partition can only have one private super network
+// and child networks must be created within the prefixes of their parent network.
+func (n *networkAdminServiceServer) validate(ctx context.Context, nw *metal.Network) error {
+	// the prefixes of a conflicting network would not be released, as the release is skipped for existing networks
+	_, err := n.ds.Network().Get(ctx, nw.ID)
+	if err == nil {
+		return connect.NewError(connect.CodeAlreadyExists, fmt.Errorf("network %q already exists", nw.ID))
+	}
+	if !generic.IsNotFound(err) {
+		return err
+	}
+
+	if nw.PartitionID != "" {
+		_, err := n.ds.Partition().Get(ctx, nw.PartitionID)
+		if err != nil {
+			if generic.IsNotFound(err) {
+				return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("partition %q of network %q does not exist", nw.PartitionID, nw.ID))
+			}
+			return err
+		}
+	}
+
+	if nw.PrivateSuper {
+		if nw.PartitionID == "" {
+			return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("private super network %q must belong to a partition", nw.ID))
+		}
+		if nw.ParentNetworkID != "" {
+			return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("private super network %q must not have a parent network", nw.ID))
+		}
+		supers, err := n.ds.Network().Search(ctx, query{partition: &nw.PartitionID, privateSuper: pointer.Pointer(true)})
+		if err != nil {
+			return err
+		}
+		if len(supers) > 0 {
+			return connect.NewError(connect.CodeAlreadyExists, fmt.Errorf("partition %q already has the private super network %q", nw.PartitionID, supers[0].ID))
+		}
+	}
+
+	if nw.ParentNetworkID != "" {
+		parent, err := n.ds.Network().Get(ctx, nw.ParentNetworkID)
+		if err != nil {
+			if generic.IsNotFound(err) {
+				return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("parent network %q of network %q does not exist", nw.ParentNetworkID, nw.ID))
+			}
+			return err
+		}
+		for _, prefix := range nw.Prefixes {
+			_, err := parentPrefix(parent, prefix)
+			if err != nil {
+				return connect.NewError(connect.CodeInvalidArgument, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// createPrefixes creates the prefixes of the network in ipam, prefixes which were already created
+// are released again if one of them fails.
+func (n *networkAdminServiceServer) createPrefixes(ctx context.Context, nw *metal.Network) error {
+	var parent *metal.Network
+	if nw.ParentNetworkID != "" {
+		var err error
+		parent, err = n.ds.Network().Get(ctx, nw.ParentNetworkID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, prefix := range nw.Prefixes {
+		var err error
+		if parent == nil {
+			_, err = n.ipam.CreatePrefix(ctx, connect.NewRequest(&ipamv1.CreatePrefixRequest{Cidr: prefix.String()}))
+		} else {
+			var parentCidr string
+			parentCidr, err = parentPrefix(parent, prefix)
+			if err == nil {
+				_, err = n.ipam.AcquireChildPrefix(ctx, connect.NewRequest(&ipamv1.AcquireChildPrefixRequest{Cidr: parentCidr, ChildCidr: pointer.Pointer(prefix.String())}))
+			}
+		}
+		if err != nil {
+			created := *nw
+			created.Prefixes = nw.Prefixes[:i]
+			n.releasePrefixes(ctx, &created)
+			err = fmt.Errorf("unable to create prefix %q of network %q: %w", prefix.String(), nw.ID, err)
+			var connectErr *connect.Error
+			if errors.As(err, &connectErr) {
+				return connect.NewError(connectErr.Code(), err)
+			}
+			return connect.NewError(connect.CodeInternal, err)
+		}
+	}
+
+	return nil
+}
+
+// parentPrefix returns the prefix of the parent network which contains the given prefix.
+func parentPrefix(parent *metal.Network, prefix metal.Prefix) (string, error) {
+	child, err := netip.ParsePrefix(prefix.String())
+	if err != nil {
+		return "", err
+	}
+	for _, p := range parent.Prefixes {
+		pfx, err := netip.ParsePrefix(p.String())
+		if err != nil {
+			return "", fmt.Errorf("unable to parse prefix %q of network %q: %w", p.String(), parent.ID, err)
+		}
+		if pfx.Bits() < child.Bits() && pfx.Contains(child.Addr()) {
+			return pfx.String(), nil
+		}
+	}
+	return "", fmt.Errorf("prefix %q is not contained in any prefix of the parent network %q", prefix.String(), parent.ID)
+}
@@ -0,0 +1,66 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
+	ipamv1connect "github.com/metal-stack/go-ipam/api/v1/apiv1connect"
+)
+
+// releaseGracePeriod is the time a pending release operation is not touched by the outbox worker,
+// the request which enqueued it should have finished its datastore modification by then.
+const releaseGracePeriod = time.Minute
+
+// ReleasePrefixesHandler returns the handler which releases the prefixes of a network in ipam if the network
+// is not present in the datastore anymore. Prefixes of a network with a parent network are child prefixes
+// which are given back to the parent, all other prefixes are deleted.
+func ReleasePrefixesHandler(ds *generic.Datastore, ipam ipamv1connect.IpamServiceClient) generic.OperationHandler {
+	return func(ctx context.Context, op *metal.Operation) error {
+		var (
+			network  = op.Payload[metal.OperationPayloadNetwork]
+			prefixes = op.Payload[metal.OperationPayloadPrefixes]
+			child    = op.Payload[metal.OperationPayloadParentNetwork] != ""
+		)
+
+		_, err := ds.Network().Get(ctx, network)
+		if err == nil {
+			return nil
+		}
+		if !generic.IsNotFound(err) {
+			return err
+		}
+
+		for _, prefix := range strings.Split(prefixes, ",") {
+			if prefix == "" {
+				continue
+			}
+			if child {
+				_, err = ipam.ReleaseChildPrefix(ctx, connect.NewRequest(&ipamv1.ReleaseChildPrefixRequest{Cidr: prefix}))
+			} else {
+				_, err = ipam.DeletePrefix(ctx, connect.NewRequest(&ipamv1.DeletePrefixRequest{Cidr: prefix}))
+			}
+			if err != nil && connect.CodeOf(err) != connect.CodeNotFound {
+				return fmt.Errorf("unable to release prefix %q of network %q: %w", prefix, network, err)
+			}
+		}
+
+		return nil
+	}
+}
+
+func releasePrefixesOperation(nw *metal.Network) *metal.Operation {
+	return &metal.Operation{
+		Type: metal.OperationReleasePrefixes,
+		Payload: map[string]string{
+			metal.OperationPayloadNetwork:       nw.ID,
+			metal.OperationPayloadPrefixes:      strings.Join(nw.Prefixes.String(), ","),
+			metal.OperationPayloadParentNetwork: nw.ParentNetworkID,
+		},
+	}
+}
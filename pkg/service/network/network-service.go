@@ -0,0 +1,399 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+
+	"connectrpc.com/connect"
+	"github.com/google/uuid"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+	"github.com/metal-stack/api/go/metalstack/api/v1/apiv1connect"
+	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
+	ipamv1connect "github.com/metal-stack/go-ipam/api/v1/apiv1connect"
+	"github.com/metal-stack/metal-lib/pkg/pointer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type Config struct {
+	Log       *slog.Logger
+	Datastore *generic.Datastore
+	Ipam      ipamv1connect.IpamServiceClient
+	Outbox    *generic.Outbox
+}
+
+// networks holds the modifications of networks which must be kept consistent between the datastore and ipam,
+// they are shared by the network service and the admin network service.
+type networks struct {
+	log    *slog.Logger
+	ds     *generic.Datastore
+	ipam   ipamv1connect.IpamServiceClient
+	outbox *generic.Outbox
+}
+
+type networkServiceServer struct {
+	networks
+}
+
+func New(c Config) apiv1connect.NetworkServiceHandler {
+	return &networkServiceServer{
+		networks: networks{
+			log:    c.Log.WithGroup("networkService"),
+			ds:     c.Datastore,
+			ipam:   c.Ipam,
+			outbox: c.Outbox,
+		},
+	}
+}
+
+// Get implements v1.NetworkServiceServer
+func (n *networkServiceServer) Get(ctx context.Context, rq *connect.Request[apiv1.NetworkServiceGetRequest]) (*connect.Response[apiv1.NetworkServiceGetResponse], error) {
+	n.log.Debug("get", "network", rq)
+	req := rq.Msg
+
+	resp, err := n.ds.Network().Get(ctx, req.Id)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+	if !visibleTo(resp, req.Project) {
+		return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("network %q not found", req.Id))
+	}
+
+	return connect.NewResponse(&apiv1.NetworkServiceGetResponse{
+		Network: convert(resp),
+	}), nil
+}
+
+// List implements v1.NetworkServiceServer
+func (n *networkServiceServer) List(ctx context.Context, rq *connect.Request[apiv1.NetworkServiceListRequest]) (*connect.Response[apiv1.NetworkServiceListResponse], error) {
+	n.log.Debug("list", "network", rq)
+	req := rq.Msg
+
+	// the networks of the project and the networks which do not belong to any project, e.g. the internet
+	var res []*apiv1.Network
+	for _, project := range []string{req.Project, ""} {
+		resp, err := n.ds.Network().Search(ctx, query{project: &project, partition: req.Partition})
+		if err != nil {
+			return nil, err
+		}
+		for _, nw := range resp {
+			if !hasLabels(nw, req.Labels) {
+				continue
+			}
+			res = append(res, convert(nw))
+		}
+	}
+
+	return connect.NewResponse(&apiv1.NetworkServiceListResponse{
+		Networks: res,
+	}), nil
+}
+
+// Create implements v1.NetworkServiceServer, it creates a private network of the project with a child prefix
+// of the private super network of the partition.
+func (n *networkServiceServer) Create(ctx context.Context, rq *connect.Request[apiv1.NetworkServiceCreateRequest]) (*connect.Response[apiv1.NetworkServiceCreateResponse], error) {
+	n.log.Debug("create", "network", rq)
+	req := rq.Msg
+
+	partition, err := n.ds.Partition().Get(ctx, req.Partition)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	supers, err := n.ds.Network().Search(ctx, query{partition: &partition.ID, privateSuper: pointer.Pointer(true)})
+	if err != nil {
+		return nil, err
+	}
+	if len(supers) == 0 {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("partition %q has no private super network", partition.ID))
+	}
+	super := supers[0]
+
+	prefix, err := n.acquireChildPrefix(ctx, super, partition.PrivateNetworkPrefixLength)
+	if err != nil {
+		return nil, err
+	}
+
+	nw := &metal.Network{
+		Base: metal.Base{
+			ID:          uuid.NewString(),
+			Name:        req.Name,
+			Description: req.Description,
+		},
+		Prefixes:        metal.Prefixes{*prefix},
+		PartitionID:     partition.ID,
+		ProjectID:       req.Project,
+		ParentNetworkID: super.ID,
+		Labels:          req.Labels,
+	}
+
+	created, err := n.store(ctx, nw)
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&apiv1.NetworkServiceCreateResponse{Network: convert(created)}), nil
+}
+
+// Update implements v1.NetworkServiceServer
+func (n *networkServiceServer) Update(ctx context.Context, rq *connect.Request[apiv1.NetworkServiceUpdateRequest]) (*connect.Response[apiv1.NetworkServiceUpdateResponse], error) {
+	n.log.Debug("update", "network", rq)
+	req := rq.Msg
+
+	old, err := n.ds.Network().Get(ctx, req.Id)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+	if old.ProjectID != req.Project {
+		return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("network %q not found", req.Id))
+	}
+
+	newNetwork := *old
+
+	if req.Name != nil {
+		newNetwork.Name = *req.Name
+	}
+	if req.Description != nil {
+		newNetwork.Description = *req.Description
+	}
+	if req.Labels != nil {
+		newNetwork.Labels = req.Labels
+	}
+
+	err = n.update(ctx, &newNetwork, old)
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&apiv1.NetworkServiceUpdateResponse{Network: convert(&newNetwork)}), nil
+}
+
+// Delete implements v1.NetworkServiceServer
+func (n *networkServiceServer) Delete(ctx context.Context, rq *connect.Request[apiv1.NetworkServiceDeleteRequest]) (*connect.Response[apiv1.NetworkServiceDeleteResponse], error) {
+	n.log.Debug("delete", "network", rq)
+	req := rq.Msg
+
+	nw, err := n.ds.Network().Get(ctx, req.Id)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+	if nw.ProjectID != req.Project {
+		return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("network %q not found", req.Id))
+	}
+
+	err = n.remove(ctx, nw)
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&apiv1.NetworkServiceDeleteResponse{Network: convert(nw)}), nil
+}
+
+// acquireChildPrefix acquires a child prefix of the given length in the first prefix of the parent network
+// which has one available.
+func (n *networks) acquireChildPrefix(ctx context.Context, parent *metal.Network, length uint8) (*metal.Prefix, error) {
+	for _, prefix := range parent.Prefixes {
+		pfx, err := netip.ParsePrefix(prefix.String())
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse prefix %q of network %q: %w", prefix.String(), parent.ID, err)
+		}
+		if pfx.Bits() >= int(length) || pfx.Addr().BitLen() < int(length) {
+			continue
+		}
+
+		resp, err := n.ipam.AcquireChildPrefix(ctx, connect.NewRequest(&ipamv1.AcquireChildPrefixRequest{Cidr: pfx.String(), Length: uint32(length)}))
+		if err != nil {
+			// the prefix is exhausted, try the next one
+			n.log.Debug("unable to acquire child prefix", "prefix", pfx.String(), "length", length, "error", err)
+			continue
+		}
+		return metal.NewPrefixFromCIDR(resp.Msg.Prefix.Cidr)
+	}
+
+	return nil, connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("no child prefix of length %d available in network %q", length, parent.ID))
+}
+
+// store creates a network whose prefixes are already created in ipam, if the network can not be stored
+// the prefixes are released again.
+func (n *networks) store(ctx context.Context, nw *metal.Network) (*metal.Network, error) {
+	op, err := n.outbox.Enqueue(ctx, releasePrefixesOperation(nw), releaseGracePeriod)
+	if err != nil {
+		n.releasePrefixes(ctx, nw)
+		return nil, err
+	}
+
+	created, err := n.ds.Network().Create(ctx, nw)
+	if err != nil {
+		if executeErr := n.outbox.Execute(context.WithoutCancel(ctx), op); executeErr != nil {
+			n.log.Warn("unable to release prefixes in ipam after failed creation, will be retried", "network", nw.ID, "error", executeErr)
+		}
+		if generic.IsConflict(err) {
+			return nil, connect.NewError(connect.CodeAlreadyExists, err)
+		}
+		return nil, err
+	}
+
+	err = n.outbox.Complete(ctx, op)
+	if err != nil {
+		// the worker will find the network in the datastore and drop the operation without releasing the prefixes
+		n.log.Warn("unable to remove pending release operation", "network", nw.ID, "error", err)
+	}
+
+	return created, nil
+}
+
+// releasePrefixes releases the prefixes of a network which was not stored in the datastore.
+func (n *networks) releasePrefixes(ctx context.Context, nw *metal.Network) {
+	err := ReleasePrefixesHandler(n.ds, n.ipam)(context.WithoutCancel(ctx), releasePrefixesOperation(nw))
+	if err != nil {
+		n.log.Error("unable to release prefixes in ipam after failed creation", "network", nw.ID, "prefixes", nw.Prefixes.String(), "error", err)
+	}
+}
+
+func (n *networks) update(ctx context.Context, newNetwork, old *metal.Network) error {
+	err := n.ds.Network().Update(ctx, newNetwork, old)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return connect.NewError(connect.CodeNotFound, err)
+		}
+		if generic.IsConflict(err) {
+			return connect.NewError(connect.CodeAborted, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// remove deletes a network and releases its prefixes in ipam, it is refused as long as the network
+// has ips or child networks.
+func (n *networks) remove(ctx context.Context, nw *metal.Network) error {
+	ips, err := n.ds.IP().Search(ctx, ipQuery{network: nw.ID})
+	if err != nil {
+		return err
+	}
+	if len(ips) > 0 {
+		return connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("network %q still has %d ips", nw.ID, len(ips)))
+	}
+
+	children, err := n.ds.Network().Search(ctx, query{parent: &nw.ID})
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		return connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("network %q still has %d child networks", nw.ID, len(children)))
+	}
+
+	// the release in ipam is stored as pending operation first, if it fails after the network was deleted
+	// in the datastore it gets retried until both stores are consistent again
+	op, err := n.outbox.Enqueue(ctx, releasePrefixesOperation(nw), releaseGracePeriod)
+	if err != nil {
+		return err
+	}
+
+	err = n.ds.Network().Delete(ctx, nw)
+	if err != nil {
+		if completeErr := n.outbox.Complete(context.WithoutCancel(ctx), op); completeErr != nil {
+			n.log.Error("unable to remove pending release operation", "network", nw.ID, "error", completeErr)
+		}
+		if generic.IsNotFound(err) {
+			return connect.NewError(connect.CodeNotFound, err)
+		}
+		return err
+	}
+
+	err = n.outbox.Execute(ctx, op)
+	if err != nil {
+		n.log.Warn("unable to release prefixes in ipam, will be retried", "network", nw.ID, "error", err)
+	}
+
+	return nil
+}
+
+// visibleTo returns true if the network belongs to the project or to no project at all.
+func visibleTo(nw *metal.Network, project string) bool {
+	return nw.ProjectID == "" || nw.ProjectID == project
+}
+
+// hasLabels returns true if the network carries all the given labels with the same values.
+func hasLabels(nw *metal.Network, labels map[string]string) bool {
+	for k, v := range labels {
+		value, ok := nw.Labels[k]
+		if !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+func convert(resp *metal.Network) *apiv1.Network {
+	return &apiv1.Network{
+		Id:                  resp.ID,
+		Name:                resp.Name,
+		Description:         resp.Description,
+		Partition:           resp.PartitionID,
+		Project:             resp.ProjectID,
+		Prefixes:            resp.Prefixes.String(),
+		DestinationPrefixes: resp.DestinationPrefixes.String(),
+		ParentNetworkId:     resp.ParentNetworkID,
+		Vrf:                 uint32(resp.Vrf),
+		PrivateSuper:        resp.PrivateSuper,
+		Nat:                 resp.Nat,
+		Underlay:            resp.Underlay,
+		Shared:              resp.Shared,
+		Labels:              resp.Labels,
+		CreatedAt:           timestamppb.New(resp.Created),
+		UpdatedAt:           timestamppb.New(resp.Changed),
+	}
+}
+
+type query struct {
+	project      *string
+	partition    *string
+	parent       *string
+	privateSuper *bool
+}
+
+func (q query) Predicates() []generic.Predicate {
+	var predicates []generic.Predicate
+
+	if q.project != nil {
+		predicates = append(predicates, generic.Eq("projectid", *q.project))
+	}
+
+	if q.partition != nil {
+		predicates = append(predicates, generic.Eq("partitionid", *q.partition))
+	}
+
+	if q.parent != nil {
+		predicates = append(predicates, generic.Eq("parentnetworkid", *q.parent))
+	}
+
+	if q.privateSuper != nil {
+		predicates = append(predicates, generic.Eq("privatesuper", *q.privateSuper))
+	}
+
+	return predicates
+}
+
+type ipQuery struct {
+	network string
+}
+
+func (q ipQuery) Predicates() []generic.Predicate {
+	return []generic.Predicate{generic.Eq("networkid", q.network)}
+}
@@ -0,0 +1,195 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/metal-stack/api-server/pkg/test"
+	adminv1 "github.com/metal-stack/api/go/metalstack/admin/v1"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
+	ipamv1connect "github.com/metal-stack/go-ipam/api/v1/apiv1connect"
+	"github.com/metal-stack/metal-lib/pkg/pointer"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_networkServiceServer_PrivateNetworks(t *testing.T) {
+	ipam := test.StartIpam(t)
+
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	c := Config{Log: log, Datastore: ds, Ipam: ipam, Outbox: newOutbox(log, ds, ipam)}
+	admin := NewAdmin(c).(*networkAdminServiceServer)
+	n := New(c).(*networkServiceServer)
+
+	_, err = ds.Partition().Create(ctx, &metal.Partition{Base: metal.Base{ID: "partition-a"}, PrivateNetworkPrefixLength: 24})
+	require.NoError(t, err)
+
+	_, err = n.Create(ctx, connect.NewRequest(&apiv1.NetworkServiceCreateRequest{Project: "p1", Partition: "partition-a"}))
+	requireCode(t, connect.CodeFailedPrecondition, err)
+
+	_, err = admin.Create(ctx, connect.NewRequest(&adminv1.NetworkServiceCreateRequest{Network: &apiv1.Network{
+		Id: "tenant-super", Partition: "partition-a", PrivateSuper: true, Prefixes: []string{"10.0.0.0/23"},
+	}}))
+	require.NoError(t, err)
+
+	_, err = admin.Create(ctx, connect.NewRequest(&adminv1.NetworkServiceCreateRequest{Network: &apiv1.Network{
+		Id: "tenant-super-2", Partition: "partition-a", PrivateSuper: true, Prefixes: []string{"10.1.0.0/23"},
+	}}))
+	requireCode(t, connect.CodeAlreadyExists, err)
+
+	first, err := n.Create(ctx, connect.NewRequest(&apiv1.NetworkServiceCreateRequest{Project: "p1", Partition: "partition-a", Name: "first"}))
+	require.NoError(t, err)
+	require.Equal(t, "tenant-super", first.Msg.Network.ParentNetworkId)
+	require.Equal(t, "p1", first.Msg.Network.Project)
+	require.Len(t, first.Msg.Network.Prefixes, 1)
+
+	second, err := n.Create(ctx, connect.NewRequest(&apiv1.NetworkServiceCreateRequest{Project: "p2", Partition: "partition-a"}))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"10.0.0.0/24", "10.0.1.0/24"}, append(first.Msg.Network.Prefixes, second.Msg.Network.Prefixes...))
+
+	_, err = n.Create(ctx, connect.NewRequest(&apiv1.NetworkServiceCreateRequest{Project: "p1", Partition: "partition-a"}))
+	requireCode(t, connect.CodeResourceExhausted, err)
+
+	list, err := n.List(ctx, connect.NewRequest(&apiv1.NetworkServiceListRequest{Project: "p1"}))
+	require.NoError(t, err)
+	var ids []string
+	for _, nw := range list.Msg.Networks {
+		ids = append(ids, nw.Id)
+	}
+	require.ElementsMatch(t, []string{first.Msg.Network.Id, "tenant-super"}, ids)
+
+	_, err = n.Get(ctx, connect.NewRequest(&apiv1.NetworkServiceGetRequest{Id: second.Msg.Network.Id, Project: "p1"}))
+	requireCode(t, connect.CodeNotFound, err)
+
+	_, err = n.Delete(ctx, connect.NewRequest(&apiv1.NetworkServiceDeleteRequest{Id: "tenant-super", Project: "p1"}))
+	requireCode(t, connect.CodeNotFound, err)
+
+	_, err = ds.IP().Create(ctx, &metal.IP{IPAddress: "10.0.0.1", ProjectID: "p1", NetworkID: first.Msg.Network.Id})
+	require.NoError(t, err)
+	_, err = n.Delete(ctx, connect.NewRequest(&apiv1.NetworkServiceDeleteRequest{Id: first.Msg.Network.Id, Project: "p1"}))
+	requireCode(t, connect.CodeFailedPrecondition, err)
+
+	_, err = admin.Delete(ctx, connect.NewRequest(&adminv1.NetworkServiceDeleteRequest{Id: "tenant-super"}))
+	requireCode(t, connect.CodeFailedPrecondition, err)
+
+	require.NoError(t, ds.IP().Delete(ctx, &metal.IP{IPAddress: "10.0.0.1"}))
+	_, err = n.Delete(ctx, connect.NewRequest(&apiv1.NetworkServiceDeleteRequest{Id: first.Msg.Network.Id, Project: "p1"}))
+	require.NoError(t, err)
+
+	// the child prefix was released and can be acquired again
+	third, err := n.Create(ctx, connect.NewRequest(&apiv1.NetworkServiceCreateRequest{Project: "p1", Partition: "partition-a"}))
+	require.NoError(t, err)
+	require.Equal(t, first.Msg.Network.Prefixes, third.Msg.Network.Prefixes)
+
+	for _, id := range []string{second.Msg.Network.Id, third.Msg.Network.Id} {
+		_, err = admin.Delete(ctx, connect.NewRequest(&adminv1.NetworkServiceDeleteRequest{Id: id}))
+		require.NoError(t, err)
+	}
+	_, err = admin.Delete(ctx, connect.NewRequest(&adminv1.NetworkServiceDeleteRequest{Id: "tenant-super"}))
+	require.NoError(t, err)
+
+	_, err = ipam.GetPrefix(ctx, connect.NewRequest(&ipamv1.GetPrefixRequest{Cidr: "10.0.0.0/23"}))
+	requireCode(t, connect.CodeNotFound, err)
+}
+
+func Test_networkAdminServiceServer_Create(t *testing.T) {
+	ipam := test.StartIpam(t)
+
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	admin := NewAdmin(Config{Log: log, Datastore: ds, Ipam: ipam, Outbox: newOutbox(log, ds, ipam)}).(*networkAdminServiceServer)
+
+	_, err = admin.Create(ctx, connect.NewRequest(&adminv1.NetworkServiceCreateRequest{Network: &apiv1.Network{
+		Id: "internet", Prefixes: []string{"1.2.3.0/24", "2001:db8::/64"}, Nat: true,
+	}}))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		network  *apiv1.Network
+		wantCode connect.Code
+	}{
+		{
+			name:     "without id",
+			network:  &apiv1.Network{Prefixes: []string{"3.4.5.0/24"}},
+			wantCode: connect.CodeInvalidArgument,
+		},
+		{
+			name:     "without prefixes",
+			network:  &apiv1.Network{Id: "empty"},
+			wantCode: connect.CodeInvalidArgument,
+		},
+		{
+			name:     "invalid prefix",
+			network:  &apiv1.Network{Id: "invalid", Prefixes: []string{"3.4.5.0/33"}},
+			wantCode: connect.CodeInvalidArgument,
+		},
+		{
+			name:     "unknown partition",
+			network:  &apiv1.Network{Id: "unknown", Partition: "partition-z", Prefixes: []string{"3.4.5.0/24"}},
+			wantCode: connect.CodeInvalidArgument,
+		},
+		{
+			name:     "child prefix outside of the parent",
+			network:  &apiv1.Network{Id: "outside", ParentNetworkId: "internet", Prefixes: []string{"3.4.5.0/28"}},
+			wantCode: connect.CodeInvalidArgument,
+		},
+		{
+			name:     "existing id",
+			network:  &apiv1.Network{Id: "internet", Prefixes: []string{"3.4.5.0/24"}},
+			wantCode: connect.CodeAlreadyExists,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := admin.Create(ctx, connect.NewRequest(&adminv1.NetworkServiceCreateRequest{Network: tt.network}))
+			requireCode(t, tt.wantCode, err)
+		})
+	}
+
+	// the prefix of the rejected network with an existing id was released again
+	_, err = ipam.GetPrefix(ctx, connect.NewRequest(&ipamv1.GetPrefixRequest{Cidr: "3.4.5.0/24"}))
+	requireCode(t, connect.CodeNotFound, err)
+
+	child, err := admin.Create(ctx, connect.NewRequest(&adminv1.NetworkServiceCreateRequest{Network: &apiv1.Network{
+		Id: "internet-child", ParentNetworkId: "internet", Prefixes: []string{"1.2.3.0/28"},
+	}}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.0/28"}, child.Msg.Network.Prefixes)
+
+	list, err := admin.List(ctx, connect.NewRequest(&adminv1.NetworkServiceListRequest{ParentNetworkId: pointer.Pointer("internet")}))
+	require.NoError(t, err)
+	require.Len(t, list.Msg.Networks, 1)
+	require.Equal(t, "internet-child", list.Msg.Networks[0].Id)
+}
+
+func newOutbox(log *slog.Logger, ds *generic.Datastore, ipam ipamv1connect.IpamServiceClient) *generic.Outbox {
+	return generic.NewOutbox(generic.OutboxConfig{
+		Log:       log,
+		Datastore: ds,
+		Handlers: map[metal.OperationType]generic.OperationHandler{
+			metal.OperationReleasePrefixes: ReleasePrefixesHandler(ds, ipam),
+		},
+	})
+}
+
+func requireCode(t *testing.T, code connect.Code, err error) {
+	t.Helper()
+	var connectErr *connect.Error
+	require.True(t, errors.As(err, &connectErr), "expected a connect error, got %v", err)
+	require.Equal(t, code, connectErr.Code())
+}
@@ -0,0 +1,236 @@
+package network
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	adminv1 "github.com/metal-stack/api/go/metalstack/admin/v1"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
+	ipamv1connect "github.com/metal-stack/go-ipam/api/v1/apiv1connect"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultUsageInterval = time.Minute
+
+var (
+	prefixIPsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("api_server", "network", "prefix_ips"),
+		"the number of available and acquired ips per prefix of a network, go-ipam reports no more than 2^31 available ips",
+		[]string{"network", "prefix", "state"}, nil,
+	)
+	prefixChildPrefixesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("api_server", "network", "prefix_child_prefixes"),
+		"the number of acquired child prefixes and of available smallest child prefixes per prefix of a network",
+		[]string{"network", "prefix", "state"}, nil,
+	)
+	networkIPsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("api_server", "network", "ips"),
+		"the number of ips stored in the datastore per network, project and type",
+		[]string{"network", "project", "type"}, nil,
+	)
+)
+
+type (
+	UsageReporterConfig struct {
+		Log       *slog.Logger
+		Datastore *generic.Datastore
+		Ipam      ipamv1connect.IpamServiceClient
+		// Interval in which the usage is reported, defaults to one minute
+		Interval time.Duration
+	}
+
+	// UsageReporter exports the usage of the prefixes and ips of all networks as prometheus gauges.
+	// It is a prometheus.Collector which must be registered, a scrape always sees the last complete report.
+	UsageReporter struct {
+		networks
+		interval time.Duration
+
+		mu sync.RWMutex
+		// usages holds the last reported usage per network id
+		usages map[string]*adminv1.NetworkUsage
+	}
+)
+
+// Usage implements adminv1.NetworkServiceServer
+func (n *networkAdminServiceServer) Usage(ctx context.Context, rq *connect.Request[adminv1.NetworkServiceUsageRequest]) (*connect.Response[adminv1.NetworkServiceUsageResponse], error) {
+	n.log.Debug("usage", "network", rq)
+	req := rq.Msg
+
+	nw, err := n.ds.Network().Get(ctx, req.Id)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	usage, err := n.usage(ctx, nw)
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&adminv1.NetworkServiceUsageResponse{Usage: usage}), nil
+}
+
+func NewUsageReporter(c UsageReporterConfig) *UsageReporter {
+	interval := defaultUsageInterval
+	if c.Interval > 0 {
+		interval = c.Interval
+	}
+	return &UsageReporter{
+		networks: networks{
+			log:  c.Log.WithGroup("networkUsageReporter"),
+			ds:   c.Datastore,
+			ipam: c.Ipam,
+		},
+		interval: interval,
+		usages:   map[string]*adminv1.NetworkUsage{},
+	}
+}
+
+// Report determines the usage of all networks and replaces the reported usage at once. Networks which were deleted
+// are dropped, networks whose usage can not be determined keep their previously reported usage.
+func (u *UsageReporter) Report(ctx context.Context) error {
+	nws, err := u.ds.Network().List(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list networks: %w", err)
+	}
+
+	u.mu.RLock()
+	previous := u.usages
+	u.mu.RUnlock()
+
+	var (
+		usages = map[string]*adminv1.NetworkUsage{}
+		errs   []error
+	)
+	for _, nw := range nws {
+		usage, err := u.usage(ctx, nw)
+		if err != nil {
+			errs = append(errs, err)
+			if p, ok := previous[nw.ID]; ok {
+				usages[nw.ID] = p
+			}
+			continue
+		}
+		usages[nw.ID] = usage
+	}
+
+	u.mu.Lock()
+	u.usages = usages
+	u.mu.Unlock()
+
+	return errors.Join(errs...)
+}
+
+// Describe implements prometheus.Collector
+func (u *UsageReporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- prefixIPsDesc
+	ch <- prefixChildPrefixesDesc
+	ch <- networkIPsDesc
+}
+
+// Collect implements prometheus.Collector
+func (u *UsageReporter) Collect(ch chan<- prometheus.Metric) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	gauge := func(desc *prometheus.Desc, value uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value), labels...)
+	}
+
+	for _, usage := range u.usages {
+		for _, p := range usage.Prefixes {
+			gauge(prefixIPsDesc, p.AvailableIps, usage.Network, p.Prefix, "available")
+			gauge(prefixIPsDesc, p.AcquiredIps, usage.Network, p.Prefix, "acquired")
+			gauge(prefixChildPrefixesDesc, p.AvailableSmallestPrefixes, usage.Network, p.Prefix, "available_smallest")
+			gauge(prefixChildPrefixesDesc, p.AcquiredPrefixes, usage.Network, p.Prefix, "acquired")
+		}
+		for _, ips := range usage.Ips {
+			gauge(networkIPsDesc, ips.Count, usage.Network, ips.Project, strings.ToLower(strings.TrimPrefix(ips.Type.String(), "IP_TYPE_")))
+		}
+	}
+}
+
+// Run reports the usage in the configured interval until the context is done.
+func (u *UsageReporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+
+	for {
+		err := u.Report(ctx)
+		if err != nil {
+			u.log.Error("unable to report network usage", "error", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			u.log.Info("stop reporting network usage")
+			return
+		}
+	}
+}
+
+// usage combines the usage of the prefixes of the network in ipam with the number of ips per project and type in the datastore.
+func (n *networks) usage(ctx context.Context, nw *metal.Network) (*adminv1.NetworkUsage, error) {
+	usage := &adminv1.NetworkUsage{Network: nw.ID}
+
+	for _, prefix := range nw.Prefixes {
+		resp, err := n.ipam.PrefixUsage(ctx, connect.NewRequest(&ipamv1.PrefixUsageRequest{Cidr: prefix.String()}))
+		if err != nil {
+			return nil, fmt.Errorf("unable to get usage of prefix %q of network %q: %w", prefix.String(), nw.ID, err)
+		}
+		usage.Prefixes = append(usage.Prefixes, &adminv1.PrefixUsage{
+			Prefix:                    prefix.String(),
+			AvailableIps:              resp.Msg.AvailableIps,
+			AcquiredIps:               resp.Msg.AcquiredIps,
+			AvailableSmallestPrefixes: resp.Msg.AvailableSmallestPrefixes,
+			AcquiredPrefixes:          resp.Msg.AcquiredPrefixes,
+		})
+	}
+
+	ips, err := n.ds.IP().Search(ctx, ipQuery{network: nw.ID})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list ips of network %q: %w", nw.ID, err)
+	}
+
+	type key struct {
+		project string
+		ipType  metal.IPType
+	}
+	counts := map[key]uint64{}
+	for _, ip := range ips {
+		counts[key{project: ip.ProjectID, ipType: ip.Type}]++
+	}
+	for k, count := range counts {
+		usage.Ips = append(usage.Ips, &adminv1.NetworkIPUsage{Project: k.project, Type: convertIPType(k.ipType), Count: count})
+	}
+	slices.SortFunc(usage.Ips, func(a, b *adminv1.NetworkIPUsage) int {
+		return cmp.Or(cmp.Compare(a.Project, b.Project), cmp.Compare(a.Type, b.Type))
+	})
+
+	return usage, nil
+}
+
+func convertIPType(t metal.IPType) apiv1.IPType {
+	switch t {
+	case metal.Ephemeral:
+		return apiv1.IPType_IP_TYPE_EPHEMERAL
+	case metal.Static:
+		return apiv1.IPType_IP_TYPE_STATIC
+	default:
+		return apiv1.IPType_IP_TYPE_UNSPECIFIED
+	}
+}
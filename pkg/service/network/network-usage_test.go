@@ -0,0 +1,136 @@
+package network
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/google/go-cmp/cmp"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	"github.com/metal-stack/api-server/pkg/test"
+	adminv1 "github.com/metal-stack/api/go/metalstack/admin/v1"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+	ipamv1 "github.com/metal-stack/go-ipam/api/v1"
+	"github.com/metal-stack/metal-lib/pkg/pointer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func Test_networkAdminServiceServer_Usage(t *testing.T) {
+	ipam := test.StartIpam(t)
+
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	admin := NewAdmin(Config{Log: log, Datastore: ds, Ipam: ipam, Outbox: newOutbox(log, ds, ipam)}).(*networkAdminServiceServer)
+
+	_, err = admin.Create(ctx, connect.NewRequest(&adminv1.NetworkServiceCreateRequest{Network: &apiv1.Network{
+		Id: "internet", Prefixes: []string{"1.2.3.0/24"},
+	}}))
+	require.NoError(t, err)
+	_, err = admin.Create(ctx, connect.NewRequest(&adminv1.NetworkServiceCreateRequest{Network: &apiv1.Network{
+		Id: "super", Prefixes: []string{"10.0.0.0/24"},
+	}}))
+	require.NoError(t, err)
+	_, err = admin.Create(ctx, connect.NewRequest(&adminv1.NetworkServiceCreateRequest{Network: &apiv1.Network{
+		Id: "child", ParentNetworkId: "super", Prefixes: []string{"10.0.0.0/28"},
+	}}))
+	require.NoError(t, err)
+
+	for _, ip := range []*metal.IP{
+		{IPAddress: "1.2.3.17", ProjectID: "p1", Type: metal.Static},
+		{IPAddress: "1.2.3.18", ProjectID: "p1", Type: metal.Ephemeral},
+		{IPAddress: "1.2.3.19", ProjectID: "p1", Type: metal.Ephemeral},
+		{IPAddress: "1.2.3.20", ProjectID: "p2", Type: metal.Ephemeral},
+	} {
+		ip.NetworkID = "internet"
+		ip.ParentPrefixCidr = "1.2.3.0/24"
+		_, err = ipam.AcquireIP(ctx, connect.NewRequest(&ipamv1.AcquireIPRequest{PrefixCidr: ip.ParentPrefixCidr, Ip: pointer.Pointer(ip.IPAddress)}))
+		require.NoError(t, err)
+		_, err = ds.IP().Create(ctx, ip)
+		require.NoError(t, err)
+	}
+
+	got, err := admin.Usage(ctx, connect.NewRequest(&adminv1.NetworkServiceUsageRequest{Id: "internet"}))
+	require.NoError(t, err)
+
+	want := &adminv1.NetworkUsage{
+		Network: "internet",
+		Prefixes: []*adminv1.PrefixUsage{
+			// the network and the broadcast address are acquired with the prefix
+			{Prefix: "1.2.3.0/24", AvailableIps: 256, AcquiredIps: 6, AvailableSmallestPrefixes: 64},
+		},
+		Ips: []*adminv1.NetworkIPUsage{
+			{Project: "p1", Type: apiv1.IPType_IP_TYPE_EPHEMERAL, Count: 2},
+			{Project: "p1", Type: apiv1.IPType_IP_TYPE_STATIC, Count: 1},
+			{Project: "p2", Type: apiv1.IPType_IP_TYPE_EPHEMERAL, Count: 1},
+		},
+	}
+	if diff := cmp.Diff(want, got.Msg.Usage, protocmp.Transform()); diff != "" {
+		t.Errorf("networkAdminServiceServer.Usage() diff = %s", diff)
+	}
+
+	_, err = admin.Usage(ctx, connect.NewRequest(&adminv1.NetworkServiceUsageRequest{Id: "unknown"}))
+	requireCode(t, connect.CodeNotFound, err)
+
+	reporter := NewUsageReporter(UsageReporterConfig{Log: log, Datastore: ds, Ipam: ipam})
+	require.NoError(t, reporter.Report(ctx))
+
+	requireGauge(t, reporter, 6, "api_server_network_prefix_ips", "internet", "1.2.3.0/24", "acquired")
+	requireGauge(t, reporter, 2, "api_server_network_ips", "internet", "p1", "ephemeral")
+	requireGauge(t, reporter, 1, "api_server_network_prefix_child_prefixes", "super", "10.0.0.0/24", "acquired")
+	requireGauge(t, reporter, 60, "api_server_network_prefix_child_prefixes", "super", "10.0.0.0/24", "available_smallest")
+	requireGauge(t, reporter, 16, "api_server_network_prefix_ips", "child", "10.0.0.0/28", "available")
+
+	// the usage of the child network can not be determined anymore, its previous usage is kept
+	_, err = ipam.DeletePrefix(ctx, connect.NewRequest(&ipamv1.DeletePrefixRequest{Cidr: "10.0.0.0/28"}))
+	require.NoError(t, err)
+	// deleted networks are dropped
+	internet, err := ds.Network().Get(ctx, "internet")
+	require.NoError(t, err)
+	require.NoError(t, ds.Network().Delete(ctx, internet))
+
+	require.Error(t, reporter.Report(ctx))
+
+	requireGauge(t, reporter, 16, "api_server_network_prefix_ips", "child", "10.0.0.0/28", "available")
+	requireGauge(t, reporter, 1, "api_server_network_prefix_child_prefixes", "super", "10.0.0.0/24", "acquired")
+	require.Nil(t, gauge(t, reporter, "api_server_network_prefix_ips", "internet", "1.2.3.0/24", "acquired"))
+}
+
+func requireGauge(t *testing.T, c prometheus.Collector, want float64, name string, labels ...string) {
+	got := gauge(t, c, name, labels...)
+	require.NotNil(t, got, "no gauge %s%v", name, labels)
+	require.InDelta(t, want, *got, 0)
+}
+
+// gauge returns the value of the gauge with the given name and label values ordered by label name, nil if it is not collected.
+func gauge(t *testing.T, c prometheus.Collector, name string, labels ...string) *float64 {
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(c))
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			var values []string
+			for _, l := range m.GetLabel() {
+				values = append(values, l.GetValue())
+			}
+			if slices.Equal(values, labels) {
+				return pointer.Pointer(m.GetGauge().GetValue())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package partition
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+
+	"connectrpc.com/connect"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	adminv1 "github.com/metal-stack/api/go/metalstack/admin/v1"
+	"github.com/metal-stack/api/go/metalstack/admin/v1/adminv1connect"
+	"github.com/metal-stack/metal-lib/pkg/pointer"
+)
+
+// DefaultPrivateNetworkPrefixLength is the length of the private networks of a partition if none is given
+const DefaultPrivateNetworkPrefixLength = 22
+
+type prefixLengthRange struct {
+	min, max uint8
+}
+
+// privateNetworkPrefixLengths are the lengths per address family of the private super network
+// which hold enough machines but do not exhaust the private super network.
+var privateNetworkPrefixLengths = map[metal.AddressFamily]prefixLengthRange{
+	metal.IPv4AddressFamily: {min: 16, max: 30},
+	metal.IPv6AddressFamily: {min: 48, max: 64},
+}
+
+type partitionAdminServiceServer struct {
+	log *slog.Logger
+	ds  *generic.Datastore
+}
+
+func NewAdmin(c Config) adminv1connect.PartitionServiceHandler {
+	return &partitionAdminServiceServer{
+		log: c.Log.WithGroup("partitionAdminService"),
+		ds:  c.Datastore,
+	}
+}
+
+// Create implements adminv1.PartitionServiceServer
+func (p *partitionAdminServiceServer) Create(ctx context.Context, rq *connect.Request[adminv1.PartitionServiceCreateRequest]) (*connect.Response[adminv1.PartitionServiceCreateResponse], error) {
+	p.log.Debug("create", "partition", rq)
+	req := rq.Msg.Partition
+	if req == nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("partition must be given"))
+	}
+	if req.Id == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("partition id must be given"))
+	}
+
+	partition := &metal.Partition{
+		Base: metal.Base{
+			ID:          req.Id,
+			Name:        req.Name,
+			Description: req.Description,
+		},
+		MgmtServiceAddress:         req.MgmtServiceAddress,
+		PrivateNetworkPrefixLength: DefaultPrivateNetworkPrefixLength,
+		Labels:                     req.Labels,
+	}
+	if req.BootConfiguration != nil {
+		partition.BootConfiguration = metal.BootConfiguration{
+			ImageURL:    req.BootConfiguration.ImageUrl,
+			KernelURL:   req.BootConfiguration.KernelUrl,
+			CommandLine: req.BootConfiguration.Commandline,
+		}
+	}
+	if req.PrivateNetworkPrefixLength > 0 {
+		partition.PrivateNetworkPrefixLength = uint8(min(req.PrivateNetworkPrefixLength, 255))
+	}
+
+	// a new partition has no private super network yet
+	err := validate(partition, nil)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	created, err := p.ds.Partition().Create(ctx, partition)
+	if err != nil {
+		if generic.IsConflict(err) {
+			return nil, connect.NewError(connect.CodeAlreadyExists, err)
+		}
+		return nil, err
+	}
+
+	return connect.NewResponse(&adminv1.PartitionServiceCreateResponse{
+		Partition: convert(created),
+	}), nil
+}
+
+// Update implements adminv1.PartitionServiceServer
+func (p *partitionAdminServiceServer) Update(ctx context.Context, rq *connect.Request[adminv1.PartitionServiceUpdateRequest]) (*connect.Response[adminv1.PartitionServiceUpdateResponse], error) {
+	p.log.Debug("update", "partition", rq)
+	req := rq.Msg
+
+	old, err := p.ds.Partition().Get(ctx, req.Id)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	newPartition := *old
+
+	if req.Name != nil {
+		newPartition.Name = *req.Name
+	}
+	if req.Description != nil {
+		newPartition.Description = *req.Description
+	}
+	if req.MgmtServiceAddress != nil {
+		newPartition.MgmtServiceAddress = *req.MgmtServiceAddress
+	}
+	if req.BootConfiguration != nil {
+		newPartition.BootConfiguration = metal.BootConfiguration{
+			ImageURL:    req.BootConfiguration.ImageUrl,
+			KernelURL:   req.BootConfiguration.KernelUrl,
+			CommandLine: req.BootConfiguration.Commandline,
+		}
+	}
+	if req.PrivateNetworkPrefixLength != nil {
+		newPartition.PrivateNetworkPrefixLength = uint8(min(*req.PrivateNetworkPrefixLength, 255))
+	}
+	if req.Labels != nil {
+		newPartition.Labels = req.Labels
+	}
+
+	supers, err := p.ds.Network().Search(ctx, networkQuery{partitionID: newPartition.ID, privateSuper: pointer.Pointer(true)})
+	if err != nil {
+		return nil, err
+	}
+
+	err = validate(&newPartition, supers)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	err = p.ds.Partition().Update(ctx, &newPartition, old)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		if generic.IsConflict(err) {
+			return nil, connect.NewError(connect.CodeAborted, err)
+		}
+		return nil, err
+	}
+
+	return connect.NewResponse(&adminv1.PartitionServiceUpdateResponse{
+		Partition: convert(&newPartition),
+	}), nil
+}
+
+// Delete implements adminv1.PartitionServiceServer
+func (p *partitionAdminServiceServer) Delete(ctx context.Context, rq *connect.Request[adminv1.PartitionServiceDeleteRequest]) (*connect.Response[adminv1.PartitionServiceDeleteResponse], error) {
+	p.log.Debug("delete", "partition", rq)
+	req := rq.Msg
+
+	partition, err := p.ds.Partition().Get(ctx, req.Id)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	networks, err := p.ds.Network().Search(ctx, networkQuery{partitionID: partition.ID})
+	if err != nil {
+		return nil, err
+	}
+	if len(networks) > 0 {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("partition %s still has %d networks", partition.ID, len(networks)))
+	}
+
+	err = p.ds.Partition().Delete(ctx, partition)
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&adminv1.PartitionServiceDeleteResponse{
+		Partition: convert(partition),
+	}), nil
+}
+
+// validate checks the boot configuration and the length of the private networks of a partition.
+// The length must fit the address family of a prefix of the private super networks,
+// without a private super network it must fit any address family.
+func validate(partition *metal.Partition, supers []*metal.Network) error {
+	families := []metal.AddressFamily{metal.IPv4AddressFamily, metal.IPv6AddressFamily}
+	if len(supers) > 0 {
+		families = nil
+		for _, super := range supers {
+			for _, prefix := range super.Prefixes {
+				family, err := prefix.AddressFamily()
+				if err != nil {
+					return fmt.Errorf("unable to determine the address family of prefix %q of the private super network %q: %w", prefix.String(), super.ID, err)
+				}
+				families = append(families, family)
+			}
+		}
+		slices.Sort(families)
+		families = slices.Compact(families)
+	}
+
+	var ranges []string
+	for _, family := range families {
+		r := privateNetworkPrefixLengths[family]
+		if partition.PrivateNetworkPrefixLength >= r.min && partition.PrivateNetworkPrefixLength <= r.max {
+			ranges = nil
+			break
+		}
+		ranges = append(ranges, fmt.Sprintf("between %d and %d for %s", r.min, r.max, family))
+	}
+	if len(ranges) > 0 {
+		return fmt.Errorf("private network prefix length %d is out of range, it must be %s",
+			partition.PrivateNetworkPrefixLength, strings.Join(ranges, " or "))
+	}
+
+	if partition.BootConfiguration.ImageURL != "" {
+		err := validateURL(partition.BootConfiguration.ImageURL)
+		if err != nil {
+			return fmt.Errorf("image url of the boot configuration is invalid: %w", err)
+		}
+	}
+	if partition.BootConfiguration.KernelURL != "" {
+		err := validateURL(partition.BootConfiguration.KernelURL)
+		if err != nil {
+			return fmt.Errorf("kernel url of the boot configuration is invalid: %w", err)
+		}
+	}
+	return nil
+}
+
+// validateURL checks that the url is absolute and can be downloaded by the metal-hammer.
+func validateURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("%q must use http or https", u)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("%q has no host", u)
+	}
+	return nil
+}
+
+type networkQuery struct {
+	partitionID  string
+	privateSuper *bool
+}
+
+func (q networkQuery) Predicates() []generic.Predicate {
+	predicates := []generic.Predicate{generic.Eq("partitionid", q.partitionID)}
+	if q.privateSuper != nil {
+		predicates = append(predicates, generic.Eq("privatesuper", *q.privateSuper))
+	}
+	return predicates
+}
@@ -0,0 +1,103 @@
+package partition
+
+import (
+	"context"
+	"log/slog"
+
+	"connectrpc.com/connect"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+	"github.com/metal-stack/api/go/metalstack/api/v1/apiv1connect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type Config struct {
+	Log       *slog.Logger
+	Datastore *generic.Datastore
+}
+type partitionServiceServer struct {
+	log *slog.Logger
+	ds  *generic.Datastore
+}
+
+func New(c Config) apiv1connect.PartitionServiceHandler {
+	return &partitionServiceServer{
+		log: c.Log.WithGroup("partitionService"),
+		ds:  c.Datastore,
+	}
+}
+
+// Get implements v1.PartitionServiceServer
+func (p *partitionServiceServer) Get(ctx context.Context, rq *connect.Request[apiv1.PartitionServiceGetRequest]) (*connect.Response[apiv1.PartitionServiceGetResponse], error) {
+	p.log.Debug("get", "partition", rq)
+	req := rq.Msg
+
+	resp, err := p.ds.Partition().Get(ctx, req.Id)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	return connect.NewResponse(&apiv1.PartitionServiceGetResponse{
+		Partition: convert(resp),
+	}), nil
+}
+
+// List implements v1.PartitionServiceServer
+func (p *partitionServiceServer) List(ctx context.Context, rq *connect.Request[apiv1.PartitionServiceListRequest]) (*connect.Response[apiv1.PartitionServiceListResponse], error) {
+	p.log.Debug("list", "partition", rq)
+	req := rq.Msg
+
+	// there are only a few partitions, they are filtered by their labels after they were read
+	resp, err := p.ds.Partition().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*apiv1.Partition
+	for _, partition := range resp {
+		if req.Id != nil && partition.ID != *req.Id {
+			continue
+		}
+		if !hasLabels(partition, req.Labels) {
+			continue
+		}
+		res = append(res, convert(partition))
+	}
+
+	return connect.NewResponse(&apiv1.PartitionServiceListResponse{
+		Partitions: res,
+	}), nil
+}
+
+// hasLabels returns true if the partition carries all the given labels with the same values.
+func hasLabels(partition *metal.Partition, labels map[string]string) bool {
+	for k, v := range labels {
+		value, ok := partition.Labels[k]
+		if !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+func convert(resp *metal.Partition) *apiv1.Partition {
+	return &apiv1.Partition{
+		Id:          resp.ID,
+		Name:        resp.Name,
+		Description: resp.Description,
+		BootConfiguration: &apiv1.PartitionBootConfiguration{
+			ImageUrl:    resp.BootConfiguration.ImageURL,
+			KernelUrl:   resp.BootConfiguration.KernelURL,
+			Commandline: resp.BootConfiguration.CommandLine,
+		},
+		MgmtServiceAddress:         resp.MgmtServiceAddress,
+		PrivateNetworkPrefixLength: uint32(resp.PrivateNetworkPrefixLength),
+		Labels:                     resp.Labels,
+		CreatedAt:                  timestamppb.New(resp.Created),
+		UpdatedAt:                  timestamppb.New(resp.Changed),
+	}
+}
@@ -0,0 +1,253 @@
+package partition
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/google/go-cmp/cmp"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	adminv1 "github.com/metal-stack/api/go/metalstack/admin/v1"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+	"github.com/metal-stack/metal-lib/pkg/pointer"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func Test_partitionServiceServer_List(t *testing.T) {
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	for _, p := range []*metal.Partition{
+		{Base: metal.Base{ID: "partition-a"}, PrivateNetworkPrefixLength: 22, Labels: map[string]string{"region": "eu", "tier": "gold"}},
+		{Base: metal.Base{ID: "partition-b"}, PrivateNetworkPrefixLength: 22, Labels: map[string]string{"region": "eu"}},
+		{Base: metal.Base{ID: "partition-c"}, PrivateNetworkPrefixLength: 22},
+	} {
+		_, err := ds.Partition().Create(ctx, p)
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		name string
+		rq   *apiv1.PartitionServiceListRequest
+		want []string
+	}{
+		{
+			name: "all",
+			rq:   &apiv1.PartitionServiceListRequest{},
+			want: []string{"partition-a", "partition-b", "partition-c"},
+		},
+		{
+			name: "by id",
+			rq:   &apiv1.PartitionServiceListRequest{Id: pointer.Pointer("partition-b")},
+			want: []string{"partition-b"},
+		},
+		{
+			name: "by label",
+			rq:   &apiv1.PartitionServiceListRequest{Labels: map[string]string{"region": "eu"}},
+			want: []string{"partition-a", "partition-b"},
+		},
+		{
+			name: "by all labels",
+			rq:   &apiv1.PartitionServiceListRequest{Labels: map[string]string{"region": "eu", "tier": "gold"}},
+			want: []string{"partition-a"},
+		},
+		{
+			name: "no match",
+			rq:   &apiv1.PartitionServiceListRequest{Labels: map[string]string{"region": "us"}},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &partitionServiceServer{log: log, ds: ds}
+			got, err := p.List(ctx, connect.NewRequest(tt.rq))
+			require.NoError(t, err)
+
+			var ids []string
+			for _, partition := range got.Msg.Partitions {
+				ids = append(ids, partition.Id)
+			}
+			require.ElementsMatch(t, tt.want, ids)
+		})
+	}
+}
+
+func Test_partitionAdminServiceServer(t *testing.T) {
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	p := &partitionAdminServiceServer{log: log, ds: ds}
+
+	created, err := p.Create(ctx, connect.NewRequest(&adminv1.PartitionServiceCreateRequest{
+		Partition: &apiv1.Partition{
+			Id: "partition-a",
+			BootConfiguration: &apiv1.PartitionBootConfiguration{
+				ImageUrl:  "https://images.metal-stack.io/metal-hammer.img",
+				KernelUrl: "https://images.metal-stack.io/metal-hammer-kernel",
+			},
+		},
+	}))
+	require.NoError(t, err)
+	require.Equal(t, uint32(DefaultPrivateNetworkPrefixLength), created.Msg.Partition.PrivateNetworkPrefixLength)
+
+	_, err = p.Create(ctx, connect.NewRequest(&adminv1.PartitionServiceCreateRequest{Partition: &apiv1.Partition{Id: "partition-a"}}))
+	requireCode(t, connect.CodeAlreadyExists, err)
+
+	updated, err := p.Update(ctx, connect.NewRequest(&adminv1.PartitionServiceUpdateRequest{
+		Id:                         "partition-a",
+		PrivateNetworkPrefixLength: pointer.Pointer(uint32(24)),
+		Labels:                     map[string]string{"region": "eu"},
+	}))
+	require.NoError(t, err)
+	if diff := cmp.Diff(
+		&apiv1.Partition{
+			Id: "partition-a",
+			BootConfiguration: &apiv1.PartitionBootConfiguration{
+				ImageUrl:  "https://images.metal-stack.io/metal-hammer.img",
+				KernelUrl: "https://images.metal-stack.io/metal-hammer-kernel",
+			},
+			PrivateNetworkPrefixLength: 24,
+			Labels:                     map[string]string{"region": "eu"},
+		},
+		updated.Msg.Partition,
+		protocmp.Transform(),
+		protocmp.IgnoreFields(&apiv1.Partition{}, "created_at", "updated_at"),
+	); diff != "" {
+		t.Errorf("partitionAdminServiceServer.Update() diff:%s", diff)
+	}
+
+	_, err = p.Update(ctx, connect.NewRequest(&adminv1.PartitionServiceUpdateRequest{Id: "partition-a", PrivateNetworkPrefixLength: pointer.Pointer(uint32(8))}))
+	requireCode(t, connect.CodeInvalidArgument, err)
+
+	// the length must fit the address family of the private super network
+	super, err := ds.Network().Create(ctx, &metal.Network{
+		Base: metal.Base{ID: "super"}, PartitionID: "partition-a", PrivateSuper: true, Prefixes: metal.Prefixes{{IP: "2001:db8::", Length: "48"}},
+	})
+	require.NoError(t, err)
+	_, err = p.Update(ctx, connect.NewRequest(&adminv1.PartitionServiceUpdateRequest{Id: "partition-a", PrivateNetworkPrefixLength: pointer.Pointer(uint32(56))}))
+	require.NoError(t, err)
+	_, err = p.Update(ctx, connect.NewRequest(&adminv1.PartitionServiceUpdateRequest{Id: "partition-a", PrivateNetworkPrefixLength: pointer.Pointer(uint32(24))}))
+	requireCode(t, connect.CodeInvalidArgument, err)
+	require.NoError(t, ds.Network().Delete(ctx, super))
+
+	_, err = ds.Network().Create(ctx, &metal.Network{Base: metal.Base{ID: "n1"}, PartitionID: "partition-a"})
+	require.NoError(t, err)
+	_, err = p.Delete(ctx, connect.NewRequest(&adminv1.PartitionServiceDeleteRequest{Id: "partition-a"}))
+	requireCode(t, connect.CodeFailedPrecondition, err)
+
+	require.NoError(t, ds.Network().Delete(ctx, &metal.Network{Base: metal.Base{ID: "n1"}}))
+	_, err = p.Delete(ctx, connect.NewRequest(&adminv1.PartitionServiceDeleteRequest{Id: "partition-a"}))
+	require.NoError(t, err)
+
+	_, err = p.Delete(ctx, connect.NewRequest(&adminv1.PartitionServiceDeleteRequest{Id: "partition-a"}))
+	requireCode(t, connect.CodeNotFound, err)
+}
+
+func Test_validate(t *testing.T) {
+	var (
+		v4Super = &metal.Network{Base: metal.Base{ID: "v4"}, Prefixes: metal.Prefixes{{IP: "10.0.0.0", Length: "8"}}}
+		v6Super = &metal.Network{Base: metal.Base{ID: "v6"}, Prefixes: metal.Prefixes{{IP: "2001:db8::", Length: "48"}}}
+	)
+
+	tests := []struct {
+		name      string
+		partition *metal.Partition
+		supers    []*metal.Network
+		wantErr   bool
+	}{
+		{
+			name:      "valid",
+			partition: &metal.Partition{PrivateNetworkPrefixLength: 22, BootConfiguration: metal.BootConfiguration{ImageURL: "http://images/hammer.img", KernelURL: "https://images/kernel"}},
+			wantErr:   false,
+		},
+		{
+			name:      "without boot configuration",
+			partition: &metal.Partition{PrivateNetworkPrefixLength: 22},
+			wantErr:   false,
+		},
+		{
+			name:      "prefix length too short",
+			partition: &metal.Partition{PrivateNetworkPrefixLength: 15},
+			wantErr:   true,
+		},
+		{
+			name:      "prefix length between the address families",
+			partition: &metal.Partition{PrivateNetworkPrefixLength: 40},
+			wantErr:   true,
+		},
+		{
+			name:      "prefix length too long",
+			partition: &metal.Partition{PrivateNetworkPrefixLength: 65},
+			wantErr:   true,
+		},
+		{
+			name:      "ipv6 prefix length without private super network",
+			partition: &metal.Partition{PrivateNetworkPrefixLength: 56},
+			wantErr:   false,
+		},
+		{
+			name:      "ipv4 prefix length of an ipv4 private super network",
+			partition: &metal.Partition{PrivateNetworkPrefixLength: 22},
+			supers:    []*metal.Network{v4Super},
+			wantErr:   false,
+		},
+		{
+			name:      "ipv4 prefix length too long for an ipv4 private super network",
+			partition: &metal.Partition{PrivateNetworkPrefixLength: 31},
+			supers:    []*metal.Network{v4Super},
+			wantErr:   true,
+		},
+		{
+			name:      "ipv6 prefix length of an ipv4 private super network",
+			partition: &metal.Partition{PrivateNetworkPrefixLength: 64},
+			supers:    []*metal.Network{v4Super},
+			wantErr:   true,
+		},
+		{
+			name:      "ipv6 prefix length of an ipv6 private super network",
+			partition: &metal.Partition{PrivateNetworkPrefixLength: 64},
+			supers:    []*metal.Network{v6Super},
+			wantErr:   false,
+		},
+		{
+			name:      "ipv4 prefix length of an ipv6 private super network",
+			partition: &metal.Partition{PrivateNetworkPrefixLength: 22},
+			supers:    []*metal.Network{v6Super},
+			wantErr:   true,
+		},
+		{
+			name:      "relative image url",
+			partition: &metal.Partition{PrivateNetworkPrefixLength: 22, BootConfiguration: metal.BootConfiguration{ImageURL: "images/hammer.img"}},
+			wantErr:   true,
+		},
+		{
+			name:      "unsupported kernel url scheme",
+			partition: &metal.Partition{PrivateNetworkPrefixLength: 22, BootConfiguration: metal.BootConfiguration{KernelURL: "ftp://images/kernel"}},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validate(tt.partition, tt.supers); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func requireCode(t *testing.T, code connect.Code, err error) {
+	t.Helper()
+	var connectErr *connect.Error
+	require.True(t, errors.As(err, &connectErr), "expected a connect error, got %v", err)
+	require.Equal(t, code, connectErr.Code())
+}
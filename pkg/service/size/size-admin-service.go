@@ -0,0 +1,203 @@
+package size
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"connectrpc.com/connect"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	adminv1 "github.com/metal-stack/api/go/metalstack/admin/v1"
+	"github.com/metal-stack/api/go/metalstack/admin/v1/adminv1connect"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+)
+
+type sizeAdminServiceServer struct {
+	log *slog.Logger
+	ds  *generic.Datastore
+}
+
+func NewAdmin(c Config) adminv1connect.SizeServiceHandler {
+	return &sizeAdminServiceServer{
+		log: c.Log.WithGroup("sizeAdminService"),
+		ds:  c.Datastore,
+	}
+}
+
+// Create implements adminv1.SizeServiceServer
+func (s *sizeAdminServiceServer) Create(ctx context.Context, rq *connect.Request[adminv1.SizeServiceCreateRequest]) (*connect.Response[adminv1.SizeServiceCreateResponse], error) {
+	s.log.Debug("create", "size", rq)
+	req := rq.Msg.Size
+	if req == nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("size must be given"))
+	}
+	if req.Id == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("size id must be given"))
+	}
+
+	constraints, err := toConstraints(req.Constraints)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	size := &metal.Size{
+		Base: metal.Base{
+			ID:          req.Id,
+			Name:        req.Name,
+			Description: req.Description,
+		},
+		Constraints: constraints,
+		Labels:      req.Labels,
+	}
+
+	err = s.validate(ctx, size)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := s.ds.Size().Create(ctx, size)
+	if err != nil {
+		if generic.IsConflict(err) {
+			return nil, connect.NewError(connect.CodeAlreadyExists, err)
+		}
+		return nil, err
+	}
+
+	return connect.NewResponse(&adminv1.SizeServiceCreateResponse{
+		Size: convert(created),
+	}), nil
+}
+
+// Update implements adminv1.SizeServiceServer
+func (s *sizeAdminServiceServer) Update(ctx context.Context, rq *connect.Request[adminv1.SizeServiceUpdateRequest]) (*connect.Response[adminv1.SizeServiceUpdateResponse], error) {
+	s.log.Debug("update", "size", rq)
+	req := rq.Msg
+
+	old, err := s.ds.Size().Get(ctx, req.Id)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	newSize := *old
+
+	if req.Name != nil {
+		newSize.Name = *req.Name
+	}
+	if req.Description != nil {
+		newSize.Description = *req.Description
+	}
+	if req.Constraints != nil {
+		constraints, err := toConstraints(req.Constraints)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		newSize.Constraints = constraints
+	}
+	if req.Labels != nil {
+		newSize.Labels = req.Labels
+	}
+
+	err = s.validate(ctx, &newSize)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.ds.Size().Update(ctx, &newSize, old)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		if generic.IsConflict(err) {
+			return nil, connect.NewError(connect.CodeAborted, err)
+		}
+		return nil, err
+	}
+
+	return connect.NewResponse(&adminv1.SizeServiceUpdateResponse{
+		Size: convert(&newSize),
+	}), nil
+}
+
+// Delete implements adminv1.SizeServiceServer
+func (s *sizeAdminServiceServer) Delete(ctx context.Context, rq *connect.Request[adminv1.SizeServiceDeleteRequest]) (*connect.Response[adminv1.SizeServiceDeleteResponse], error) {
+	s.log.Debug("delete", "size", rq)
+	req := rq.Msg
+
+	size, err := s.ds.Size().Get(ctx, req.Id)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	machines, err := s.ds.Machine().Search(ctx, machineQuery{size: size.ID})
+	if err != nil {
+		return nil, err
+	}
+	if len(machines) > 0 {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("size %s is still used by %d machines", size.ID, len(machines)))
+	}
+
+	err = s.ds.Size().Delete(ctx, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&adminv1.SizeServiceDeleteResponse{
+		Size: convert(size),
+	}), nil
+}
+
+// validate checks the constraints of the size and that no other size matches the same hardware.
+func (s *sizeAdminServiceServer) validate(ctx context.Context, size *metal.Size) error {
+	err := size.Validate()
+	if err != nil {
+		return connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	sizes, err := s.ds.Size().List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, other := range sizes {
+		if other.ID == size.ID {
+			continue
+		}
+		if size.Overlaps(other) {
+			return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("constraints of size %s overlap with the constraints of size %s", size.ID, other.ID))
+		}
+	}
+	return nil
+}
+
+func toConstraints(constraints []*apiv1.SizeConstraint) ([]metal.Constraint, error) {
+	var result []metal.Constraint
+	for _, c := range constraints {
+		var t metal.ConstraintType
+		switch c.Type {
+		case apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_CORES:
+			t = metal.CoreConstraint
+		case apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_MEMORY:
+			t = metal.MemoryConstraint
+		case apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_STORAGE:
+			t = metal.StorageConstraint
+		default:
+			return nil, fmt.Errorf("size constraint type %s is not supported", c.Type)
+		}
+		result = append(result, metal.Constraint{Type: t, Min: c.Min, Max: c.Max})
+	}
+	return result, nil
+}
+
+type machineQuery struct {
+	size string
+}
+
+func (q machineQuery) Predicates() []generic.Predicate {
+	return []generic.Predicate{generic.Eq("sizeid", q.size)}
+}
@@ -0,0 +1,127 @@
+package size
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"connectrpc.com/connect"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+	"github.com/metal-stack/api/go/metalstack/api/v1/apiv1connect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type Config struct {
+	Log       *slog.Logger
+	Datastore *generic.Datastore
+}
+type sizeServiceServer struct {
+	log *slog.Logger
+	ds  *generic.Datastore
+}
+
+func New(c Config) apiv1connect.SizeServiceHandler {
+	return &sizeServiceServer{
+		log: c.Log.WithGroup("sizeService"),
+		ds:  c.Datastore,
+	}
+}
+
+// Get implements v1.SizeServiceServer
+func (s *sizeServiceServer) Get(ctx context.Context, rq *connect.Request[apiv1.SizeServiceGetRequest]) (*connect.Response[apiv1.SizeServiceGetResponse], error) {
+	s.log.Debug("get", "size", rq)
+	req := rq.Msg
+
+	resp, err := s.ds.Size().Get(ctx, req.Id)
+	if err != nil {
+		if generic.IsNotFound(err) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, err
+	}
+
+	return connect.NewResponse(&apiv1.SizeServiceGetResponse{
+		Size: convert(resp),
+	}), nil
+}
+
+// List implements v1.SizeServiceServer
+func (s *sizeServiceServer) List(ctx context.Context, rq *connect.Request[apiv1.SizeServiceListRequest]) (*connect.Response[apiv1.SizeServiceListResponse], error) {
+	s.log.Debug("list", "size", rq)
+
+	resp, err := s.ds.Size().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*apiv1.Size
+	for _, size := range resp {
+		res = append(res, convert(size))
+	}
+
+	return connect.NewResponse(&apiv1.SizeServiceListResponse{
+		Sizes: res,
+	}), nil
+}
+
+// Match implements v1.SizeServiceServer, it returns the size whose constraints match the given hardware.
+func (s *sizeServiceServer) Match(ctx context.Context, rq *connect.Request[apiv1.SizeServiceMatchRequest]) (*connect.Response[apiv1.SizeServiceMatchResponse], error) {
+	s.log.Debug("match", "size", rq)
+	req := rq.Msg
+	if req.Hardware == nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("hardware must be given"))
+	}
+
+	hw := metal.MachineHardware{
+		Memory:   req.Hardware.Memory,
+		CPUCores: int(req.Hardware.CpuCores),
+	}
+	for _, disk := range req.Hardware.Disks {
+		hw.Disks = append(hw.Disks, metal.BlockDevice{Name: disk.Name, Size: disk.Size})
+	}
+
+	// there are only a few sizes, the constraints are evaluated after they were read
+	sizes, err := s.ds.Size().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the constraints of different sizes never overlap, therefore at most one size matches
+	for _, size := range sizes {
+		if size.Matches(hw) {
+			return connect.NewResponse(&apiv1.SizeServiceMatchResponse{Size: convert(size)}), nil
+		}
+	}
+
+	return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("no size matches the hardware with %d cores and %d bytes of memory", hw.CPUCores, hw.Memory))
+}
+
+func convert(resp *metal.Size) *apiv1.Size {
+	size := &apiv1.Size{
+		Id:          resp.ID,
+		Name:        resp.Name,
+		Description: resp.Description,
+		Labels:      resp.Labels,
+		CreatedAt:   timestamppb.New(resp.Created),
+		UpdatedAt:   timestamppb.New(resp.Changed),
+	}
+	for _, c := range resp.Constraints {
+		t := apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_UNSPECIFIED
+		switch c.Type {
+		case metal.CoreConstraint:
+			t = apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_CORES
+		case metal.MemoryConstraint:
+			t = apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_MEMORY
+		case metal.StorageConstraint:
+			t = apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_STORAGE
+		}
+		size.Constraints = append(size.Constraints, &apiv1.SizeConstraint{
+			Type: t,
+			Min:  c.Min,
+			Max:  c.Max,
+		})
+	}
+	return size
+}
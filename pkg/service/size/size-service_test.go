@@ -0,0 +1,186 @@
+package size
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/metal-stack/api-server/pkg/db/generic"
+	"github.com/metal-stack/api-server/pkg/db/metal"
+	adminv1 "github.com/metal-stack/api/go/metalstack/admin/v1"
+	apiv1 "github.com/metal-stack/api/go/metalstack/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+const gib = 1 << 30
+
+func Test_sizeServiceServer_Match(t *testing.T) {
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	for _, size := range []*metal.Size{
+		{Base: metal.Base{ID: "c1-large-x86"}, Constraints: []metal.Constraint{
+			{Type: metal.CoreConstraint, Min: 8, Max: 8},
+			{Type: metal.MemoryConstraint, Min: 60 * gib, Max: 64 * gib},
+			{Type: metal.StorageConstraint, Min: 400 * gib, Max: 1000 * gib},
+		}},
+		{Base: metal.Base{ID: "c1-xlarge-x86"}, Constraints: []metal.Constraint{
+			{Type: metal.CoreConstraint, Min: 16, Max: 32},
+		}},
+	} {
+		_, err := ds.Size().Create(ctx, size)
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		name           string
+		hardware       *apiv1.MachineHardware
+		want           string
+		wantReturnCode connect.Code
+	}{
+		{
+			name: "all constraints match",
+			hardware: &apiv1.MachineHardware{CpuCores: 8, Memory: 64 * gib, Disks: []*apiv1.MachineBlockDevice{
+				{Name: "/dev/sda", Size: 240 * gib},
+				{Name: "/dev/sdb", Size: 240 * gib},
+			}},
+			want: "c1-large-x86",
+		},
+		{
+			name:     "a size without memory constraint matches any memory",
+			hardware: &apiv1.MachineHardware{CpuCores: 24, Memory: 512 * gib},
+			want:     "c1-xlarge-x86",
+		},
+		{
+			name:           "storage is too small",
+			hardware:       &apiv1.MachineHardware{CpuCores: 8, Memory: 64 * gib, Disks: []*apiv1.MachineBlockDevice{{Name: "/dev/sda", Size: 240 * gib}}},
+			wantReturnCode: connect.CodeNotFound,
+		},
+		{
+			name:           "no hardware",
+			wantReturnCode: connect.CodeInvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &sizeServiceServer{log: log, ds: ds}
+			got, err := s.Match(ctx, connect.NewRequest(&apiv1.SizeServiceMatchRequest{Hardware: tt.hardware}))
+			if tt.wantReturnCode != 0 {
+				require.Error(t, err)
+				require.Equal(t, tt.wantReturnCode, connect.CodeOf(err))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got.Msg.Size.Id)
+		})
+	}
+}
+
+func Test_sizeAdminServiceServer_Create(t *testing.T) {
+	ctx := context.Background()
+	log := slog.Default()
+
+	ds, err := generic.NewMemory(log)
+	require.NoError(t, err)
+
+	s := &sizeAdminServiceServer{log: log, ds: ds}
+
+	_, err = s.Create(ctx, connect.NewRequest(&adminv1.SizeServiceCreateRequest{Size: &apiv1.Size{
+		Id: "c1-large-x86",
+		Constraints: []*apiv1.SizeConstraint{
+			{Type: apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_CORES, Min: 8, Max: 8},
+			{Type: apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_MEMORY, Min: 60 * gib, Max: 64 * gib},
+		},
+	}}))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		constraints    []*apiv1.SizeConstraint
+		wantReturnCode connect.Code
+	}{
+		{
+			name: "other cores",
+			constraints: []*apiv1.SizeConstraint{
+				{Type: apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_CORES, Min: 16, Max: 16},
+				{Type: apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_MEMORY, Min: 60 * gib, Max: 64 * gib},
+			},
+		},
+		{
+			name: "memory ranges touch",
+			constraints: []*apiv1.SizeConstraint{
+				{Type: apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_CORES, Min: 8, Max: 8},
+				{Type: apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_MEMORY, Min: 64 * gib, Max: 128 * gib},
+			},
+			wantReturnCode: connect.CodeInvalidArgument,
+		},
+		{
+			name: "constraint type missing in the other size",
+			constraints: []*apiv1.SizeConstraint{
+				{Type: apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_CORES, Min: 4, Max: 8},
+				{Type: apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_STORAGE, Min: 100 * gib, Max: 200 * gib},
+			},
+			wantReturnCode: connect.CodeInvalidArgument,
+		},
+		{
+			name: "min greater than max",
+			constraints: []*apiv1.SizeConstraint{
+				{Type: apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_CORES, Min: 64, Max: 32},
+			},
+			wantReturnCode: connect.CodeInvalidArgument,
+		},
+		{
+			name: "duplicate constraint type",
+			constraints: []*apiv1.SizeConstraint{
+				{Type: apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_CORES, Min: 32, Max: 32},
+				{Type: apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_CORES, Min: 64, Max: 64},
+			},
+			wantReturnCode: connect.CodeInvalidArgument,
+		},
+		{
+			name: "unspecified constraint type",
+			constraints: []*apiv1.SizeConstraint{
+				{Min: 1, Max: 2},
+			},
+			wantReturnCode: connect.CodeInvalidArgument,
+		},
+		{
+			name:           "no constraints",
+			wantReturnCode: connect.CodeInvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Create(ctx, connect.NewRequest(&adminv1.SizeServiceCreateRequest{Size: &apiv1.Size{
+				Id:          tt.name,
+				Constraints: tt.constraints,
+			}}))
+			if tt.wantReturnCode != 0 {
+				require.Error(t, err)
+				require.Equal(t, tt.wantReturnCode, connect.CodeOf(err))
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+
+	// the size itself is not considered an overlap on update
+	_, err = s.Update(ctx, connect.NewRequest(&adminv1.SizeServiceUpdateRequest{
+		Id: "c1-large-x86",
+		Constraints: []*apiv1.SizeConstraint{
+			{Type: apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_CORES, Min: 8, Max: 12},
+			{Type: apiv1.SizeConstraintType_SIZE_CONSTRAINT_TYPE_MEMORY, Min: 60 * gib, Max: 64 * gib},
+		},
+	}))
+	require.NoError(t, err)
+
+	_, err = ds.Machine().Create(ctx, &metal.Machine{Base: metal.Base{ID: "m1"}, SizeID: "c1-large-x86"})
+	require.NoError(t, err)
+	_, err = s.Delete(ctx, connect.NewRequest(&adminv1.SizeServiceDeleteRequest{Id: "c1-large-x86"}))
+	require.Error(t, err)
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+}
@@ -0,0 +1,51 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	_ "github.com/lib/pq"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+func StartPostgres(t testing.TB) (container testcontainers.Container, db *sql.DB, err error) {
+	ctx := context.Background()
+	var log testcontainers.Logging
+	if t != nil {
+		log = testcontainers.TestLogger(t)
+	}
+	req := testcontainers.ContainerRequest{
+		Image:        "postgres:16-alpine",
+		ExposedPorts: []string{"5432/tcp"},
+		Env:          map[string]string{"POSTGRES_PASSWORD": "password", "POSTGRES_USER": "metal", "POSTGRES_DB": "metal"},
+		WaitingFor: wait.ForAll(
+			wait.ForLog("database system is ready to accept connections").WithOccurrence(2),
+			wait.ForListeningPort("5432/tcp"),
+		),
+	}
+	pgContainer, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+		Logger:           log,
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+	ip, err := pgContainer.Host(ctx)
+	if err != nil {
+		return pgContainer, nil, err
+	}
+	port, err := pgContainer.MappedPort(ctx, "5432")
+	if err != nil {
+		return pgContainer, nil, err
+	}
+	db, err = sql.Open("postgres", fmt.Sprintf("host=%s port=%s user=metal password=password dbname=metal sslmode=disable", ip, port.Port()))
+	if err != nil {
+		return pgContainer, nil, err
+	}
+
+	return pgContainer, db, db.Ping()
+}